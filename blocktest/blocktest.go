@@ -0,0 +1,496 @@
+// Package blocktest checks that a BlockHandlerV2 keeps the contract the rest of pmfs relies on,
+// so that a new backend can be tested the same way as the ones in the tree:
+//
+//	func TestConformance(t *testing.T) {
+//		blocktest.TestBlockHandler(t, func(t *testing.T) (fs.BlockHandlerV2, string) {
+//			return &MyFileSystem{}, t.TempDir()
+//		})
+//	}
+//
+// The contract, as checked here, is:
+//
+//   - Init readies the handler to use the storage named by the configuration, and Format empties it.
+//   - Every node handed out by GetFreeBlockNode and GetFreeDataBlockNode has the type asked for
+//     (DATA for a data node, which is also RelativeTo its parent) and an id different from every
+//     other node in use and from the SuperBlock. A node can be handed out again once it is freed.
+//   - At most BlockCount nodes, the SuperBlock included, are in use at once. Once BlockCount-1
+//     nodes have been handed out and not freed both methods return fs.ErrNoSpace, and after that
+//     the nodes handed out are the ones freed.
+//   - A block reads back exactly as it was saved, whatever its length (including empty and several
+//     times the block size), and the latest save wins. The handler keeps its own copy, so changing
+//     the slice saved or read afterwards doesn't change the block. The SuperBlock can be saved
+//     without being handed out.
+//   - Reading a block that has never been saved, or has been freed, returns fs.ErrBlockNotFound.
+//     Freeing a block that isn't there is not an error.
+//   - Every method can be called from several goroutines at once.
+//   - Blocks saved, and which nodes are in use, survive the handler being initialized again with
+//     the same configuration.
+//   - A handler that is a BlockLister lists exactly the blocks that have been saved and not freed.
+//   - A handler that is a BlockReserver never hands out a node that has been reserved (whether its
+//     id has been freed or not handed out yet) until it is freed. Reserving a node in use is not an
+//     error.
+//   - Every method returns the context's error when the context has been cancelled.
+//
+// Open and NewFileSystem set up a RootFileSystem over a handler, for tests that go through the
+// filesystem rather than the handler itself.
+package blocktest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// The block count and size handlers are formatted with
+const (
+	BlockCount = 200
+	BlockSize  = 64
+)
+
+// A Factory returns a new handler, not yet initialized, and the configuration to initialize it
+// with. It is called once for each part of the contract, and should give each a handler over
+// fresh storage (e.g. in t.TempDir()).
+type Factory func(t *testing.T) (fs.BlockHandlerV2, string)
+
+// Run every check of the contract against handlers from the factory, each as a subtest
+func TestBlockHandler(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string)
+	}{
+		{"Format", testFormat},
+		{"Allocation", testAllocation},
+		{"DataNodes", testDataNodes},
+		{"RoundTrip", testRoundTrip},
+		{"Free", testFree},
+		{"Exhaustion", testExhaustion},
+		{"Concurrency", testConcurrency},
+		{"Persistence", testPersistence},
+		{"ListBlocks", testListBlocks},
+		{"Reserve", testReserve},
+		{"Cancelled", testCancelled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			handler, configuration := factory(t)
+			if err := handler.Init(ctx, configuration); err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			if err := handler.Format(ctx, BlockCount, BlockSize); err != nil {
+				t.Fatalf("Format: %v", err)
+			}
+			test.test(t, ctx, handler, configuration)
+		})
+	}
+}
+
+func allocate(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, nodeType fs.BlockNodeType) fs.BlockNode {
+	node, err := handler.GetFreeBlockNode(ctx, nodeType)
+	if err != nil {
+		t.Fatalf("GetFreeBlockNode(%v): %v", nodeType, err)
+	}
+	return node
+}
+
+func save(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, node fs.BlockNode, data []byte) {
+	if _, err := handler.SaveRawBlock(ctx, node, data); err != nil {
+		t.Fatalf("SaveRawBlock(%v): %v", node, err)
+	}
+}
+
+// An error unless the block holds the data
+func holds(ctx context.Context, handler fs.BlockHandlerV2, node fs.BlockNode, data []byte) error {
+	x, err := handler.GetRawBlock(ctx, node)
+	if err != nil {
+		return fmt.Errorf("GetRawBlock(%v): %v", node, err)
+	}
+	if !bytes.Equal(x, data) {
+		return fmt.Errorf("Block %v holds %d bytes %q, expected %d bytes %q", node, len(x), x, len(data), data)
+	}
+	return nil
+}
+
+func missing(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, node fs.BlockNode) {
+	if x, err := handler.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		t.Errorf("Expected fs.ErrBlockNotFound for %v, got %q, %v", node, x, err)
+	}
+}
+
+func testFormat(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	node := allocate(t, ctx, handler, fs.FILE)
+	missing(t, ctx, handler, node)
+	save(t, ctx, handler, node, []byte("Before format"))
+	save(t, ctx, handler, fs.SuperBlock, []byte("Super block"))
+	if err := handler.Format(ctx, BlockCount, BlockSize); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	missing(t, ctx, handler, node)
+	missing(t, ctx, handler, fs.SuperBlock)
+}
+
+func testAllocation(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	types := []fs.BlockNodeType{fs.DIRECTORY, fs.FILE, fs.ROUTE, fs.DATA, fs.SEARCHINDEX, fs.SEARCHTREE}
+	used := map[int]bool{fs.SuperBlock.Id: true}
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < BlockCount/2; i++ {
+		nodeType := types[i%len(types)]
+		node := allocate(t, ctx, handler, nodeType)
+		if node.Type != nodeType {
+			t.Errorf("Asked for a %v node, got %v", nodeType, node)
+		}
+		if used[node.Id] {
+			t.Fatalf("Node id %d handed out twice", node.Id)
+		}
+		used[node.Id] = true
+		nodes = append(nodes, node)
+		// Save some of them, which must not change what is handed out
+		if i%2 == 0 {
+			save(t, ctx, handler, node, []byte(fmt.Sprintf("Block %d", i)))
+		}
+	}
+
+	// Freed nodes can be handed out again, but never one still in use
+	if err := handler.FreeBlocks(ctx, nodes[:10]); err != nil {
+		t.Fatalf("FreeBlocks: %v", err)
+	}
+	for _, node := range nodes[:10] {
+		delete(used, node.Id)
+	}
+	for i := 0; i < 20; i++ {
+		node := allocate(t, ctx, handler, fs.FILE)
+		if used[node.Id] {
+			t.Fatalf("Node id %d handed out while in use", node.Id)
+		}
+		used[node.Id] = true
+	}
+}
+
+func testDataNodes(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	file := allocate(t, ctx, handler, fs.FILE)
+	save(t, ctx, handler, file, []byte("File"))
+	used := map[int]bool{fs.SuperBlock.Id: true, file.Id: true}
+	for i := 0; i < 10; i++ {
+		node, err := handler.GetFreeDataBlockNode(ctx, file, fmt.Sprintf("%05d", i))
+		if err != nil {
+			t.Fatalf("GetFreeDataBlockNode: %v", err)
+		}
+		if node.Type != fs.DATA || node.RelativeTo != file.Id {
+			t.Errorf("Expected a DATA node relative to %d, got %v", file.Id, node)
+		}
+		if used[node.Id] {
+			t.Fatalf("Node id %d handed out twice", node.Id)
+		}
+		used[node.Id] = true
+		save(t, ctx, handler, node, []byte(fmt.Sprintf("Data %d", i)))
+		if err = holds(ctx, handler, node, []byte(fmt.Sprintf("Data %d", i))); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// Data of the given length that differs from block to block
+func pattern(length int, seed int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i*7 + seed)
+	}
+	return data
+}
+
+func testRoundTrip(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	for seed, length := range []int{0, 1, BlockSize - 1, BlockSize, BlockSize + 1, 3*BlockSize + 5} {
+		node := allocate(t, ctx, handler, fs.DATA)
+		data := pattern(length, seed)
+		save(t, ctx, handler, node, data)
+		if err := holds(ctx, handler, node, pattern(length, seed)); err != nil {
+			t.Error(err)
+		}
+		// Overwrite with something shorter, then longer
+		for _, replacement := range [][]byte{[]byte("short"), pattern(2*BlockSize, seed+1)} {
+			save(t, ctx, handler, node, replacement)
+			if err := holds(ctx, handler, node, replacement); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// The handler keeps its own copy
+	node := allocate(t, ctx, handler, fs.FILE)
+	data := []byte("Original")
+	save(t, ctx, handler, node, data)
+	data[0] = 'X'
+	if read, err := handler.GetRawBlock(ctx, node); err == nil && len(read) > 0 {
+		read[1] = 'X'
+	}
+	if err := holds(ctx, handler, node, []byte("Original")); err != nil {
+		t.Errorf("Changing a slice after saving or reading it changed the block: %v", err)
+	}
+
+	save(t, ctx, handler, fs.SuperBlock, []byte("Super block"))
+	if err := holds(ctx, handler, fs.SuperBlock, []byte("Super block")); err != nil {
+		t.Error(err)
+	}
+}
+
+func testFree(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	kept := allocate(t, ctx, handler, fs.FILE)
+	freed := allocate(t, ctx, handler, fs.FILE)
+	unsaved := allocate(t, ctx, handler, fs.FILE)
+	save(t, ctx, handler, kept, []byte("Kept"))
+	save(t, ctx, handler, freed, []byte("Freed"))
+	if err := handler.FreeBlocks(ctx, []fs.BlockNode{freed, unsaved}); err != nil {
+		t.Fatalf("FreeBlocks: %v", err)
+	}
+	missing(t, ctx, handler, freed)
+	missing(t, ctx, handler, unsaved)
+	if err := holds(ctx, handler, kept, []byte("Kept")); err != nil {
+		t.Error(err)
+	}
+	if err := handler.FreeBlocks(ctx, []fs.BlockNode{freed}); err != nil {
+		t.Errorf("Freeing a block twice: %v", err)
+	}
+	if err := handler.FreeBlocks(ctx, nil); err != nil {
+		t.Errorf("Freeing nothing: %v", err)
+	}
+}
+
+func testExhaustion(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	file := allocate(t, ctx, handler, fs.FILE)
+	nodes := []fs.BlockNode{file}
+	for {
+		node, err := handler.GetFreeDataBlockNode(ctx, file, fmt.Sprintf("%05d", len(nodes)))
+		if errors.Is(err, fs.ErrNoSpace) {
+			break
+		} else if err != nil {
+			t.Fatalf("GetFreeDataBlockNode: %v", err)
+		}
+		if len(nodes) == BlockCount {
+			t.Fatalf("More than %d nodes handed out", BlockCount-1)
+		}
+		// Only some of them saved, nodes count whether they have been saved or not
+		if len(nodes)%3 == 0 {
+			save(t, ctx, handler, node, []byte("Data"))
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) != BlockCount-1 {
+		t.Errorf("Expected %d nodes to be handed out before fs.ErrNoSpace, got %d", BlockCount-1, len(nodes))
+	}
+	if _, err := handler.GetFreeBlockNode(ctx, fs.FILE); !errors.Is(err, fs.ErrNoSpace) {
+		t.Errorf("Expected fs.ErrNoSpace from GetFreeBlockNode, got %v", err)
+	}
+
+	// Freed ids are handed out again, and no others
+	freed := map[int]bool{nodes[5].Id: true, nodes[6].Id: true, nodes[40].Id: true}
+	if err := handler.FreeBlocks(ctx, []fs.BlockNode{nodes[5], nodes[6], nodes[40]}); err != nil {
+		t.Fatalf("FreeBlocks: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		node := allocate(t, ctx, handler, fs.ROUTE)
+		if !freed[node.Id] {
+			t.Errorf("Expected one of the freed ids %v, got %d", freed, node.Id)
+		}
+		delete(freed, node.Id)
+	}
+	if _, err := handler.GetFreeBlockNode(ctx, fs.FILE); !errors.Is(err, fs.ErrNoSpace) {
+		t.Errorf("Expected fs.ErrNoSpace once the freed ids are used, got %v", err)
+	}
+}
+
+func testConcurrency(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	const workers, rounds = 8, 10
+	var wait sync.WaitGroup
+	errs := make(chan error, workers*rounds)
+	var usedLock sync.Mutex
+	used := make(map[int]bool)
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func(w int) {
+			defer wait.Done()
+			for r := 0; r < rounds; r++ {
+				node, err := handler.GetFreeBlockNode(ctx, fs.FILE)
+				if err != nil {
+					errs <- err
+					return
+				}
+				usedLock.Lock()
+				if used[node.Id] {
+					errs <- fmt.Errorf("Node id %d handed out twice at once", node.Id)
+				}
+				used[node.Id] = true
+				usedLock.Unlock()
+				data := pattern(BlockSize+w, r)
+				if _, err = handler.SaveRawBlock(ctx, node, data); err != nil {
+					errs <- err
+					return
+				}
+				if err = holds(ctx, handler, node, data); err != nil {
+					errs <- err
+				}
+				if r%2 == 1 {
+					usedLock.Lock()
+					delete(used, node.Id)
+					usedLock.Unlock()
+					if err = handler.FreeBlocks(ctx, []fs.BlockNode{node}); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testPersistence(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	kept := allocate(t, ctx, handler, fs.FILE)
+	freed := allocate(t, ctx, handler, fs.FILE)
+	parent := allocate(t, ctx, handler, fs.FILE)
+	data, err := handler.GetFreeDataBlockNode(ctx, parent, "00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := pattern(3*BlockSize, 1)
+	save(t, ctx, handler, fs.SuperBlock, []byte("Super block"))
+	save(t, ctx, handler, kept, []byte("Kept"))
+	save(t, ctx, handler, freed, []byte("Freed"))
+	save(t, ctx, handler, parent, []byte("Parent"))
+	save(t, ctx, handler, data, long)
+	handler.FreeBlocks(ctx, []fs.BlockNode{freed})
+
+	if err := handler.Init(ctx, configuration); err != nil {
+		t.Fatalf("Init again: %v", err)
+	}
+	for node, contents := range map[fs.BlockNode][]byte{fs.SuperBlock: []byte("Super block"), kept: []byte("Kept"), parent: []byte("Parent"), data: long} {
+		if err := holds(ctx, handler, node, contents); err != nil {
+			t.Error(err)
+		}
+	}
+	missing(t, ctx, handler, freed)
+	for i := 0; i < 10; i++ {
+		node := allocate(t, ctx, handler, fs.FILE)
+		if node.Id == kept.Id || node.Id == parent.Id || node.Id == data.Id || node.Id == fs.SuperBlock.Id {
+			t.Fatalf("Node id %d in use handed out after Init", node.Id)
+		}
+	}
+}
+
+func testListBlocks(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	lister, ok := handler.(fs.BlockLister)
+	if !ok {
+		t.Skip("Not a BlockLister")
+	}
+	expected := map[fs.BlockNode]bool{fs.SuperBlock: true}
+	save(t, ctx, handler, fs.SuperBlock, []byte("Super block"))
+	for i := 0; i < 10; i++ {
+		node := allocate(t, ctx, handler, fs.FILE)
+		if i == 9 {
+			// Handed out but never saved
+			break
+		}
+		save(t, ctx, handler, node, pattern(2*BlockSize, i))
+		expected[node] = true
+		if i%3 == 0 {
+			handler.FreeBlocks(ctx, []fs.BlockNode{node})
+			delete(expected, node)
+		}
+	}
+	blocks, err := lister.ListBlocks(ctx)
+	if err != nil {
+		t.Fatalf("ListBlocks: %v", err)
+	}
+	listed := make(map[fs.BlockNode]bool)
+	for _, node := range blocks {
+		if listed[node] {
+			t.Errorf("%v listed twice", node)
+		}
+		listed[node] = true
+		if !expected[node] {
+			t.Errorf("%v listed but not saved", node)
+		}
+	}
+	for node := range expected {
+		if !listed[node] {
+			t.Errorf("%v saved but not listed", node)
+		}
+	}
+}
+
+func testReserve(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	reserver, ok := handler.(fs.BlockReserver)
+	if !ok {
+		t.Skip("Not a BlockReserver")
+	}
+	used := allocate(t, ctx, handler, fs.FILE)
+	freed := allocate(t, ctx, handler, fs.FILE)
+	if err := handler.FreeBlocks(ctx, []fs.BlockNode{freed}); err != nil {
+		t.Fatalf("FreeBlocks: %v", err)
+	}
+	ahead := fs.BlockNode{Type: fs.FILE, Id: used.Id + 50}
+	for _, node := range []fs.BlockNode{used, freed, ahead} {
+		if err := reserver.ReserveBlockNode(ctx, node); err != nil {
+			t.Fatalf("ReserveBlockNode(%v): %v", node, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		node := allocate(t, ctx, handler, fs.FILE)
+		if node.Id == used.Id || node.Id == freed.Id || node.Id == ahead.Id {
+			t.Fatalf("Reserved node %v handed out", node)
+		}
+	}
+	// Once freed a reserved node can be handed out again
+	save(t, ctx, handler, ahead, []byte("Ahead"))
+	if err := holds(ctx, handler, ahead, []byte("Ahead")); err != nil {
+		t.Error(err)
+	}
+	if err := handler.FreeBlocks(ctx, []fs.BlockNode{freed, ahead}); err != nil {
+		t.Fatalf("FreeBlocks: %v", err)
+	}
+	seen := make(map[int]bool)
+	for {
+		node, err := handler.GetFreeBlockNode(ctx, fs.FILE)
+		if errors.Is(err, fs.ErrNoSpace) {
+			break
+		} else if err != nil {
+			t.Fatalf("GetFreeBlockNode: %v", err)
+		}
+		seen[node.Id] = true
+	}
+	if !seen[freed.Id] || !seen[ahead.Id] {
+		t.Errorf("Expected the freed reserved ids %d and %d to be handed out again", freed.Id, ahead.Id)
+	}
+}
+
+func testCancelled(t *testing.T, ctx context.Context, handler fs.BlockHandlerV2, configuration string) {
+	node := allocate(t, ctx, handler, fs.FILE)
+	save(t, ctx, handler, node, []byte("Saved"))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := handler.GetFreeBlockNode(cancelled, fs.FILE); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetFreeBlockNode: expected context.Canceled, got %v", err)
+	}
+	if _, err := handler.GetFreeDataBlockNode(cancelled, node, "00001"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetFreeDataBlockNode: expected context.Canceled, got %v", err)
+	}
+	if _, err := handler.GetRawBlock(cancelled, node); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetRawBlock: expected context.Canceled, got %v", err)
+	}
+	if _, err := handler.SaveRawBlock(cancelled, node, []byte("Not saved")); !errors.Is(err, context.Canceled) {
+		t.Errorf("SaveRawBlock: expected context.Canceled, got %v", err)
+	}
+	if err := handler.FreeBlocks(cancelled, []fs.BlockNode{node}); !errors.Is(err, context.Canceled) {
+		t.Errorf("FreeBlocks: expected context.Canceled, got %v", err)
+	}
+	if err := holds(ctx, handler, node, []byte("Saved")); err != nil {
+		t.Errorf("A cancelled call changed the block: %v", err)
+	}
+}
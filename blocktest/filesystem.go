@@ -0,0 +1,33 @@
+package blocktest
+
+import (
+	"testing"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Open a RootFileSystem over the handler (or one made from the configuration if the handler is
+// nil), failing the test if it can't be initialized. Its notifications are read and dropped, so
+// nothing waits on them; it still has to be formatted or mounted.
+func Open(t testing.TB, handler fs.BlockHandlerV2, configuration string) *fs.RootFileSystem {
+	t.Helper()
+	f := &fs.RootFileSystem{}
+	if err := f.InitV2(handler, configuration); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	go func() {
+		for range f.Notification {
+		}
+	}()
+	return f
+}
+
+// Open a RootFileSystem as Open does, then format it with the block count and size
+func NewFileSystem(t testing.TB, handler fs.BlockHandlerV2, configuration string, blockCount int, blockSize int) *fs.RootFileSystem {
+	t.Helper()
+	f := Open(t, handler, configuration)
+	if err := f.Format(blockCount, blockSize); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	return f
+}
@@ -0,0 +1,164 @@
+// Checksumming block handler - wraps another BlockHandlerV2, storing a CRC32C checksum in front
+// of every block and checking it whenever the block is read back. A block that does not match its
+// checksum is reported as an *fs.ErrCorruptBlock.
+//
+// The configuration string passed to Init is the configuration of the inner handler, including
+// its scheme, so the handler can be selected with e.g. "checksum:disk:/var/pmfs/data.pmfs".
+// When Inner is set before Init the configuration is passed to it as it is.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//	var mh memory.MemoryFileSystem
+//
+//	f.InitV2(&checksum.ChecksumFileSystem{Inner: fs.AdaptBlockHandler(&mh)}, "")
+//	f.Format(1000, 4096)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+//	report, err := f.Scrub()
+package checksum
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// The checksum is stored big endian in the first checksumSize bytes of the block
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type ChecksumFileSystem struct {
+	Inner fs.BlockHandlerV2
+}
+
+func init() {
+	fs.RegisterBlockHandler("checksum", func() fs.BlockHandlerV2 { return &ChecksumFileSystem{} })
+}
+
+// Create the inner handler from the configuration if there isn't one, and initialize it
+func (cfs *ChecksumFileSystem) Init(ctx context.Context, configuration string) error {
+	if cfs.Inner == nil {
+		inner, rest, err := fs.NewBlockHandler(configuration)
+		if err != nil {
+			return err
+		}
+		cfs.Inner, configuration = inner, rest
+	}
+	return cfs.Inner.Init(ctx, configuration)
+}
+
+func (cfs *ChecksumFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	return cfs.Inner.Format(ctx, blockCount, blockSize)
+}
+
+func (cfs *ChecksumFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return cfs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (cfs *ChecksumFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return cfs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+// Read the block from the inner handler, returning an *fs.ErrCorruptBlock if it does not match
+// its checksum
+func (cfs *ChecksumFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	raw, err := cfs.Inner.GetRawBlock(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < checksumSize {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Block is too short to hold a checksum"}
+	}
+	stored := binary.BigEndian.Uint32(raw)
+	data := raw[checksumSize:]
+	if sum := crc32.Checksum(data, castagnoli); sum != stored {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: fmt.Sprintf("Checksum is %08x, expected %08x", sum, stored)}
+	}
+	return data, nil
+}
+
+func (cfs *ChecksumFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	raw := make([]byte, checksumSize+len(data))
+	binary.BigEndian.PutUint32(raw, crc32.Checksum(data, castagnoli))
+	copy(raw[checksumSize:], data)
+	return cfs.Inner.SaveRawBlock(ctx, node, raw)
+}
+
+func (cfs *ChecksumFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	return cfs.Inner.FreeBlocks(ctx, blocks)
+}
+
+// Every block held by the inner handler, if it is a BlockLister
+func (cfs *ChecksumFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := cfs.Inner.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	return lister.ListBlocks(ctx)
+}
+
+// Pass a transaction on to the inner handler, if it is Transactional
+func (cfs *ChecksumFileSystem) Begin(ctx context.Context) {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		tx.Begin(ctx)
+	}
+}
+
+func (cfs *ChecksumFileSystem) Commit(ctx context.Context) error {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		return tx.Commit(ctx)
+	}
+	return nil
+}
+
+func (cfs *ChecksumFileSystem) Rollback(ctx context.Context) {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		tx.Rollback(ctx)
+	}
+}
+
+func (cfs *ChecksumFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(cfs.Inner)
+}
+
+// Write out the blocks the inner handler is holding back, if it is a BlockFlusher
+func (cfs *ChecksumFileSystem) Flush(ctx context.Context) error {
+	if flusher, ok := cfs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Reserve the node in the inner handler, if it is a BlockReserver
+func (cfs *ChecksumFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := cfs.Inner.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// Copy the block (checksum and all) in the inner handler, if it is a BlockCopier
+func (cfs *ChecksumFileSystem) CopyBlock(ctx context.Context, source fs.BlockNode, target fs.BlockNode) error {
+	if copier, ok := cfs.Inner.(fs.BlockCopier); ok {
+		return copier.CopyBlock(ctx, source, target)
+	}
+	return fs.ErrNotSupported
+}
+
+// The counters of the inner handler, if it is a StatsReporter
+func (cfs *ChecksumFileSystem) HandlerStats() map[string]float64 {
+	if reporter, ok := cfs.Inner.(fs.StatsReporter); ok {
+		return reporter.HandlerStats()
+	}
+	return make(map[string]float64)
+}
+
+func (cfs *ChecksumFileSystem) DumpInfo() {
+	fmt.Println("Checksum file system (CRC32C) over:")
+	cfs.Inner.DumpInfo()
+}
@@ -0,0 +1,132 @@
+package checksum
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/dedupfs"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func TestDetectsCorruption(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	cfs := ChecksumFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+	cfs.Init(ctx, "")
+	cfs.Format(ctx, 100, 100)
+	node, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.SaveRawBlock(ctx, node, []byte("Hello world"))
+	if x, err := cfs.GetRawBlock(ctx, node); err != nil || string(x) != "Hello world" {
+		m.Errorf("Block not read back, got %s, %v", string(x), err)
+	}
+
+	mh.Blocks[node][6] ^= 0x01
+	_, err := cfs.GetRawBlock(ctx, node)
+	var corrupt *fs.ErrCorruptBlock
+	if !errors.As(err, &corrupt) || corrupt.Node != node {
+		m.Errorf("Expected a corrupt block error, got %v", err)
+	}
+	mh.Blocks[node] = []byte{1}
+	if _, err := cfs.GetRawBlock(ctx, node); !errors.As(err, &corrupt) {
+		m.Errorf("Expected a corrupt block error for a short block, got %v", err)
+	}
+}
+
+func TestScrub(m *testing.T) {
+	f := blocktest.NewFileSystem(m, nil, "checksum:memory", 1000, 10)
+	f.WriteFile("/scrub/good", []byte("Nothing wrong with this file"))
+	f.WriteFile("/scrub/bad", []byte("This one will be damaged"))
+	report, err := f.Scrub()
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.Problems) != 0 || !report.OrphansChecked || report.Scanned == 0 {
+		m.Errorf("Expected a clean scrub, got %v", report)
+	}
+
+	// Damage a data block of the file underneath the checksums
+	fileNode, _ := f.StatFile("/scrub/bad")
+	inner := f.BlockHandler.(*ChecksumFileSystem).Inner
+	data := fileNode.DataBlocks[fileNode.DefaultRoute.DataBlockNames[0]]
+	raw, _ := inner.GetRawBlock(context.Background(), data)
+	raw[len(raw)-1] ^= 0x80
+	inner.SaveRawBlock(context.Background(), data, raw)
+
+	var corrupt *fs.ErrCorruptBlock
+	if _, err := f.ReadFile("/scrub/bad"); !errors.As(err, &corrupt) || corrupt.Node != data {
+		m.Errorf("Expected the data block to be reported corrupt, got %v", err)
+	}
+	report, err = f.Scrub()
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.DamagedPaths) != 1 || report.DamagedPaths[0] != "/scrub/bad" || len(report.Problems) != 1 {
+		m.Errorf("Expected /scrub/bad to be damaged, got %v", report)
+	}
+}
+
+func TestForwardsToInner(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(inner fs.BlockHandlerV2) *ChecksumFileSystem {
+		cfs := &ChecksumFileSystem{Inner: inner}
+		if err := cfs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		cfs.Format(ctx, 100, 100)
+		return cfs
+	}
+
+	// Transactions, only when the inner handler has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a wrapper over memory not to be transactional")
+	}
+	cfs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(cfs) {
+		m.Errorf("Expected a wrapper over walfs to be transactional")
+	}
+	node, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.Begin(ctx)
+	cfs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	cfs.Rollback(ctx)
+	if _, err := cfs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	cfs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = cfs.GetFreeBlockNode(ctx, fs.DATA)
+	cfs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := cfs.Flush(ctx); err != nil || len(cold.Blocks[node]) == 0 {
+		m.Errorf("Expected the flush to reach the cold tier, got %v", err)
+	}
+
+	// Reservations
+	cfs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := cfs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := cfs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+
+	// and copies
+	cfs = wrap(&dedupfs.DedupFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})})
+	file, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	source, _ := cfs.GetFreeDataBlockNode(ctx, file, "00001")
+	target, _ := cfs.GetFreeDataBlockNode(ctx, file, "00002")
+	cfs.SaveRawBlock(ctx, source, []byte("Shared"))
+	if err := cfs.CopyBlock(ctx, source, target); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := cfs.GetRawBlock(ctx, target); err != nil || string(x) != "Shared" {
+		m.Errorf("Expected the copy to read back, got %q, %v", x, err)
+	}
+}
@@ -0,0 +1,324 @@
+// Compressing block handler - wraps another BlockHandlerV2, compressing every block before it is
+// saved and decompressing it when it is read. Blocks that don't get any smaller are saved as they
+// are, so incompressible data costs only the one byte header.
+//
+// The configuration string passed to Init is the name of the compressor followed by the
+// configuration of the inner handler, including its scheme, e.g. "compress:gzip:disk:/var/pmfs/
+// data.pmfs". When Inner is set before Init only the name of the compressor is needed. gzip, flate,
+// zlib, zstd and snappy are built in, others can be added with RegisterCompressor.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//	var mh memory.MemoryFileSystem
+//
+//	f.InitV2(&compressfs.CompressedFileSystem{Inner: fs.AdaptBlockHandler(&mh)}, "gzip")
+//	f.Format(1000, 4096)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+package compressfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// A Compressor is registered under an id, which is stored in the first byte of every block it
+// compresses so that blocks can be read whichever compressor is configured now. Id 0 marks a
+// block that is stored uncompressed and 1 to 5 are the built in compressors.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+const stored = 0
+
+var compressors = map[byte]Compressor{}
+var compressorLock sync.RWMutex
+
+func init() {
+	RegisterCompressor(1, streamCompressor{"gzip",
+		func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }})
+	RegisterCompressor(2, streamCompressor{"flate",
+		func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }})
+	RegisterCompressor(3, streamCompressor{"zlib",
+		func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) }})
+	RegisterCompressor(4, zstdCompressor{})
+	RegisterCompressor(5, snappyCompressor{})
+	fs.RegisterBlockHandler("compress", func() fs.BlockHandlerV2 { return &CompressedFileSystem{} })
+}
+
+func RegisterCompressor(id byte, compressor Compressor) {
+	if id == stored {
+		panic("Compressor id 0 is used for uncompressed blocks")
+	}
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressors[id] = compressor
+}
+
+// The id of the registered compressor with the given name
+func lookupCompressor(name string) (byte, Compressor, bool) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	for id, compressor := range compressors {
+		if compressor.Name() == name {
+			return id, compressor, true
+		}
+	}
+	return 0, nil, false
+}
+
+func compressorFor(id byte) (Compressor, bool) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	compressor, ok := compressors[id]
+	return compressor, ok
+}
+
+// A Compressor built from the standard library's streaming writers and readers
+type streamCompressor struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (s streamCompressor) Name() string {
+	return s.name
+}
+
+func (s streamCompressor) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	w, err := s.newWriter(&buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (s streamCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := s.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type CompressedFileSystem struct {
+	Inner      fs.BlockHandlerV2
+	Compressor Compressor
+	id         byte
+	// Totals for the blocks saved since Init
+	stats compressionStats
+	lock  sync.Mutex
+}
+
+type compressionStats struct {
+	BytesIn    int64
+	BytesOut   int64
+	Compressed int64
+	Skipped    int64
+}
+
+// Pick the compressor named at the start of the configuration and initialize the inner handler
+// (creating it from the rest of the configuration if there isn't one)
+func (cfs *CompressedFileSystem) Init(ctx context.Context, configuration string) error {
+	name, rest := configuration, ""
+	if i := strings.Index(configuration, ":"); i >= 0 {
+		name, rest = configuration[:i], configuration[i+1:]
+	}
+	id, compressor, ok := lookupCompressor(name)
+	if !ok {
+		return fmt.Errorf("No compressor registered for '%s'", name)
+	}
+	cfs.lock.Lock()
+	cfs.id, cfs.Compressor = id, compressor
+	cfs.stats = compressionStats{}
+	cfs.lock.Unlock()
+	if cfs.Inner == nil {
+		inner, innerConfiguration, err := fs.NewBlockHandler(rest)
+		if err != nil {
+			return err
+		}
+		cfs.Inner, rest = inner, innerConfiguration
+	}
+	return cfs.Inner.Init(ctx, rest)
+}
+
+func (cfs *CompressedFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	return cfs.Inner.Format(ctx, blockCount, blockSize)
+}
+
+func (cfs *CompressedFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return cfs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (cfs *CompressedFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return cfs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+func (cfs *CompressedFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	raw, err := cfs.Inner.GetRawBlock(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Block has no compression header"}
+	}
+	if raw[0] == stored {
+		return raw[1:], nil
+	}
+	compressor, ok := compressorFor(raw[0])
+	if !ok {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: fmt.Sprintf("No compressor registered for id %d", raw[0])}
+	}
+	data, err := compressor.Decompress(raw[1:])
+	if err != nil {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: err.Error()}
+	}
+	return data, nil
+}
+
+// Compress the block, saving it uncompressed if that doesn't make it smaller
+func (cfs *CompressedFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	raw := []byte{stored}
+	compressed, err := cfs.Compressor.Compress(data)
+	if err != nil {
+		return fs.NilBlock, err
+	}
+	if len(compressed) < len(data) {
+		raw = append([]byte{cfs.id}, compressed...)
+	} else {
+		raw = append(raw, data...)
+	}
+	saved, err := cfs.Inner.SaveRawBlock(ctx, node, raw)
+	if err != nil {
+		return saved, err
+	}
+	cfs.lock.Lock()
+	defer cfs.lock.Unlock()
+	cfs.stats.BytesIn += int64(len(data))
+	cfs.stats.BytesOut += int64(len(raw))
+	if raw[0] == stored {
+		cfs.stats.Skipped++
+	} else {
+		cfs.stats.Compressed++
+	}
+	return saved, nil
+}
+
+func (cfs *CompressedFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	return cfs.Inner.FreeBlocks(ctx, blocks)
+}
+
+// Every block held by the inner handler, if it is a BlockLister
+func (cfs *CompressedFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := cfs.Inner.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	return lister.ListBlocks(ctx)
+}
+
+// Transactions are passed on to the inner handler, if it is Transactional
+func (cfs *CompressedFileSystem) Begin(ctx context.Context) {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		tx.Begin(ctx)
+	}
+}
+
+func (cfs *CompressedFileSystem) Commit(ctx context.Context) error {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		return tx.Commit(ctx)
+	}
+	return nil
+}
+
+func (cfs *CompressedFileSystem) Rollback(ctx context.Context) {
+	if tx, ok := cfs.Inner.(fs.Transactional); ok {
+		tx.Rollback(ctx)
+	}
+}
+
+func (cfs *CompressedFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(cfs.Inner)
+}
+
+// Flush the inner handler, if it is a BlockFlusher
+func (cfs *CompressedFileSystem) Flush(ctx context.Context) error {
+	if flusher, ok := cfs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Reserve the node in the inner handler, if it is a BlockReserver
+func (cfs *CompressedFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := cfs.Inner.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// A compressed block reads the same whichever node it is in, so it can be copied by the inner
+// handler if that is a BlockCopier
+func (cfs *CompressedFileSystem) CopyBlock(ctx context.Context, source fs.BlockNode, target fs.BlockNode) error {
+	if copier, ok := cfs.Inner.(fs.BlockCopier); ok {
+		return copier.CopyBlock(ctx, source, target)
+	}
+	return fs.ErrNotSupported
+}
+
+// The size of the blocks saved since Init before and after compression and the ratio between
+// them, with the counters of the inner handler
+func (cfs *CompressedFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := cfs.Inner.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	cfs.lock.Lock()
+	defer cfs.lock.Unlock()
+	stats["compress.bytes_in"] = float64(cfs.stats.BytesIn)
+	stats["compress.bytes_out"] = float64(cfs.stats.BytesOut)
+	stats["compress.blocks_compressed"] = float64(cfs.stats.Compressed)
+	stats["compress.blocks_skipped"] = float64(cfs.stats.Skipped)
+	stats["compress.ratio"] = cfs.ratio()
+	return stats
+}
+
+// Must be called with the lock held
+func (cfs *CompressedFileSystem) ratio() float64 {
+	if cfs.stats.BytesOut == 0 {
+		return 1
+	}
+	return float64(cfs.stats.BytesIn) / float64(cfs.stats.BytesOut)
+}
+
+func (cfs *CompressedFileSystem) DumpInfo() {
+	cfs.lock.Lock()
+	fmt.Printf("Compressed file system (%s): %d bytes saved as %d, ratio %.2f\n", cfs.Compressor.Name(), cfs.stats.BytesIn, cfs.stats.BytesOut, cfs.ratio())
+	fmt.Printf("%d blocks compressed, %d stored uncompressed, over:\n", cfs.stats.Compressed, cfs.stats.Skipped)
+	cfs.lock.Unlock()
+	cfs.Inner.DumpInfo()
+}
@@ -0,0 +1,228 @@
+package compressfs
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/dedupfs"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func TestCompressors(m *testing.T) {
+	ctx := context.Background()
+	text := []byte(strings.Repeat("A line of text that compresses well\n", 20))
+	for _, name := range []string{"gzip", "flate", "zlib", "zstd", "snappy"} {
+		var mh memory.MemoryFileSystem
+		cfs := CompressedFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+		if err := cfs.Init(ctx, name); err != nil {
+			m.Fatal(err)
+		}
+		cfs.Format(ctx, 100, 1000)
+		node, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+		cfs.SaveRawBlock(ctx, node, text)
+		if len(mh.Blocks[node]) >= len(text)/2 {
+			m.Errorf("%s: block not compressed, %d bytes", name, len(mh.Blocks[node]))
+		}
+		if x, err := cfs.GetRawBlock(ctx, node); err != nil || string(x) != string(text) {
+			m.Errorf("%s: block not read back, %v", name, err)
+		}
+	}
+}
+
+func TestIncompressibleBlocks(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	cfs := CompressedFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+	cfs.Init(ctx, "gzip")
+	cfs.Format(ctx, 100, 100)
+	node, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.SaveRawBlock(ctx, node, []byte("xyz"))
+	if raw := mh.Blocks[node]; len(raw) != 4 || raw[0] != stored {
+		m.Errorf("Expected the block to be stored as it is, got %v", raw)
+	}
+	if x, _ := cfs.GetRawBlock(ctx, node); string(x) != "xyz" {
+		m.Errorf("Block not read back, got %s", string(x))
+	}
+	stats := cfs.HandlerStats()
+	if stats["compress.blocks_skipped"] != 1 || stats["compress.blocks_compressed"] != 0 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+
+	// A block compressed with another compressor can still be read
+	other := CompressedFileSystem{Inner: cfs.Inner}
+	other.Init(ctx, "zlib")
+	text := []byte(strings.Repeat("zlib zlib zlib ", 10))
+	other.SaveRawBlock(ctx, node, text)
+	if x, _ := cfs.GetRawBlock(ctx, node); string(x) != string(text) {
+		m.Errorf("Block compressed with zlib not read back, got %s", string(x))
+	}
+}
+
+func TestStats(m *testing.T) {
+	f := blocktest.NewFileSystem(m, nil, "compress:gzip:memory", 1000, 4096)
+	for i := 0; i < 10; i++ {
+		f.AppendFile("/log/messages", []byte(strings.Repeat("Everything is fine. ", 50)))
+	}
+	f.Sync()
+	if v, _ := f.ReadFile("/log/messages"); len(v) != 10000 {
+		m.Errorf("Expected 10000 bytes, got %d", len(v))
+	}
+	stats := f.Stats()
+	if stats.Handler["compress.ratio"] < 2 {
+		m.Errorf("Expected a compression ratio of at least 2, got %v", stats.Handler)
+	}
+}
+
+func TestForwardsToInner(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(inner fs.BlockHandlerV2) *CompressedFileSystem {
+		cfs := &CompressedFileSystem{Inner: inner}
+		if err := cfs.Init(ctx, "gzip"); err != nil {
+			m.Fatal(err)
+		}
+		cfs.Format(ctx, 100, 100)
+		return cfs
+	}
+
+	// Transactions, only when the inner handler has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a wrapper over memory not to be transactional")
+	}
+	cfs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(cfs) {
+		m.Errorf("Expected a wrapper over walfs to be transactional")
+	}
+	node, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.Begin(ctx)
+	cfs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	cfs.Rollback(ctx)
+	if _, err := cfs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	cfs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = cfs.GetFreeBlockNode(ctx, fs.DATA)
+	cfs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := cfs.Flush(ctx); err != nil || len(cold.Blocks[node]) == 0 {
+		m.Errorf("Expected the flush to reach the cold tier, got %v", err)
+	}
+
+	// Reservations
+	cfs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = cfs.GetFreeBlockNode(ctx, fs.FILE)
+	cfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := cfs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := cfs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+
+	// and copies
+	cfs = wrap(&dedupfs.DedupFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})})
+	file, _ := cfs.GetFreeBlockNode(ctx, fs.FILE)
+	source, _ := cfs.GetFreeDataBlockNode(ctx, file, "00001")
+	target, _ := cfs.GetFreeDataBlockNode(ctx, file, "00002")
+	cfs.SaveRawBlock(ctx, source, []byte("Shared"))
+	if err := cfs.CopyBlock(ctx, source, target); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := cfs.GetRawBlock(ctx, target); err != nil || string(x) != "Shared" {
+		m.Errorf("Expected the copy to read back, got %q, %v", x, err)
+	}
+}
+
+func TestSnappy(m *testing.T) {
+	// Written by hand from the format: a four byte literal, then copies with one and two byte offsets
+	encoded := []byte{18, 3 << 2, 'a', 'b', 'c', 'd', 4<<2 | 1, 4, 0<<2 | 1, 4, 1<<2 | 2, 2, 0}
+	if x, err := (snappyCompressor{}).Decompress(encoded); err != nil || string(x) != "abcdabcdabcdabcdcd" {
+		m.Errorf("Expected abcdabcdabcdabcdcd, got %q, %v", string(x), err)
+	}
+
+	long := []byte(strings.Repeat("x", 70000) + strings.Repeat("A line of text\n", 5000))
+	for _, data := range [][]byte{nil, []byte("abc"), []byte(strings.Repeat("ab", 100)), long} {
+		compressed, _ := (snappyCompressor{}).Compress(data)
+		if x, err := (snappyCompressor{}).Decompress(compressed); err != nil || string(x) != string(data) {
+			m.Errorf("%d bytes not read back, %v", len(data), err)
+		}
+	}
+	compressed, _ := (snappyCompressor{}).Compress(long)
+	if len(compressed) >= len(long)/10 {
+		m.Errorf("Expected %d bytes to compress well, got %d", len(long), len(compressed))
+	}
+	for _, corrupt := range [][]byte{{}, {4, 0}, {4, 3 << 2, 'a'}, {4, 1, 9}, {8, 0, 'a', 4<<2 | 1, 4}} {
+		if _, err := (snappyCompressor{}).Decompress(corrupt); err == nil {
+			m.Errorf("Expected %v to be rejected", corrupt)
+		}
+	}
+}
+
+func TestZstd(m *testing.T) {
+	// Written by the reference implementation: at level 19, with Huffman coded literals and FSE
+	// tables of its own
+	beer := ""
+	for i := 99; i > 0; i-- {
+		beer += fmt.Sprintf("%d bottles of beer on the wall, %d bottles of beer.\n", i, i)
+	}
+	encoded, _ := hex.DecodeString("28b52ffd640a134d0700628f2413a01b1b00edcef10fffd0bbbb7b67927d" +
+		"576cc665ff66778899aabb4455f66f768798a9bab5455465ff66778899aa" +
+		"eb355195fd9bdd2166aaeef74455f66f768798a9bab6465465ff66778899" +
+		"aa7b7b4455f66f768798a9bab8485465ff66778899aa9b9b4455f66f7687" +
+		"98a9baba4a5465ff66778899aa0b0c819024c413188813284bc01846111c" +
+		"4bd01889e32c45b01b80c5a821e40efbbf01f035d611fc7b70e1c77cf9b2" +
+		"58cc582c2d166caa8cb5edb6d583e74a9cf73b9a76def6fdf05cc1f3be63" +
+		"d3ceedbe0fcf2d38df7734edb9edf7e1b922e7fd8ea69db77de7e3955531" +
+		"56590541e4c583")
+	if x, err := (zstdCompressor{}).Decompress(encoded); err != nil || string(x) != beer {
+		m.Errorf("Expected the song, got %q, %v", x, err)
+	}
+	// and with the default level, in three blocks of which the last is a single repeated byte
+	xs, _ := hex.DecodeString("28b52ffda4e09304005400001078780100fbff39c00202001078039f04788f729ba2")
+	if x, err := (zstdCompressor{}).Decompress(xs); err != nil || string(x) != strings.Repeat("x", 300000) {
+		m.Errorf("Expected 300000 x's, got %d bytes, %v", len(x), err)
+	}
+	// Frames can follow each other, with skippable frames between them
+	both := append(append(append([]byte(nil), encoded...), 0x50, 0x2a, 0x4d, 0x18, 2, 0, 0, 0, 'h', 'i'), xs...)
+	if x, err := (zstdCompressor{}).Decompress(both); err != nil || string(x) != beer+strings.Repeat("x", 300000) {
+		m.Errorf("Expected both frames, got %d bytes, %v", len(x), err)
+	}
+
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	long := []byte(strings.Repeat("x", 70000) + strings.Repeat(beer, 40))
+	for _, data := range [][]byte{nil, []byte("abc"), []byte(strings.Repeat("ab", 100)), []byte(beer), random, long} {
+		compressed, _ := (zstdCompressor{}).Compress(data)
+		if x, err := (zstdCompressor{}).Decompress(compressed); err != nil || string(x) != string(data) {
+			m.Errorf("%d bytes not read back, %v", len(data), err)
+		}
+	}
+	compressed, _ := (zstdCompressor{}).Compress(long)
+	if len(compressed) >= len(long)/20 {
+		m.Errorf("Expected %d bytes to compress well, got %d", len(long), len(compressed))
+	}
+	// Huffman coding the literals makes text smaller than matches alone would
+	compressed, _ = (zstdCompressor{}).Compress([]byte(beer))
+	if snappy, _ := (snappyCompressor{}).Compress([]byte(beer)); len(compressed) >= len(snappy) {
+		m.Errorf("Expected zstd to beat snappy, got %d and %d bytes", len(compressed), len(snappy))
+	}
+
+	changed := append([]byte(nil), compressed...)
+	changed[len(changed)-10] ^= 1
+	dictionary := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 1, 0, 1, 0, 0}
+	for _, corrupt := range [][]byte{{}, encoded[:100], encoded[4:], changed, dictionary, append(encoded, 0)} {
+		if _, err := (zstdCompressor{}).Decompress(corrupt); err == nil {
+			m.Errorf("Expected %d bytes to be rejected", len(corrupt))
+		}
+	}
+}
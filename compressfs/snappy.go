@@ -0,0 +1,158 @@
+package compressfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The snappy block format, as written by the reference implementation: the uncompressed length
+// as a uvarint, then a sequence of literals and copies of earlier output. The encoder here looks
+// for four byte matches through a small hash table, which compresses less than the reference one
+// does but is read by any snappy decoder, and the decoder reads anything they write.
+type snappyCompressor struct{}
+
+var errSnappyCorrupt = errors.New("Corrupt snappy block")
+
+const (
+	snappyLiteral = 0
+	snappyCopy1   = 1
+	snappyCopy2   = 2
+	snappyCopy4   = 3
+	// Copies with a two byte offset reach this far back
+	snappyWindow   = 1<<16 - 1
+	snappyHashBits = 14
+)
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64, len(data)+len(data)/6+binary.MaxVarintLen64)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(data)))]
+	// The position after each hashed four bytes, so that zero means none yet
+	var table [1 << snappyHashBits]int
+	literal := 0
+	for i := 0; i+4 <= len(data); {
+		v := binary.LittleEndian.Uint32(data[i:])
+		h := (v * 0x1e35a7bd) >> (32 - snappyHashBits)
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > snappyWindow || binary.LittleEndian.Uint32(data[candidate:]) != v {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(data) && data[candidate+length] == data[i+length] {
+			length++
+		}
+		dst = snappyEmitLiteral(dst, data[literal:i])
+		dst = snappyEmitCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyEmitLiteral(dst, data[literal:]), nil
+}
+
+func snappyEmitLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// A copy takes at most 64 bytes, so a longer match is split, leaving at least 4 for the last
+func snappyEmitCopy(dst []byte, offset int, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyCopy1, byte(offset))
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > 1<<32-1 {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, len(data))
+	for s := n; s < len(data); {
+		tag := data[s]
+		var length, offset int
+		switch tag & 3 {
+		case snappyLiteral:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(data) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(data[s+j])
+				}
+				s += extra
+			}
+			length++
+			if length <= 0 || length > len(data)-s {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, data[s:s+length]...)
+			s += length
+			continue
+		case snappyCopy1:
+			if s+2 > len(data) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(data[s+1])
+			s += 2
+		case snappyCopy2:
+			if s+3 > len(data) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(data[s+1:]))
+			s += 3
+		case snappyCopy4:
+			if s+5 > len(data) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(data[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > size {
+			return nil, errSnappyCorrupt
+		}
+		// The copy may overlap the bytes it is writing, so it goes a byte at a time
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
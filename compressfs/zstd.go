@@ -0,0 +1,725 @@
+package compressfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// The zstd format (RFC 8878). The decoder reads any frame that doesn't need a dictionary, as the
+// reference implementation writes them. The encoder finds matches through a hash table as the
+// snappy one does, Huffman codes the literals when that makes them smaller and codes the
+// sequences with the predefined FSE tables, so it compresses less than the reference one does but
+// is read by any zstd decoder. Every frame carries a checksum of its content.
+type zstdCompressor struct{}
+
+var (
+	errZstdCorrupt    = errors.New("Corrupt zstd frame")
+	errZstdChecksum   = errors.New("zstd frame checksum doesn't match its content")
+	errZstdDictionary = errors.New("zstd frames that need a dictionary are not supported")
+)
+
+const (
+	zstdMagic        = 0xFD2FB528
+	zstdMaxBlockSize = 1 << 17
+	zstdHashBits     = 14
+	zstdMinMatch     = 4
+	zstdMaxOffset    = 1<<28 - 1
+	zstdLiteralsRaw  = 0
+	zstdLiteralsRLE  = 1
+	zstdLiteralsHuff = 2
+)
+
+// The lengths and offsets of sequences are coded as a symbol and a number of extra bits
+type zstdCodeTable struct {
+	base []int
+	bits []uint8
+}
+
+var zstdLiteralLengths = zstdCodeTable{
+	[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40, 48, 64,
+		128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536},
+	[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16},
+}
+
+var zstdMatchLengths = zstdCodeTable{
+	[]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27,
+		28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027,
+		2051, 4099, 8195, 16387, 32771, 65539},
+	[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+}
+
+// The code of a length, the last one whose base isn't above it
+func (t zstdCodeTable) code(length int) int {
+	code := len(t.base) - 1
+	for t.base[code] > length {
+		code--
+	}
+	return code
+}
+
+// The predefined distributions of the literal length, match length and offset codes
+var (
+	zstdLiteralLengthCounts = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2,
+		2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthCounts = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetCounts = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1}
+)
+
+var (
+	zstdLiteralLengthDecoder, _ = newFSEDecoder(zstdLiteralLengthCounts, 6)
+	zstdMatchLengthDecoder, _   = newFSEDecoder(zstdMatchLengthCounts, 6)
+	zstdOffsetDecoder, _        = newFSEDecoder(zstdOffsetCounts, 5)
+	zstdLiteralLengthEncoder    = newFSEEncoder(zstdLiteralLengthCounts, 6)
+	zstdMatchLengthEncoder      = newFSEEncoder(zstdMatchLengthCounts, 6)
+	zstdOffsetEncoder           = newFSEEncoder(zstdOffsetCounts, 5)
+)
+
+func (zstdCompressor) Name() string {
+	return "zstd"
+}
+
+// Write a single frame holding the whole of data, with its size and checksum
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	dst := make([]byte, 4, len(data)/2+32)
+	binary.LittleEndian.PutUint32(dst, zstdMagic)
+	// The frame is a single segment, so the window is the whole content
+	size := uint64(len(data))
+	switch {
+	case size < 256:
+		dst = append(dst, 1<<5|1<<2, byte(size))
+	case size < 1<<16+256:
+		dst = append(dst, 1<<6|1<<5|1<<2, byte(size-256), byte((size-256)>>8))
+	case size < 1<<32:
+		dst = append(dst, 2<<6|1<<5|1<<2)
+		dst = append(dst, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(dst[len(dst)-4:], uint32(size))
+	default:
+		dst = append(dst, 3<<6|1<<5|1<<2)
+		dst = append(dst, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(dst[len(dst)-8:], size)
+	}
+	e := &zstdEncoder{data: data}
+	for start := 0; ; start += zstdMaxBlockSize {
+		end := start + zstdMaxBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		dst = e.appendBlock(dst, start, end, end == len(data))
+		if end == len(data) {
+			break
+		}
+	}
+	sum := uint32(xxhash64(data))
+	return append(dst, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24)), nil
+}
+
+type zstdSequence struct {
+	literals int
+	offset   int
+	match    int
+}
+
+type zstdEncoder struct {
+	data []byte
+	// The position after each hashed four bytes, so that zero means none yet
+	table     [1 << zstdHashBits]int32
+	literals  []byte
+	sequences []zstdSequence
+}
+
+// Append the block of data from start to end, compressed if that makes it smaller
+func (e *zstdEncoder) appendBlock(dst []byte, start int, end int, last bool) []byte {
+	header := len(dst)
+	dst = e.appendCompressedBlock(append(dst, 0, 0, 0), start, end)
+	blockType, size := 2, len(dst)-header-3
+	if size >= end-start {
+		dst = append(dst[:header+3], e.data[start:end]...)
+		blockType, size = 0, end-start
+	}
+	h := size<<3 | blockType<<1
+	if last {
+		h |= 1
+	}
+	dst[header], dst[header+1], dst[header+2] = byte(h), byte(h>>8), byte(h>>16)
+	return dst
+}
+
+// Matches may reach back into earlier blocks, but not past the end of this one
+func (e *zstdEncoder) appendCompressedBlock(dst []byte, start int, end int) []byte {
+	data := e.data[:end]
+	e.literals, e.sequences = e.literals[:0], e.sequences[:0]
+	literal := start
+	for i := start; i+zstdMinMatch <= end; {
+		v := binary.LittleEndian.Uint32(data[i:])
+		h := (v * 0x9e3779b1) >> (32 - zstdHashBits)
+		candidate := int(e.table[h]) - 1
+		e.table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > zstdMaxOffset || binary.LittleEndian.Uint32(data[candidate:]) != v {
+			i++
+			continue
+		}
+		length := zstdMinMatch
+		for i+length < end && data[candidate+length] == data[i+length] {
+			length++
+		}
+		e.literals = append(e.literals, data[literal:i]...)
+		e.sequences = append(e.sequences, zstdSequence{i - literal, i - candidate, length})
+		i += length
+		literal = i
+	}
+	e.literals = append(e.literals, data[literal:end]...)
+	return appendZstdSequences(appendZstdLiterals(dst, e.literals), e.sequences)
+}
+
+// Append the literals section, Huffman coded if that is smaller than the literals are
+func appendZstdLiterals(dst []byte, literals []byte) []byte {
+	var counts [256]int
+	maxSymbol := 0
+	for _, b := range literals {
+		counts[b]++
+		if int(b) > maxSymbol {
+			maxSymbol = int(b)
+		}
+	}
+	if len(literals) > 0 && counts[literals[0]] == len(literals) {
+		return append(appendZstdLiteralsHeader(dst, zstdLiteralsRLE, len(literals)), literals[0])
+	}
+	// The weights are written four bits each, which can only describe up to 128 symbols
+	if len(literals) >= 64 && maxSymbol <= 128 {
+		if section := huffmanLiterals(literals, counts[:maxSymbol+1]); section != nil && len(section) < len(literals) {
+			return append(dst, section...)
+		}
+	}
+	return append(appendZstdLiteralsHeader(dst, zstdLiteralsRaw, len(literals)), literals...)
+}
+
+func appendZstdLiteralsHeader(dst []byte, literalsType int, size int) []byte {
+	switch {
+	case size < 32:
+		return append(dst, byte(size<<3|literalsType))
+	case size < 1<<12:
+		return append(dst, byte(size<<4|1<<2|literalsType), byte(size>>4))
+	default:
+		return append(dst, byte(size<<4|3<<2|literalsType), byte(size>>4), byte(size>>12))
+	}
+}
+
+// The literals section for the literals Huffman coded, in one stream when there are few of them
+// and four otherwise
+func huffmanLiterals(literals []byte, counts []int) []byte {
+	lengths := huffmanLengths(counts, zstdMaxHuffmanBits)
+	maxBits := 0
+	for _, l := range lengths {
+		if l > maxBits {
+			maxBits = l
+		}
+	}
+	// Codes are handed out from the longest up, and in order of symbol for each length
+	var start [zstdMaxHuffmanBits + 2]int
+	for _, l := range lengths {
+		if l > 0 {
+			start[maxBits-l+2] += 1 << uint(maxBits-l)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	codes := make([]uint64, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			w := maxBits + 1 - l
+			codes[s] = uint64(start[w] >> uint(w-1))
+			start[w] += 1 << uint(w-1)
+		}
+	}
+
+	// The weights of every symbol but the last
+	last := len(counts) - 1
+	table := []byte{byte(127 + last)}
+	for s := 0; s < last; s += 2 {
+		w := byte(0)
+		if lengths[s] > 0 {
+			w = byte(maxBits+1-lengths[s]) << 4
+		}
+		if s+1 < last && lengths[s+1] > 0 {
+			w |= byte(maxBits + 1 - lengths[s+1])
+		}
+		table = append(table, w)
+	}
+
+	encode := func(dst []byte, literals []byte) []byte {
+		w := zstdBitWriter{dst: dst}
+		for i := len(literals) - 1; i >= 0; i-- {
+			w.add(codes[literals[i]], uint(lengths[literals[i]]))
+		}
+		return w.close()
+	}
+	var body []byte
+	single := len(literals) < 1<<10
+	if single {
+		body = encode(table, literals)
+	} else {
+		segment := (len(literals) + 3) / 4
+		body = append(table, make([]byte, 6)...)
+		jump := len(table)
+		for i := 0; i < 4; i++ {
+			before := len(body)
+			body = encode(body, literals[minInt(i*segment, len(literals)):minInt((i+1)*segment, len(literals))])
+			if i < 3 {
+				binary.LittleEndian.PutUint16(body[jump+2*i:], uint16(len(body)-before))
+			}
+		}
+	}
+	regenerated, compressed := len(literals), len(body)
+	var header []byte
+	switch {
+	case single && compressed < 1<<10:
+		v := uint32(zstdLiteralsHuff) | uint32(regenerated)<<4 | uint32(compressed)<<14
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+	case single:
+		return nil
+	case regenerated < 1<<14 && compressed < 1<<14:
+		v := uint32(zstdLiteralsHuff) | 2<<2 | uint32(regenerated)<<4 | uint32(compressed)<<18
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+	default:
+		v := uint64(zstdLiteralsHuff) | 3<<2 | uint64(regenerated)<<4 | uint64(compressed)<<22
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24), byte(v >> 32)}
+	}
+	return append(header, body...)
+}
+
+// Append the sequences section, coded with the predefined tables. Offsets are always given in
+// full, rather than as one of the recent offsets.
+func appendZstdSequences(dst []byte, sequences []zstdSequence) []byte {
+	n := len(sequences)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+	dst = append(dst, 0)
+	type coded struct {
+		llCode, mlCode, ofCode int
+		offset                 int
+	}
+	codes := make([]coded, n)
+	for i, s := range sequences {
+		offset := s.offset + 3
+		codes[i] = coded{zstdLiteralLengths.code(s.literals), zstdMatchLengths.code(s.match), bits.Len(uint(offset)) - 1, offset}
+	}
+	w := zstdBitWriter{dst: dst}
+	extra := func(i int) {
+		s, c := sequences[i], codes[i]
+		w.add(uint64(s.literals-zstdLiteralLengths.base[c.llCode]), uint(zstdLiteralLengths.bits[c.llCode]))
+		w.add(uint64(s.match-zstdMatchLengths.base[c.mlCode]), uint(zstdMatchLengths.bits[c.mlCode]))
+		w.add(uint64(c.offset), uint(c.ofCode))
+	}
+	// The decoder reads the stream backwards, so the last sequence goes first
+	ml := zstdMatchLengthEncoder.init(codes[n-1].mlCode)
+	of := zstdOffsetEncoder.init(codes[n-1].ofCode)
+	ll := zstdLiteralLengthEncoder.init(codes[n-1].llCode)
+	extra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		of = zstdOffsetEncoder.encode(&w, of, codes[i].ofCode)
+		ml = zstdMatchLengthEncoder.encode(&w, ml, codes[i].mlCode)
+		ll = zstdLiteralLengthEncoder.encode(&w, ll, codes[i].llCode)
+		extra(i)
+	}
+	zstdMatchLengthEncoder.flush(&w, ml)
+	zstdOffsetEncoder.flush(&w, of)
+	zstdLiteralLengthEncoder.flush(&w, ll)
+	return w.close()
+}
+
+// Read every frame in data, skipping skippable frames
+func (zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	var dst []byte
+	for {
+		if len(data) < 4 {
+			return nil, errZstdCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		if magic&^0xf == 0x184d2a50 {
+			if len(data) < 8 || uint64(len(data)-8) < uint64(binary.LittleEndian.Uint32(data[4:])) {
+				return nil, errZstdCorrupt
+			}
+			data = data[8+int(binary.LittleEndian.Uint32(data[4:])):]
+		} else if magic != zstdMagic {
+			return nil, errZstdCorrupt
+		} else {
+			var err error
+			var d zstdDecoder
+			if dst, data, err = d.decodeFrame(dst, data[4:]); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) == 0 {
+			return dst, nil
+		}
+	}
+}
+
+// The state a frame's blocks share: the recent offsets and the tables that later blocks can repeat
+type zstdDecoder struct {
+	offsets                                  [3]int
+	literalLengths, matchLengths, offsetsFSE *fseDecoder
+	huffman                                  []huffmanEntry
+	huffmanBits                              int
+	literals                                 []byte
+}
+
+// Decode a frame after its magic number, appending its content to dst and returning the data
+// after it
+func (d *zstdDecoder) decodeFrame(dst []byte, src []byte) ([]byte, []byte, error) {
+	if len(src) < 1 || src[0]&8 != 0 {
+		return nil, nil, errZstdCorrupt
+	}
+	descriptor := src[0]
+	src = src[1:]
+	singleSegment, checksum := descriptor&(1<<5) != 0, descriptor&(1<<2) != 0
+	windowSize := uint64(0)
+	if !singleSegment {
+		if len(src) < 1 {
+			return nil, nil, errZstdCorrupt
+		}
+		windowBase := uint64(1) << (10 + src[0]>>3)
+		windowSize = windowBase + windowBase/8*uint64(src[0]&7)
+		src = src[1:]
+	}
+	dictionarySize := [4]int{0, 1, 2, 4}[descriptor&3]
+	sizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if singleSegment && sizeSize == 0 {
+		sizeSize = 1
+	}
+	if len(src) < dictionarySize+sizeSize {
+		return nil, nil, errZstdCorrupt
+	}
+	if readZstdLittleEndian(src[:dictionarySize]) != 0 {
+		return nil, nil, errZstdDictionary
+	}
+	contentSize := readZstdLittleEndian(src[dictionarySize : dictionarySize+sizeSize])
+	if sizeSize == 2 {
+		contentSize += 256
+	}
+	src = src[dictionarySize+sizeSize:]
+	if singleSegment {
+		windowSize = contentSize
+	}
+	maxBlockSize := zstdMaxBlockSize
+	if windowSize < uint64(maxBlockSize) {
+		maxBlockSize = int(windowSize)
+	}
+
+	d.offsets = [3]int{1, 4, 8}
+	start := len(dst)
+	for last := false; !last; {
+		if len(src) < 3 {
+			return nil, nil, errZstdCorrupt
+		}
+		header := int(src[0]) | int(src[1])<<8 | int(src[2])<<16
+		src = src[3:]
+		last = header&1 != 0
+		size := header >> 3
+		if size > maxBlockSize {
+			return nil, nil, errZstdCorrupt
+		}
+		switch header >> 1 & 3 {
+		case 0:
+			if size > len(src) {
+				return nil, nil, errZstdCorrupt
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+		case 1:
+			if len(src) < 1 {
+				return nil, nil, errZstdCorrupt
+			}
+			for i := 0; i < size; i++ {
+				dst = append(dst, src[0])
+			}
+			src = src[1:]
+		case 2:
+			if size > len(src) {
+				return nil, nil, errZstdCorrupt
+			}
+			var err error
+			if dst, err = d.decodeBlock(dst, start, src[:size], maxBlockSize); err != nil {
+				return nil, nil, err
+			}
+			src = src[size:]
+		default:
+			return nil, nil, errZstdCorrupt
+		}
+	}
+	if sizeSize > 0 && uint64(len(dst)-start) != contentSize {
+		return nil, nil, errZstdCorrupt
+	}
+	if checksum {
+		if len(src) < 4 {
+			return nil, nil, errZstdCorrupt
+		}
+		if binary.LittleEndian.Uint32(src) != uint32(xxhash64(dst[start:])) {
+			return nil, nil, errZstdChecksum
+		}
+		src = src[4:]
+	}
+	return dst, src, nil
+}
+
+func readZstdLittleEndian(b []byte) uint64 {
+	v := uint64(0)
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// Decode a compressed block, whose matches may reach back to the start of the frame
+func (d *zstdDecoder) decodeBlock(dst []byte, frameStart int, src []byte, maxSize int) ([]byte, error) {
+	literals, src, err := d.decodeLiterals(src, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) < 1 {
+		return nil, errZstdCorrupt
+	}
+	n := int(src[0])
+	src = src[1:]
+	switch {
+	case n == 255:
+		if len(src) < 2 {
+			return nil, errZstdCorrupt
+		}
+		n = int(src[0]) + int(src[1])<<8 + 0x7f00
+		src = src[2:]
+	case n >= 128:
+		if len(src) < 1 {
+			return nil, errZstdCorrupt
+		}
+		n = (n-128)<<8 + int(src[0])
+		src = src[1:]
+	}
+	blockStart := len(dst)
+	if n == 0 {
+		if len(src) != 0 || len(literals) > maxSize {
+			return nil, errZstdCorrupt
+		}
+		return append(dst, literals...), nil
+	}
+
+	if len(src) < 1 || src[0]&3 != 0 {
+		return nil, errZstdCorrupt
+	}
+	modes := src[0]
+	src = src[1:]
+	if src, err = setupZstdTable(&d.literalLengths, modes>>6, src, zstdLiteralLengthDecoder, 35, 9); err != nil {
+		return nil, err
+	}
+	if src, err = setupZstdTable(&d.offsetsFSE, modes>>4&3, src, zstdOffsetDecoder, 31, 8); err != nil {
+		return nil, err
+	}
+	if src, err = setupZstdTable(&d.matchLengths, modes>>2&3, src, zstdMatchLengthDecoder, 52, 9); err != nil {
+		return nil, err
+	}
+
+	var r zstdBitReader
+	if err := r.init(src); err != nil {
+		return nil, err
+	}
+	llState := d.literalLengths.init(&r)
+	ofState := d.offsetsFSE.init(&r)
+	mlState := d.matchLengths.init(&r)
+	for i := 0; i < n; i++ {
+		llCode := int(d.literalLengths.table[llState].symbol)
+		mlCode := int(d.matchLengths.table[mlState].symbol)
+		ofCode := int(d.offsetsFSE.table[ofState].symbol)
+		value := 1<<uint(ofCode) + int(r.read(ofCode))
+		match := zstdMatchLengths.base[mlCode] + int(r.read(int(zstdMatchLengths.bits[mlCode])))
+		literal := zstdLiteralLengths.base[llCode] + int(r.read(int(zstdLiteralLengths.bits[llCode])))
+		offset := d.offset(value, literal == 0)
+		if i < n-1 {
+			llState = d.literalLengths.update(&r, llState)
+			mlState = d.matchLengths.update(&r, mlState)
+			ofState = d.offsetsFSE.update(&r, ofState)
+		}
+		if r.pos < 0 || literal > len(literals) || offset <= 0 || offset > len(dst)+literal-frameStart ||
+			len(dst)+literal+match-blockStart > maxSize {
+			return nil, errZstdCorrupt
+		}
+		dst = append(dst, literals[:literal]...)
+		literals = literals[literal:]
+		// The match may overlap the bytes it is writing, so it goes a byte at a time
+		for j := 0; j < match; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if r.pos != 0 || len(dst)+len(literals)-blockStart > maxSize {
+		return nil, errZstdCorrupt
+	}
+	return append(dst, literals...), nil
+}
+
+// The offset a sequence's offset value gives. Values 1 to 3 pick one of the recent offsets, and
+// one less than the most recent, shifted along by one when there are no literals.
+func (d *zstdDecoder) offset(value int, noLiterals bool) int {
+	if value > 3 {
+		d.offsets = [3]int{value - 3, d.offsets[0], d.offsets[1]}
+		return d.offsets[0]
+	}
+	index := value - 1
+	if noLiterals {
+		index++
+	}
+	var offset int
+	switch index {
+	case 0:
+		return d.offsets[0]
+	case 3:
+		offset = d.offsets[0] - 1
+	default:
+		offset = d.offsets[index]
+	}
+	if index > 1 {
+		d.offsets[2] = d.offsets[1]
+	}
+	d.offsets[0], d.offsets[1] = offset, d.offsets[0]
+	return offset
+}
+
+// Set up the table for one of the sequence codes from its mode: predefined, a single symbol, FSE
+// coded in the block or the one the previous block used
+func setupZstdTable(table **fseDecoder, mode byte, src []byte, predefined *fseDecoder, maxSymbol int, maxLog int) ([]byte, error) {
+	switch mode {
+	case 0:
+		*table = predefined
+	case 1:
+		if len(src) < 1 || int(src[0]) > maxSymbol {
+			return nil, errZstdCorrupt
+		}
+		*table = newRLEDecoder(src[0])
+		return src[1:], nil
+	case 2:
+		counts, tableLog, n, err := readFSECounts(src, maxSymbol, maxLog)
+		if err != nil {
+			return nil, err
+		}
+		if *table, err = newFSEDecoder(counts, tableLog); err != nil {
+			return nil, err
+		}
+		return src[n:], nil
+	default:
+		if *table == nil {
+			return nil, errZstdCorrupt
+		}
+	}
+	return src, nil
+}
+
+// Decode the literals section at the start of a compressed block, returning the literals and the
+// rest of the block
+func (d *zstdDecoder) decodeLiterals(src []byte, maxSize int) ([]byte, []byte, error) {
+	if len(src) < 1 {
+		return nil, nil, errZstdCorrupt
+	}
+	literalsType, sizeFormat := int(src[0]&3), src[0]>>2&3
+	if literalsType == zstdLiteralsRaw || literalsType == zstdLiteralsRLE {
+		size, header := int(src[0]>>3), 1
+		switch sizeFormat {
+		case 1:
+			header = 2
+		case 3:
+			header = 3
+		}
+		if len(src) < header {
+			return nil, nil, errZstdCorrupt
+		}
+		if header > 1 {
+			size = int(readZstdLittleEndian(src[:header]) >> 4)
+		}
+		src = src[header:]
+		if size > maxSize {
+			return nil, nil, errZstdCorrupt
+		}
+		if literalsType == zstdLiteralsRaw {
+			if size > len(src) {
+				return nil, nil, errZstdCorrupt
+			}
+			return src[:size], src[size:], nil
+		}
+		if len(src) < 1 {
+			return nil, nil, errZstdCorrupt
+		}
+		d.literals = d.literals[:0]
+		for i := 0; i < size; i++ {
+			d.literals = append(d.literals, src[0])
+		}
+		return d.literals, src[1:], nil
+	}
+
+	// Huffman coded, with its own table or the previous one
+	header, sizeBits := [4]int{3, 3, 4, 5}[sizeFormat], [4]uint{10, 10, 14, 18}[sizeFormat]
+	if len(src) < header {
+		return nil, nil, errZstdCorrupt
+	}
+	v := readZstdLittleEndian(src[:header]) >> 4
+	regenerated, compressed := int(v&(1<<sizeBits-1)), int(v>>sizeBits)
+	src = src[header:]
+	if regenerated > maxSize || compressed > len(src) {
+		return nil, nil, errZstdCorrupt
+	}
+	body, rest := src[:compressed], src[compressed:]
+	if literalsType == zstdLiteralsHuff {
+		table, maxBits, n, err := readHuffmanTable(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.huffman, d.huffmanBits = table, maxBits
+		body = body[n:]
+	} else if d.huffman == nil {
+		return nil, nil, errZstdCorrupt
+	}
+	if cap(d.literals) < regenerated {
+		d.literals = make([]byte, regenerated)
+	}
+	d.literals = d.literals[:regenerated]
+	if sizeFormat == 0 {
+		return d.literals, rest, decodeHuffmanStream(d.literals, body, d.huffman, d.huffmanBits)
+	}
+	if len(body) < 6 {
+		return nil, nil, errZstdCorrupt
+	}
+	segment := (regenerated + 3) / 4
+	if 3*segment > regenerated {
+		return nil, nil, errZstdCorrupt
+	}
+	streams := body[6:]
+	for i := 0; i < 4; i++ {
+		size := len(streams)
+		if i < 3 {
+			size = int(binary.LittleEndian.Uint16(body[2*i:]))
+		}
+		if size > len(streams) {
+			return nil, nil, errZstdCorrupt
+		}
+		out := d.literals[i*segment:]
+		if i < 3 {
+			out = out[:segment]
+		}
+		if err := decodeHuffmanStream(out, streams[:size], d.huffman, d.huffmanBits); err != nil {
+			return nil, nil, err
+		}
+		streams = streams[size:]
+	}
+	return d.literals, rest, nil
+}
@@ -0,0 +1,560 @@
+package compressfs
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// The entropy coding zstd is built on: bitstreams, FSE (tabled asymmetric numeral systems) and
+// Huffman tables, and the xxhash64 checksum of a frame.
+
+// Reads a bitstream backwards from its end, as FSE and Huffman coded streams are read. The last
+// byte holds a marker bit above the first bit to read, and bits past the start read as zero.
+type zstdBitReader struct {
+	data []byte
+	// The number of bits left to read
+	pos int
+}
+
+func (r *zstdBitReader) init(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return errZstdCorrupt
+	}
+	r.data = data
+	r.pos = (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1
+	return nil
+}
+
+// The next n bits, at most 56, the first of them the highest
+func (r *zstdBitReader) peek(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start, shift := r.pos-n, 0
+	if start < 0 {
+		start, shift = 0, -start
+	}
+	if start >= r.pos {
+		return 0
+	}
+	var v uint64
+	for i, b := 0, start/8; i < 8 && b+i < len(r.data); i++ {
+		v |= uint64(r.data[b+i]) << (8 * uint(i))
+	}
+	v = v >> uint(start%8) & (1<<uint(r.pos-start) - 1)
+	return v << uint(shift)
+}
+
+func (r *zstdBitReader) read(n int) uint64 {
+	v := r.peek(n)
+	r.pos -= n
+	return v
+}
+
+// Reads a bitstream forwards, lowest bit first, as the FSE table descriptions are written
+type zstdForwardReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *zstdForwardReader) peek(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if b := (r.pos + i) / 8; b < len(r.data) {
+			v |= int(r.data[b]>>uint((r.pos+i)%8)&1) << uint(i)
+		}
+	}
+	return v
+}
+
+func (r *zstdForwardReader) read(n int) int {
+	v := r.peek(n)
+	r.pos += n
+	return v
+}
+
+// Writes a bitstream, lowest bit first. Closing it adds the marker bit that a zstdBitReader reads
+// back from.
+type zstdBitWriter struct {
+	dst  []byte
+	bits uint64
+	n    uint
+}
+
+func (w *zstdBitWriter) add(value uint64, n uint) {
+	w.bits |= (value & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.dst = append(w.dst, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *zstdBitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.dst = append(w.dst, byte(w.bits))
+	}
+	return w.dst
+}
+
+// Read the normalized counts of an FSE table, returning them with the accuracy log and the number
+// of bytes they took. A count of -1 is a symbol less likely than 1 in the table size.
+func readFSECounts(src []byte, maxSymbol int, maxLog int) ([]int16, int, int, error) {
+	r := zstdForwardReader{data: src}
+	tableLog := r.read(4) + 5
+	if tableLog > maxLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	remaining := 1<<uint(tableLog) + 1
+	threshold := 1 << uint(tableLog)
+	nbBits := tableLog + 1
+	counts := make([]int16, 0, maxSymbol+1)
+	previous0 := false
+	for remaining > 1 {
+		if previous0 {
+			// Two bit repeat flags give the number of further symbols with a count of zero
+			for {
+				repeat := r.read(2)
+				for i := 0; i < repeat; i++ {
+					counts = append(counts, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+				if len(counts) > maxSymbol {
+					return nil, 0, 0, errZstdCorrupt
+				}
+			}
+		}
+		if len(counts) > maxSymbol || r.pos > len(src)*8 {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		count := r.peek(nbBits - 1)
+		if count < max {
+			r.pos += nbBits - 1
+		} else {
+			count = r.read(nbBits)
+			if count >= threshold {
+				count -= max
+			}
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		counts = append(counts, int16(count))
+		previous0 = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if r.pos > len(src)*8 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	return counts, tableLog, (r.pos + 7) / 8, nil
+}
+
+// Spread the symbols over a table of 1 << tableLog states as the reference implementation does.
+// Symbols with a count of -1 take one state each at the end of the table.
+func spreadFSESymbols(counts []int16, tableLog int) ([]uint8, bool) {
+	size := 1 << uint(tableLog)
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, count := range counts {
+		if count == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, count := range counts {
+		for i := 0; i < int(count); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	return symbols, pos == 0
+}
+
+type fseDecoderEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+type fseDecoder struct {
+	table    []fseDecoderEntry
+	tableLog int
+}
+
+func newFSEDecoder(counts []int16, tableLog int) (*fseDecoder, error) {
+	symbols, ok := spreadFSESymbols(counts, tableLog)
+	if !ok {
+		return nil, errZstdCorrupt
+	}
+	size := 1 << uint(tableLog)
+	next := make([]int, len(counts))
+	for s, count := range counts {
+		next[s] = int(count)
+		if count == -1 {
+			next[s] = 1
+		}
+	}
+	d := &fseDecoder{table: make([]fseDecoderEntry, size), tableLog: tableLog}
+	for u, s := range symbols {
+		state := next[s]
+		next[s]++
+		nbBits := tableLog - (bits.Len(uint(state)) - 1)
+		d.table[u] = fseDecoderEntry{s, uint8(nbBits), uint16(state<<uint(nbBits) - size)}
+	}
+	return d, nil
+}
+
+// A table that always gives the same symbol and reads no bits
+func newRLEDecoder(symbol uint8) *fseDecoder {
+	return &fseDecoder{table: []fseDecoderEntry{{symbol: symbol}}}
+}
+
+func (d *fseDecoder) init(r *zstdBitReader) int {
+	return int(r.read(d.tableLog))
+}
+
+func (d *fseDecoder) update(r *zstdBitReader, state int) int {
+	entry := d.table[state]
+	return int(entry.newState) + int(r.read(int(entry.nbBits)))
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+type fseEncoder struct {
+	tableLog   int
+	stateTable []uint16
+	symbols    []fseSymbolTransform
+}
+
+func newFSEEncoder(counts []int16, tableLog int) *fseEncoder {
+	symbols, _ := spreadFSESymbols(counts, tableLog)
+	size := 1 << uint(tableLog)
+	cumulative := make([]int, len(counts)+1)
+	for s, count := range counts {
+		if count == -1 {
+			count = 1
+		}
+		cumulative[s+1] = cumulative[s] + int(count)
+	}
+	e := &fseEncoder{tableLog: tableLog, stateTable: make([]uint16, size), symbols: make([]fseSymbolTransform, len(counts))}
+	for u, s := range symbols {
+		e.stateTable[cumulative[s]] = uint16(size + u)
+		cumulative[s]++
+	}
+	total := 0
+	for s, count := range counts {
+		switch count {
+		case 0:
+			e.symbols[s].deltaNbBits = uint32(tableLog+1)<<16 - uint32(size)
+		case -1, 1:
+			e.symbols[s] = fseSymbolTransform{uint32(tableLog)<<16 - uint32(size), int32(total - 1)}
+			total++
+		default:
+			maxBitsOut := tableLog - (bits.Len(uint(count-1)) - 1)
+			minStatePlus := uint32(count) << uint(maxBitsOut)
+			e.symbols[s] = fseSymbolTransform{uint32(maxBitsOut)<<16 - minStatePlus, int32(total - int(count))}
+			total += int(count)
+		}
+	}
+	return e
+}
+
+// The state to start encoding from, for the last symbol of the stream
+func (e *fseEncoder) init(symbol int) uint32 {
+	tt := e.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	return uint32(e.stateTable[int32(value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) encode(w *zstdBitWriter, state uint32, symbol int) uint32 {
+	tt := e.symbols[symbol]
+	nbBitsOut := (state + tt.deltaNbBits) >> 16
+	w.add(uint64(state), uint(nbBitsOut))
+	return uint32(e.stateTable[int32(state>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) flush(w *zstdBitWriter, state uint32) {
+	w.add(uint64(state), uint(e.tableLog))
+}
+
+// Huffman codes are at most this long
+const zstdMaxHuffmanBits = 11
+
+type huffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// Read the weights of a Huffman table, returning the table and the number of bytes the weights
+// took. The weights are either FSE coded or four bits each, and the weight of the last symbol is
+// left out as it is the one that makes the code complete.
+func readHuffmanTable(src []byte) ([]huffmanEntry, int, int, error) {
+	if len(src) == 0 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	header := int(src[0])
+	weights := make([]uint8, 0, 256)
+	used := 1
+	if header < 128 {
+		if 1+header > len(src) {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		data := src[1 : 1+header]
+		counts, tableLog, n, err := readFSECounts(data, zstdMaxHuffmanBits+1, 6)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		d, err := newFSEDecoder(counts, tableLog)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		var r zstdBitReader
+		if err := r.init(data[n:]); err != nil {
+			return nil, 0, 0, err
+		}
+		// Two states take turns until the stream runs out, then the other one gives the last weight
+		states := [2]int{d.init(&r), d.init(&r)}
+		for i := 0; ; i ^= 1 {
+			if len(weights) >= 255 {
+				return nil, 0, 0, errZstdCorrupt
+			}
+			weights = append(weights, d.table[states[i]].symbol)
+			states[i] = d.update(&r, states[i])
+			if r.pos < 0 {
+				weights = append(weights, d.table[states[i^1]].symbol)
+				break
+			}
+		}
+		used += header
+	} else {
+		count := header - 127
+		used += (count + 1) / 2
+		if used > len(src) {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			weights = append(weights, src[1+i/2]>>uint(4*(1-i%2))&15)
+		}
+	}
+	total := 0
+	for _, w := range weights {
+		if w > zstdMaxHuffmanBits {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	maxBits := bits.Len(uint(total))
+	rest := 1<<uint(maxBits) - total
+	if maxBits > zstdMaxHuffmanBits || rest&(rest-1) != 0 || len(weights) > 255 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(bits.Len(uint(rest))))
+
+	// The longest codes come first in the table, and each symbol takes 1 << (weight-1) entries
+	var start [zstdMaxHuffmanBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	table := make([]huffmanEntry, 1<<uint(maxBits))
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		for i := 0; i < 1<<(w-1); i++ {
+			table[start[w]+i] = huffmanEntry{uint8(s), uint8(maxBits + 1 - int(w))}
+		}
+		start[w] += 1 << (w - 1)
+	}
+	return table, maxBits, used, nil
+}
+
+// Decode one Huffman coded stream into dst, which it must fill exactly
+func decodeHuffmanStream(dst []byte, src []byte, table []huffmanEntry, maxBits int) error {
+	var r zstdBitReader
+	if err := r.init(src); err != nil {
+		return err
+	}
+	for i := range dst {
+		entry := table[r.peek(maxBits)]
+		dst[i] = entry.symbol
+		r.pos -= int(entry.nbBits)
+	}
+	if r.pos != 0 {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+// The lengths of a Huffman code for the symbols with the given counts, none longer than limit. The
+// code is always complete, and there must be at least two symbols.
+func huffmanLengths(counts []int, limit int) []int {
+	symbols := make([]int, 0, len(counts))
+	for s, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return counts[symbols[i]] < counts[symbols[j]] })
+
+	// Build the tree from two queues, the leaves in order of count and the nodes as they are made
+	n := len(symbols)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range symbols {
+		weight[i] = counts[s]
+	}
+	leaf, node := 0, n
+	take := func(next int) int {
+		if leaf < n && (node >= next || weight[leaf] <= weight[node]) {
+			leaf++
+			return leaf - 1
+		}
+		node++
+		return node - 1
+	}
+	for next := n; next < 2*n-1; next++ {
+		a, b := take(next), take(next)
+		weight[next] = weight[a] + weight[b]
+		parent[a], parent[b] = next, next
+	}
+	depth := make([]int, 2*n-1)
+	lengths := make([]int, limit+1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+		if i < n {
+			lengths[minInt(depth[i], limit)]++
+		}
+	}
+
+	// Codes cut down to the limit over fill the code space, so lengthen the longest of the others
+	// until they fit, then shorten the longest until it is full again
+	full := 1 << uint(limit)
+	total := 0
+	for l := 1; l <= limit; l++ {
+		total += lengths[l] << uint(limit-l)
+	}
+	for total > full {
+		l := limit - 1
+		for lengths[l] == 0 {
+			l--
+		}
+		lengths[l]--
+		lengths[l+1]++
+		total -= 1 << uint(limit-l-1)
+	}
+	for total < full {
+		l := limit
+		for lengths[l] == 0 {
+			l--
+		}
+		lengths[l]--
+		lengths[l-1]++
+		total += 1 << uint(limit-l)
+	}
+
+	// The least likely symbols get the longest codes
+	result := make([]int, len(counts))
+	i := 0
+	for l := limit; l >= 1; l-- {
+		for k := 0; k < lengths[l]; k++ {
+			result[symbols[i]] = l
+			i++
+		}
+	}
+	return result
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc uint64, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*xxPrime2, 31) * xxPrime1
+}
+
+func xxMerge(h uint64, acc uint64) uint64 {
+	return (h^xxRound(0, acc))*xxPrime1 + xxPrime4
+}
+
+// The xxhash64 of data with a seed of zero, which zstd checks the content of a frame with
+func xxhash64(data []byte) uint64 {
+	var h, seed uint64
+	n := len(data)
+	if n >= 32 {
+		v1, v2, v3, v4 := seed+xxPrime1+xxPrime2, seed+xxPrime2, seed, seed-xxPrime1
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(xxMerge(xxMerge(xxMerge(h, v1), v2), v3), v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
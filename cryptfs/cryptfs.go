@@ -0,0 +1,455 @@
+// Encrypting block handler - wraps another BlockHandlerV2, encrypting every block with AES-GCM
+// before it is saved. The BlockNode is used as the associated data, so a block copied or moved to
+// another node can't be decrypted there.
+//
+// Keys come from a KeyProvider. Each block records the id of the key it was encrypted with, so
+// after rotating to a new key blocks written with the old one can still be read, and Reencrypt
+// (or StartReencryption in the background) rewrites them with the current key.
+//
+// The configuration string passed to Init is the path of a key file (see LoadKeyFile) followed by
+// the configuration of the inner handler, e.g. "crypt:/etc/pmfs/keys:disk:/var/pmfs/data.pmfs".
+// When Keys and Inner are set before Init the configuration is passed to Inner as it is.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//	var mh memory.MemoryFileSystem
+//
+//	keys := cryptfs.NewStaticKeys(1, key)
+//	f.InitV2(&cryptfs.EncryptedFileSystem{Inner: fs.AdaptBlockHandler(&mh), Keys: keys}, "")
+//	f.Format(1000, 4096)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+package cryptfs
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Supplies the keys used to encrypt blocks. Keys must be 16, 24 or 32 bytes long (for AES-128,
+// AES-192 or AES-256).
+type KeyProvider interface {
+	// The id and key that new blocks are encrypted with
+	CurrentKey() (uint32, []byte, error)
+	// The key with the given id, to read blocks encrypted with it
+	Key(id uint32) ([]byte, error)
+}
+
+// A KeyProvider holding its keys in memory
+type StaticKeys struct {
+	Current uint32
+	Keys    map[uint32][]byte
+	lock    sync.RWMutex
+}
+
+func NewStaticKeys(id uint32, key []byte) *StaticKeys {
+	return &StaticKeys{Current: id, Keys: map[uint32][]byte{id: key}}
+}
+
+func (k *StaticKeys) CurrentKey() (uint32, []byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.Keys[k.Current]
+	if !ok {
+		return 0, nil, fmt.Errorf("No key with id %d", k.Current)
+	}
+	return k.Current, key, nil
+}
+
+func (k *StaticKeys) Key(id uint32) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("No key with id %d", id)
+	}
+	return key, nil
+}
+
+// Add a key and make it the one new blocks are encrypted with. The old keys are kept so that
+// blocks written with them can still be read.
+func (k *StaticKeys) Rotate(id uint32, key []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.Keys == nil {
+		k.Keys = make(map[uint32][]byte)
+	}
+	k.Keys[id] = key
+	k.Current = id
+}
+
+// Load keys from a file with a line for each key of its id and the key in hex. Blank lines and
+// lines starting with # are ignored. The key with the highest id is the current one.
+func LoadKeyFile(path string) (*StaticKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := &StaticKeys{Keys: make(map[uint32][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		keys.Keys[uint32(id)] = key
+		if uint32(id) >= keys.Current {
+			keys.Current = uint32(id)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+// Every block is stored as a format byte, the id of the key (big endian), the nonce and then the
+// sealed data
+const blockFormat = 1
+const headerSize = 1 + 4
+
+type EncryptedFileSystem struct {
+	Inner fs.BlockHandlerV2
+	Keys  KeyProvider
+	// Ciphers by key id
+	ciphers     map[uint32]cipher.AEAD
+	reencrypted int64
+	lock        sync.Mutex
+	// Saves and frees hold a read lock, re-encrypting a block holds the write lock so that a
+	// block can't be changed between being read and written back
+	rewriteLock sync.RWMutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("crypt", func() fs.BlockHandlerV2 { return &EncryptedFileSystem{} })
+}
+
+// Load the keys from the key file named at the start of the configuration, if there is no
+// KeyProvider, then initialize the inner handler (creating it from the rest of the configuration
+// if there isn't one)
+func (efs *EncryptedFileSystem) Init(ctx context.Context, configuration string) error {
+	if efs.Keys == nil {
+		path, rest := configuration, ""
+		if i := strings.Index(configuration, ":"); i >= 0 {
+			path, rest = configuration[:i], configuration[i+1:]
+		}
+		keys, err := LoadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		efs.Keys, configuration = keys, rest
+	}
+	if efs.Inner == nil {
+		inner, rest, err := fs.NewBlockHandler(configuration)
+		if err != nil {
+			return err
+		}
+		efs.Inner, configuration = inner, rest
+	}
+	efs.lock.Lock()
+	efs.ciphers = make(map[uint32]cipher.AEAD)
+	efs.reencrypted = 0
+	efs.lock.Unlock()
+	return efs.Inner.Init(ctx, configuration)
+}
+
+func (efs *EncryptedFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	return efs.Inner.Format(ctx, blockCount, blockSize)
+}
+
+func (efs *EncryptedFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return efs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (efs *EncryptedFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return efs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+// The AEAD for the key id, creating it from the KeyProvider the first time it is used
+func (efs *EncryptedFileSystem) cipherFor(id uint32, key []byte) (cipher.AEAD, error) {
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+	if efs.ciphers == nil {
+		efs.ciphers = make(map[uint32]cipher.AEAD)
+	}
+	if aead, ok := efs.ciphers[id]; ok {
+		return aead, nil
+	}
+	var err error
+	if key == nil {
+		key, err = efs.Keys.Key(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	efs.ciphers[id] = aead
+	return aead, nil
+}
+
+// The associated data for a block
+func associatedData(node fs.BlockNode) []byte {
+	data := make([]byte, 24)
+	binary.BigEndian.PutUint64(data, uint64(int64(node.RelativeTo)))
+	binary.BigEndian.PutUint64(data[8:], uint64(int64(node.Type)))
+	binary.BigEndian.PutUint64(data[16:], uint64(int64(node.Id)))
+	return data
+}
+
+// The id of the key the block was encrypted with
+func keyId(node fs.BlockNode, raw []byte) (uint32, error) {
+	if len(raw) < headerSize || raw[0] != blockFormat {
+		return 0, &fs.ErrCorruptBlock{Node: node, Reason: "Block is not encrypted"}
+	}
+	return binary.BigEndian.Uint32(raw[1:headerSize]), nil
+}
+
+func (efs *EncryptedFileSystem) decrypt(node fs.BlockNode, raw []byte) ([]byte, error) {
+	id, err := keyId(node, raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := efs.cipherFor(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	sealed := raw[headerSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Block is too short"}
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], associatedData(node))
+	if err != nil {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: err.Error()}
+	}
+	return data, nil
+}
+
+func (efs *EncryptedFileSystem) encrypt(node fs.BlockNode, data []byte) ([]byte, error) {
+	id, key, err := efs.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := efs.cipherFor(id, key)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(data)+aead.Overhead())
+	raw[0] = blockFormat
+	binary.BigEndian.PutUint32(raw[1:], id)
+	nonce := raw[headerSize:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(raw, nonce, data, associatedData(node)), nil
+}
+
+// Read and decrypt the block, returning an *fs.ErrCorruptBlock if it can't be decrypted (which
+// includes a block that was saved as a different node)
+func (efs *EncryptedFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	raw, err := efs.Inner.GetRawBlock(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	return efs.decrypt(node, raw)
+}
+
+// The block is encrypted with the lock held, so that a save can't take the current key before a
+// rotation and land after Reencrypt has passed the block
+func (efs *EncryptedFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	efs.rewriteLock.RLock()
+	defer efs.rewriteLock.RUnlock()
+	raw, err := efs.encrypt(node, data)
+	if err != nil {
+		return fs.NilBlock, err
+	}
+	return efs.Inner.SaveRawBlock(ctx, node, raw)
+}
+
+func (efs *EncryptedFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	efs.rewriteLock.RLock()
+	defer efs.rewriteLock.RUnlock()
+	return efs.Inner.FreeBlocks(ctx, blocks)
+}
+
+// Every block held by the inner handler, if it is a BlockLister
+func (efs *EncryptedFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := efs.Inner.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	return lister.ListBlocks(ctx)
+}
+
+// Transactions are passed on to the inner handler, if it is Transactional
+func (efs *EncryptedFileSystem) Begin(ctx context.Context) {
+	if tx, ok := efs.Inner.(fs.Transactional); ok {
+		tx.Begin(ctx)
+	}
+}
+
+func (efs *EncryptedFileSystem) Commit(ctx context.Context) error {
+	if tx, ok := efs.Inner.(fs.Transactional); ok {
+		return tx.Commit(ctx)
+	}
+	return nil
+}
+
+func (efs *EncryptedFileSystem) Rollback(ctx context.Context) {
+	if tx, ok := efs.Inner.(fs.Transactional); ok {
+		tx.Rollback(ctx)
+	}
+}
+
+func (efs *EncryptedFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(efs.Inner)
+}
+
+// Flush the inner handler, if it is a BlockFlusher
+func (efs *EncryptedFileSystem) Flush(ctx context.Context) error {
+	if flusher, ok := efs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Reserve the node in the inner handler, if it is a BlockReserver
+func (efs *EncryptedFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := efs.Inner.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// Blocks are sealed with their node as the associated data, so a copy made by the inner handler
+// could not be decrypted; they are always read and saved again instead
+func (efs *EncryptedFileSystem) CopyBlock(ctx context.Context, source fs.BlockNode, target fs.BlockNode) error {
+	return fs.ErrNotSupported
+}
+
+// Rewrite every block that was not encrypted with the current key, returning the number of blocks
+// rewritten. This can run while the filesystem is in use, but needs the inner handler to be a
+// BlockLister.
+func (efs *EncryptedFileSystem) Reencrypt(ctx context.Context) (int, error) {
+	// Wait for any save that took the old key, so that the block it saves is listed
+	efs.rewriteLock.Lock()
+	efs.rewriteLock.Unlock()
+	blocks, err := efs.ListBlocks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, node := range blocks {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		rewritten, err := efs.reencryptBlock(ctx, node)
+		if err != nil {
+			return count, err
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (efs *EncryptedFileSystem) reencryptBlock(ctx context.Context, node fs.BlockNode) (bool, error) {
+	efs.rewriteLock.Lock()
+	defer efs.rewriteLock.Unlock()
+	current, _, err := efs.Keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	raw, err := efs.Inner.GetRawBlock(ctx, node)
+	if err == fs.ErrBlockNotFound {
+		// Freed since the blocks were listed
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	id, err := keyId(node, raw)
+	if err != nil || id == current {
+		return false, err
+	}
+	data, err := efs.decrypt(node, raw)
+	if err != nil {
+		return false, err
+	}
+	raw, err = efs.encrypt(node, data)
+	if err != nil {
+		return false, err
+	}
+	if _, err = efs.Inner.SaveRawBlock(ctx, node, raw); err != nil {
+		return false, err
+	}
+	efs.lock.Lock()
+	efs.reencrypted++
+	efs.lock.Unlock()
+	return true, nil
+}
+
+// Run Reencrypt in a background goroutine. The channel receives its result when it has finished
+// (or the context is cancelled).
+func (efs *EncryptedFileSystem) StartReencryption(ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := efs.Reencrypt(ctx)
+		done <- err
+	}()
+	return done
+}
+
+// The number of blocks re-encrypted since Init, with the counters of the inner handler
+func (efs *EncryptedFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := efs.Inner.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+	stats["crypt.reencrypted"] = float64(efs.reencrypted)
+	return stats
+}
+
+func (efs *EncryptedFileSystem) DumpInfo() {
+	efs.lock.Lock()
+	fmt.Printf("Encrypted file system (AES-GCM), %d blocks re-encrypted, over:\n", efs.reencrypted)
+	efs.lock.Unlock()
+	efs.Inner.DumpInfo()
+}
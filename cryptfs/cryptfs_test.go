@@ -0,0 +1,208 @@
+package cryptfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/dedupfs"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+var firstKey = bytes.Repeat([]byte{1}, 32)
+var secondKey = bytes.Repeat([]byte{2}, 32)
+
+func TestEncryption(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	efs := EncryptedFileSystem{Inner: fs.AdaptBlockHandler(&mh), Keys: NewStaticKeys(1, firstKey)}
+	efs.Init(ctx, "")
+	efs.Format(ctx, 100, 100)
+	one, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	two, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.SaveRawBlock(ctx, one, []byte("Hello world"))
+	efs.SaveRawBlock(ctx, two, []byte("Goodbye world"))
+	if bytes.Contains(mh.Blocks[one], []byte("Hello")) {
+		m.Error("Block saved in the clear")
+	}
+	if x, err := efs.GetRawBlock(ctx, one); err != nil || string(x) != "Hello world" {
+		m.Errorf("Block not read back, got %s, %v", string(x), err)
+	}
+
+	// A block moved to another node can't be read
+	mh.Blocks[two] = mh.Blocks[one]
+	_, err := efs.GetRawBlock(ctx, two)
+	var corrupt *fs.ErrCorruptBlock
+	if !errors.As(err, &corrupt) || corrupt.Node != two {
+		m.Errorf("Expected a swapped block to be corrupt, got %v", err)
+	}
+}
+
+func TestKeyRotation(m *testing.T) {
+	var mh memory.MemoryFileSystem
+	keys := NewStaticKeys(1, firstKey)
+	efs := &EncryptedFileSystem{Inner: fs.AdaptBlockHandler(&mh), Keys: keys}
+	f := blocktest.NewFileSystem(m, efs, "", 1000, 10)
+	f.WriteFile("/secret/one", []byte("Written with the first key"))
+	f.Sync()
+
+	keys.Rotate(2, secondKey)
+	f.WriteFile("/secret/two", []byte("Written with the second key"))
+	f.Sync()
+	if v, _ := f.ReadFile("/secret/one"); string(v) != "Written with the first key" {
+		m.Errorf("Old block not readable after rotation, got %s", string(v))
+	}
+
+	err := <-efs.StartReencryption(context.Background())
+	if err != nil {
+		m.Fatal(err)
+	}
+	if f.Stats().Handler["crypt.reencrypted"] == 0 {
+		m.Error("Nothing re-encrypted")
+	}
+	// With the old key gone everything can still be read
+	delete(keys.Keys, 1)
+	for node, raw := range mh.Blocks {
+		if id, _ := keyId(node, raw); id != 2 {
+			m.Errorf("Block %v still encrypted with key %d", node, id)
+		}
+	}
+	if v, _ := f.ReadFile("/secret/one"); string(v) != "Written with the first key" {
+		m.Errorf("Block not readable after re-encryption, got %s", string(v))
+	}
+	if count, _ := efs.Reencrypt(context.Background()); count != 0 {
+		m.Errorf("Expected nothing left to re-encrypt, got %d", count)
+	}
+}
+
+// A KeyProvider that holds up the first caller of CurrentKey until it is released
+type pausedKeys struct {
+	*StaticKeys
+	reached chan bool
+	release chan bool
+	once    sync.Once
+}
+
+func (k *pausedKeys) CurrentKey() (uint32, []byte, error) {
+	id, key, err := k.StaticKeys.CurrentKey()
+	k.once.Do(func() {
+		k.reached <- true
+		<-k.release
+	})
+	return id, key, err
+}
+
+// A save that took the old key before a rotation is re-encrypted by a pass started after it
+func TestReencryptDuringSave(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	keys := &pausedKeys{StaticKeys: NewStaticKeys(1, firstKey), reached: make(chan bool), release: make(chan bool)}
+	efs := EncryptedFileSystem{Inner: fs.AdaptBlockHandler(&mh), Keys: keys}
+	efs.Init(ctx, "")
+	efs.Format(ctx, 100, 100)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	saved := make(chan error)
+	go func() {
+		_, err := efs.SaveRawBlock(ctx, node, []byte("Saved across the rotation"))
+		saved <- err
+	}()
+	<-keys.reached
+	keys.Rotate(2, secondKey)
+	done := efs.StartReencryption(ctx)
+	time.Sleep(10 * time.Millisecond)
+	keys.release <- true
+	if err := <-saved; err != nil {
+		m.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		m.Fatal(err)
+	}
+	if id, _ := keyId(node, mh.Blocks[node]); id != 2 {
+		m.Errorf("Expected the block to be encrypted with key 2 after the pass, got %d", id)
+	}
+}
+
+func TestKeyFile(m *testing.T) {
+	path := filepath.Join(m.TempDir(), "keys")
+	os.WriteFile(path, []byte("# pmfs keys\n1 0101010101010101010101010101010101010101010101010101010101010101\n2 02020202020202020202020202020202\n"), 0600)
+	keys, err := LoadKeyFile(path)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if id, key, _ := keys.CurrentKey(); id != 2 || len(key) != 16 {
+		m.Errorf("Expected key 2 to be current, got %d", id)
+	}
+
+	f := blocktest.NewFileSystem(m, nil, "crypt:"+path+":memory", 1000, 100)
+	f.WriteFile("/fred/alan", []byte("Hello world"))
+	if v, _ := f.ReadFile("/fred/alan"); string(v) != "Hello world" {
+		m.Errorf("Contents not the same, got %s", string(v))
+	}
+}
+
+func TestForwardsToInner(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(inner fs.BlockHandlerV2) *EncryptedFileSystem {
+		efs := &EncryptedFileSystem{Inner: inner, Keys: NewStaticKeys(1, firstKey)}
+		if err := efs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		efs.Format(ctx, 100, 100)
+		return efs
+	}
+
+	// Transactions, only when the inner handler has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a wrapper over memory not to be transactional")
+	}
+	efs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(efs) {
+		m.Errorf("Expected a wrapper over walfs to be transactional")
+	}
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.Begin(ctx)
+	efs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	efs.Rollback(ctx)
+	if _, err := efs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	efs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = efs.GetFreeBlockNode(ctx, fs.DATA)
+	efs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := efs.Flush(ctx); err != nil || len(cold.Blocks[node]) == 0 {
+		m.Errorf("Expected the flush to reach the cold tier, got %v", err)
+	}
+
+	// Reservations
+	efs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := efs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := efs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+
+	// but not copies, which couldn't be decrypted in their new node
+	efs = wrap(&dedupfs.DedupFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})})
+	file, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	source, _ := efs.GetFreeDataBlockNode(ctx, file, "00001")
+	target, _ := efs.GetFreeDataBlockNode(ctx, file, "00002")
+	efs.SaveRawBlock(ctx, source, []byte("Not shared"))
+	if err := efs.CopyBlock(ctx, source, target); !errors.Is(err, fs.ErrNotSupported) {
+		m.Errorf("Expected copies not to be supported, got %v", err)
+	}
+}
@@ -0,0 +1,503 @@
+// Deduplicating block handler - wraps another BlockHandlerV2 so that DATA blocks with the same
+// contents share storage, whichever files and versions they belong to. Other blocks are passed
+// straight through.
+//
+// Data is keyed by its SHA-256 hash. The first DATA block saved with some contents holds them and
+// any later DATA block with the same contents is saved as a small reference to it. Freeing a
+// block drops a reference, and the contents are only freed in the inner handler once nothing
+// refers to them. A block that holds contents other blocks still refer to is kept (marked as
+// retired) when it is freed, and is not listed by ListBlocks.
+//
+// The index of contents and references is rebuilt by Init from the blocks of the inner handler,
+// which must be a BlockLister.
+//
+// The configuration string passed to Init is the configuration of the inner handler, including
+// its scheme, e.g. "dedup:disk:/var/pmfs/data.pmfs". When Inner is set before Init the
+// configuration is passed to it as it is.
+package dedupfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Every DATA block in the inner handler starts with a tag
+const (
+	tagData      = 'D' // followed by the contents
+	tagReference = 'R' // followed by the node holding the contents
+	tagRetired   = 'X' // contents held only for the blocks that refer to them
+)
+
+// Some contents and the blocks that use them
+type content struct {
+	hash   [sha256.Size]byte
+	size   int
+	holder fs.BlockNode
+	// Whether the holder is still a block of the filesystem, rather than retired
+	live       bool
+	referrers  map[fs.BlockNode]bool
+	registered bool
+}
+
+// The number of DATA blocks using the contents
+func (c *content) refs() int {
+	if c.live {
+		return len(c.referrers) + 1
+	}
+	return len(c.referrers)
+}
+
+type DedupFileSystem struct {
+	Inner  fs.BlockHandlerV2
+	byHash map[[sha256.Size]byte]*content
+	// The contents of every DATA block of the filesystem
+	byNode map[fs.BlockNode]*content
+	// Blocks holding contents only for the blocks that refer to them
+	retired map[fs.BlockNode]*content
+	// Reads of DATA blocks hold a read lock, so they never see contents part way through being
+	// moved
+	lock sync.RWMutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("dedup", func() fs.BlockHandlerV2 { return &DedupFileSystem{} })
+}
+
+// Initialize the inner handler (creating it from the configuration if there isn't one) and
+// rebuild the index from the blocks it holds
+func (dfs *DedupFileSystem) Init(ctx context.Context, configuration string) error {
+	if dfs.Inner == nil {
+		inner, rest, err := fs.NewBlockHandler(configuration)
+		if err != nil {
+			return err
+		}
+		dfs.Inner, configuration = inner, rest
+	}
+	if _, ok := dfs.Inner.(fs.BlockLister); !ok {
+		return fmt.Errorf("%w: the inner handler must be a BlockLister", fs.ErrNotSupported)
+	}
+	err := dfs.Inner.Init(ctx, configuration)
+	if err != nil {
+		return err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	return dfs.rebuild(ctx)
+}
+
+// Must be called with the lock held
+func (dfs *DedupFileSystem) rebuild(ctx context.Context) error {
+	dfs.reset()
+	blocks, err := dfs.Inner.(fs.BlockLister).ListBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	byHolder := make(map[fs.BlockNode]*content)
+	references := make(map[fs.BlockNode]fs.BlockNode)
+	for _, node := range blocks {
+		if node.Type != fs.DATA {
+			continue
+		}
+		raw, err := dfs.Inner.GetRawBlock(ctx, node)
+		if err != nil {
+			return err
+		}
+		if len(raw) == 0 {
+			continue
+		}
+		switch raw[0] {
+		case tagData, tagRetired:
+			c := dfs.newContent(node, raw[1:])
+			c.live = raw[0] == tagData
+			byHolder[node] = c
+			if c.live {
+				dfs.byNode[node] = c
+			}
+		case tagReference:
+			if holder, ok := decodeReference(raw); ok {
+				references[node] = holder
+			}
+		}
+	}
+	for node, holder := range references {
+		if c, ok := byHolder[holder]; ok {
+			c.referrers[node] = true
+			dfs.byNode[node] = c
+		}
+	}
+	for holder, c := range byHolder {
+		if c.live {
+			continue
+		}
+		if c.refs() > 0 {
+			dfs.retired[holder] = c
+			continue
+		}
+		// Retired contents left behind with nothing referring to them
+		dfs.forget(c)
+		if err = dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{holder}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (dfs *DedupFileSystem) reset() {
+	dfs.byHash = make(map[[sha256.Size]byte]*content)
+	dfs.byNode = make(map[fs.BlockNode]*content)
+	dfs.retired = make(map[fs.BlockNode]*content)
+}
+
+// Must be called with the lock held
+func (dfs *DedupFileSystem) newContent(holder fs.BlockNode, data []byte) *content {
+	c := &content{hash: sha256.Sum256(data), size: len(data), holder: holder, live: true, referrers: make(map[fs.BlockNode]bool)}
+	// Contents held twice (which only happens if blocks are written around this handler) are
+	// left unshared
+	if _, ok := dfs.byHash[c.hash]; !ok {
+		dfs.byHash[c.hash] = c
+		c.registered = true
+	}
+	return c
+}
+
+// Drop contents that nothing uses any more. Must be called with the lock held.
+func (dfs *DedupFileSystem) forget(c *content) {
+	if c.registered {
+		delete(dfs.byHash, c.hash)
+	}
+	delete(dfs.retired, c.holder)
+}
+
+func encodeReference(holder fs.BlockNode) []byte {
+	raw := make([]byte, 1, 1+3*binary.MaxVarintLen64)
+	raw[0] = tagReference
+	raw = binary.AppendVarint(raw, int64(holder.RelativeTo))
+	raw = binary.AppendVarint(raw, int64(holder.Type))
+	return binary.AppendVarint(raw, int64(holder.Id))
+}
+
+func decodeReference(raw []byte) (fs.BlockNode, bool) {
+	r := bytes.NewReader(raw[1:])
+	relativeTo, err1 := binary.ReadVarint(r)
+	nodeType, err2 := binary.ReadVarint(r)
+	id, err3 := binary.ReadVarint(r)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fs.NilBlock, false
+	}
+	return fs.BlockNode{RelativeTo: int(relativeTo), Type: fs.BlockNodeType(nodeType), Id: int(id)}, true
+}
+
+func (dfs *DedupFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	err := dfs.Inner.Format(ctx, blockCount, blockSize)
+	if err != nil {
+		return err
+	}
+	dfs.reset()
+	return nil
+}
+
+func (dfs *DedupFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return dfs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (dfs *DedupFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return dfs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+func (dfs *DedupFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	if node.Type != fs.DATA {
+		return dfs.Inner.GetRawBlock(ctx, node)
+	}
+	dfs.lock.RLock()
+	defer dfs.lock.RUnlock()
+	raw, err := dfs.Inner.GetRawBlock(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 && raw[0] == tagReference {
+		holder, ok := decodeReference(raw)
+		if !ok {
+			return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Reference can't be decoded"}
+		}
+		raw, err = dfs.Inner.GetRawBlock(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) == 0 || (raw[0] != tagData && raw[0] != tagRetired) {
+			return nil, &fs.ErrCorruptBlock{Node: holder, Reason: "Referenced block holds no data"}
+		}
+		return raw[1:], nil
+	}
+	if len(raw) == 0 {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Block has no tag"}
+	}
+	switch raw[0] {
+	case tagData:
+		return raw[1:], nil
+	case tagRetired:
+		// Only kept for the blocks that refer to it
+		return nil, fs.ErrBlockNotFound
+	}
+	return nil, &fs.ErrCorruptBlock{Node: node, Reason: fmt.Sprintf("Unknown tag %d", raw[0])}
+}
+
+// Save a DATA block as a reference if its contents are already held, otherwise hold them in the
+// block
+func (dfs *DedupFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if node.Type != fs.DATA {
+		return dfs.Inner.SaveRawBlock(ctx, node, data)
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	hash := sha256.Sum256(data)
+	if c, ok := dfs.byNode[node]; ok && c.hash == hash {
+		return node, nil
+	}
+	err := dfs.release(ctx, node, true)
+	if err != nil {
+		return fs.NilBlock, err
+	}
+	if c, ok := dfs.byHash[hash]; ok {
+		saved, err := dfs.Inner.SaveRawBlock(ctx, node, encodeReference(c.holder))
+		if err != nil {
+			return saved, err
+		}
+		c.referrers[node] = true
+		dfs.byNode[node] = c
+		return saved, nil
+	}
+	saved, err := dfs.Inner.SaveRawBlock(ctx, node, append([]byte{tagData}, data...))
+	if err != nil {
+		return saved, err
+	}
+	dfs.byNode[node] = dfs.newContent(node, data)
+	return saved, nil
+}
+
+// Save the target DATA block as a reference to the contents of the source, without reading them
+func (dfs *DedupFileSystem) CopyBlock(ctx context.Context, source fs.BlockNode, target fs.BlockNode) error {
+	if source.Type != fs.DATA || target.Type != fs.DATA {
+		return fs.ErrNotSupported
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	c, ok := dfs.byNode[source]
+	if !ok {
+		return fs.ErrNotSupported
+	}
+	if err := dfs.release(ctx, target, true); err != nil {
+		return err
+	}
+	if _, err := dfs.Inner.SaveRawBlock(ctx, target, encodeReference(c.holder)); err != nil {
+		return err
+	}
+	c.referrers[target] = true
+	dfs.byNode[target] = c
+	return nil
+}
+
+// Drop a DATA block from the contents it uses, freeing the contents if nothing else uses them.
+// If overwrite is set the block is about to be saved again, so it is not freed and any contents
+// it holds for other blocks are moved elsewhere. Must be called with the lock held.
+func (dfs *DedupFileSystem) release(ctx context.Context, node fs.BlockNode, overwrite bool) error {
+	c, ok := dfs.byNode[node]
+	if !ok {
+		if overwrite {
+			return nil
+		}
+		return dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{node})
+	}
+	delete(dfs.byNode, node)
+	if c.holder != node {
+		delete(c.referrers, node)
+		if !overwrite {
+			if err := dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{node}); err != nil {
+				return err
+			}
+		}
+		if c.refs() == 0 {
+			dfs.forget(c)
+			return dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{c.holder})
+		}
+		return nil
+	}
+	c.live = false
+	if c.refs() == 0 {
+		dfs.forget(c)
+		if overwrite {
+			return nil
+		}
+		return dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{node})
+	}
+	raw, err := dfs.Inner.GetRawBlock(ctx, node)
+	if err != nil {
+		return err
+	}
+	raw[0] = tagRetired
+	if !overwrite {
+		_, err = dfs.Inner.SaveRawBlock(ctx, node, raw)
+		if err == nil {
+			dfs.retired[node] = c
+		}
+		return err
+	}
+	// Move the contents to a new block and point everything that refers to them there
+	holder, err := dfs.Inner.GetFreeDataBlockNode(ctx, node, "dedup")
+	if err != nil {
+		return err
+	}
+	if _, err = dfs.Inner.SaveRawBlock(ctx, holder, raw); err != nil {
+		dfs.Inner.FreeBlocks(ctx, []fs.BlockNode{holder})
+		return err
+	}
+	c.holder = holder
+	dfs.retired[holder] = c
+	for referrer := range c.referrers {
+		if _, err = dfs.Inner.SaveRawBlock(ctx, referrer, encodeReference(holder)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Free the blocks, DATA blocks only release their contents once nothing else uses them
+func (dfs *DedupFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	others := make([]fs.BlockNode, 0, len(blocks))
+	for _, node := range blocks {
+		if node.Type != fs.DATA {
+			others = append(others, node)
+			continue
+		}
+		if _, ok := dfs.retired[node]; ok {
+			// Not a block of the filesystem any more
+			continue
+		}
+		if err := dfs.release(ctx, node, false); err != nil {
+			return err
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	return dfs.Inner.FreeBlocks(ctx, others)
+}
+
+// The blocks of the inner handler, without the retired ones
+func (dfs *DedupFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	blocks, err := dfs.Inner.(fs.BlockLister).ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]fs.BlockNode, 0, len(blocks))
+	for _, node := range blocks {
+		if _, ok := dfs.retired[node]; !ok {
+			listed = append(listed, node)
+		}
+	}
+	return listed, nil
+}
+
+// Pass a transaction on to the inner handler, if it is Transactional. The index is rebuilt when a
+// transaction is rolled back (or fails to commit), as it holds the saves and frees that were
+// discarded.
+func (dfs *DedupFileSystem) Begin(ctx context.Context) {
+	if tx, ok := dfs.Inner.(fs.Transactional); ok {
+		tx.Begin(ctx)
+	}
+}
+
+func (dfs *DedupFileSystem) Commit(ctx context.Context) error {
+	tx, ok := dfs.Inner.(fs.Transactional)
+	if !ok {
+		return nil
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if err := tx.Commit(ctx); err != nil {
+		dfs.rebuild(ctx)
+		return err
+	}
+	return nil
+}
+
+func (dfs *DedupFileSystem) Rollback(ctx context.Context) {
+	tx, ok := dfs.Inner.(fs.Transactional)
+	if !ok {
+		return
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	tx.Rollback(ctx)
+	dfs.rebuild(ctx)
+}
+
+func (dfs *DedupFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(dfs.Inner)
+}
+
+// Write out the blocks the inner handler is holding back, if it is a BlockFlusher
+func (dfs *DedupFileSystem) Flush(ctx context.Context) error {
+	if flusher, ok := dfs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Reserve the node in the inner handler, if it is a BlockReserver
+func (dfs *DedupFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := dfs.Inner.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (dfs *DedupFileSystem) totals() (logical int64, stored int64, shared int64) {
+	counted := make(map[*content]bool)
+	for _, c := range dfs.byNode {
+		logical += int64(c.size)
+		if !counted[c] {
+			counted[c] = true
+			stored += int64(c.size)
+		}
+	}
+	return logical, stored, int64(len(dfs.byNode) - len(counted))
+}
+
+// The size of the DATA blocks of the filesystem, the size of the contents actually stored and
+// the difference, with the counters of the inner handler
+func (dfs *DedupFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := dfs.Inner.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	logical, stored, shared := dfs.totals()
+	stats["dedup.logical_bytes"] = float64(logical)
+	stats["dedup.stored_bytes"] = float64(stored)
+	stats["dedup.saved_bytes"] = float64(logical - stored)
+	stats["dedup.shared_blocks"] = float64(shared)
+	return stats
+}
+
+func (dfs *DedupFileSystem) DumpInfo() {
+	dfs.lock.Lock()
+	logical, stored, shared := dfs.totals()
+	fmt.Printf("Deduplicating file system: %d bytes of data stored as %d, %d blocks shared, over:\n", logical, stored, shared)
+	dfs.lock.Unlock()
+	dfs.Inner.DumpInfo()
+}
@@ -0,0 +1,214 @@
+package dedupfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func dataBlocks(mh *memory.MemoryFileSystem) int {
+	count := 0
+	for node := range mh.Blocks {
+		if node.Type == fs.DATA {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSharedContents(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	dfs := DedupFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+	dfs.Init(ctx, "")
+	dfs.Format(ctx, 100, 100)
+	file, _ := dfs.GetFreeBlockNode(ctx, fs.FILE)
+	one, _ := dfs.GetFreeDataBlockNode(ctx, file, "00001")
+	two, _ := dfs.GetFreeDataBlockNode(ctx, file, "00002")
+	dfs.SaveRawBlock(ctx, one, []byte("Same contents"))
+	dfs.SaveRawBlock(ctx, two, []byte("Same contents"))
+	if mh.Blocks[two][0] != tagReference {
+		m.Error("Second block not saved as a reference")
+	}
+	stats := dfs.HandlerStats()
+	if stats["dedup.saved_bytes"] != 13 || stats["dedup.shared_blocks"] != 1 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+
+	// Overwriting the block holding the contents moves them
+	dfs.SaveRawBlock(ctx, one, []byte("New contents"))
+	if x, _ := dfs.GetRawBlock(ctx, two); string(x) != "Same contents" {
+		m.Errorf("Shared contents lost, got %s", string(x))
+	}
+	if x, _ := dfs.GetRawBlock(ctx, one); string(x) != "New contents" {
+		m.Errorf("Block not overwritten, got %s", string(x))
+	}
+
+	// Contents are only freed when nothing uses them
+	three, _ := dfs.GetFreeDataBlockNode(ctx, file, "00003")
+	dfs.SaveRawBlock(ctx, three, []byte("New contents"))
+	dfs.FreeBlocks(ctx, []fs.BlockNode{one})
+	if x, _ := dfs.GetRawBlock(ctx, three); string(x) != "New contents" {
+		m.Errorf("Contents freed while still used, got %s", string(x))
+	}
+	if _, err := dfs.GetRawBlock(ctx, one); err != fs.ErrBlockNotFound {
+		m.Errorf("Expected ErrBlockNotFound for a freed block, got %v", err)
+	}
+	listed, _ := dfs.ListBlocks(ctx)
+	for _, node := range listed {
+		if node == one {
+			m.Error("Freed block still listed")
+		}
+	}
+
+	// The index is rebuilt from the inner handler
+	reopened := DedupFileSystem{Inner: dfs.Inner}
+	if err := reopened.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	if x, _ := reopened.GetRawBlock(ctx, three); string(x) != "New contents" {
+		m.Errorf("Reference not restored, got %s", string(x))
+	}
+	reopened.FreeBlocks(ctx, []fs.BlockNode{two, three})
+	if count := dataBlocks(&mh); count != 0 {
+		m.Errorf("Expected every data block to be freed, %d left", count)
+	}
+}
+
+func TestFileSystem(m *testing.T) {
+	f := blocktest.NewFileSystem(m, nil, "dedup:memory", 1000, 10)
+	contents := make([]byte, 0)
+	for i := 0; i < 10; i++ {
+		contents = append(contents, fmt.Sprintf("block %4d", i)...)
+	}
+	f.WriteFile("/dedup/one", contents)
+	f.WriteFile("/dedup/two", contents)
+	// Rewriting a file with the same contents shares the blocks it replaces
+	f.WriteFile("/dedup/one", contents)
+	f.Sync()
+	stats := f.Stats()
+	if stats.Handler["dedup.logical_bytes"] != 200 || stats.Handler["dedup.stored_bytes"] != 100 {
+		m.Errorf("Expected 200 bytes stored as 100, got %v", stats.Handler)
+	}
+
+	f.DeleteFile("/dedup/one")
+	if v, _ := f.ReadFile("/dedup/two"); string(v) != string(contents) {
+		m.Errorf("Contents not the same, got %s", string(v))
+	}
+	report, err := f.Check(false)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v", report.Problems)
+	}
+	if reclaimed, _ := f.Collector.Collect(); reclaimed != 0 {
+		m.Errorf("Expected nothing to collect, got %d", reclaimed)
+	}
+	if v, _ := f.ReadFile("/dedup/two"); string(v) != string(contents) {
+		m.Errorf("Contents lost after collection, got %s", string(v))
+	}
+}
+
+func TestCopy(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	dfs := DedupFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+	dfs.Init(ctx, "")
+	dfs.Format(ctx, 100, 100)
+	file, _ := dfs.GetFreeBlockNode(ctx, fs.FILE)
+	one, _ := dfs.GetFreeDataBlockNode(ctx, file, "00001")
+	two, _ := dfs.GetFreeDataBlockNode(ctx, file, "00002")
+	dfs.SaveRawBlock(ctx, one, []byte("Copied contents"))
+	if err := dfs.CopyBlock(ctx, one, two); err != nil {
+		m.Fatal(err)
+	}
+	if mh.Blocks[two][0] != tagReference {
+		m.Error("Copy not saved as a reference")
+	}
+	dfs.FreeBlocks(ctx, []fs.BlockNode{one})
+	if x, _ := dfs.GetRawBlock(ctx, two); string(x) != "Copied contents" {
+		m.Errorf("Copied contents lost, got %s", string(x))
+	}
+	unknown, _ := dfs.GetFreeDataBlockNode(ctx, file, "00003")
+	if err := dfs.CopyBlock(ctx, unknown, one); err != fs.ErrNotSupported {
+		m.Errorf("Expected a block without contents to be refused, got %v", err)
+	}
+
+	// Copying a file within the filesystem stores nothing more
+	f := blocktest.NewFileSystem(m, nil, "dedup:memory", 1000, 10)
+	f.WriteFile("/dedup/one", []byte("Some contents over several blocks"))
+	stored := f.Stats().Handler["dedup.stored_bytes"]
+	if err := f.CopyFileOrFolder("/dedup/one", "/dedup/two", fs.CopyOptions{History: true}); err != nil {
+		m.Fatal(err)
+	}
+	if stats := f.Stats(); stats.Handler["dedup.stored_bytes"] != stored || stats.Handler["dedup.logical_bytes"] != 2*stored {
+		m.Errorf("Expected the copy to share the contents, got %v", stats.Handler)
+	}
+	f.DeleteFile("/dedup/one")
+	if v, _ := f.ReadFile("/dedup/two"); string(v) != "Some contents over several blocks" {
+		m.Errorf("Copy lost with the original, got %s", string(v))
+	}
+}
+
+func TestForwardsToInner(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(inner fs.BlockHandlerV2) *DedupFileSystem {
+		dfs := &DedupFileSystem{Inner: inner}
+		if err := dfs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		dfs.Format(ctx, 100, 100)
+		return dfs
+	}
+
+	// Transactions, only when the inner handler has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a wrapper over memory not to be transactional")
+	}
+	dfs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(dfs) {
+		m.Errorf("Expected a wrapper over walfs to be transactional")
+	}
+	file, _ := dfs.GetFreeBlockNode(ctx, fs.FILE)
+	node, _ := dfs.GetFreeDataBlockNode(ctx, file, "00001")
+	dfs.Begin(ctx)
+	dfs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	dfs.Rollback(ctx)
+	if _, err := dfs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+	// The contents that were rolled back aren't shared with a later save
+	other, _ := dfs.GetFreeDataBlockNode(ctx, file, "00002")
+	dfs.SaveRawBlock(ctx, other, []byte("Rolled back"))
+	if x, err := dfs.GetRawBlock(ctx, other); err != nil || string(x) != "Rolled back" {
+		m.Errorf("Expected the later save to read back, got %q, %v", x, err)
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	dfs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = dfs.GetFreeBlockNode(ctx, fs.DATA)
+	dfs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := dfs.Flush(ctx); err != nil || len(cold.Blocks[node]) == 0 {
+		m.Errorf("Expected the flush to reach the cold tier, got %v", err)
+	}
+
+	// and reservations
+	dfs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = dfs.GetFreeBlockNode(ctx, fs.FILE)
+	dfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := dfs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := dfs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+}
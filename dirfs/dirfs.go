@@ -0,0 +1,355 @@
+// Directory file system - a persistent block handler that stores every block as a file
+// under a root directory on the host filesystem, handy for debugging and for backups with
+// standard tools.
+//
+// The configuration string passed to Init is the root directory. The handler registers itself
+// under the "dir" scheme.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//
+//	f.Init(nil, "dir:/var/pmfs")
+//	f.Format(1000, 4096)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+package dirfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Blocks are stored at <root>/<type>/<id>, except for DATA blocks which are grouped under the
+// file node they belong to at <root>/data/<relativeTo>/<id>. The format and the next never used
+// id are kept in <root>/state.json. The ids in use are found from the blocks by Init, and freed
+// ids are handed out again before new ones so that at most BlockCount blocks (including the super
+// block) are in use at once.
+
+const stateFile = "state.json"
+const tempPrefix = ".tmp-"
+
+type state struct {
+	BlockCount int
+	BlockSize  int
+	NextId     int
+}
+
+type DirFileSystem struct {
+	Root  string
+	State state
+	// The ids handed out or saved and not freed, and the ids below State.NextId that are free
+	used map[int]bool
+	free []int
+	lock sync.Mutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("dir", func() fs.BlockHandlerV2 { return &DirFileSystem{} })
+}
+
+// Load the state of an existing store under the root directory, removing any partially written
+// blocks left over from a crash
+func (dfs *DirFileSystem) Init(ctx context.Context, configuration string) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	dfs.Root = configuration
+	dfs.State = state{}
+	dfs.used, dfs.free = make(map[int]bool), nil
+	data, err := ioutil.ReadFile(filepath.Join(dfs.Root, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(data, &dfs.State); err != nil {
+		return err
+	}
+	err = filepath.Walk(dfs.Root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), tempPrefix) {
+			return os.Remove(path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	blocks, err := dfs.ListBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range blocks {
+		if node.Type != fs.SUPERBLOCK {
+			dfs.used[node.Id] = true
+		}
+	}
+	for id := fs.SuperBlock.Id + 1; id < dfs.State.NextId; id++ {
+		if !dfs.used[id] {
+			dfs.free = append(dfs.free, id)
+		}
+	}
+	return nil
+}
+
+// Format the file system - removing the blocks and state under the root directory. Anything else
+// in the directory is left alone, and a directory that isn't empty and doesn't hold a store
+// already (so has no state file) is refused, so that a mistyped root can't destroy anything.
+func (dfs *DirFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if err := os.MkdirAll(dfs.Root, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dfs.Root)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(dfs.Root, stateFile)); os.IsNotExist(err) && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty and holds no pmfs store, refusing to format it", dfs.Root)
+	}
+	for _, entry := range entries {
+		_, isType := fs.ParseBlockNodeType(entry.Name())
+		if isType || entry.Name() == stateFile || strings.HasPrefix(entry.Name(), tempPrefix) {
+			if err = os.RemoveAll(filepath.Join(dfs.Root, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	dfs.State = state{BlockCount: blockCount, BlockSize: blockSize, NextId: fs.SuperBlock.Id + 1}
+	dfs.used, dfs.free = make(map[int]bool), nil
+	return dfs.saveState()
+}
+
+// Returns a freed node id if there is one, otherwise the next never used id (persisting the
+// counter before handing it out). Returns fs.ErrNoSpace if BlockCount blocks are in use.
+func (dfs *DirFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return fs.NilBlock, err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if dfs.used == nil {
+		dfs.used = make(map[int]bool)
+	}
+	// The super block always takes one of the blocks
+	if dfs.State.BlockCount > 0 && len(dfs.used)+1 >= dfs.State.BlockCount {
+		return fs.NilBlock, fs.ErrNoSpace
+	}
+	var node fs.BlockNode
+	node.Type = NodeType
+	if n := len(dfs.free); n > 0 {
+		node.Id = dfs.free[n-1]
+		dfs.free = dfs.free[:n-1]
+	} else {
+		node.Id = dfs.State.NextId
+		dfs.State.NextId++
+		if err := dfs.saveState(); err != nil {
+			dfs.State.NextId--
+			return fs.NilBlock, err
+		}
+	}
+	dfs.used[node.Id] = true
+	return node, nil
+}
+
+func (dfs *DirFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, key string) (fs.BlockNode, error) {
+	node, err := dfs.GetFreeBlockNode(ctx, fs.DATA)
+	if err != nil {
+		return node, err
+	}
+	node.RelativeTo = parent.Id
+	return node, nil
+}
+
+// Read the file for a node, returns fs.ErrBlockNotFound if it has never been saved
+func (dfs *DirFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(dfs.blockPath(node))
+	if os.IsNotExist(err) {
+		return nil, fs.ErrBlockNotFound
+	}
+	return data, err
+}
+
+func (dfs *DirFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return node, err
+	}
+	path := dfs.blockPath(node)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	return node, err
+}
+
+// Claim the id of a node handed out by another handler (e.g. when mirroring), so that it is never
+// handed out here
+func (dfs *DirFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if node.Type == fs.SUPERBLOCK || dfs.used[node.Id] {
+		return nil
+	}
+	if dfs.used == nil {
+		dfs.used = make(map[int]bool)
+	}
+	dfs.used[node.Id] = true
+	if node.Id >= dfs.State.NextId {
+		for id := dfs.State.NextId; id < node.Id; id++ {
+			dfs.free = append(dfs.free, id)
+		}
+		dfs.State.NextId = node.Id + 1
+		return dfs.saveState()
+	}
+	// From the end, as ids reserved in descending order are added there
+	for i := len(dfs.free) - 1; i >= 0; i-- {
+		if dfs.free[i] == node.Id {
+			dfs.free = append(dfs.free[:i], dfs.free[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (dfs *DirFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	for _, node := range blocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if node.Type == fs.SUPERBLOCK {
+			continue
+		}
+		path := dfs.blockPath(node)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if node.Type == fs.DATA {
+			// Tidy up the folder for the parent file node once it is empty (fails if not)
+			os.Remove(filepath.Dir(path))
+		}
+		dfs.lock.Lock()
+		if dfs.used[node.Id] {
+			delete(dfs.used, node.Id)
+			dfs.free = append(dfs.free, node.Id)
+		}
+		dfs.lock.Unlock()
+	}
+	return nil
+}
+
+// Every block that has been saved and not freed, found by walking the folders under the root
+func (dfs *DirFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	blocks := make([]fs.BlockNode, 0)
+	err := filepath.Walk(dfs.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) || info.Name() == stateFile {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		node, ok := dfs.parseBlockPath(path)
+		if ok {
+			blocks = append(blocks, node)
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+func (dfs *DirFileSystem) DumpInfo() {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	count := 0
+	filepath.Walk(dfs.Root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() != stateFile {
+			count++
+		}
+		return nil
+	})
+	fmt.Printf("Directory file system: %s\n", dfs.Root)
+	fmt.Printf("Next block id %v, total blocks %v, free list %v, block count %v\n", dfs.State.NextId, count, len(dfs.free), dfs.State.BlockCount)
+}
+
+func (dfs *DirFileSystem) blockPath(node fs.BlockNode) string {
+	id := strconv.Itoa(node.Id)
+	if node.Type == fs.DATA {
+		return filepath.Join(dfs.Root, node.Type.String(), strconv.Itoa(node.RelativeTo), id)
+	}
+	return filepath.Join(dfs.Root, node.Type.String(), id)
+}
+
+// The reverse of blockPath, returns false for anything that isn't a block
+func (dfs *DirFileSystem) parseBlockPath(path string) (fs.BlockNode, bool) {
+	rel, err := filepath.Rel(dfs.Root, path)
+	if err != nil {
+		return fs.NilBlock, false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	nodeType, ok := fs.ParseBlockNodeType(parts[0])
+	if !ok || (nodeType == fs.DATA) != (len(parts) == 3) || len(parts) < 2 || len(parts) > 3 {
+		return fs.NilBlock, false
+	}
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return fs.NilBlock, false
+	}
+	if nodeType == fs.SUPERBLOCK {
+		return fs.SuperBlock, id == fs.SuperBlock.Id
+	}
+	node := fs.BlockNode{Type: nodeType, Id: id}
+	if nodeType == fs.DATA {
+		if node.RelativeTo, err = strconv.Atoi(parts[1]); err != nil {
+			return fs.NilBlock, false
+		}
+	}
+	return node, true
+}
+
+// Must be called with the lock held
+func (dfs *DirFileSystem) saveState() error {
+	data, err := json.Marshal(dfs.State)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dfs.Root, stateFile), data)
+}
+
+// Write to a temporary file in the same folder and rename it over the target, so that a crash
+// leaves either the old or the new contents and never a partial block
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package dirfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+)
+
+func TestBlockLayout(m *testing.T) {
+	ctx := context.Background()
+	var dh DirFileSystem
+	dh.Init(ctx, m.TempDir())
+	dh.Format(ctx, 100, 100)
+	file, _ := dh.GetFreeBlockNode(ctx, fs.FILE)
+	data, _ := dh.GetFreeDataBlockNode(ctx, file, "00001")
+	dh.SaveRawBlock(ctx, file, []byte("file"))
+	dh.SaveRawBlock(ctx, data, []byte("data"))
+
+	if _, err := os.Stat(filepath.Join(dh.Root, "data", "1", "2")); err != nil {
+		m.Error(err)
+	}
+	dh.FreeBlocks(ctx, []fs.BlockNode{data})
+	if _, err := os.Stat(filepath.Join(dh.Root, "data", "1")); !os.IsNotExist(err) {
+		m.Error("Empty data folder not removed")
+	}
+	if _, err := dh.GetRawBlock(ctx, data); err != fs.ErrBlockNotFound {
+		m.Errorf("Expected ErrBlockNotFound for a freed block, got %v", err)
+	}
+
+	var reopened DirFileSystem
+	reopened.Init(ctx, dh.Root)
+	if x, err := reopened.GetRawBlock(ctx, file); err != nil || string(x) != "file" {
+		m.Errorf("File block not restored, %v", err)
+	}
+	// The freed id is handed out again before the next new one
+	if next, _ := reopened.GetFreeBlockNode(ctx, fs.ROUTE); next.Id != 2 {
+		m.Errorf("Freed id not restored, got %d", next.Id)
+	}
+	if next, _ := reopened.GetFreeBlockNode(ctx, fs.ROUTE); next.Id != 3 {
+		m.Errorf("Next free id not restored, got %d", next.Id)
+	}
+}
+
+func TestFormatLeavesOtherFiles(m *testing.T) {
+	ctx := context.Background()
+	root := m.TempDir()
+	other := filepath.Join(root, "notes.txt")
+	os.WriteFile(other, []byte("Not a block"), 0644)
+	var dh DirFileSystem
+	dh.Init(ctx, root)
+	if err := dh.Format(ctx, 100, 100); err == nil {
+		m.Errorf("Expected formatting a directory with other files in it to fail")
+	}
+	if _, err := os.Stat(other); err != nil {
+		m.Errorf("Expected the other file to be kept, %v", err)
+	}
+
+	// A store that has other files added alongside it keeps them when it is formatted again
+	dh.Init(ctx, filepath.Join(root, "store"))
+	if err := dh.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	file, _ := dh.GetFreeBlockNode(ctx, fs.FILE)
+	dh.SaveRawBlock(ctx, file, []byte("file"))
+	other = filepath.Join(dh.Root, "README")
+	os.WriteFile(other, []byte("Not a block either"), 0644)
+	if err := dh.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		m.Errorf("Expected the other file to be kept, %v", err)
+	}
+	if _, err := dh.GetRawBlock(ctx, file); err != fs.ErrBlockNotFound {
+		m.Errorf("Expected the block to be removed, got %v", err)
+	}
+}
+
+func TestSelectByConfiguration(m *testing.T) {
+	root := m.TempDir()
+	f := blocktest.NewFileSystem(m, nil, "dir:"+root, 1000, 100)
+	f.WriteFile("/fred/alan", []byte("Hello world"))
+	f.Sync()
+
+	restarted := blocktest.Open(m, nil, "dir:"+root)
+	if err := restarted.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	x, err := restarted.ReadFile("/fred/alan")
+	if err != nil {
+		m.Fatal(err)
+	}
+	if string(x) != "Hello world" {
+		m.Errorf("Contents not the same, got %s", string(x))
+	}
+	if report, err := restarted.Check(false); err != nil || len(report.Problems) != 0 || !report.OrphansChecked {
+		m.Errorf("Check failed %v %v", err, report)
+	}
+	if _, ok := restarted.BlockHandler.(*DirFileSystem); !ok {
+		m.Errorf("Wrong handler %T", restarted.BlockHandler)
+	}
+}
+
+func TestConformance(m *testing.T) {
+	blocktest.TestBlockHandler(m, func(m *testing.T) (fs.BlockHandlerV2, string) {
+		return &DirFileSystem{}, m.TempDir()
+	})
+}
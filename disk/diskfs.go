@@ -0,0 +1,498 @@
+// Disk file system - a persistent block handler backed by a single preallocated data file
+//
+// The configuration string passed to Init is the path of the data file. The handler registers
+// itself under the "disk" scheme, so f.Init(nil, "disk:/var/pmfs/data.pmfs") also works.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//	var dh disk.DiskFileSystem
+//
+//	f.InitV2(&dh, "/var/pmfs/data.pmfs")
+//	f.Format(1000, 4096)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+package disk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// The layout of the data file is
+//
+//  [file header][free block bitmap][slot 0][slot 1]...[slot blockCount-1]
+//
+// Each slot is a slot header followed by blockSize bytes of payload. The slot id is the
+// BlockNode id, slot 0 always holds the super block. A block that is larger than blockSize
+// (typically a large DirectoryNode or FileNode) continues in further slots, taken from the
+// bitmap and linked through the Next field of the slot header.
+
+const diskMagic = "PMFSDISK"
+const diskVersion = 1
+
+const (
+	slotHead         uint32 = 1 // the first slot of a saved block
+	slotContinuation uint32 = 2 // a follow on slot of a block that didn't fit in one slot
+)
+
+type fileHeader struct {
+	Magic      [8]byte
+	Version    uint32
+	BlockCount int64
+	BlockSize  int64
+}
+
+type slotHeader struct {
+	Flags      uint32
+	Type       int32
+	RelativeTo int64
+	Length     uint32
+	Next       int64
+}
+
+var fileHeaderSize = int64(binary.Size(fileHeader{}))
+var slotHeaderSize = int64(binary.Size(slotHeader{}))
+
+// The DiskFileSystem stores blocks in fixed size slots of a single data file, with a bitmap
+// recording which slots are in use.
+type DiskFileSystem struct {
+	Path       string
+	BlockCount int
+	BlockSize  int
+	file       *os.File
+	bitmap     []byte
+	lock       sync.Mutex
+}
+
+var errNotOpen = errors.New("Data file is not open, it needs to be formatted")
+
+func init() {
+	fs.RegisterBlockHandler("disk", func() fs.BlockHandlerV2 { return &DiskFileSystem{} })
+}
+
+// Open the data file at the path given by the configuration, if it exists. If it does not exist
+// Format will create it.
+func (dfs *DiskFileSystem) Init(ctx context.Context, configuration string) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	dfs.Path = configuration
+	dfs.closeFile()
+	file, err := os.OpenFile(dfs.Path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	dfs.file = file
+	return dfs.readHeader()
+}
+
+// Format the file system - creating (or truncating) the data file, preallocating blockCount slots
+// of blockSize bytes each
+func (dfs *DiskFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	dfs.closeFile()
+	file, err := os.OpenFile(dfs.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	dfs.file = file
+	dfs.BlockCount = blockCount
+	dfs.BlockSize = blockSize
+	dfs.bitmap = make([]byte, (blockCount+7)/8)
+
+	header := fileHeader{Version: diskVersion, BlockCount: int64(blockCount), BlockSize: int64(blockSize)}
+	copy(header.Magic[:], diskMagic)
+	err = binary.Write(&offsetWriter{dfs.file, 0}, binary.LittleEndian, header)
+	if err == nil {
+		err = dfs.file.Truncate(dfs.slotOffset(blockCount))
+	}
+	if err == nil {
+		// The super block always lives at slot 0
+		err = dfs.setUsed(fs.SuperBlock.Id, true)
+	}
+	return err
+}
+
+// Returns the first unused slot as a new node, or fs.ErrNoSpace if the file is full
+func (dfs *DiskFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return fs.NilBlock, err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	id, err := dfs.allocate()
+	if err != nil {
+		return fs.NilBlock, err
+	}
+	var node fs.BlockNode
+	node.Type = NodeType
+	node.Id = id
+	return node, nil
+}
+
+func (dfs *DiskFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, key string) (fs.BlockNode, error) {
+	node, err := dfs.GetFreeBlockNode(ctx, fs.DATA)
+	if err != nil {
+		return node, err
+	}
+	node.RelativeTo = parent.Id
+	return node, nil
+}
+
+// Claim the slot of a node handed out by another handler (e.g. when mirroring), so that it is not
+// taken for a continuation before the node is saved
+func (dfs *DiskFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if !dfs.validId(node.Id) {
+		return fmt.Errorf("Block %v is outside of the file system", node)
+	}
+	if dfs.isUsed(node.Id) {
+		header, err := dfs.readSlotHeader(node.Id)
+		if err == nil && header.Flags == slotContinuation {
+			err = fmt.Errorf("Block %v is in use as a continuation", node)
+		}
+		return err
+	}
+	err := dfs.writeSlot(node.Id, slotHeader{Next: -1}, nil)
+	if err == nil {
+		err = dfs.setUsed(node.Id, true)
+	}
+	return err
+}
+
+// Read the data for a node, following any continuation slots. Returns fs.ErrBlockNotFound if the
+// node has never been saved.
+func (dfs *DiskFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if !dfs.validId(node.Id) || !dfs.isUsed(node.Id) {
+		return nil, fs.ErrBlockNotFound
+	}
+	header, err := dfs.readSlotHeader(node.Id)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags != slotHead {
+		return nil, fs.ErrBlockNotFound
+	}
+	data := make([]byte, 0, header.Length)
+	id := node.Id
+	for {
+		chunk := make([]byte, header.Length)
+		_, err = dfs.file.ReadAt(chunk, dfs.slotOffset(id)+slotHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if header.Next < 0 {
+			return data, nil
+		}
+		id = int(header.Next)
+		if !dfs.validId(id) {
+			return nil, fmt.Errorf("Block %v has an invalid continuation %d", node, id)
+		}
+		header, err = dfs.readSlotHeader(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Write the data for a node, spilling into continuation slots if it is larger than the block
+// size. If there are not enough free slots for the continuations the existing contents of the
+// block are left alone and fs.ErrNoSpace is returned.
+func (dfs *DiskFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return node, err
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if !dfs.validId(node.Id) {
+		return node, fmt.Errorf("Block %v is outside of the file system", node)
+	}
+
+	// Reuse the continuation slots from a previous save of this block before taking new ones
+	var slots []int
+	if dfs.isUsed(node.Id) {
+		header, err := dfs.readSlotHeader(node.Id)
+		if err != nil {
+			return node, err
+		}
+		for next := int(header.Next); header.Flags == slotHead && dfs.validId(next) && dfs.isUsed(next); {
+			slots = append(slots, next)
+			continuation, err := dfs.readSlotHeader(next)
+			if err != nil || continuation.Flags != slotContinuation {
+				break
+			}
+			next = int(continuation.Next)
+		}
+	}
+	needed := 0
+	if dfs.BlockSize > 0 && len(data) > dfs.BlockSize {
+		needed = (len(data) - 1) / dfs.BlockSize
+	}
+	reused := len(slots)
+	for len(slots) < needed {
+		id, err := dfs.allocate()
+		if err != nil {
+			for _, taken := range slots[reused:] {
+				dfs.setUsed(taken, false)
+			}
+			return node, err
+		}
+		slots = append(slots, id)
+	}
+	for _, spare := range slots[needed:] {
+		if err := dfs.freeSlot(spare); err != nil {
+			return node, err
+		}
+	}
+	slots = slots[:needed]
+	if !dfs.isUsed(node.Id) {
+		if err := dfs.setUsed(node.Id, true); err != nil {
+			return node, err
+		}
+	}
+
+	id := node.Id
+	flags := slotHead
+	for i := 0; ; i++ {
+		toWrite := data
+		if len(toWrite) > dfs.BlockSize {
+			toWrite = data[:dfs.BlockSize]
+		}
+		data = data[len(toWrite):]
+		header := slotHeader{Flags: flags, Type: int32(node.Type), RelativeTo: int64(node.RelativeTo), Length: uint32(len(toWrite)), Next: -1}
+		if i < len(slots) {
+			header.Next = int64(slots[i])
+		}
+		if err := dfs.writeSlot(id, header, toWrite); err != nil {
+			return node, err
+		}
+		if i >= len(slots) {
+			return node, nil
+		}
+		id = slots[i]
+		flags = slotContinuation
+	}
+}
+
+func (dfs *DiskFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	for _, node := range blocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Never release the super block
+		if node.Type == fs.SUPERBLOCK || node.Id == fs.SuperBlock.Id {
+			continue
+		}
+		if err := dfs.freeChain(node.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Every block that has been saved and not freed, found from the head slots in use
+func (dfs *DiskFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	blocks := make([]fs.BlockNode, 0)
+	for id := 0; id < dfs.BlockCount && dfs.file != nil; id++ {
+		if !dfs.isUsed(id) {
+			continue
+		}
+		header, err := dfs.readSlotHeader(id)
+		if err != nil {
+			return nil, err
+		}
+		if header.Flags == slotHead {
+			blocks = append(blocks, fs.BlockNode{RelativeTo: int(header.RelativeTo), Type: fs.BlockNodeType(header.Type), Id: id})
+		}
+	}
+	return blocks, ctx.Err()
+}
+
+func (dfs *DiskFileSystem) DumpInfo() {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	used := 0
+	for id := 0; id < dfs.BlockCount; id++ {
+		if dfs.isUsed(id) {
+			used++
+		}
+	}
+	fmt.Printf("Disk file system: %s\n", dfs.Path)
+	fmt.Printf("Block size %v, used blocks %v of %v\n", dfs.BlockSize, used, dfs.BlockCount)
+}
+
+// Flush everything to disk and close the data file
+func (dfs *DiskFileSystem) Close() error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	return dfs.closeFile()
+}
+
+func (dfs *DiskFileSystem) closeFile() error {
+	if dfs.file == nil {
+		return nil
+	}
+	err := dfs.file.Sync()
+	if closeErr := dfs.file.Close(); err == nil {
+		err = closeErr
+	}
+	dfs.file = nil
+	return err
+}
+
+func (dfs *DiskFileSystem) readHeader() error {
+	var header fileHeader
+	err := binary.Read(&offsetReader{dfs.file, 0}, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+	if string(header.Magic[:]) != diskMagic {
+		return errors.New("Not a pmfs data file")
+	}
+	if header.Version != diskVersion {
+		return fmt.Errorf("Unsupported data file version %d", header.Version)
+	}
+	dfs.BlockCount = int(header.BlockCount)
+	dfs.BlockSize = int(header.BlockSize)
+	dfs.bitmap = make([]byte, (dfs.BlockCount+7)/8)
+	_, err = dfs.file.ReadAt(dfs.bitmap, fileHeaderSize)
+	return err
+}
+
+func (dfs *DiskFileSystem) slotOffset(id int) int64 {
+	return fileHeaderSize + int64(len(dfs.bitmap)) + int64(id)*(slotHeaderSize+int64(dfs.BlockSize))
+}
+
+func (dfs *DiskFileSystem) validId(id int) bool {
+	return dfs.file != nil && id >= 0 && id < dfs.BlockCount
+}
+
+func (dfs *DiskFileSystem) isUsed(id int) bool {
+	return dfs.bitmap[id/8]&(1<<uint(id%8)) != 0
+}
+
+// Set or clear the bitmap entry for a slot, writing the changed byte straight through to the file
+func (dfs *DiskFileSystem) setUsed(id int, used bool) error {
+	if used {
+		dfs.bitmap[id/8] |= 1 << uint(id%8)
+	} else {
+		dfs.bitmap[id/8] &^= 1 << uint(id%8)
+	}
+	_, err := dfs.file.WriteAt(dfs.bitmap[id/8:id/8+1], fileHeaderSize+int64(id/8))
+	return err
+}
+
+// Find and claim the first unused slot, returns fs.ErrNoSpace if there are none left
+func (dfs *DiskFileSystem) allocate() (int, error) {
+	if dfs.file == nil {
+		return -1, errNotOpen
+	}
+	for i, b := range dfs.bitmap {
+		if b == 0xff {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			id := i*8 + bit
+			if id >= dfs.BlockCount {
+				return -1, fs.ErrNoSpace
+			}
+			if b&(1<<uint(bit)) == 0 {
+				// Clear out anything left over from a previous use of this slot
+				err := dfs.writeSlot(id, slotHeader{Next: -1}, nil)
+				if err == nil {
+					err = dfs.setUsed(id, true)
+				}
+				return id, err
+			}
+		}
+	}
+	return -1, fs.ErrNoSpace
+}
+
+// Release a single slot
+func (dfs *DiskFileSystem) freeSlot(id int) error {
+	err := dfs.writeSlot(id, slotHeader{Next: -1}, nil)
+	if err == nil {
+		err = dfs.setUsed(id, false)
+	}
+	return err
+}
+
+// Release a slot and every continuation slot linked from it
+func (dfs *DiskFileSystem) freeChain(id int) error {
+	for dfs.validId(id) && dfs.isUsed(id) {
+		header, err := dfs.readSlotHeader(id)
+		if err != nil {
+			return err
+		}
+		if err = dfs.freeSlot(id); err != nil {
+			return err
+		}
+		if header.Flags == 0 {
+			return nil
+		}
+		id = int(header.Next)
+	}
+	return nil
+}
+
+func (dfs *DiskFileSystem) readSlotHeader(id int) (slotHeader, error) {
+	var header slotHeader
+	err := binary.Read(&offsetReader{dfs.file, dfs.slotOffset(id)}, binary.LittleEndian, &header)
+	return header, err
+}
+
+func (dfs *DiskFileSystem) writeSlot(id int, header slotHeader, data []byte) error {
+	err := binary.Write(&offsetWriter{dfs.file, dfs.slotOffset(id)}, binary.LittleEndian, header)
+	if err == nil && len(data) > 0 {
+		_, err = dfs.file.WriteAt(data, dfs.slotOffset(id)+slotHeaderSize)
+	}
+	return err
+}
+
+// Adapters so that encoding/binary can read and write at a fixed position in the data file
+type offsetReader struct {
+	file   *os.File
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
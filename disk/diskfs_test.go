@@ -0,0 +1,137 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+)
+
+func TestReopenDataFile(m *testing.T) {
+	path := filepath.Join(m.TempDir(), "data.pmfs")
+	ctx := context.Background()
+	var dh DiskFileSystem
+	dh.Init(ctx, path)
+	if err := dh.Format(ctx, 50, 16); err != nil {
+		m.Fatal(err)
+	}
+
+	small, _ := dh.GetFreeBlockNode(ctx, fs.FILE)
+	large, _ := dh.GetFreeDataBlockNode(ctx, small, "00001")
+	if small.Id == large.Id {
+		m.Error("Allocated the same block twice")
+	}
+	if large.RelativeTo != small.Id {
+		m.Error("Data block not relative to its parent")
+	}
+	largeData := bytes.Repeat([]byte("0123456789"), 10)
+	dh.SaveRawBlock(ctx, small, []byte("Hello"))
+	if _, err := dh.SaveRawBlock(ctx, large, largeData); err != nil {
+		m.Fatal(err)
+	}
+	dh.Close()
+
+	var reopened DiskFileSystem
+	if err := reopened.Init(ctx, path); err != nil {
+		m.Fatal(err)
+	}
+	if reopened.BlockCount != 50 || reopened.BlockSize != 16 {
+		m.Errorf("Header not restored, got %d blocks of %d", reopened.BlockCount, reopened.BlockSize)
+	}
+	if x, _ := reopened.GetRawBlock(ctx, small); string(x) != "Hello" {
+		m.Error("Small block not restored")
+	}
+	if x, _ := reopened.GetRawBlock(ctx, large); !bytes.Equal(x, largeData) {
+		m.Error("Large block not restored")
+	}
+
+	// Freeing the large block should release all of its continuation slots
+	if err := reopened.FreeBlocks(ctx, []fs.BlockNode{large}); err != nil {
+		m.Fatal(err)
+	}
+	if _, err := reopened.GetRawBlock(ctx, large); err != fs.ErrBlockNotFound {
+		m.Errorf("Freed block still readable, got %v", err)
+	}
+	count := 0
+	for {
+		_, err := reopened.GetFreeBlockNode(ctx, fs.DATA)
+		if err == fs.ErrNoSpace {
+			break
+		} else if err != nil {
+			m.Fatal(err)
+		}
+		count++
+	}
+	// 50 slots, less the super block and the small block
+	if count != 48 {
+		m.Errorf("Expected 48 free blocks, found %d", count)
+	}
+	// With no room for the continuations the existing contents must survive
+	if _, err := reopened.SaveRawBlock(ctx, small, largeData); err != fs.ErrNoSpace {
+		m.Errorf("Expected ErrNoSpace, got %v", err)
+	}
+	if x, _ := reopened.GetRawBlock(ctx, small); string(x) != "Hello" {
+		m.Error("Small block damaged by a failed save")
+	}
+	reopened.Close()
+}
+
+func TestRootFileSystemOnDisk(m *testing.T) {
+	var dh DiskFileSystem
+	f := blocktest.NewFileSystem(m, &dh, filepath.Join(m.TempDir(), "data.pmfs"), 1000, 64)
+	if err := f.WriteFile("/fred/alan", []byte("Hello world")); err != nil {
+		m.Fatal(err)
+	}
+	if err := f.AppendFile("/fred/alan", []byte(", and again")); err != nil {
+		m.Fatal(err)
+	}
+	x, err := f.ReadFile("/fred/alan")
+	if err != nil {
+		m.Fatal(err)
+	}
+	if string(x) != "Hello world, and again" {
+		m.Errorf("Contents not the same, got %s", string(x))
+	}
+	if err := f.Sync(); err != nil {
+		m.Error(err)
+	}
+}
+
+func TestMountAfterRestart(m *testing.T) {
+	path := filepath.Join(m.TempDir(), "data.pmfs")
+
+	var dh DiskFileSystem
+	f := blocktest.Open(m, &dh, path)
+	if err := f.Mount(); err != fs.ErrNotFormatted {
+		m.Errorf("Expected ErrNotFormatted, got %v", err)
+	}
+	f.Format(1000, 64)
+	f.WriteFile("/fred/alan", []byte("Hello from yesterday"))
+	f.Sync()
+	dh.Close()
+
+	var rdh DiskFileSystem
+	restarted := blocktest.Open(m, &rdh, path)
+	if err := restarted.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	x, err := restarted.ReadFile("/fred/alan")
+	if err != nil {
+		m.Fatal(err)
+	}
+	if string(x) != "Hello from yesterday" {
+		m.Errorf("Contents not the same, got %s", string(x))
+	}
+	if report, err := restarted.Check(false); err != nil || len(report.Problems) != 0 || !report.OrphansChecked {
+		m.Errorf("Check failed %v %v", err, report)
+	}
+}
+
+func TestConformance(m *testing.T) {
+	blocktest.TestBlockHandler(m, func(m *testing.T) (fs.BlockHandlerV2, string) {
+		return &DiskFileSystem{}, filepath.Join(m.TempDir(), "data.pmfs")
+	})
+}
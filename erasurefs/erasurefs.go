@@ -0,0 +1,566 @@
+// Erasure coded block handler - splits every block into DataShards data shards, adds parity shards
+// using a Reed-Solomon code and saves one shard in each of several inner handlers. A block can be
+// read back as long as any DataShards of its shards can, so with n handlers up to n - DataShards
+// of them can lose the block (or be lost altogether) for a fraction of the space a mirror needs.
+//
+// Every shard carries the length, checksum and generation of the whole block and a checksum of its
+// own, so a damaged shard is treated as missing. Each save of a block has a later generation than
+// the one before it, and a read uses the newest generation that DataShards handlers have, so a
+// shard left behind by a save it missed is treated as missing too, while a save that fails leaves
+// the previous version readable (see SaveRawBlock). Repair rebuilds the missing shards of every block from the others,
+// e.g. after one of the handlers has been replaced.
+//
+// Nodes are handed out by the first handler that has one; handlers that place blocks themselves
+// should be BlockReservers (as the disk handler is) so that they keep the node free until it is
+// saved. Repair needs the handlers to be BlockListers.
+//
+// The configuration string passed to Init is the configuration of each inner handler, including
+// its scheme, separated by semicolons. An item of "data=N" sets DataShards, otherwise every handler
+// but one holds data, e.g. "erasure:data=4;memory;memory;memory;memory;memory;memory" stores each
+// block in six shards, any four of which are enough to read it. When Shards is set before Init the
+// configuration is passed to each of them as it is.
+package erasurefs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Each shard is stored as the length, checksum and generation of the block, the checksum of the
+// shard and then the shard, all big endian
+const shardHeaderSize = 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type ErasureFileSystem struct {
+	Shards     []fs.BlockHandlerV2
+	DataShards int
+	code       *reedSolomon
+	stats      erasureStats
+	// The generation of the last save
+	generation uint64
+	lock       sync.Mutex
+	// Held for writing by Repair, so that nothing changes while a block is rebuilt
+	repairLock sync.RWMutex
+}
+
+type erasureStats struct {
+	ReconstructedReads int64
+	FailedShardWrites  int64
+	RepairedShards     int64
+}
+
+// What Repair found. Unrecoverable lists the blocks that have too few good shards left to rebuild.
+type RepairReport struct {
+	Checked       int
+	Repaired      int
+	Unrecoverable []fs.BlockNode
+}
+
+func init() {
+	fs.RegisterBlockHandler("erasure", func() fs.BlockHandlerV2 { return &ErasureFileSystem{} })
+}
+
+// Create the inner handlers from the configuration if there aren't any, and initialize them
+func (efs *ErasureFileSystem) Init(ctx context.Context, configuration string) error {
+	configurations := make([]string, 0)
+	if len(efs.Shards) == 0 {
+		for _, item := range strings.Split(configuration, ";") {
+			if strings.HasPrefix(item, "data=") {
+				dataShards, err := strconv.Atoi(item[len("data="):])
+				if err != nil {
+					return err
+				}
+				efs.DataShards = dataShards
+				continue
+			}
+			handler, rest, err := fs.NewBlockHandler(item)
+			if err != nil {
+				return err
+			}
+			efs.Shards = append(efs.Shards, handler)
+			configurations = append(configurations, rest)
+		}
+	} else {
+		for range efs.Shards {
+			configurations = append(configurations, configuration)
+		}
+	}
+	if efs.DataShards == 0 {
+		efs.DataShards = len(efs.Shards) - 1
+	}
+	if efs.DataShards < 1 || efs.DataShards > len(efs.Shards) {
+		return fmt.Errorf("Can't store %d data shards in %d handlers", efs.DataShards, len(efs.Shards))
+	}
+	code, err := newReedSolomon(efs.DataShards, len(efs.Shards)-efs.DataShards)
+	if err != nil {
+		return err
+	}
+	efs.lock.Lock()
+	efs.code = code
+	efs.stats = erasureStats{}
+	efs.lock.Unlock()
+	for i, handler := range efs.Shards {
+		if err := handler.Init(ctx, configurations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format every inner handler. The shards are smaller than the blocks, so the block size is an
+// upper bound for them.
+func (efs *ErasureFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	for _, handler := range efs.Shards {
+		if err := handler.Format(ctx, blockCount, blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take a node from the first handler that has one and reserve it on the others
+func (efs *ErasureFileSystem) allocate(ctx context.Context, get func(handler fs.BlockHandlerV2) (fs.BlockNode, error)) (fs.BlockNode, error) {
+	var err error = fs.ErrNoSpace
+	for i, handler := range efs.Shards {
+		var node fs.BlockNode
+		if node, err = get(handler); err != nil {
+			continue
+		}
+		for j, other := range efs.Shards {
+			if reserver, ok := other.(fs.BlockReserver); ok && j != i {
+				if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+					return fs.NilBlock, err
+				}
+			}
+		}
+		return node, nil
+	}
+	return fs.NilBlock, err
+}
+
+func (efs *ErasureFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return efs.allocate(ctx, func(handler fs.BlockHandlerV2) (fs.BlockNode, error) {
+		return handler.GetFreeBlockNode(ctx, NodeType)
+	})
+}
+
+func (efs *ErasureFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return efs.allocate(ctx, func(handler fs.BlockHandlerV2) (fs.BlockNode, error) {
+		return handler.GetFreeDataBlockNode(ctx, parent, id)
+	})
+}
+
+// The length, checksum and generation of the block a shard belongs to
+type stripeHeader struct {
+	Length     uint32
+	Sum        uint32
+	Generation uint64
+}
+
+func encodeShard(header stripeHeader, shard []byte) []byte {
+	raw := make([]byte, shardHeaderSize+len(shard))
+	binary.BigEndian.PutUint32(raw, header.Length)
+	binary.BigEndian.PutUint32(raw[4:], header.Sum)
+	binary.BigEndian.PutUint64(raw[8:], header.Generation)
+	binary.BigEndian.PutUint32(raw[16:], crc32.Checksum(shard, castagnoli))
+	copy(raw[shardHeaderSize:], shard)
+	return raw
+}
+
+func decodeShard(raw []byte) (stripeHeader, []byte, bool) {
+	if len(raw) < shardHeaderSize {
+		return stripeHeader{}, nil, false
+	}
+	header := stripeHeader{binary.BigEndian.Uint32(raw), binary.BigEndian.Uint32(raw[4:]), binary.BigEndian.Uint64(raw[8:])}
+	shard := raw[shardHeaderSize:]
+	return header, shard, crc32.Checksum(shard, castagnoli) == binary.BigEndian.Uint32(raw[16:])
+}
+
+// The generation for a new save. Generations follow the clock, so they keep increasing when the
+// handler is initialized again, and never repeat within a run.
+func (efs *ErasureFileSystem) nextGeneration() uint64 {
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+	efs.generation++
+	if now := uint64(time.Now().UnixNano()); now > efs.generation {
+		efs.generation = now
+	}
+	return efs.generation
+}
+
+// The shards of a block as read from the inner handlers. Shards that are missing, damaged or
+// belong to another version of the block are nil, and listed in bad.
+type stripe struct {
+	header stripeHeader
+	shards [][]byte
+	bad    []int
+	// Whether any handler might have the block
+	found bool
+}
+
+// Read every shard of the block, keeping those of the newest generation that enough handlers have
+// to rebuild it. If none has, those of the newest generation are kept, so the block can't be
+// rebuilt.
+func (efs *ErasureFileSystem) readStripe(ctx context.Context, node fs.BlockNode) (*stripe, error) {
+	s := &stripe{shards: make([][]byte, len(efs.Shards))}
+	headers := make([]*stripeHeader, len(efs.Shards))
+	counts := make(map[stripeHeader]int)
+	for i, handler := range efs.Shards {
+		raw, err := handler.GetRawBlock(ctx, node)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !errors.Is(err, fs.ErrBlockNotFound) {
+				s.found = true
+			}
+			continue
+		}
+		s.found = true
+		header, shard, ok := decodeShard(raw)
+		if !ok {
+			continue
+		}
+		headers[i], s.shards[i] = &header, shard
+		counts[header]++
+	}
+	chosen, complete := false, false
+	for header, count := range counts {
+		enough := count >= efs.DataShards
+		if !chosen || (enough && !complete) || (enough == complete && header.Generation > s.header.Generation) {
+			chosen, complete, s.header = true, enough, header
+		}
+	}
+	for i := range s.shards {
+		if headers[i] == nil || *headers[i] != s.header {
+			s.shards[i] = nil
+			s.bad = append(s.bad, i)
+		}
+	}
+	return s, nil
+}
+
+// Rebuild the missing shards of a stripe, returning the block
+func (efs *ErasureFileSystem) rebuild(node fs.BlockNode, s *stripe) ([]byte, error) {
+	if len(s.bad) > 0 {
+		if err := efs.code.reconstruct(s.shards); err != nil {
+			return nil, &fs.ErrCorruptBlock{Node: node, Reason: err.Error()}
+		}
+	}
+	data := make([]byte, 0, len(s.shards[0])*efs.DataShards)
+	for _, shard := range s.shards[:efs.DataShards] {
+		data = append(data, shard...)
+	}
+	if int(s.header.Length) > len(data) {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: fmt.Sprintf("Shards hold %d bytes, expected %d", len(data), s.header.Length)}
+	}
+	data = data[:s.header.Length]
+	if sum := crc32.Checksum(data, castagnoli); sum != s.header.Sum {
+		return nil, &fs.ErrCorruptBlock{Node: node, Reason: fmt.Sprintf("Checksum is %08x, expected %08x", sum, s.header.Sum)}
+	}
+	return data, nil
+}
+
+// Read the shards of the block, rebuilding it from the others if any are missing. Returns
+// fs.ErrBlockNotFound if no handler has the block and an *fs.ErrCorruptBlock if too few of them do.
+func (efs *ErasureFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	s, err := efs.readStripe(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if !s.found {
+		return nil, fs.ErrBlockNotFound
+	}
+	data, err := efs.rebuild(node, s)
+	if err == nil && len(s.bad) > 0 {
+		efs.lock.Lock()
+		efs.stats.ReconstructedReads++
+		efs.lock.Unlock()
+	}
+	return data, err
+}
+
+// Save a shard of the block, as a new generation, in every handler. Succeeds if at least
+// DataShards of them were saved, and then the handlers that failed have their old shard freed (if
+// they can), which can be put back by Repair. Otherwise the block still reads as it was.
+//
+// When there are fewer than 2*DataShards-1 handlers a save that reaches some but too few of them
+// could leave too few shards of either version, so the shards are first staged in a spare node
+// and only copied over the old ones once DataShards of them have been saved. If too few of the
+// copies then succeed the old shards are put back.
+func (efs *ErasureFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	efs.repairLock.RLock()
+	defer efs.repairLock.RUnlock()
+	header := stripeHeader{uint32(len(data)), crc32.Checksum(data, castagnoli), efs.nextGeneration()}
+	shards := make([][]byte, len(efs.Shards))
+	for i, shard := range efs.code.split(data) {
+		shards[i] = encodeShard(header, shard)
+	}
+	var saved []bool
+	var err error
+	if len(efs.Shards) < 2*efs.DataShards-1 {
+		saved, err = efs.stageShards(ctx, node, shards)
+	} else {
+		saved, err = efs.saveShards(ctx, node, shards, nil)
+	}
+	if err != nil {
+		return node, err
+	}
+	for i := range efs.Shards {
+		if !saved[i] {
+			efs.Shards[i].FreeBlocks(ctx, []fs.BlockNode{node})
+		}
+	}
+	return node, nil
+}
+
+// Save the shards in the handlers that are selected (all of them if none are), returning which of
+// them were saved. Fails if fewer than DataShards were.
+func (efs *ErasureFileSystem) saveShards(ctx context.Context, node fs.BlockNode, shards [][]byte, selected []bool) ([]bool, error) {
+	saved := make([]bool, len(efs.Shards))
+	count := 0
+	var firstErr error
+	for i, handler := range efs.Shards {
+		if selected != nil && !selected[i] {
+			continue
+		}
+		if _, err := handler.SaveRawBlock(ctx, node, shards[i]); err != nil {
+			if ctx.Err() != nil {
+				return saved, ctx.Err()
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			efs.lock.Lock()
+			efs.stats.FailedShardWrites++
+			efs.lock.Unlock()
+			continue
+		}
+		saved[i] = true
+		count++
+	}
+	if count < efs.DataShards {
+		return saved, firstErr
+	}
+	return saved, nil
+}
+
+// Save the shards in a spare node, then copy those that were saved over the old shards of the
+// block, putting the old shards back if too few of the copies succeed
+func (efs *ErasureFileSystem) stageShards(ctx context.Context, node fs.BlockNode, shards [][]byte) ([]bool, error) {
+	spare, err := efs.allocate(ctx, func(handler fs.BlockHandlerV2) (fs.BlockNode, error) {
+		return handler.GetFreeBlockNode(ctx, node.Type)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, handler := range efs.Shards {
+			handler.FreeBlocks(ctx, []fs.BlockNode{spare})
+		}
+	}()
+	staged, err := efs.saveShards(ctx, spare, shards, nil)
+	if err != nil {
+		return nil, err
+	}
+	old := make([][]byte, len(efs.Shards))
+	for i, handler := range efs.Shards {
+		if staged[i] {
+			old[i], _ = handler.GetRawBlock(ctx, node)
+		}
+	}
+	saved, err := efs.saveShards(ctx, node, shards, staged)
+	if err != nil {
+		for i, handler := range efs.Shards {
+			if saved[i] && old[i] != nil {
+				handler.SaveRawBlock(ctx, node, old[i])
+			} else if saved[i] {
+				handler.FreeBlocks(ctx, []fs.BlockNode{node})
+			}
+		}
+	}
+	return saved, err
+}
+
+// Free the blocks in every handler, returning the first error
+func (efs *ErasureFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	efs.repairLock.RLock()
+	defer efs.repairLock.RUnlock()
+	var firstErr error
+	for _, handler := range efs.Shards {
+		if err := handler.FreeBlocks(ctx, blocks); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Every block that any of the handlers holds a shard of
+func (efs *ErasureFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	seen := make(map[fs.BlockNode]bool)
+	blocks := make([]fs.BlockNode, 0)
+	for _, handler := range efs.Shards {
+		lister, ok := handler.(fs.BlockLister)
+		if !ok {
+			return nil, fs.ErrNotSupported
+		}
+		nodes, err := lister.ListBlocks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if !seen[node] {
+				seen[node] = true
+				blocks = append(blocks, node)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// Pass a transaction on to every handler that is Transactional. A commit succeeds if it succeeds
+// on at least DataShards of them, as a save does.
+func (efs *ErasureFileSystem) Begin(ctx context.Context) {
+	for _, handler := range efs.Shards {
+		if tx, ok := handler.(fs.Transactional); ok {
+			tx.Begin(ctx)
+		}
+	}
+}
+
+func (efs *ErasureFileSystem) Commit(ctx context.Context) error {
+	failed := 0
+	var firstErr error
+	for _, handler := range efs.Shards {
+		if tx, ok := handler.(fs.Transactional); ok {
+			if err := tx.Commit(ctx); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed++
+			}
+		}
+	}
+	if len(efs.Shards)-failed < efs.DataShards {
+		return firstErr
+	}
+	return nil
+}
+
+func (efs *ErasureFileSystem) Rollback(ctx context.Context) {
+	for _, handler := range efs.Shards {
+		if tx, ok := handler.(fs.Transactional); ok {
+			tx.Rollback(ctx)
+		}
+	}
+}
+
+// Only when every handler is, as otherwise a change could be half applied to one of them
+func (efs *ErasureFileSystem) InnerTransactional() bool {
+	for _, handler := range efs.Shards {
+		if !fs.IsTransactional(handler) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write out the blocks held back by every handler that is a BlockFlusher, returning the first
+// error
+func (efs *ErasureFileSystem) Flush(ctx context.Context) error {
+	var firstErr error
+	for _, handler := range efs.Shards {
+		if flusher, ok := handler.(fs.BlockFlusher); ok {
+			if err := flusher.Flush(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Reserve the node in every handler that is a BlockReserver
+func (efs *ErasureFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	for _, handler := range efs.Shards {
+		if reserver, ok := handler.(fs.BlockReserver); ok {
+			if err := reserver.ReserveBlockNode(ctx, node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check every block, saving the shards that are missing, damaged or out of date again from the
+// others
+func (efs *ErasureFileSystem) Repair(ctx context.Context) (*RepairReport, error) {
+	efs.repairLock.Lock()
+	defer efs.repairLock.Unlock()
+	blocks, err := efs.ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{Unrecoverable: make([]fs.BlockNode, 0)}
+	for _, node := range blocks {
+		report.Checked++
+		s, err := efs.readStripe(ctx, node)
+		if err != nil {
+			return report, err
+		}
+		if len(s.bad) == 0 {
+			continue
+		}
+		if _, err = efs.rebuild(node, s); err != nil {
+			report.Unrecoverable = append(report.Unrecoverable, node)
+			continue
+		}
+		for _, i := range s.bad {
+			if reserver, ok := efs.Shards[i].(fs.BlockReserver); ok {
+				if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+					return report, err
+				}
+			}
+			if _, err = efs.Shards[i].SaveRawBlock(ctx, node, encodeShard(s.header, s.shards[i])); err != nil {
+				return report, err
+			}
+			report.Repaired++
+		}
+	}
+	efs.lock.Lock()
+	efs.stats.RepairedShards += int64(report.Repaired)
+	efs.lock.Unlock()
+	return report, nil
+}
+
+// The number of reads that needed a block rebuilt, shards that failed to save and shards put back
+// by Repair, with the counters of the first handler
+func (efs *ErasureFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := efs.Shards[0].(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	efs.lock.Lock()
+	defer efs.lock.Unlock()
+	stats["erasure.reconstructed_reads"] = float64(efs.stats.ReconstructedReads)
+	stats["erasure.failed_shard_writes"] = float64(efs.stats.FailedShardWrites)
+	stats["erasure.repaired_shards"] = float64(efs.stats.RepairedShards)
+	return stats
+}
+
+func (efs *ErasureFileSystem) DumpInfo() {
+	fmt.Printf("Erasure coded file system, %d data and %d parity shards\n", efs.DataShards, len(efs.Shards)-efs.DataShards)
+	for i, handler := range efs.Shards {
+		fmt.Printf("Shard %d:\n", i)
+		handler.DumpInfo()
+	}
+}
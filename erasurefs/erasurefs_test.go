@@ -0,0 +1,342 @@
+package erasurefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func newErasure(m *testing.T, handlers int, dataShards int) (*ErasureFileSystem, []*memory.MemoryFileSystem) {
+	memories := make([]*memory.MemoryFileSystem, handlers)
+	efs := &ErasureFileSystem{DataShards: dataShards}
+	for i := range memories {
+		memories[i] = &memory.MemoryFileSystem{}
+		efs.Shards = append(efs.Shards, fs.AdaptBlockHandler(memories[i]))
+	}
+	ctx := context.Background()
+	if err := efs.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	if err := efs.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	return efs, memories
+}
+
+func TestReedSolomon(m *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		m.Fatal(err)
+	}
+	data := make([]byte, 1001)
+	rand.New(rand.NewSource(1)).Read(data)
+	shards := rs.split(data)
+	if !bytes.Equal(shards[0], data[:len(shards[0])]) {
+		m.Errorf("Expected the first shard to hold the start of the data")
+	}
+	// Every way of losing two shards can be recovered
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			damaged := append([][]byte(nil), shards...)
+			damaged[a], damaged[b] = nil, nil
+			if err := rs.reconstruct(damaged); err != nil {
+				m.Fatalf("Losing shards %d and %d: %v", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					m.Errorf("Losing shards %d and %d, shard %d was rebuilt wrongly", a, b, i)
+				}
+			}
+		}
+	}
+	shards[0], shards[1], shards[2] = nil, nil, nil
+	if err := rs.reconstruct(shards); err == nil {
+		m.Errorf("Expected losing three shards to fail")
+	}
+}
+
+func TestReconstructOnRead(m *testing.T) {
+	ctx := context.Background()
+	efs, memories := newErasure(m, 6, 4)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	if _, err := efs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected an unsaved block to be not found, got %v", err)
+	}
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	efs.SaveRawBlock(ctx, node, data)
+	for i, mh := range memories {
+		if len(mh.Blocks[node]) != shardHeaderSize+11 {
+			m.Errorf("Shard %d is %d bytes", i, len(mh.Blocks[node]))
+		}
+	}
+
+	delete(memories[0].Blocks, node)
+	memories[4].Blocks[node][shardHeaderSize] ^= 0x01
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || !bytes.Equal(x, data) {
+		m.Errorf("Expected the block to be rebuilt, got %q, %v", x, err)
+	}
+	if stats := efs.HandlerStats(); stats["erasure.reconstructed_reads"] != 1 {
+		m.Errorf("Expected a reconstructed read, got %v", stats)
+	}
+
+	delete(memories[2].Blocks, node)
+	var corrupt *fs.ErrCorruptBlock
+	if _, err := efs.GetRawBlock(ctx, node); !errors.As(err, &corrupt) {
+		m.Errorf("Expected a corrupt block with three shards lost, got %v", err)
+	}
+}
+
+func TestStaleShardIsIgnored(m *testing.T) {
+	ctx := context.Background()
+	efs, memories := newErasure(m, 4, 0)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.SaveRawBlock(ctx, node, []byte("First version"))
+	stale := memories[1].Blocks[node]
+	efs.SaveRawBlock(ctx, node, []byte("Second version of the block"))
+	memories[1].Blocks[node] = stale
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "Second version of the block" {
+		m.Errorf("Expected the second version, got %q, %v", x, err)
+	}
+}
+
+// The newest save wins even when more handlers hold an older one
+func TestNewestGenerationWins(m *testing.T) {
+	ctx := context.Background()
+	efs, memories := newErasure(m, 5, 2)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.SaveRawBlock(ctx, node, []byte("First version"))
+	stale := make([][]byte, 0)
+	for _, mh := range memories[2:] {
+		stale = append(stale, mh.Blocks[node])
+	}
+	efs.SaveRawBlock(ctx, node, []byte("Second version of the block"))
+	for i, mh := range memories[2:] {
+		mh.Blocks[node] = stale[i]
+	}
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "Second version of the block" {
+		m.Errorf("Expected the second version, got %q, %v", x, err)
+	}
+
+	// Unless too few handlers hold it to rebuild it
+	delete(memories[1].Blocks, node)
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "First version" {
+		m.Errorf("Expected the first version, got %q, %v", x, err)
+	}
+}
+
+// Fails every save, as a handler that has gone away would
+type failingHandler struct {
+	fs.BlockHandlerV2
+}
+
+func (failingHandler) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	return node, errors.New("Handler has gone away")
+}
+
+// Fails the saves of one node
+type failingNode struct {
+	fs.BlockHandlerV2
+	node fs.BlockNode
+}
+
+func (f failingNode) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if node == f.node {
+		return node, errors.New("Disk is full")
+	}
+	return f.BlockHandlerV2.SaveRawBlock(ctx, node, data)
+}
+
+func TestFailedSaveKeepsOldVersion(m *testing.T) {
+	ctx := context.Background()
+	efs, _ := newErasure(m, 5, 3)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.SaveRawBlock(ctx, node, []byte("First version"))
+	handlers := append([]fs.BlockHandlerV2(nil), efs.Shards...)
+	for i := 2; i < 5; i++ {
+		efs.Shards[i] = failingHandler{handlers[i]}
+	}
+	if _, err := efs.SaveRawBlock(ctx, node, []byte("Second version of the block")); err == nil {
+		m.Errorf("Expected a save to two of five handlers to fail")
+	}
+	copy(efs.Shards, handlers)
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "First version" {
+		m.Errorf("Expected the first version to be kept, got %q, %v", x, err)
+	}
+}
+
+// With fewer handlers than 2*DataShards-1 a save that reaches some but too few of them must not
+// leave too few shards of either version
+func TestPartlyFailedSaveKeepsOldVersion(m *testing.T) {
+	ctx := context.Background()
+	efs, memories := newErasure(m, 6, 4)
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.SaveRawBlock(ctx, node, []byte("First version"))
+	handlers := append([]fs.BlockHandlerV2(nil), efs.Shards...)
+	for i := 3; i < 6; i++ {
+		efs.Shards[i] = failingHandler{handlers[i]}
+	}
+	if _, err := efs.SaveRawBlock(ctx, node, []byte("Second version of the block")); err == nil {
+		m.Errorf("Expected a save to three of six handlers to fail")
+	}
+	copy(efs.Shards, handlers)
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "First version" {
+		m.Errorf("Expected the first version to be kept, got %q, %v", x, err)
+	}
+
+	// as it is when the shards are staged but too few of them can be copied over the old ones
+	for i := 3; i < 6; i++ {
+		efs.Shards[i] = failingNode{handlers[i], node}
+	}
+	if _, err := efs.SaveRawBlock(ctx, node, []byte("Second version of the block")); err == nil {
+		m.Errorf("Expected a save to three of six handlers to fail")
+	}
+	copy(efs.Shards, handlers)
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "First version" {
+		m.Errorf("Expected the first version to be put back, got %q, %v", x, err)
+	}
+
+	// A save that succeeds replaces it, and leaves no staged shards behind
+	if _, err := efs.SaveRawBlock(ctx, node, []byte("Second version of the block")); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "Second version of the block" {
+		m.Errorf("Expected the second version, got %q, %v", x, err)
+	}
+	for i, mh := range memories {
+		if len(mh.Blocks) != 1 {
+			m.Errorf("Expected handler %d to hold only the block, got %d blocks", i, len(mh.Blocks))
+		}
+	}
+}
+
+func TestRepair(m *testing.T) {
+	ctx := context.Background()
+	efs, memories := newErasure(m, 5, 3)
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < 10; i++ {
+		node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+		efs.SaveRawBlock(ctx, node, []byte(fmt.Sprintf("Block number %d", i)))
+		nodes = append(nodes, node)
+	}
+
+	// Lose a whole handler, and the shards of one block on another
+	memories[3].Format(100, 100)
+	delete(memories[0].Blocks, nodes[4])
+	// and too many shards of the last block
+	for _, mh := range memories[:3] {
+		delete(mh.Blocks, nodes[9])
+	}
+
+	report, err := efs.Repair(ctx)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if report.Checked != 10 || report.Repaired != 10 {
+		m.Errorf("Expected ten shards repaired, got %v", report)
+	}
+	if len(report.Unrecoverable) != 1 || report.Unrecoverable[0] != nodes[9] {
+		m.Errorf("Expected the last block to be unrecoverable, got %v", report.Unrecoverable)
+	}
+	for i, node := range nodes[:9] {
+		for j, mh := range memories {
+			if _, ok := mh.Blocks[node]; !ok {
+				m.Errorf("Block %d has no shard in handler %d", i, j)
+			}
+		}
+	}
+
+	// With the rebuilt shards any two handlers can be lost again
+	memories[0].Format(100, 100)
+	memories[1].Format(100, 100)
+	if x, err := efs.GetRawBlock(ctx, nodes[4]); err != nil || string(x) != "Block number 4" {
+		m.Errorf("Expected the block to be read from the repaired shards, got %q, %v", x, err)
+	}
+}
+
+func TestErasureFileSystem(m *testing.T) {
+	f := blocktest.NewFileSystem(m, nil, "erasure:data=2;memory;memory;memory;memory", 1000, 100)
+	f.WriteFile("/erasure/file", []byte("Hello world"))
+	f.ChangeCache.Flush()
+	f.ChangeCache.Clear()
+
+	efs := f.BlockHandler.(*ErasureFileSystem)
+	for _, i := range []int{0, 3} {
+		efs.Shards[i].Format(context.Background(), 1000, 100)
+	}
+	if x, err := f.ReadFile("/erasure/file"); err != nil || string(x) != "Hello world" {
+		m.Errorf("Expected the file to be read with two handlers lost, got %q, %v", x, err)
+	}
+}
+
+func TestForwardsToShards(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(handlers ...fs.BlockHandlerV2) *ErasureFileSystem {
+		efs := &ErasureFileSystem{Shards: handlers, DataShards: 2}
+		if err := efs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		efs.Format(ctx, 100, 100)
+		return efs
+	}
+	wal := func() fs.BlockHandlerV2 {
+		return &walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}}
+	}
+
+	// Transactions, only when every handler has them
+	if fs.IsTransactional(wrap(wal(), wal(), fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected erasure coding with a handler over memory not to be transactional")
+	}
+	efs := wrap(wal(), wal(), wal())
+	if !fs.IsTransactional(efs) {
+		m.Errorf("Expected erasure coding over walfs to be transactional")
+	}
+	node, _ := efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.Begin(ctx)
+	efs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	efs.Rollback(ctx)
+	if _, err := efs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+	efs.Begin(ctx)
+	efs.SaveRawBlock(ctx, node, []byte("Committed"))
+	if err := efs.Commit(ctx); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := efs.GetRawBlock(ctx, node); err != nil || string(x) != "Committed" {
+		m.Errorf("Expected the save to be committed, got %q, %v", x, err)
+	}
+
+	// Flushes
+	colds := []*memory.MemoryFileSystem{{}, {}, {}}
+	tiers := make([]fs.BlockHandlerV2, len(colds))
+	for i := range colds {
+		tiers[i] = &tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(colds[i])}
+	}
+	efs = wrap(tiers...)
+	node, _ = efs.GetFreeBlockNode(ctx, fs.DATA)
+	efs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := efs.Flush(ctx); err != nil || len(colds[2].Blocks[node]) == 0 {
+		m.Errorf("Expected the flush to reach the cold tiers, got %v", err)
+	}
+
+	// and reservations
+	memories := []*memory.MemoryFileSystem{{}, {}, {}}
+	efs = wrap(fs.AdaptBlockHandler(memories[0]), fs.AdaptBlockHandler(memories[1]), fs.AdaptBlockHandler(memories[2]))
+	node, _ = efs.GetFreeBlockNode(ctx, fs.FILE)
+	efs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := efs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh := memories[2].GetFreeBlockNode(fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out by the last handler")
+	}
+}
@@ -0,0 +1,218 @@
+package erasurefs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, using log and exp tables
+const polynomial = 0x11d
+
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+	// Doubled so that the sum of two logs can be looked up without taking it modulo 255
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range result {
+		for c := range result[r] {
+			var sum byte
+			for i := range other {
+				sum ^= gfMul(m[r][i], other[i][c])
+			}
+			result[r][c] = sum
+		}
+	}
+	return result
+}
+
+var errSingular = errors.New("Matrix is singular")
+
+// The inverse of a square matrix, by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, size*2)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+	for c := 0; c < size; c++ {
+		pivot := c
+		for pivot < size && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInverse(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < size; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= gfMul(factor, work[c][i])
+				}
+			}
+		}
+	}
+	inverse := newMatrix(size, size)
+	for r := range inverse {
+		copy(inverse[r], work[r][size:])
+	}
+	return inverse, nil
+}
+
+// A systematic Reed-Solomon code with dataShards data shards and parityShards parity shards. Any
+// dataShards of the shards are enough to rebuild all of them.
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	// The first dataShards rows are the identity, so the data shards are stored as they are
+	encoding matrix
+}
+
+func newReedSolomon(dataShards, parityShards int) (*reedSolomon, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("Can't code %d data and %d parity shards", dataShards, parityShards)
+	}
+	total := dataShards + parityShards
+	// A Vandermonde matrix, any dataShards rows of which are independent, made systematic by
+	// multiplying by the inverse of its top square
+	vandermonde := newMatrix(total, dataShards)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{dataShards, parityShards, vandermonde.multiply(top)}, nil
+}
+
+// Compute one shard from the data shards using a row of the encoding matrix
+func codeShard(row []byte, data [][]byte, shard []byte) {
+	for i := range shard {
+		shard[i] = 0
+	}
+	for j, coefficient := range row {
+		if coefficient == 0 {
+			continue
+		}
+		for i, b := range data[j] {
+			shard[i] ^= gfMul(coefficient, b)
+		}
+	}
+}
+
+// Split the data into equal sized data shards (padding the last with zeros) and add the parity
+// shards
+func (rs *reedSolomon) split(data []byte) [][]byte {
+	size := (len(data) + rs.dataShards - 1) / rs.dataShards
+	shards := make([][]byte, rs.dataShards+rs.parityShards)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < rs.dataShards && i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+	for i := rs.dataShards; i < len(shards); i++ {
+		codeShard(rs.encoding[i], shards[:rs.dataShards], shards[i])
+	}
+	return shards
+}
+
+// Fill in the missing (nil) shards from any dataShards of the others, which must all be the same
+// size
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	present := make([]int, 0, rs.dataShards)
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.dataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.dataShards {
+		return fmt.Errorf("Only %d of the %d shards needed are available", len(present), rs.dataShards)
+	}
+	size := len(shards[present[0]])
+	sub := newMatrix(rs.dataShards, rs.dataShards)
+	available := make([][]byte, rs.dataShards)
+	for r, i := range present {
+		if len(shards[i]) != size {
+			return fmt.Errorf("Shard %d is %d bytes, expected %d", i, len(shards[i]), size)
+		}
+		copy(sub[r], rs.encoding[i])
+		available[r] = shards[i]
+	}
+	decoding, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	data := make([][]byte, rs.dataShards)
+	for j := range data {
+		if shards[j] != nil {
+			data[j] = shards[j]
+			continue
+		}
+		data[j] = make([]byte, size)
+		codeShard(decoding[j], available, data[j])
+		shards[j] = data[j]
+	}
+	for i := rs.dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			codeShard(rs.encoding[i], data, shards[i])
+		}
+	}
+	return nil
+}
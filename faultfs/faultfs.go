@@ -0,0 +1,386 @@
+// Fault injecting block handler - wraps another BlockHandlerV2 and, according to the rules it is
+// given, delays operations, fails them, tears or drops writes or flips bits in the blocks written
+// or read. It is meant for testing how an application (and the filesystem) behaves when storage
+// misbehaves, so every decision it makes comes from a random source seeded with Seed and the same
+// rules over the same operations inject the same faults.
+//
+// A Rule picks the operations it applies to by kind and block type, and then fires either on the
+// Nth of them, with a probability, or on all of them, at most Limit times. Every rule that fires
+// on an operation is applied, in the order they were added.
+//
+// The configuration string passed to Init is the seed followed by the configuration of the inner
+// handler, including its scheme, e.g. "fault:42:memory". When Inner is set before Init only the
+// seed is needed (and can be left empty). Rules are added with AddRule.
+//
+// Example:
+//
+//	ffs := &faultfs.FaultyFileSystem{Inner: fs.AdaptBlockHandler(&mh)}
+//	f.InitV2(ffs, "1")
+//	ffs.AddRule(&faultfs.Rule{Ops: []faultfs.Op{faultfs.SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Nth: 3, Fault: faultfs.ERROR})
+package faultfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// The kinds of operation a Rule can apply to
+type Op int
+
+const (
+	GET      Op = iota // GetRawBlock
+	SAVE               // SaveRawBlock
+	FREE               // FreeBlocks, once for each block
+	ALLOCATE           // GetFreeBlockNode and GetFreeDataBlockNode
+)
+
+var opNames = []string{"get", "save", "free", "allocate"}
+
+func (o Op) String() string {
+	if o < 0 || int(o) >= len(opNames) {
+		return fmt.Sprintf("op%d", int(o))
+	}
+	return opNames[o]
+}
+
+// The faults a Rule can inject
+type Fault int
+
+const (
+	LATENCY Fault = iota // wait for Delay before carrying out the operation
+	ERROR                // fail the operation with Err, without carrying it out
+	TORN                 // save only the first half of the block, reporting success
+	DROPPED              // report success for a save or free without carrying it out
+	BITFLIP              // flip a random bit in the block saved or read
+)
+
+var faultNames = []string{"latency", "error", "torn", "dropped", "bitflip"}
+
+func (f Fault) String() string {
+	if f < 0 || int(f) >= len(faultNames) {
+		return fmt.Sprintf("fault%d", int(f))
+	}
+	return faultNames[f]
+}
+
+// The error returned by an ERROR fault when the Rule has no Err of its own
+var ErrInjected = errors.New("Injected fault")
+
+type Rule struct {
+	// The operations and block types the rule applies to, all of them if empty. Allocations are
+	// matched on the type asked for.
+	Ops   []Op
+	Types []fs.BlockNodeType
+	// Fire on the Nth matching operation only (counting from 1), or if Nth is 0 on each with the
+	// Probability, or on every one if that is 0 too
+	Nth         int
+	Probability float64
+	// The most times the rule fires, unlimited if 0
+	Limit int
+	Fault Fault
+	Delay time.Duration
+	Err   error
+	// How many operations the rule has matched and how many times it has fired
+	matched int
+	fired   int
+}
+
+func (r *Rule) matches(op Op, nodeType fs.BlockNodeType) bool {
+	found := len(r.Ops) == 0
+	for _, o := range r.Ops {
+		found = found || o == op
+	}
+	if !found {
+		return false
+	}
+	found = len(r.Types) == 0
+	for _, t := range r.Types {
+		found = found || t == nodeType
+	}
+	return found
+}
+
+type FaultyFileSystem struct {
+	Inner fs.BlockHandlerV2
+	Seed  int64
+	rules []*Rule
+	rng   *rand.Rand
+	// The number of times each fault has been injected
+	injected map[Fault]int64
+	lock     sync.Mutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("fault", func() fs.BlockHandlerV2 { return &FaultyFileSystem{} })
+}
+
+// Take the seed from the start of the configuration and initialize the inner handler (creating it
+// from the rest of the configuration if there isn't one)
+func (ffs *FaultyFileSystem) Init(ctx context.Context, configuration string) error {
+	seed, rest := configuration, ""
+	if i := strings.Index(configuration, ":"); i >= 0 {
+		seed, rest = configuration[:i], configuration[i+1:]
+	}
+	if seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return err
+		}
+		ffs.Seed = value
+	}
+	ffs.lock.Lock()
+	ffs.rng = rand.New(rand.NewSource(ffs.Seed))
+	ffs.injected = make(map[Fault]int64)
+	ffs.lock.Unlock()
+	if ffs.Inner == nil {
+		inner, innerConfiguration, err := fs.NewBlockHandler(rest)
+		if err != nil {
+			return err
+		}
+		ffs.Inner, rest = inner, innerConfiguration
+	}
+	return ffs.Inner.Init(ctx, rest)
+}
+
+// Add a rule, which applies from the next operation
+func (ffs *FaultyFileSystem) AddRule(rule *Rule) {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	ffs.rules = append(ffs.rules, rule)
+}
+
+// Remove every rule, so that operations are passed straight through
+func (ffs *FaultyFileSystem) ClearRules() {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	ffs.rules = nil
+}
+
+// The number of times each fault has been injected since Init
+func (ffs *FaultyFileSystem) Injected() map[Fault]int64 {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	injected := make(map[Fault]int64, len(ffs.injected))
+	for fault, count := range ffs.injected {
+		injected[fault] = count
+	}
+	return injected
+}
+
+// The rules that fire on an operation
+func (ffs *FaultyFileSystem) fire(op Op, nodeType fs.BlockNodeType) []*Rule {
+	ffs.lock.Lock()
+	defer ffs.lock.Unlock()
+	if ffs.rng == nil {
+		ffs.rng = rand.New(rand.NewSource(ffs.Seed))
+		ffs.injected = make(map[Fault]int64)
+	}
+	fired := make([]*Rule, 0)
+	for _, rule := range ffs.rules {
+		if !rule.matches(op, nodeType) || (rule.Limit > 0 && rule.fired >= rule.Limit) {
+			continue
+		}
+		rule.matched++
+		switch {
+		case rule.Nth > 0:
+			if rule.matched != rule.Nth {
+				continue
+			}
+		case rule.Probability > 0:
+			if ffs.rng.Float64() >= rule.Probability {
+				continue
+			}
+		}
+		rule.fired++
+		ffs.injected[rule.Fault]++
+		fired = append(fired, rule)
+	}
+	return fired
+}
+
+// Flip a random bit of a copy of the data
+func (ffs *FaultyFileSystem) flip(data []byte) []byte {
+	flipped := append([]byte(nil), data...)
+	if len(flipped) == 0 {
+		return flipped
+	}
+	ffs.lock.Lock()
+	bit := ffs.rng.Intn(len(flipped) * 8)
+	ffs.lock.Unlock()
+	flipped[bit/8] ^= 1 << uint(bit%8)
+	return flipped
+}
+
+// Apply the LATENCY and ERROR faults of the rules, which are common to every operation
+func (ffs *FaultyFileSystem) delayOrFail(ctx context.Context, rules []*Rule) error {
+	for _, rule := range rules {
+		switch rule.Fault {
+		case LATENCY:
+			select {
+			case <-time.After(rule.Delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case ERROR:
+			if rule.Err != nil {
+				return rule.Err
+			}
+			return ErrInjected
+		}
+	}
+	return nil
+}
+
+func hasFault(rules []*Rule, fault Fault) bool {
+	for _, rule := range rules {
+		if rule.Fault == fault {
+			return true
+		}
+	}
+	return false
+}
+
+func (ffs *FaultyFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	return ffs.Inner.Format(ctx, blockCount, blockSize)
+}
+
+func (ffs *FaultyFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	if err := ffs.delayOrFail(ctx, ffs.fire(ALLOCATE, NodeType)); err != nil {
+		return fs.NilBlock, err
+	}
+	return ffs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (ffs *FaultyFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	if err := ffs.delayOrFail(ctx, ffs.fire(ALLOCATE, fs.DATA)); err != nil {
+		return fs.NilBlock, err
+	}
+	return ffs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+func (ffs *FaultyFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	rules := ffs.fire(GET, node.Type)
+	if err := ffs.delayOrFail(ctx, rules); err != nil {
+		return nil, err
+	}
+	data, err := ffs.Inner.GetRawBlock(ctx, node)
+	if err == nil && hasFault(rules, BITFLIP) {
+		data = ffs.flip(data)
+	}
+	return data, err
+}
+
+func (ffs *FaultyFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	rules := ffs.fire(SAVE, node.Type)
+	if err := ffs.delayOrFail(ctx, rules); err != nil {
+		return node, err
+	}
+	if hasFault(rules, DROPPED) {
+		return node, nil
+	}
+	if hasFault(rules, TORN) {
+		data = data[:len(data)/2]
+	}
+	if hasFault(rules, BITFLIP) {
+		data = ffs.flip(data)
+	}
+	return ffs.Inner.SaveRawBlock(ctx, node, data)
+}
+
+// Free the blocks, the rules being applied to each block in turn. A block whose free is dropped
+// stays in the inner handler; an error stops the blocks after it being freed.
+func (ffs *FaultyFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	freed := make([]fs.BlockNode, 0, len(blocks))
+	var err error
+	for _, node := range blocks {
+		rules := ffs.fire(FREE, node.Type)
+		if err = ffs.delayOrFail(ctx, rules); err != nil {
+			break
+		}
+		if !hasFault(rules, DROPPED) {
+			freed = append(freed, node)
+		}
+	}
+	if len(freed) > 0 {
+		if freeErr := ffs.Inner.FreeBlocks(ctx, freed); err == nil {
+			err = freeErr
+		}
+	}
+	return err
+}
+
+// Every block held by the inner handler, if it is a BlockLister
+func (ffs *FaultyFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := ffs.Inner.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	return lister.ListBlocks(ctx)
+}
+
+// Pass a transaction on to the inner handler, if it is Transactional
+func (ffs *FaultyFileSystem) Begin(ctx context.Context) {
+	if tx, ok := ffs.Inner.(fs.Transactional); ok {
+		tx.Begin(ctx)
+	}
+}
+
+func (ffs *FaultyFileSystem) Commit(ctx context.Context) error {
+	if tx, ok := ffs.Inner.(fs.Transactional); ok {
+		return tx.Commit(ctx)
+	}
+	return nil
+}
+
+func (ffs *FaultyFileSystem) Rollback(ctx context.Context) {
+	if tx, ok := ffs.Inner.(fs.Transactional); ok {
+		tx.Rollback(ctx)
+	}
+}
+
+func (ffs *FaultyFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(ffs.Inner)
+}
+
+// Write out the blocks the inner handler is holding back, if it is a BlockFlusher
+func (ffs *FaultyFileSystem) Flush(ctx context.Context) error {
+	if flusher, ok := ffs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Reserve the node in the inner handler, if it is a BlockReserver
+func (ffs *FaultyFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := ffs.Inner.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// The number of each fault injected, with the counters of the inner handler
+func (ffs *FaultyFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := ffs.Inner.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	for fault, count := range ffs.Injected() {
+		stats["fault."+fault.String()] = float64(count)
+	}
+	return stats
+}
+
+func (ffs *FaultyFileSystem) DumpInfo() {
+	ffs.lock.Lock()
+	fmt.Printf("Fault injecting file system with %d rules, seed %d, injected %v, over:\n", len(ffs.rules), ffs.Seed, ffs.injected)
+	ffs.lock.Unlock()
+	ffs.Inner.DumpInfo()
+}
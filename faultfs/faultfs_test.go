@@ -0,0 +1,310 @@
+package faultfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/checksum"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func newFaulty(m *testing.T) *FaultyFileSystem {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	if err := ffs.Init(context.Background(), "1"); err != nil {
+		m.Fatal(err)
+	}
+	ffs.Format(context.Background(), 1000, 100)
+	return ffs
+}
+
+// A filesystem over a fault injecting handler, with a file and its search terms written
+func newFileSystem(m *testing.T, handler fs.BlockHandlerV2) *fs.RootFileSystem {
+	f := blocktest.NewFileSystem(m, handler, "", 1000, 100)
+	f.WriteFile("/fault/existing", []byte("Some existing words"))
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+	return f
+}
+
+func TestRules(m *testing.T) {
+	ctx := context.Background()
+	ffs := newFaulty(m)
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Nth: 3, Fault: ERROR})
+	node, _ := ffs.GetFreeBlockNode(ctx, fs.DATA)
+	file, _ := ffs.GetFreeBlockNode(ctx, fs.FILE)
+	for i := 1; i <= 5; i++ {
+		_, err := ffs.SaveRawBlock(ctx, node, []byte("data"))
+		if (i == 3) != errors.Is(err, ErrInjected) {
+			m.Errorf("Save %d returned %v", i, err)
+		}
+		if _, err = ffs.SaveRawBlock(ctx, file, []byte("file")); err != nil {
+			m.Errorf("Expected saves of other types to be left alone, got %v", err)
+		}
+	}
+
+	// The same seed injects the same faults
+	outcomes := func() []bool {
+		ffs := newFaulty(m)
+		ffs.AddRule(&Rule{Ops: []Op{GET}, Probability: 0.5, Limit: 20, Fault: ERROR})
+		ffs.SaveRawBlock(ctx, node, []byte("data"))
+		failed := make([]bool, 0)
+		for i := 0; i < 50; i++ {
+			_, err := ffs.GetRawBlock(ctx, node)
+			failed = append(failed, err != nil)
+		}
+		if ffs.Injected()[ERROR] != 20 {
+			m.Errorf("Expected the limit to stop the rule, got %v", ffs.Injected())
+		}
+		return failed
+	}
+	first, second := outcomes(), outcomes()
+	for i := range first {
+		if first[i] != second[i] {
+			m.Fatalf("Outcome %d differs between runs with the same seed", i)
+		}
+	}
+
+	ffs.ClearRules()
+	ffs.AddRule(&Rule{Ops: []Op{ALLOCATE}, Fault: ERROR, Err: fs.ErrNoSpace})
+	if _, err := ffs.GetFreeBlockNode(ctx, fs.FILE); !errors.Is(err, fs.ErrNoSpace) {
+		m.Errorf("Expected the rule's own error, got %v", err)
+	}
+	if stats := ffs.HandlerStats(); stats["fault.error"] != 2 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+// Reads of blocks the cache holds don't reach the handler, so only see the latency once
+func TestLatency(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, ffs)
+	f.ChangeCache.Clear()
+	delay := 20 * time.Millisecond
+	ffs.AddRule(&Rule{Ops: []Op{GET}, Types: []fs.BlockNodeType{fs.DIRECTORY}, Fault: LATENCY, Delay: delay})
+	start := time.Now()
+	if _, err := f.ListDirectory("/fault"); err != nil {
+		m.Fatal(err)
+	}
+	if time.Since(start) < delay {
+		m.Errorf("Expected the listing to be delayed")
+	}
+	reads := ffs.Injected()[LATENCY]
+	f.ListDirectory("/fault")
+	if ffs.Injected()[LATENCY] != reads {
+		m.Errorf("Expected the directories to come from the cache the second time")
+	}
+
+	// A cancelled context cuts the delay short
+	ffs.AddRule(&Rule{Ops: []Op{GET}, Types: []fs.BlockNodeType{fs.DATA}, Fault: LATENCY, Delay: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	f.Context = ctx
+	cancel()
+	if _, err := f.ReadFile("/fault/existing"); !errors.Is(err, context.Canceled) {
+		m.Errorf("Expected the read to be cancelled, got %v", err)
+	}
+}
+
+func TestErrors(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, ffs)
+
+	// Data blocks are written straight away, so the error is returned by the write
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Fault: ERROR})
+	if err := f.WriteFile("/fault/data", []byte("Not saved")); !errors.Is(err, ErrInjected) {
+		m.Errorf("Expected the write to fail, got %v", err)
+	}
+	ffs.ClearRules()
+
+	// File nodes are written by the cache, so the write succeeds and the error comes from Sync.
+	// The entry is left dirty, and written by the next Sync once the fault has cleared.
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.FILE}, Fault: ERROR})
+	if err := f.WriteFile("/fault/file", []byte("Saved later")); err != nil {
+		m.Errorf("Expected the write to succeed, got %v", err)
+	}
+	if err := f.Sync(); !errors.Is(err, ErrInjected) {
+		m.Errorf("Expected Sync to fail, got %v", err)
+	}
+	ffs.ClearRules()
+	if err := f.Sync(); err != nil {
+		m.Errorf("Expected Sync to succeed once the fault cleared, got %v", err)
+	}
+	f.Mount()
+	if x, err := f.ReadFile("/fault/file"); err != nil || string(x) != "Saved later" {
+		m.Errorf("Expected the file to be saved, got %q, %v", x, err)
+	}
+
+	// Adding to the search index reads the search tree, so a write fails if it can't be read
+	f.ChangeCache.Clear()
+	ffs.AddRule(&Rule{Ops: []Op{GET}, Types: []fs.BlockNodeType{fs.SEARCHTREE}, Fault: ERROR})
+	if _, err := f.SearchFindTerms("text", "Some", "Somez"); !errors.Is(err, ErrInjected) {
+		m.Errorf("Expected the search to fail, got %v", err)
+	}
+	if err := f.WriteFile("/fault/indexed", []byte("More words")); !errors.Is(err, ErrInjected) {
+		m.Errorf("Expected indexing the write to fail, got %v", err)
+	}
+}
+
+// A File whose new version can't be saved leaves the file as it was when it is closed
+func TestFailedClose(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, ffs)
+	w, err := f.Create("/fault/existing")
+	if err != nil {
+		m.Fatal(err)
+	}
+	w.Write([]byte("Never replaces the existing words"))
+	ffs.AddRule(&Rule{Ops: []Op{ALLOCATE}, Types: []fs.BlockNodeType{fs.ROUTE}, Fault: ERROR})
+	if err := w.Close(); !errors.Is(err, ErrInjected) {
+		m.Errorf("Expected Close to fail, got %v", err)
+	}
+	ffs.ClearRules()
+	if x, err := f.ReadFile("/fault/existing"); err != nil || string(x) != "Some existing words" {
+		m.Errorf("Expected the existing contents, got %q, %v", x, err)
+	}
+	if fileNode, _ := f.StatFile("/fault/existing"); fileNode.Stats.Size != 19 || len(fileNode.AlternateRoutes) != 1 {
+		m.Errorf("Expected the size and version to be kept, got %d, %v", fileNode.Stats.Size, fileNode.AlternateRoutes)
+	}
+	f.Sync()
+	if report, err := f.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+}
+
+func TestTornWrites(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, ffs)
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Nth: 1, Fault: TORN})
+	if err := f.WriteFile("/fault/torn", []byte("0123456789")); err != nil {
+		m.Fatal(err)
+	}
+	// Without checksums the torn block is read back as it is, and only Check notices
+	if x, err := f.ReadFile("/fault/torn"); err != nil || string(x) != "01234" {
+		m.Errorf("Expected half the file, got %q, %v", x, err)
+	}
+	report, err := f.Check(false)
+	if err != nil || len(report.Problems) != 1 || report.Problems[0].Type != fs.SIZEMISMATCH {
+		m.Errorf("Expected a size mismatch, got %v, %v", report, err)
+	}
+
+	// With checksums over the fault the torn block is reported as corrupt when it is read
+	ffs = &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f = newFileSystem(m, &checksum.ChecksumFileSystem{Inner: ffs})
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Nth: 1, Fault: TORN})
+	f.WriteFile("/fault/torn", []byte("0123456789"))
+	var corrupt *fs.ErrCorruptBlock
+	if _, err := f.ReadFile("/fault/torn"); !errors.As(err, &corrupt) {
+		m.Errorf("Expected a corrupt block, got %v", err)
+	}
+}
+
+func TestDroppedWrites(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, ffs)
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DIRECTORY}, Fault: DROPPED})
+	if err := f.WriteFile("/dropped/file", []byte("Lost")); err != nil {
+		m.Fatal(err)
+	}
+	// Nothing notices until the directory has left the cache
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := f.ReadFile("/dropped/file"); err != nil || string(x) != "Lost" {
+		m.Errorf("Expected the cached directory to find the file, got %q, %v", x, err)
+	}
+	ffs.ClearRules()
+	f.Mount()
+	if _, err := f.ReadFile("/fault/existing"); err != nil {
+		m.Errorf("Expected the existing file to survive, got %v", err)
+	}
+	if _, err := f.ReadFile("/dropped/file"); err == nil {
+		m.Errorf("Expected the file to be lost with its directory")
+	}
+	if report, err := f.Check(false); err != nil || len(report.Problems) == 0 {
+		m.Errorf("Expected Check to find the damage, got %v, %v", report, err)
+	}
+	if ffs.Injected()[DROPPED] == 0 {
+		m.Errorf("Expected dropped writes to be counted")
+	}
+}
+
+func TestBitFlips(m *testing.T) {
+	ffs := &FaultyFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{})}
+	f := newFileSystem(m, &checksum.ChecksumFileSystem{Inner: ffs})
+	f.ChangeCache.Clear()
+
+	// A bit flipped on the way back is caught by the checksum, and not there when read again
+	ffs.AddRule(&Rule{Ops: []Op{GET}, Types: []fs.BlockNodeType{fs.SEARCHTREE}, Nth: 1, Fault: BITFLIP})
+	var corrupt *fs.ErrCorruptBlock
+	if _, err := f.SearchFindTerms("text", "Some", "Somez"); !errors.As(err, &corrupt) {
+		m.Errorf("Expected the search tree to be corrupt, got %v", err)
+	}
+	if found, err := f.SearchFindTerms("text", "Some", "Somez"); err != nil || len(found) != 1 {
+		m.Errorf("Expected the search to work when read again, got %v, %v", found, err)
+	}
+
+	// A bit flipped when it was saved stays, and Scrub finds the damaged file
+	ffs.AddRule(&Rule{Ops: []Op{SAVE}, Types: []fs.BlockNodeType{fs.DATA}, Nth: 1, Fault: BITFLIP})
+	f.WriteFile("/fault/flipped", []byte("A file with a flipped bit"))
+	report, err := f.Scrub()
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.DamagedPaths) != 1 || report.DamagedPaths[0] != "/fault/flipped" {
+		m.Errorf("Expected the file to be damaged, got %v", report)
+	}
+}
+
+func TestForwardsToInner(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(inner fs.BlockHandlerV2) *FaultyFileSystem {
+		ffs := &FaultyFileSystem{Inner: inner}
+		if err := ffs.Init(ctx, "1"); err != nil {
+			m.Fatal(err)
+		}
+		ffs.Format(ctx, 100, 100)
+		return ffs
+	}
+
+	// Transactions, only when the inner handler has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a wrapper over memory not to be transactional")
+	}
+	ffs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(ffs) {
+		m.Errorf("Expected a wrapper over walfs to be transactional")
+	}
+	node, _ := ffs.GetFreeBlockNode(ctx, fs.FILE)
+	ffs.Begin(ctx)
+	ffs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	ffs.Rollback(ctx)
+	if _, err := ffs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the save to be rolled back, got %v", err)
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	ffs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = ffs.GetFreeBlockNode(ctx, fs.DATA)
+	ffs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := ffs.Flush(ctx); err != nil || string(cold.Blocks[node]) != "Held back" {
+		m.Errorf("Expected the flush to reach the cold tier, got %v", err)
+	}
+
+	// and reservations
+	ffs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = ffs.GetFreeBlockNode(ctx, fs.FILE)
+	ffs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := ffs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := ffs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+}
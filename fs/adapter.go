@@ -0,0 +1,107 @@
+package fs
+
+import "context"
+
+// Wraps a BlockHandler so that it can be used where a BlockHandlerV2 is needed. The v1 handler
+// signals a full filesystem by returning NilBlock and a missing block by returning nil, these
+// are turned into ErrNoSpace and ErrBlockNotFound. The context is checked before each call.
+func AdaptBlockHandler(handler BlockHandler) BlockHandlerV2 {
+	return &v1Adapter{handler}
+}
+
+type v1Adapter struct {
+	Handler BlockHandler
+}
+
+func (a *v1Adapter) Init(ctx context.Context, configuration string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Handler.Init(configuration)
+	return nil
+}
+
+func (a *v1Adapter) Format(ctx context.Context, blockCount int, blockSize int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Handler.Format(blockCount, blockSize)
+	return nil
+}
+
+func (a *v1Adapter) GetFreeBlockNode(ctx context.Context, NodeType BlockNodeType) (BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return NilBlock, err
+	}
+	node := a.Handler.GetFreeBlockNode(NodeType)
+	if node == NilBlock {
+		return NilBlock, ErrNoSpace
+	}
+	return node, nil
+}
+
+func (a *v1Adapter) GetFreeDataBlockNode(ctx context.Context, parent BlockNode, id string) (BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return NilBlock, err
+	}
+	node := a.Handler.GetFreeDataBlockNode(parent, id)
+	if node == NilBlock {
+		return NilBlock, ErrNoSpace
+	}
+	return node, nil
+}
+
+func (a *v1Adapter) GetRawBlock(ctx context.Context, node BlockNode) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data := a.Handler.GetRawBlock(node)
+	if data == nil {
+		return nil, ErrBlockNotFound
+	}
+	return data, nil
+}
+
+func (a *v1Adapter) SaveRawBlock(ctx context.Context, node BlockNode, data []byte) (BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return node, err
+	}
+	return a.Handler.SaveRawBlock(node, data), nil
+}
+
+func (a *v1Adapter) FreeBlocks(ctx context.Context, blocks []BlockNode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Handler.FreeBlocks(blocks)
+	return nil
+}
+
+func (a *v1Adapter) DumpInfo() {
+	a.Handler.DumpInfo()
+}
+
+// Forwards to the wrapped handler if it is a BlockLister, otherwise returns ErrNotSupported
+func (a *v1Adapter) ListBlocks(ctx context.Context) ([]BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	lister, ok := a.Handler.(BlockLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListBlocks(ctx)
+}
+
+// Forwards to the wrapped handler if it is a BlockReserver. Handlers that aren't hand out ids
+// without looking at what has been saved, so there is nothing to reserve.
+func (a *v1Adapter) ReserveBlockNode(ctx context.Context, node BlockNode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reserver, ok := a.Handler.(BlockReserver)
+	if !ok {
+		return nil
+	}
+	return reserver.ReserveBlockNode(ctx, node)
+}
@@ -0,0 +1,387 @@
+package fs
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// The binary codec writes values without any field names or type information, so it is much
+// smaller than gob or JSON. Integers are varints, strings, slices and maps are prefixed with
+// their length, map entries are sorted by key, structs are their exported fields in order and
+// anything implementing encoding.BinaryMarshaler (e.g. time.Time) is written as a length prefixed
+// MarshalBinary. Values held in an interface (e.g. Attributes) are prefixed with a tag for their
+// type and must be one of binaryInterfaceTypes.
+//
+// As there are no field names, changing a structure means changing the block header version.
+type binaryCodec struct{}
+
+var binaryInterfaceTypes = []reflect.Type{
+	nil,
+	reflect.TypeOf(""),
+	reflect.TypeOf(false),
+	reflect.TypeOf(int(0)),
+	reflect.TypeOf(int64(0)),
+	reflect.TypeOf(float64(0)),
+	reflect.TypeOf([]byte(nil)),
+	reflect.TypeOf([]string(nil)),
+	reflect.TypeOf([]interface{}(nil)),
+	reflect.TypeOf(map[string]interface{}(nil)),
+	reflect.TypeOf(time.Time{}),
+}
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+var errBinaryTruncated = errors.New("Binary data is truncated")
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("Can't marshal a nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	var e binaryEncoder
+	err := e.encode(rv)
+	return e.buffer.Bytes(), err
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Can only unmarshal into a non nil pointer")
+	}
+	d := binaryDecoder{data: data}
+	err := d.decode(rv.Elem())
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("%d bytes left over", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+type binaryEncoder struct {
+	buffer  bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *binaryEncoder) uvarint(x uint64) {
+	n := binary.PutUvarint(e.scratch[:], x)
+	e.buffer.Write(e.scratch[:n])
+}
+
+func (e *binaryEncoder) varint(x int64) {
+	n := binary.PutVarint(e.scratch[:], x)
+	e.buffer.Write(e.scratch[:n])
+}
+
+func (e *binaryEncoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buffer.Write(b)
+}
+
+func (e *binaryEncoder) encode(v reflect.Value) error {
+	if v.Kind() == reflect.Struct && v.Type().Implements(binaryMarshalerType) {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.bytes(b)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buffer.WriteByte(1)
+		} else {
+			e.buffer.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.varint(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.uvarint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Float()))
+		e.buffer.Write(b[:])
+	case reflect.String:
+		e.bytes([]byte(v.String()))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.bytes(v.Bytes())
+			return nil
+		}
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.buffer.WriteByte(0)
+			return nil
+		}
+		e.buffer.WriteByte(1)
+		return e.encode(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			e.uvarint(0)
+			return nil
+		}
+		inner := v.Elem()
+		for tag, t := range binaryInterfaceTypes {
+			if t == inner.Type() {
+				e.uvarint(uint64(tag))
+				return e.encode(inner)
+			}
+		}
+		return fmt.Errorf("Can't encode a %v held in an interface", inner.Type())
+	default:
+		return fmt.Errorf("Can't encode a %v", v.Type())
+	}
+	return nil
+}
+
+// Map entries are sorted by their encoded key so that the same map always encodes the same way
+func (e *binaryEncoder) encodeMap(v reflect.Value) error {
+	type entry struct {
+		key   []byte
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var k binaryEncoder
+		if err := k.encode(iter.Key()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{k.buffer.Bytes(), iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	e.uvarint(uint64(len(entries)))
+	for _, en := range entries {
+		e.buffer.Write(en.key)
+		if err := e.encode(en.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.pos += n
+	return x, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	x, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.pos += n
+	return x, nil
+}
+
+// A length, which can't be more than the bytes left as every element takes at least one byte
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errBinaryTruncated
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) next(n int) ([]byte, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errBinaryTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	if v.Kind() == reflect.Struct && reflect.PtrTo(v.Type()).Implements(binaryUnmarshalerType) {
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := d.varint()
+		if err != nil {
+			return err
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			if len(b) > 0 {
+				v.SetBytes(append([]byte(nil), b...))
+			}
+			return nil
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := d.decode(elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Interface:
+		tag, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if tag == 0 {
+			return nil
+		}
+		if tag >= uint64(len(binaryInterfaceTypes)) {
+			return fmt.Errorf("Unknown interface type %d", tag)
+		}
+		inner := reflect.New(binaryInterfaceTypes[tag]).Elem()
+		if err := d.decode(inner); err != nil {
+			return err
+		}
+		v.Set(inner)
+	default:
+		return fmt.Errorf("Can't decode a %v", v.Type())
+	}
+	return nil
+}
@@ -33,6 +33,8 @@ type Cache struct {
 	Fs       *RootFileSystem
 	c        chan BlockNode
 	rwmutex  sync.RWMutex
+	// The first error seen writing an entry in the background, returned by the next Flush
+	err error
 }
 
 func (c *Cache) Init(fs *RootFileSystem) {
@@ -56,25 +58,19 @@ func cacheManager(cache *Cache) {
 		select {
 		case id := <-cache.c:
 			// Peform the activity for the entry in the cache
+			cache.rwmutex.Lock()
 			entry, ok := cache.EntryMap[id]
-			if ok {
-				//cache.rwmutex.Lock()
-				if entry.action == UPDATE {
-					vals := rawBlock(entry.entry)
-					cache.Fs.deliverMessage(fmt.Sprintf("Cache save to fs, size is %d, type is %v", len(vals), reflect.TypeOf(entry.entry)))
-					cache.Fs.BlockHandler.SaveRawBlock(id, rawBlock(entry.entry))
-					entry.dirty = false
-					cache.EntryMap[id] = entry
-				} else if entry.action == DELETE {
-					cache.Fs.deliverMessage("Cache delete from fs")
-					blocks := make([]BlockNode, 1)
-					blocks[0] = entry.Node
-					cache.Fs.BlockHandler.FreeBlocks(blocks)
-					entry.dirty = false
-					cache.EntryMap[id] = entry
+			if ok && entry.dirty {
+				err := cache.writeEntry(entry)
+				if err != nil {
+					// Leave the entry dirty so that it is retried by the next save or Flush
+					cache.Fs.deliverMessage(fmt.Sprintf("Cache write of %v failed: %v", id, err))
+					if cache.err == nil {
+						cache.err = err
+					}
 				}
-				//cache.rwmutex.Unlock()
 			}
+			cache.rwmutex.Unlock()
 		case <-timer:
 			// Do clean up work
 			cache.Fs.deliverMessage("Cache cleanup")
@@ -90,30 +86,116 @@ func cacheManager(cache *Cache) {
 	}
 }
 
-func (c *Cache) GetSearchIndex() *SearchIndex {
-	entry, ok := c.EntryMap[c.Fs.SuperBlock.SearchIndexNode]
+// Send a dirty entry through to the BlockHandler. Must be called with the lock held.
+func (c *Cache) writeEntry(entry *CacheEntry) error {
+	var err error
+	if entry.action == UPDATE {
+		var vals []byte
+		vals, err = c.Fs.encodeBlock(entry.entry)
+		if err != nil {
+			return err
+		}
+		c.Fs.deliverMessage(fmt.Sprintf("Cache save to fs, size is %d, type is %v", len(vals), reflect.TypeOf(entry.entry)))
+		_, err = c.Fs.BlockHandler.SaveRawBlock(c.Fs.Context, entry.Node, vals)
+	} else if entry.action == DELETE {
+		c.Fs.deliverMessage("Cache delete from fs")
+		blocks := make([]BlockNode, 1)
+		blocks[0] = entry.Node
+		err = c.Fs.BlockHandler.FreeBlocks(c.Fs.Context, blocks)
+	}
+	if err == nil {
+		entry.dirty = false
+	}
+	return err
+}
+
+// Synchronously write every dirty entry through to the BlockHandler. Returns the first error
+// from this or from any earlier background write that failed.
+func (c *Cache) Flush() error {
+	c.rwmutex.Lock()
+	defer c.rwmutex.Unlock()
+	err := c.err
+	c.err = nil
+	for _, entry := range c.EntryMap {
+		if entry.dirty {
+			writeErr := c.writeEntry(entry)
+			if err == nil {
+				err = writeErr
+			}
+		}
+	}
+	return err
+}
+
+// Discard everything in the cache (including unwritten changes)
+func (c *Cache) Clear() {
+	c.rwmutex.Lock()
+	defer c.rwmutex.Unlock()
+	c.EntryMap = make(map[BlockNode]*CacheEntry)
+}
+
+// Drop any entries for the nodes, used when their blocks have been freed without going through
+// the cache
+func (c *Cache) forget(nodes []BlockNode) {
+	c.rwmutex.Lock()
+	defer c.rwmutex.Unlock()
+	for _, node := range nodes {
+		delete(c.EntryMap, node)
+	}
+}
+
+// Whether the cache still has to write or delete the node
+func (c *Cache) pending(node BlockNode) bool {
+	c.rwmutex.RLock()
+	defer c.rwmutex.RUnlock()
+	entry, ok := c.EntryMap[node]
+	return ok && (entry.dirty || entry.action == DELETE)
+}
+
+// A copy of the entry for the node, if the cache holds one
+func (c *Cache) lookup(node BlockNode) (CacheEntry, bool) {
+	c.rwmutex.RLock()
+	defer c.rwmutex.RUnlock()
+	entry, ok := c.EntryMap[node]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return *entry, true
+}
+
+func (c *Cache) GetSearchIndex() (*SearchIndex, error) {
+	entry, ok := c.lookup(c.Fs.SuperBlock.SearchIndexNode)
 	var si *SearchIndex
 	if !ok {
-		si := c.Fs.getSearchIndex()
+		si, err := c.Fs.getSearchIndex()
+		if err != nil {
+			return nil, err
+		}
 		newEntry := CacheEntry{c.Fs.SuperBlock.SearchIndexNode, false, NONE, si}
 		c.rwmutex.Lock()
 		c.EntryMap[c.Fs.SuperBlock.SearchIndexNode] = &newEntry
 		c.rwmutex.Unlock()
-		return si
+		return si, nil
 	} else {
 		c.Fs.deliverMessage("Search search index from cache")
 		si = entry.entry.(*SearchIndex)
-		return si
+		return si, nil
 	}
 }
 
 func (c *Cache) GetSearchTree(nodeId BlockNode) (*SearchTree, error) {
-	entry, ok := c.EntryMap[nodeId]
+	entry, ok := c.lookup(nodeId)
 	var searchTree *SearchTree
 	if !ok {
 		c.Fs.deliverMessage("Put search tree in cache")
-		rawData := c.Fs.BlockHandler.GetRawBlock(nodeId)
-		searchTree := getSearchTree(rawData)
+		rawData, err := c.Fs.BlockHandler.GetRawBlock(c.Fs.Context, nodeId)
+		if err != nil {
+			return nil, err
+		}
+		searchTree, err := getSearchTree(nodeId, rawData)
+		if err != nil {
+			return nil, err
+		}
 		newEntry := CacheEntry{nodeId, false, NONE, searchTree}
 		c.rwmutex.Lock()
 		c.EntryMap[nodeId] = &newEntry
@@ -133,12 +215,18 @@ func (c *Cache) GetSearchTree(nodeId BlockNode) (*SearchTree, error) {
 
 // Retrieve a file node from either the cache or the FileSystem
 func (c *Cache) GetFileNode(nodeId BlockNode) (*FileNode, error) {
-	entry, ok := c.EntryMap[nodeId]
+	entry, ok := c.lookup(nodeId)
 	var fileNode *FileNode
 	if !ok {
 		c.Fs.deliverMessage("Put file in cache")
-		rawData := c.Fs.BlockHandler.GetRawBlock(nodeId)
-		fn := getFileNode(rawData)
+		rawData, err := c.Fs.BlockHandler.GetRawBlock(c.Fs.Context, nodeId)
+		if err != nil {
+			return nil, err
+		}
+		fn, err := getFileNode(nodeId, rawData)
+		if err != nil {
+			return nil, err
+		}
 		newEntry := CacheEntry{nodeId, false, NONE, fn}
 		c.rwmutex.Lock()
 		c.EntryMap[nodeId] = &newEntry
@@ -157,12 +245,18 @@ func (c *Cache) GetFileNode(nodeId BlockNode) (*FileNode, error) {
 
 // Retrieve a directory node from either the cache or the FileSystem
 func (c *Cache) GetDirectoryNode(nodeId BlockNode) (*DirectoryNode, error) {
-	entry, ok := c.EntryMap[nodeId]
+	entry, ok := c.lookup(nodeId)
 	var dirNode *DirectoryNode
 	if !ok {
 		c.Fs.deliverMessage("Put dir in cache")
-		rawData := c.Fs.BlockHandler.GetRawBlock(nodeId)
-		dn := getDirectoryNode(rawData)
+		rawData, err := c.Fs.BlockHandler.GetRawBlock(c.Fs.Context, nodeId)
+		if err != nil {
+			return nil, err
+		}
+		dn, err := getDirectoryNode(nodeId, rawData)
+		if err != nil {
+			return nil, err
+		}
 		newEntry := CacheEntry{nodeId, false, NONE, dn}
 		c.rwmutex.Lock()
 		c.EntryMap[nodeId] = &newEntry
@@ -170,14 +264,18 @@ func (c *Cache) GetDirectoryNode(nodeId BlockNode) (*DirectoryNode, error) {
 		return dn, nil
 	} else {
 		c.Fs.deliverMessage("Serve dir from cache")
-		dirNode = entry.entry.(*DirectoryNode)
-		return dirNode, nil
+		if entry.action != DELETE {
+			dirNode = entry.entry.(*DirectoryNode)
+			return dirNode, nil
+		} else {
+			return nil, errors.New("No directory found, was deleted in cache")
+		}
 	}
 }
 
 func (c *Cache) SaveSearchIndex(searchIndex *SearchIndex) error {
-	entry, ok := c.EntryMap[searchIndex.Node]
 	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[searchIndex.Node]
 	if !ok {
 		newEntry := CacheEntry{searchIndex.Node, true, UPDATE, searchIndex}
 		c.EntryMap[searchIndex.Node] = &newEntry
@@ -187,14 +285,15 @@ func (c *Cache) SaveSearchIndex(searchIndex *SearchIndex) error {
 		entry.entry = searchIndex
 		c.EntryMap[searchIndex.Node] = entry
 	}
-	c.pushEntry(searchIndex.Node)
 	c.rwmutex.Unlock()
+	c.Fs.Collector.shade(searchIndex.Node)
+	c.pushEntry(searchIndex.Node)
 	return nil
 }
 
 func (c *Cache) SaveDirectoryNode(dirNode *DirectoryNode) error {
-	entry, ok := c.EntryMap[dirNode.Node]
 	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[dirNode.Node]
 	if !ok {
 		newEntry := CacheEntry{dirNode.Node, true, UPDATE, dirNode}
 		c.EntryMap[dirNode.Node] = &newEntry
@@ -204,14 +303,15 @@ func (c *Cache) SaveDirectoryNode(dirNode *DirectoryNode) error {
 		entry.entry = dirNode
 		c.EntryMap[dirNode.Node] = entry
 	}
-	c.pushEntry(dirNode.Node)
 	c.rwmutex.Unlock()
+	c.Fs.Collector.shade(dirNode.Node)
+	c.pushEntry(dirNode.Node)
 	return nil
 }
 
 func (c *Cache) DeleteFileNode(fileNode *FileNode) {
-	entry, ok := c.EntryMap[fileNode.Node]
 	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[fileNode.Node]
 
 	if !ok {
 		newEntry := CacheEntry{fileNode.Node, true, DELETE, fileNode}
@@ -222,13 +322,30 @@ func (c *Cache) DeleteFileNode(fileNode *FileNode) {
 		entry.entry = fileNode
 		c.EntryMap[fileNode.Node] = entry
 	}
+	c.rwmutex.Unlock()
 	c.pushEntry(fileNode.Node)
+}
+
+func (c *Cache) DeleteDirectoryNode(dirNode *DirectoryNode) {
+	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[dirNode.Node]
+
+	if !ok {
+		newEntry := CacheEntry{dirNode.Node, true, DELETE, dirNode}
+		c.EntryMap[dirNode.Node] = &newEntry
+	} else {
+		entry.dirty = true
+		entry.action = DELETE
+		entry.entry = dirNode
+		c.EntryMap[dirNode.Node] = entry
+	}
 	c.rwmutex.Unlock()
+	c.pushEntry(dirNode.Node)
 }
 
 func (c *Cache) SaveSearchTree(searchTree *SearchTree) error {
-	entry, ok := c.EntryMap[searchTree.Node]
 	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[searchTree.Node]
 	if !ok {
 		newEntry := CacheEntry{searchTree.Node, true, UPDATE, searchTree}
 		c.EntryMap[searchTree.Node] = &newEntry
@@ -238,14 +355,14 @@ func (c *Cache) SaveSearchTree(searchTree *SearchTree) error {
 		entry.entry = searchTree
 		c.EntryMap[searchTree.Node] = entry
 	}
-	c.pushEntry(searchTree.Node)
 	c.rwmutex.Unlock()
+	c.pushEntry(searchTree.Node)
 	return nil
 }
 
 func (c *Cache) SaveFileNode(fileNode *FileNode) error {
-	entry, ok := c.EntryMap[fileNode.Node]
 	c.rwmutex.Lock()
+	entry, ok := c.EntryMap[fileNode.Node]
 	if !ok {
 		newEntry := CacheEntry{fileNode.Node, true, UPDATE, fileNode}
 		c.EntryMap[fileNode.Node] = &newEntry
@@ -255,7 +372,8 @@ func (c *Cache) SaveFileNode(fileNode *FileNode) error {
 		entry.entry = fileNode
 		c.EntryMap[fileNode.Node] = entry
 	}
-	c.pushEntry(fileNode.Node)
 	c.rwmutex.Unlock()
+	c.Fs.Collector.shade(fileNode.Node)
+	c.pushEntry(fileNode.Node)
 	return nil
 }
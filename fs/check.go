@@ -0,0 +1,263 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// The kinds of problem found by Check
+type ProblemType int
+
+const (
+	ORPHAN       ProblemType = iota // a block that cannot be reached from the SuperBlockNode
+	DANGLING                        // a reference to a block that does not exist
+	UNREADABLE                      // a block that exists but could not be read or does not hold what it should
+	SIZEMISMATCH                    // a file whose FileStats.Size is not the size of its data
+	CORRUPT                         // a block whose contents are damaged (see ErrCorruptBlock)
+)
+
+var problemTypeNames = []string{"orphan", "dangling", "unreadable", "size mismatch", "corrupt"}
+
+func (t ProblemType) String() string {
+	if t < 0 || int(t) >= len(problemTypeNames) {
+		return fmt.Sprintf("problem%d", int(t))
+	}
+	return problemTypeNames[t]
+}
+
+// A Problem found by Check. Path is the file or directory it was found in (empty for orphans).
+type Problem struct {
+	Type    ProblemType
+	Node    BlockNode
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if len(p.Path) == 0 {
+		return fmt.Sprintf("%v %v %d: %s", p.Type, p.Node.Type, p.Node.Id, p.Message)
+	}
+	return fmt.Sprintf("%v %v %d in %s: %s", p.Type, p.Node.Type, p.Node.Id, p.Path, p.Message)
+}
+
+// The result of a Check
+type CheckReport struct {
+	// The number of blocks reachable from the SuperBlockNode
+	Reachable int
+	// Orphans can only be found if the BlockHandler is a BlockLister
+	OrphansChecked bool
+	Problems       []Problem
+	// The number of orphaned blocks freed by a repair
+	Freed int
+}
+
+// Walk the filesystem from the SuperBlockNode through every directory, file, version and the
+// search index, reporting unreachable blocks, references to blocks that do not exist and files
+// whose size does not match their data. With repair set orphaned blocks are freed.
+//
+// Pending changes are written from the cache first. Check should be run while nothing else is
+// using the filesystem. The blocks already written by a File opened with Create are not part of
+// the file until it is closed, and are not reported as orphans.
+func (rfs *RootFileSystem) Check(repair bool) (*CheckReport, error) {
+	rfs.lock.Lock()
+	defer rfs.lock.Unlock()
+	err := rfs.Sync()
+	if err != nil {
+		return nil, err
+	}
+	c := checker{rfs: rfs, report: &CheckReport{}, reachable: make(map[int]bool)}
+	if !c.walk() {
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c.report, nil
+	}
+
+	lister, ok := rfs.BlockHandler.(BlockLister)
+	if !ok {
+		return c.report, nil
+	}
+	blocks, err := lister.ListBlocks(rfs.Context)
+	if err == ErrNotSupported {
+		return c.report, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.report.OrphansChecked = true
+	orphans := make([]BlockNode, 0)
+	for _, node := range blocks {
+		if !c.reachable[node.Id] && !rfs.Collector.isHeld(node) {
+			c.problem(ORPHAN, node, "", "Not reachable from the super block")
+			orphans = append(orphans, node)
+		}
+	}
+	if repair && len(orphans) > 0 {
+		err = rfs.BlockHandler.FreeBlocks(rfs.Context, orphans)
+		if err != nil {
+			return c.report, err
+		}
+		rfs.ChangeCache.forget(orphans)
+		c.report.Freed = len(orphans)
+		rfs.deliverMessage(fmt.Sprintf("Check freed %d orphaned blocks", len(orphans)))
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	rfs       *RootFileSystem
+	report    *CheckReport
+	reachable map[int]bool
+	// Set if the check had to stop, e.g. because the context was cancelled
+	err error
+}
+
+// Check everything reachable from the SuperBlockNode, returning false if the walk couldn't be
+// completed
+func (c *checker) walk() bool {
+	raw, ok := c.read(SuperBlock, "/")
+	if !ok {
+		return false
+	}
+	sb, err := getSuperBlockNode(SuperBlock, raw)
+	if err != nil {
+		c.decodeProblem(SuperBlock, "/", err)
+		return false
+	}
+	c.checkDirectory(sb.RootDirectory, "/")
+	c.checkSearchIndex(sb.SearchIndexNode)
+	if c.err != nil {
+		return false
+	}
+	c.report.Reachable = len(c.reachable)
+	return true
+}
+
+func (c *checker) problem(problemType ProblemType, node BlockNode, path string, message string) {
+	c.report.Problems = append(c.report.Problems, Problem{problemType, node, path, message})
+}
+
+// Mark the node as reachable and read it, recording a problem if it cannot be read
+func (c *checker) read(node BlockNode, path string) ([]byte, bool) {
+	if c.err != nil {
+		return nil, false
+	}
+	c.reachable[node.Id] = true
+	raw, err := c.rfs.BlockHandler.GetRawBlock(c.rfs.Context, node)
+	if err == nil {
+		return raw, true
+	}
+	if c.rfs.Context.Err() != nil {
+		c.err = c.rfs.Context.Err()
+	} else if err == ErrBlockNotFound {
+		c.problem(DANGLING, node, path, "Block does not exist")
+	} else {
+		c.decodeProblem(node, path, err)
+	}
+	return nil, false
+}
+
+// Record a block that could be read but not used, which is corruption if it failed verification
+// or couldn't be decoded
+func (c *checker) decodeProblem(node BlockNode, path string, err error) {
+	var corrupt *ErrCorruptBlock
+	if errors.As(err, &corrupt) {
+		c.problem(CORRUPT, node, path, corrupt.Reason)
+	} else {
+		c.problem(UNREADABLE, node, path, err.Error())
+	}
+}
+
+func (c *checker) checkDirectory(node BlockNode, dirPath string) {
+	// A large directory can continue in further blocks
+	for node.Type == DIRECTORY && !c.reachable[node.Id] {
+		raw, ok := c.read(node, dirPath)
+		if !ok {
+			return
+		}
+		dn, err := getDirectoryNode(node, raw)
+		if err != nil {
+			c.decodeProblem(node, dirPath, err)
+			return
+		}
+		if dn.Node != node {
+			c.problem(UNREADABLE, node, dirPath, "Block does not hold this directory")
+			return
+		}
+		for name, folder := range dn.Folders {
+			c.checkDirectory(folder, path.Join(dirPath, name))
+		}
+		for name, file := range dn.Files {
+			c.checkFile(file, path.Join(dirPath, name))
+		}
+		node = dn.Continuation
+	}
+}
+
+func (c *checker) checkFile(node BlockNode, filePath string) {
+	raw, ok := c.read(node, filePath)
+	if !ok {
+		return
+	}
+	fn, err := getFileNode(node, raw)
+	if err != nil {
+		c.decodeProblem(node, filePath, err)
+		return
+	}
+	if fn.Node != node {
+		c.problem(UNREADABLE, node, filePath, "Block does not hold this file")
+		return
+	}
+	sizes := make(map[string]int)
+	for key, data := range fn.DataBlocks {
+		if raw, ok := c.read(data, filePath); ok {
+			sizes[key] = len(raw)
+		}
+	}
+	for tag, routeNode := range fn.AlternateRoutes {
+		raw, ok := c.read(routeNode, filePath)
+		if !ok {
+			continue
+		}
+		route, err := getRoute(routeNode, raw)
+		if err != nil {
+			c.decodeProblem(routeNode, filePath, err)
+			continue
+		}
+		for _, name := range route.DataBlockNames {
+			if _, ok := fn.DataBlocks[name]; !ok {
+				c.problem(DANGLING, node, filePath, fmt.Sprintf("Version %s refers to missing data block %s", tag, name))
+			}
+		}
+	}
+	size := 0
+	complete := true
+	for _, name := range fn.DefaultRoute.DataBlockNames {
+		blockSize, ok := sizes[name]
+		if !ok {
+			complete = false
+			if _, known := fn.DataBlocks[name]; !known {
+				c.problem(DANGLING, node, filePath, fmt.Sprintf("Refers to missing data block %s", name))
+			}
+		}
+		size += blockSize
+	}
+	if complete && size != fn.Stats.Size {
+		c.problem(SIZEMISMATCH, node, filePath, fmt.Sprintf("Size is %d but the data is %d bytes", fn.Stats.Size, size))
+	}
+}
+
+func (c *checker) checkSearchIndex(node BlockNode) {
+	raw, ok := c.read(node, "")
+	if !ok {
+		return
+	}
+	si, err := getSearchIndex(node, raw)
+	if err != nil {
+		c.decodeProblem(node, "", err)
+		return
+	}
+	for _, tree := range si.Terms {
+		c.read(tree, "")
+	}
+}
@@ -0,0 +1,193 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/petar/GoLLRB/llrb"
+)
+
+// A Codec turns the metadata structures of a filesystem (the SuperBlockNode, DirectoryNodes,
+// FileNodes, DataRoutes and the search index) into the bytes stored in a block and back again.
+// Data blocks hold the contents of files as they are and are never encoded.
+//
+// The codec used is chosen per filesystem by setting RootFileSystem.Codec before calling Format.
+// Its name is written in a header at the start of every metadata block so a block can always be
+// decoded, whichever codec wrote it, as long as that codec is registered.
+type Codec interface {
+	// The name recorded in the header of every block written with this codec
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The codecs provided by pmfs. Gob is the default and is what blocks written before codecs
+// existed were encoded with. JSON is easy to inspect, but numbers stored in Attributes are read
+// back as float64. Binary is the most compact.
+var (
+	GobCodec    Codec = gobCodec{}
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecs = map[string]Codec{}
+var codecLock sync.RWMutex
+
+func init() {
+	RegisterCodec(GobCodec)
+	RegisterCodec(JSONCodec)
+	RegisterCodec(BinaryCodec)
+}
+
+// Make a codec available for decoding blocks (usually called from an init function)
+func RegisterCodec(codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// The registered codec with the given name
+func LookupCodec(name string) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(v)
+	return buffer.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Every metadata block starts with a header of blockMagic, the header version and the name of
+// the codec (a length byte followed by the name). Blocks written before there was a header are
+// gob encoded, and a gob stream can never start with blockMagic.
+const blockMagic = 0xB5
+
+// The version of the block header, blocks with a later version can't be read
+const blockHeaderVersion = 1
+
+// A search tree is stored as its node followed by its entries in order
+type searchTreeBlock struct {
+	Node    BlockNode
+	Entries []SearchEntry
+}
+
+// Encode a metadata structure with the codec of this filesystem, adding the block header
+func (rfs *RootFileSystem) encodeBlock(v interface{}) ([]byte, error) {
+	codec := rfs.Codec
+	if codec == nil {
+		codec = GobCodec
+	}
+	if st, ok := v.(*SearchTree); ok {
+		block := searchTreeBlock{Node: st.Node, Entries: make([]SearchEntry, 0, st.Tree.Len())}
+		if st.Tree.Len() > 0 {
+			st.Tree.AscendGreaterOrEqual(st.Tree.Min(), func(i llrb.Item) bool {
+				block.Entries = append(block.Entries, i.(SearchEntry))
+				return true
+			})
+		}
+		v = block
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	name := codec.Name()
+	if len(name) > 255 {
+		return nil, fmt.Errorf("Codec name '%s' is too long", name)
+	}
+	data := make([]byte, 0, 3+len(name)+len(body))
+	data = append(data, blockMagic, blockHeaderVersion, byte(len(name)))
+	data = append(data, name...)
+	return append(data, body...), nil
+}
+
+// Read the header of a metadata block, returning the codec named in it and the encoded body.
+// The codec is nil for a block written before there was a header.
+func splitBlockHeader(node BlockNode, contents []byte) (Codec, []byte, error) {
+	if len(contents) == 0 {
+		return nil, nil, &ErrCorruptBlock{node, "Block is empty"}
+	}
+	if contents[0] != blockMagic {
+		return nil, contents, nil
+	}
+	if len(contents) < 3 || len(contents) < 3+int(contents[2]) {
+		return nil, nil, &ErrCorruptBlock{node, "Block header is truncated"}
+	}
+	if contents[1] > blockHeaderVersion {
+		return nil, nil, fmt.Errorf("%w: %v block %d has header version %d", ErrIncompatibleVersion, node.Type, node.Id, contents[1])
+	}
+	name := string(contents[3 : 3+int(contents[2])])
+	codec, ok := LookupCodec(name)
+	if !ok {
+		return nil, nil, &ErrCorruptBlock{node, fmt.Sprintf("Codec '%s' is not registered", name)}
+	}
+	return codec, contents[3+int(contents[2]):], nil
+}
+
+// Decode a metadata block into v
+func decodeBlock(node BlockNode, contents []byte, v interface{}) error {
+	codec, body, err := splitBlockHeader(node, contents)
+	if err != nil {
+		return err
+	}
+	if codec == nil {
+		codec = GobCodec
+	}
+	err = codec.Unmarshal(body, v)
+	if err != nil {
+		return &ErrCorruptBlock{node, err.Error()}
+	}
+	return nil
+}
+
+// Search trees written before there was a header are a gob stream of the node followed by each
+// entry in turn
+func decodeLegacySearchTree(node BlockNode, contents []byte) (*SearchTree, error) {
+	dec := gob.NewDecoder(bytes.NewReader(contents))
+	ret := &SearchTree{Tree: llrb.New()}
+	err := dec.Decode(&ret.Node)
+	if err != nil {
+		return nil, &ErrCorruptBlock{node, err.Error()}
+	}
+	for {
+		var element SearchEntry
+		err = dec.Decode(&element)
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, &ErrCorruptBlock{node, err.Error()}
+		}
+		ret.Tree.ReplaceOrInsert(element)
+	}
+}
@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How CopyFileOrFolder copies files
+type CopyOptions struct {
+	// Copy every version of each file, rather than just the latest as the first version of the copy
+	History bool
+	// The filesystem to copy into, the one being copied from if nil
+	Target *RootFileSystem
+}
+
+// Copy a file, or a directory and everything below it, to a target path that doesn't exist yet.
+// The directories above the target are created if they need to be.
+//
+// Within a filesystem each data block is copied with the BlockHandler's CopyBlock if it is a
+// BlockCopier (so that a handler such as dedupfs can share the contents), and otherwise read and
+// saved again. Files never share data blocks, as freeing the blocks of one would lose the data of
+// the other, so only a BlockCopier saves space. Into another filesystem the blocks are read and
+// saved one at a time, a block larger than the target's block size split into several. The source
+// is not locked when copying into another filesystem, so a file that is changed while it is copied
+// may fail to copy.
+//
+// A file that fails to copy is left out with any blocks copied for it freed. A directory that
+// fails part way through keeps what was copied before the failure.
+func (rfs *RootFileSystem) CopyFileOrFolder(source string, target string, opts CopyOptions) (err error) {
+	to := opts.Target
+	if to == nil {
+		to = rfs
+	}
+	defer to.beginUpdate()(&err)
+	if source == "/" {
+		return errors.New("Cannot copy the root directory")
+	}
+	if to == rfs && strings.HasPrefix(target, source+"/") {
+		return errors.New("Cannot copy a directory into itself")
+	}
+	parts := strings.Split(source, "/")
+	lastName := parts[len(parts)-1]
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return err
+	}
+	sourceNode, err := dn.findParentDirectoryNode(parts[1:], rfs, false)
+	if err != nil {
+		return err
+	}
+	fileNode, isFile := sourceNode.Files[lastName]
+	folderNode, isFolder := sourceNode.Folders[lastName]
+	if !isFile && !isFolder {
+		return errors.New("Source not found")
+	}
+
+	targPaths := strings.Split(target, "/")
+	lastTargName := targPaths[len(targPaths)-1]
+	if lastTargName == "" {
+		return fmt.Errorf("Invalid path %s", target)
+	}
+	dn, err = to.ChangeCache.GetDirectoryNode(to.SuperBlock.RootDirectory)
+	if err != nil {
+		return err
+	}
+	targetNode, err := dn.findParentDirectoryNode(targPaths[1:], to, true)
+	if err != nil {
+		return fmt.Errorf("Could not create or find target: %v", err)
+	}
+	_, fileExists := targetNode.Files[lastTargName]
+	_, folderExists := targetNode.Folders[lastTargName]
+	if fileExists || folderExists {
+		return errors.New("Target already exists")
+	}
+	c := copier{from: rfs, to: to, history: opts.History}
+	if isFile {
+		return c.copyFile(fileNode, targetNode, lastTargName, target)
+	}
+	return c.copyFolder(folderNode, targetNode, lastTargName, target)
+}
+
+type copier struct {
+	from    *RootFileSystem
+	to      *RootFileSystem
+	history bool
+}
+
+// Copy a directory (and its continuations) into a new directory of the parent
+func (c *copier) copyFolder(node BlockNode, parent *DirectoryNode, name string, path string) error {
+	source, err := c.from.ChangeCache.GetDirectoryNode(node)
+	if err != nil {
+		return err
+	}
+	dn, err := parent.createSubDirectory(name, c.to)
+	if err != nil {
+		return err
+	}
+	dn.Stats.Owner, dn.Stats.Group, dn.Stats.Permissions = source.Stats.Owner, source.Stats.Group, source.Stats.Permissions
+	for k, v := range source.Attributes {
+		dn.Attributes[k] = v
+	}
+	c.to.ChangeCache.SaveDirectoryNode(dn)
+
+	folders := make(map[string]BlockNode)
+	files := make(map[string]BlockNode)
+	for {
+		for k, v := range source.Folders {
+			folders[k] = v
+		}
+		for k, v := range source.Files {
+			files[k] = v
+		}
+		if source.Continuation.Type != DIRECTORY {
+			break
+		}
+		if source, err = c.from.ChangeCache.GetDirectoryNode(source.Continuation); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedNames(folders) {
+		if err = c.copyFolder(folders[k], dn, k, path+"/"+k); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedNames(files) {
+		if err = c.copyFile(files[k], dn, k, path+"/"+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedNames(nodes map[string]BlockNode) []string {
+	names := getKeys(nodes)
+	sort.Strings(names)
+	return names
+}
+
+// Copy a file into a new file of the parent, adding it to the search index
+func (c *copier) copyFile(node BlockNode, parent *DirectoryNode, name string, path string) error {
+	source, err := c.from.ChangeCache.GetFileNode(node)
+	if err != nil {
+		return err
+	}
+	nodeId, err := c.to.getFreeBlockNode(FILE)
+	if err != nil {
+		return err
+	}
+	fn := &FileNode{Node: nodeId, Type: source.Type, DataBlocks: make(map[string]BlockNode), AlternateRoutes: make(map[string]BlockNode), Attributes: make(map[string]interface{}), DataBlockSizes: make(map[string]int)}
+	fn.Stats.setNow()
+	fn.Stats.Owner, fn.Stats.Group, fn.Stats.Permissions = source.Stats.Owner, source.Stats.Group, source.Stats.Permissions
+	fn.Stats.Size = source.Stats.Size
+	for k, v := range source.Attributes {
+		fn.Attributes[k] = v
+	}
+
+	if err = c.copyBlocks(source, fn); err != nil {
+		c.to.BlockHandler.FreeBlocks(c.to.Context, append(fn.getBlocksToFree(), nodeId))
+		return err
+	}
+	if c.history {
+		fn.Version, fn.LatestTag = source.Version, source.LatestTag
+		c.to.ChangeCache.SaveFileNode(fn)
+	} else if err = c.to.saveVersion(fn); err != nil {
+		c.to.BlockHandler.FreeBlocks(c.to.Context, append(fn.getBlocksToFree(), nodeId))
+		return err
+	}
+	parent.Files[name] = nodeId
+	c.to.ChangeCache.SaveDirectoryNode(parent)
+	return c.to.addWordIndex(path, fn)
+}
+
+// Copy the data blocks of the latest version of the source, or of every version along with their
+// routes. The routes name the blocks each source block was split into.
+func (c *copier) copyBlocks(source *FileNode, fn *FileNode) error {
+	keys := source.DefaultRoute.DataBlockNames
+	if c.history {
+		keys = getKeys(source.DataBlocks)
+		sort.Strings(keys)
+	}
+	last := lastKey(source.DataBlocks)
+	split := make(map[string][]string)
+	for _, key := range keys {
+		added, err := c.copyBlock(source, fn, key, &last)
+		if err != nil {
+			return err
+		}
+		split[key] = added
+	}
+	fn.DefaultRoute.DataBlockNames = splitNames(source.DefaultRoute.DataBlockNames, split)
+	if !c.history {
+		return nil
+	}
+	for tag, routeNode := range source.AlternateRoutes {
+		route, err := c.from.getRoute(routeNode)
+		if err != nil {
+			return err
+		}
+		route.DataBlockNames = splitNames(route.DataBlockNames, split)
+		node, err := c.to.getFreeBlockNode(ROUTE)
+		if err != nil {
+			return err
+		}
+		fn.AlternateRoutes[tag] = node
+		raw, err := c.to.encodeBlock(*route)
+		if err == nil {
+			_, err = c.to.BlockHandler.SaveRawBlock(c.to.Context, node, raw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the data block for the key into new blocks of the file, returning their keys. That is just
+// the key unless the block is larger than the target's block size, when the rest of it goes in
+// blocks with the keys after last.
+func (c *copier) copyBlock(source *FileNode, fn *FileNode, key string, last *int) ([]string, error) {
+	sourceNode, ok := source.DataBlocks[key]
+	if !ok {
+		return nil, fmt.Errorf("Data block %s missing from file", key)
+	}
+	node, err := c.to.getFreeDataBlockNode(fn.Node, key)
+	if err != nil {
+		return nil, err
+	}
+	fn.DataBlocks[key] = node
+	if copier, ok := c.to.BlockHandler.(BlockCopier); ok && c.from == c.to {
+		err = copier.CopyBlock(c.to.Context, sourceNode, node)
+		if err == nil {
+			if size, ok := source.DataBlockSizes[key]; ok {
+				fn.DataBlockSizes[key] = size
+			}
+			return []string{key}, nil
+		} else if !errors.Is(err, ErrNotSupported) {
+			return nil, err
+		}
+	}
+	data, err := c.from.BlockHandler.GetRawBlock(c.from.Context, sourceNode)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := c.to.SuperBlock.BlockSize
+	keys := []string{key}
+	for i := blockSize; i < len(data); i += blockSize {
+		*last++
+		keys = append(keys, getKeyName(*last))
+	}
+	for i, name := range keys {
+		chunk := data[i*blockSize:]
+		if len(chunk) > blockSize {
+			chunk = chunk[:blockSize]
+		}
+		if i > 0 {
+			if node, err = c.to.getFreeDataBlockNode(fn.Node, name); err != nil {
+				return nil, err
+			}
+			fn.DataBlocks[name] = node
+		}
+		if _, err = c.to.BlockHandler.SaveRawBlock(c.to.Context, node, chunk); err != nil {
+			return nil, err
+		}
+		fn.DataBlockSizes[name] = len(chunk)
+	}
+	return keys, nil
+}
+
+// The names with each replaced by the names of the blocks it was split into
+func splitNames(names []string, split map[string][]string) []string {
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		result = append(result, split[name]...)
+	}
+	return result
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 )
 
+var errFolderNotFound = errors.New("Folder not found")
+
 // Finds the parent directory, the one above this one
 func (dn *DirectoryNode) findParentDirectoryNode(paths []string, rfs *RootFileSystem, createDirectoryNode bool) (*DirectoryNode, error) {
 	if len(paths) < 2 {
@@ -13,31 +15,33 @@ func (dn *DirectoryNode) findParentDirectoryNode(paths []string, rfs *RootFileSy
 	var dirNode *DirectoryNode
 	if !ok {
 		if createDirectoryNode {
-			dirNode = dn.createSubDirectory(paths[0], rfs)
-
+			var err error
+			dirNode, err = dn.createSubDirectory(paths[0], rfs)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			return nil, errors.New("Parent Folder not found")
 		}
 	} else {
-
-		dirNode, _ = rfs.ChangeCache.GetDirectoryNode(nodeId)
-	}
-	if len(paths) == 2 {
-		return dirNode, nil
-	} else {
-		return dirNode.findDirectoryNode(paths[1:], rfs)
+		var err error
+		dirNode, err = rfs.ChangeCache.GetDirectoryNode(nodeId)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return dirNode.findParentDirectoryNode(paths[1:], rfs, createDirectoryNode)
 }
 
 func (dn *DirectoryNode) findDirectoryNode(paths []string, rfs *RootFileSystem) (*DirectoryNode, error) {
 	nodeId, ok := dn.Folders[paths[0]]
 	var dirNode *DirectoryNode
 	if !ok {
-		return nil, errors.New("Folder not found")
+		return nil, errFolderNotFound
 	} else {
 		var err error
 		dirNode, err = rfs.ChangeCache.GetDirectoryNode(nodeId)
-		if len(paths) == 1 {
+		if len(paths) == 1 || err != nil {
 			return dirNode, err
 		} else {
 			return dirNode.findDirectoryNode(paths[1:], rfs)
@@ -45,24 +49,30 @@ func (dn *DirectoryNode) findDirectoryNode(paths []string, rfs *RootFileSystem)
 	}
 }
 
-func (dn *DirectoryNode) createSubDirectory(name string, rfs *RootFileSystem) *DirectoryNode {
-	newDnId := rfs.BlockHandler.GetFreeBlockNode(DIRECTORY)
+func (dn *DirectoryNode) createSubDirectory(name string, rfs *RootFileSystem) (*DirectoryNode, error) {
+	newDnId, err := rfs.getFreeBlockNode(DIRECTORY)
+	if err != nil {
+		return nil, err
+	}
 	newDn := &DirectoryNode{Node: newDnId, Folders: make(map[string]BlockNode), Files: make(map[string]BlockNode), Continuation: NilBlock, Attributes: make(map[string]interface{})}
 	newDn.Stats.setNow()
 	rfs.ChangeCache.SaveDirectoryNode(newDn)
 	dn.Folders[name] = newDnId
 	rfs.ChangeCache.SaveDirectoryNode(dn)
-	return newDn
+	return newDn, nil
 }
 
-func (dn *DirectoryNode) createNewFile(name string, rfs *RootFileSystem) *FileNode {
-	nodeId := rfs.BlockHandler.GetFreeBlockNode(FILE)
-	fileNode := &FileNode{Node: nodeId, DataBlocks: make(map[string]BlockNode, 0), AlternateRoutes: make(map[string]BlockNode, 0), Version: 0, Attributes: make(map[string]interface{})}
+func (dn *DirectoryNode) createNewFile(name string, rfs *RootFileSystem) (*FileNode, error) {
+	nodeId, err := rfs.getFreeBlockNode(FILE)
+	if err != nil {
+		return nil, err
+	}
+	fileNode := &FileNode{Node: nodeId, DataBlocks: make(map[string]BlockNode, 0), AlternateRoutes: make(map[string]BlockNode, 0), Version: 0, Attributes: make(map[string]interface{}), DataBlockSizes: make(map[string]int)}
 	fileNode.Stats.setNow()
 	rfs.ChangeCache.SaveFileNode(fileNode)
 	dn.Files[name] = nodeId
 	rfs.ChangeCache.SaveDirectoryNode(dn)
-	return fileNode
+	return fileNode, nil
 }
 
 // Returns the BlockNode and whether it is a directory or not
@@ -72,7 +82,7 @@ func (dn *DirectoryNode) findNode(paths []string, rfs *RootFileSystem, createFil
 		nodeId, ok := dn.Files[paths[0]]
 		if !ok {
 			if createFileNode {
-				return dn.createNewFile(paths[0], rfs), nil
+				return dn.createNewFile(paths[0], rfs)
 			} else {
 				return nil, errors.New("File not found")
 			}
@@ -86,12 +96,20 @@ func (dn *DirectoryNode) findNode(paths []string, rfs *RootFileSystem, createFil
 		var newDn *DirectoryNode
 		if !ok {
 			if createFileNode {
-				newDn = dn.createSubDirectory(paths[0], rfs)
+				var err error
+				newDn, err = dn.createSubDirectory(paths[0], rfs)
+				if err != nil {
+					return nil, err
+				}
 			} else {
 				return nil, errors.New("Directory not found")
 			}
 		} else {
-			newDn, _ = rfs.ChangeCache.GetDirectoryNode(newDnId)
+			var err error
+			newDn, err = rfs.ChangeCache.GetDirectoryNode(newDnId)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		return newDn.findNode(paths[1:], rfs, createFileNode)
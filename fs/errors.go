@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned by Mount when the BlockHandler does not contain a formatted filesystem
+var ErrNotFormatted = errors.New("Filesystem is not formatted")
+
+// Returned by Mount when the filesystem was written by an incompatible version of pmfs
+var ErrIncompatibleVersion = errors.New("Filesystem version is not supported")
+
+// Returned when the BlockHandler has no free blocks left
+var ErrNoSpace = errors.New("No space left in filesystem")
+
+// Returned by a BlockHandlerV2 when asked for a block that has not been saved
+var ErrBlockNotFound = errors.New("Block not found")
+
+// Returned when the BlockHandler does not support an optional operation
+var ErrNotSupported = errors.New("Not supported by the block handler")
+
+// Returned when a File is used after it has been closed
+var ErrFileClosed = errors.New("File already closed")
+
+// Returned when a File opened with Open is written, or one opened with Create is read
+var ErrBadFileMode = errors.New("File not open for that operation")
+
+// Returned when the contents of a block can't be decoded or are not what was saved
+type ErrCorruptBlock struct {
+	Node   BlockNode
+	Reason string
+}
+
+func (e *ErrCorruptBlock) Error() string {
+	return fmt.Sprintf("Corrupt %v block %d: %s", e.Node.Type, e.Node.Id, e.Reason)
+}
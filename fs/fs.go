@@ -1,20 +1,44 @@
 package fs
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 )
 
 // Initialize a filesystem - storing the handler and then calling the Init method of the
-// file system handler
-func (rfs *RootFileSystem) Init(handler BlockHandler, configuration string) {
+// file system handler. If handler is nil one is created from the scheme at the start of the
+// configuration (see RegisterBlockHandler) and the rest of the configuration is passed to it.
+func (rfs *RootFileSystem) Init(handler BlockHandler, configuration string) error {
+	if handler == nil {
+		return rfs.InitV2(nil, configuration)
+	}
+	return rfs.InitV2(AdaptBlockHandler(handler), configuration)
+}
+
+// Initialize a filesystem with a BlockHandlerV2, as for Init
+func (rfs *RootFileSystem) InitV2(handler BlockHandlerV2, configuration string) error {
+	if handler == nil {
+		var err error
+		handler, configuration, err = NewBlockHandler(configuration)
+		if err != nil {
+			return err
+		}
+	}
+	if rfs.Context == nil {
+		rfs.Context = context.Background()
+	}
 	rfs.BlockHandler = handler
 	rfs.Configuration = configuration
-	rfs.BlockHandler.Init(configuration)
+	err := rfs.BlockHandler.Init(rfs.Context, configuration)
+	if err != nil {
+		return err
+	}
 	rfs.Notification = make(chan string)
 	rfs.ChangeCache.Init(rfs)
+	rfs.Collector.Init(rfs)
+	return nil
 }
 
 // Dump to std out information about this filesystem (system specific)
@@ -23,31 +47,148 @@ func (rfs *RootFileSystem) Dump() {
 }
 
 // Format (initialize the contents) of this filesystem
-func (rfs *RootFileSystem) Format(bc int, bs int) {
-	rfs.BlockHandler.Format(bc, bs)
+func (rfs *RootFileSystem) Format(bc int, bs int) error {
+	ctx := rfs.Context
+	err := rfs.BlockHandler.Format(ctx, bc, bs)
+	if err != nil {
+		return err
+	}
+	// Anything cached belongs to whatever was there before
+	rfs.ChangeCache.Clear()
+	rfs.Collector.reset()
 	// Write Raw Directory node
 	rdn := DirectoryNode{Folders: make(map[string]BlockNode), Files: make(map[string]BlockNode), Continuation: NilBlock}
 	rdn.Stats.setNow()
-	blockNode := rfs.BlockHandler.GetFreeBlockNode(DIRECTORY)
+	blockNode, err := rfs.BlockHandler.GetFreeBlockNode(ctx, DIRECTORY)
+	if err != nil {
+		return err
+	}
 	rdn.Node = blockNode
-	searchNode := rfs.BlockHandler.GetFreeBlockNode(SEARCHINDEX)
+	searchNode, err := rfs.BlockHandler.GetFreeBlockNode(ctx, SEARCHINDEX)
+	if err != nil {
+		return err
+	}
 	searchIndex := SearchIndex{Node: searchNode, Terms: make(map[string]BlockNode)}
 
-	rfs.BlockHandler.SaveRawBlock(searchNode, rawBlock(searchIndex))
+	raw, err := rfs.encodeBlock(searchIndex)
+	if err != nil {
+		return err
+	}
+	_, err = rfs.BlockHandler.SaveRawBlock(ctx, searchNode, raw)
+	if err != nil {
+		return err
+	}
 
-	Root := rfs.BlockHandler.SaveRawBlock(blockNode, rawBlock(rdn))
-	sb := SuperBlockNode{SuperBlock, bc, bs, Root, searchNode}
+	raw, err = rfs.encodeBlock(rdn)
+	if err != nil {
+		return err
+	}
+	Root, err := rfs.BlockHandler.SaveRawBlock(ctx, blockNode, raw)
+	if err != nil {
+		return err
+	}
+	sb := SuperBlockNode{Node: SuperBlock, Version: FormatVersion, BlockCount: bc, BlockSize: bs, RootDirectory: Root, SearchIndexNode: searchNode}
 
-	rfs.BlockHandler.SaveRawBlock(SuperBlock, rawBlock(sb))
+	raw, err = rfs.encodeBlock(sb)
+	if err != nil {
+		return err
+	}
+	_, err = rfs.BlockHandler.SaveRawBlock(ctx, SuperBlock, raw)
+	if err != nil {
+		return err
+	}
 	rfs.SuperBlock = sb
+	return nil
 }
 
-func (rfs *RootFileSystem) GetFileOrDirectory(path string, createIfNotExist bool) (*FileNode, *DirectoryNode, error) {
-	dn, _ := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+// Mount an existing (previously formatted) filesystem, reading the SuperBlockNode from the
+// BlockHandler rather than creating a new one. Returns ErrNotFormatted if there is no usable
+// SuperBlockNode and ErrIncompatibleVersion if it was written by a later version of pmfs.
+func (rfs *RootFileSystem) Mount() error {
+	raw, err := rfs.BlockHandler.GetRawBlock(rfs.Context, SuperBlock)
+	if err == ErrBlockNotFound || (err == nil && len(raw) == 0) {
+		return ErrNotFormatted
+	} else if err != nil {
+		return err
+	}
+	sb, err := getSuperBlockNode(SuperBlock, raw)
+	if errors.Is(err, ErrIncompatibleVersion) {
+		return err
+	} else if err != nil || sb.Node != SuperBlock || sb.BlockSize <= 0 {
+		return ErrNotFormatted
+	}
+	codec, _, _ := splitBlockHeader(SuperBlock, raw)
+	if codec == nil {
+		codec = GobCodec
+	}
+	if sb.Version > FormatVersion {
+		return fmt.Errorf("%w: found version %d, supported version %d", ErrIncompatibleVersion, sb.Version, FormatVersion)
+	}
+	_, err = rfs.BlockHandler.GetRawBlock(rfs.Context, sb.RootDirectory)
+	if err == ErrBlockNotFound {
+		return fmt.Errorf("%w: root directory missing", ErrNotFormatted)
+	} else if err != nil {
+		return err
+	}
+	rfs.SuperBlock = *sb
+	rfs.Codec = codec
+	// Anything cached belongs to whatever was mounted before
+	rfs.ChangeCache.Clear()
+	rfs.Collector.reset()
+	return nil
+}
+
+// Write any pending changes held in the cache through to the BlockHandler, and have the
+// BlockHandler write out any it is holding back if it is a BlockFlusher
+func (rfs *RootFileSystem) Sync() error {
+	if err := rfs.ChangeCache.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := rfs.BlockHandler.(BlockFlusher); ok {
+		return flusher.Flush(rfs.Context)
+	}
+	return nil
+}
+
+// Start a change to the filesystem, taking the lock and beginning a transaction if the
+// BlockHandler is Transactional. The function returned must be deferred with the error the change
+// returns; it writes the change from the cache and commits it, or rolls it back if there was an
+// error (forgetting what the cache holds, as it may have been part of the change).
+func (rfs *RootFileSystem) beginUpdate() func(err *error) {
+	rfs.lock.Lock()
+	tx, ok := rfs.BlockHandler.(Transactional)
+	if ok = ok && IsTransactional(rfs.BlockHandler); ok {
+		tx.Begin(rfs.Context)
+	}
+	return func(err *error) {
+		defer rfs.lock.Unlock()
+		if !ok {
+			return
+		}
+		if *err == nil {
+			*err = rfs.ChangeCache.Flush()
+		}
+		if *err == nil {
+			if *err = tx.Commit(rfs.Context); *err == nil {
+				return
+			}
+		}
+		tx.Rollback(rfs.Context)
+		rfs.ChangeCache.Clear()
+	}
+}
+
+func (rfs *RootFileSystem) GetFileOrDirectory(path string, createIfNotExist bool) (_ *FileNode, _ *DirectoryNode, err error) {
+	if createIfNotExist {
+		defer rfs.beginUpdate()(&err)
+	}
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var dnReal *DirectoryNode
 	var fnReal *FileNode
-	var err error
 
 	if path == "/" {
 		dnReal = dn
@@ -56,7 +197,7 @@ func (rfs *RootFileSystem) GetFileOrDirectory(path string, createIfNotExist bool
 		dnReal, err = dn.findDirectoryNode(parts[1:], rfs)
 		// And now get the names of things and add them to "entries"
 		// for now, don't do the continuation
-		if err != nil {
+		if err == errFolderNotFound {
 			// Must be a file
 			fnReal, err = dn.findNode(parts[1:], rfs, createIfNotExist)
 		}
@@ -68,10 +209,12 @@ func (rfs *RootFileSystem) GetFileOrDirectory(path string, createIfNotExist bool
 func (rfs *RootFileSystem) ListDirectory(path string) ([]string, error) {
 	// As a test, simply return the names of things at this path. Later on we'll return a structure that defines names, types and stats
 
-	dn, _ := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
 
 	var dnReal *DirectoryNode
-	var err error
 
 	if path == "/" {
 		dnReal = dn
@@ -99,12 +242,19 @@ func (rfs *RootFileSystem) ListDirectory(path string) ([]string, error) {
 }
 
 // Delete the contents (that the fileName points to)
-func (rfs *RootFileSystem) DeleteFile(fileName string) error {
+func (rfs *RootFileSystem) DeleteFile(fileName string) (err error) {
+	defer rfs.beginUpdate()(&err)
 	parts := strings.Split(fileName, "/")
-	dn, _ := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return err
+	}
 	fn, err := dn.findNode(parts[1:], rfs, false)
-	dnReal, err2 := dn.findDirectoryNode(parts[1:len(parts)-1], rfs)
-	if err == nil && err2 == nil {
+	if err != nil {
+		return err
+	}
+	dnReal, err := dn.findParentDirectoryNode(parts[1:], rfs, false)
+	if err == nil {
 		rfs.deliverMessage("Removing blocks")
 		blocks := make([]BlockNode, 0)
 		//blocks = append(blocks, fn.Node)
@@ -115,37 +265,181 @@ func (rfs *RootFileSystem) DeleteFile(fileName string) error {
 			blocks = append(blocks, v)
 		}
 
-		rfs.BlockHandler.FreeBlocks(blocks)
+		err = rfs.BlockHandler.FreeBlocks(rfs.Context, blocks)
+		if err != nil {
+			return err
+		}
 		// Now update the directory node
 		delete(dnReal.Files, parts[len(parts)-1])
 		rfs.ChangeCache.DeleteFileNode(fn)
 		rfs.ChangeCache.SaveDirectoryNode(dnReal)
-		// TODO Also remove from search index
-		return nil
+		if err = rfs.removeEmptyDirectories(dn, parts[1:len(parts)-1]); err != nil {
+			return err
+		}
+		return rfs.searchRemovePaths(func(path string) bool { return path == fileName })
 	}
 	return err
 }
 
+// Remove the directories along the path below dn that are left empty, from the deepest up. The
+// root is never removed.
+func (rfs *RootFileSystem) removeEmptyDirectories(dn *DirectoryNode, names []string) error {
+	dirs := []*DirectoryNode{dn}
+	for _, name := range names {
+		node, ok := dirs[len(dirs)-1].Folders[name]
+		if !ok {
+			return errFolderNotFound
+		}
+		sub, err := rfs.ChangeCache.GetDirectoryNode(node)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, sub)
+	}
+	for i := len(dirs) - 1; i > 0; i-- {
+		if len(dirs[i].Files) > 0 || len(dirs[i].Folders) > 0 || dirs[i].Continuation.Type == DIRECTORY {
+			break
+		}
+		rfs.ChangeCache.DeleteDirectoryNode(dirs[i])
+		delete(dirs[i-1].Folders, names[i-1])
+		rfs.ChangeCache.SaveDirectoryNode(dirs[i-1])
+	}
+	return nil
+}
+
+// Create a directory, along with any directories above it that don't exist. It is not an error
+// for the directory to exist already.
+func (rfs *RootFileSystem) MakeDirectory(path string) (err error) {
+	defer rfs.beginUpdate()(&err)
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil || path == "/" {
+		return err
+	}
+	for _, name := range strings.Split(path, "/")[1:] {
+		if name == "" {
+			return fmt.Errorf("Invalid path %s", path)
+		}
+		if _, ok := dn.Files[name]; ok {
+			return fmt.Errorf("%s is a file", name)
+		}
+		if node, ok := dn.Folders[name]; ok {
+			dn, err = rfs.ChangeCache.GetDirectoryNode(node)
+		} else {
+			dn, err = dn.createSubDirectory(name, rfs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a directory, which must be empty unless recursive is set. Removing recursively frees the
+// blocks of every directory and file below it (with all of their versions) and removes the files
+// from the search index.
+func (rfs *RootFileSystem) RemoveDirectory(path string, recursive bool) (err error) {
+	defer rfs.beginUpdate()(&err)
+	if path == "/" {
+		return errors.New("Cannot remove the root directory")
+	}
+	parts := strings.Split(path, "/")
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return err
+	}
+	parent, err := dn.findParentDirectoryNode(parts[1:], rfs, false)
+	if err != nil {
+		return err
+	}
+	node, ok := parent.Folders[parts[len(parts)-1]]
+	if !ok {
+		return errFolderNotFound
+	}
+	dn, err = rfs.ChangeCache.GetDirectoryNode(node)
+	if err != nil {
+		return err
+	}
+	if !recursive && (len(dn.Folders) > 0 || len(dn.Files) > 0) {
+		return errors.New("Directory not empty")
+	}
+
+	// Find everything below the directory before changing anything
+	dirs := []*DirectoryNode{dn}
+	files := make([]*FileNode, 0)
+	blocks := make([]BlockNode, 0)
+	for i := 0; i < len(dirs); i++ {
+		for _, folder := range dirs[i].Folders {
+			sub, err := rfs.ChangeCache.GetDirectoryNode(folder)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, sub)
+		}
+		if dirs[i].Continuation.Type == DIRECTORY {
+			sub, err := rfs.ChangeCache.GetDirectoryNode(dirs[i].Continuation)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, sub)
+		}
+		for _, file := range dirs[i].Files {
+			fn, err := rfs.ChangeCache.GetFileNode(file)
+			if err != nil {
+				return err
+			}
+			files = append(files, fn)
+			blocks = append(blocks, fn.getBlocksToFree()...)
+		}
+	}
+
+	rfs.deliverMessage("Removing blocks")
+	if err = rfs.BlockHandler.FreeBlocks(rfs.Context, blocks); err != nil {
+		return err
+	}
+	for _, fn := range files {
+		rfs.ChangeCache.DeleteFileNode(fn)
+	}
+	for _, sub := range dirs {
+		rfs.ChangeCache.DeleteDirectoryNode(sub)
+	}
+	delete(parent.Folders, parts[len(parts)-1])
+	rfs.ChangeCache.SaveDirectoryNode(parent)
+	if len(files) == 0 {
+		return nil
+	}
+	prefix := path + "/"
+	return rfs.searchRemovePaths(func(path string) bool { return strings.HasPrefix(path, prefix) })
+}
+
 func (rfs *RootFileSystem) RetrieveFileNode(id BlockNode) (*FileNode, error) {
-	rawBlock := rfs.BlockHandler.GetRawBlock(id)
-	return getFileNode(rawBlock), nil
+	rawBlock, err := rfs.BlockHandler.GetRawBlock(rfs.Context, id)
+	if err != nil {
+		return nil, err
+	}
+	return getFileNode(id, rawBlock)
 }
 
 func (rfs *RootFileSystem) RetrieveDirectoryNode(id BlockNode) (*DirectoryNode, error) {
-	rawBlock := rfs.BlockHandler.GetRawBlock(id)
-	return getDirectoryNode(rawBlock), nil
+	rawBlock, err := rfs.BlockHandler.GetRawBlock(rfs.Context, id)
+	if err != nil {
+		return nil, err
+	}
+	return getDirectoryNode(id, rawBlock)
 }
 
 // Moving something means taking the definition (FileNode or DirectoryNode blockId) in one
 // DirectoryNode entry and moving it to another DirectoryNode entry, creating that DirectoryNode
 // in the target if it doesn't exist. Note that if we move filesystems we will have to actually
 // copy the file/folder (<-- eek) and then delete from source
-func (rfs *RootFileSystem) MoveFileOrFolder(source string, target string) error {
+func (rfs *RootFileSystem) MoveFileOrFolder(source string, target string) (err error) {
+	defer rfs.beginUpdate()(&err)
 	// Get source DirectoryNode for this entity
 	parts := strings.Split(source, "/")
 	lastName := parts[len(parts)-1]
-	rawRoot := rfs.BlockHandler.GetRawBlock(rfs.SuperBlock.RootDirectory)
-	dn := getDirectoryNode(rawRoot)
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return err
+	}
 	rfs.deliverMessage(fmt.Sprintf("Searching for source, parts is %v", parts))
 	rfs.deliverMessage(fmt.Sprintf("Folders are %v", dn.Folders))
 	sourceNode, err := dn.findParentDirectoryNode(parts[1:], rfs, false)
@@ -166,7 +460,7 @@ func (rfs *RootFileSystem) MoveFileOrFolder(source string, target string) error
 		lastTargName := targPaths[len(targPaths)-1]
 		targetNode, err2 := dn.findParentDirectoryNode(targPaths[1:], rfs, true)
 		if err2 != nil {
-			return errors.New("Could not create or find target")
+			return fmt.Errorf("Could not create or find target: %v", err2)
 		}
 		withinNode := false
 		if isFolderMove {
@@ -212,7 +506,10 @@ func (rfs *RootFileSystem) GetBlock(fileNode *FileNode, tag string, start string
 		if !ok {
 			return nil, errors.New("No tag found")
 		}
-		r := getRoute(rfs.BlockHandler.GetRawBlock(routeNode))
+		r, err := rfs.getRoute(routeNode)
+		if err != nil {
+			return nil, err
+		}
 		route = r.DataBlockNames
 	}
 	// Now we need to filter DataBlockNames
@@ -244,7 +541,10 @@ func (rfs *RootFileSystem) GetBlock(fileNode *FileNode, tag string, start string
 		if !ok {
 			return nil, errors.New("Invalid block structure")
 		}
-		data := rfs.BlockHandler.GetRawBlock(rNode)
+		data, err := rfs.BlockHandler.GetRawBlock(rfs.Context, rNode)
+		if err != nil {
+			return nil, err
+		}
 		b := Block{}
 		b.Key = newRoute[point]
 		b.Value = string(data)
@@ -254,7 +554,8 @@ func (rfs *RootFileSystem) GetBlock(fileNode *FileNode, tag string, start string
 }
 
 // Appends the content to the given file, creating the file if it doesn't exist
-func (rfs *RootFileSystem) AppendFile(fileName string, contents []byte) error {
+func (rfs *RootFileSystem) AppendFile(fileName string, contents []byte) (err error) {
+	defer rfs.beginUpdate()(&err)
 	fn, err := rfs.retrieveFn(fileName, true)
 
 	if err == nil {
@@ -265,11 +566,13 @@ func (rfs *RootFileSystem) AppendFile(fileName string, contents []byte) error {
 		// in the routes information. After appending the blocks, we update the DefaultRoute and copy the
 		// DefaultRoute into the new version in the version route information
 
-		rfs.saveNewData(fileName, fn, contents)
+		if err = rfs.saveNewData(fn, contents); err != nil {
+			return err
+		}
+		return rfs.addWordIndex(fileName, fn)
 	} else {
 		return err
 	}
-	return nil
 }
 
 // Retrieves the version tags
@@ -287,17 +590,25 @@ func (rfs *RootFileSystem) GetTags(fileName string) ([]string, error) {
 }
 
 // Writes a file, creating if it doesn't exist, overwriting if it does
-func (rfs *RootFileSystem) WriteFile(fileName string, contents []byte) error {
+func (rfs *RootFileSystem) WriteFile(fileName string, contents []byte) (err error) {
+	defer rfs.beginUpdate()(&err)
 	// Find record for this fileName from RootFileSystem
 	// After splitting on /
 	fn, err := rfs.retrieveFn(fileName, true)
 
 	if err == nil {
-		rfs.BlockHandler.FreeBlocks(fn.getBlocksToFree())
-
-		rfs.saveNewData(fileName, fn, contents)
-
-		return nil
+		// Overwriting throws away the existing data and all of the versions. They are freed
+		// once the new data has been written, so a BlockHandler can share any unchanged blocks.
+		// If the new data can't be saved the file is put back as it was.
+		old := fn.clearContents()
+		if err = rfs.saveNewData(fn, contents); err != nil {
+			fn.restoreContents(old)
+			return err
+		}
+		if err = rfs.BlockHandler.FreeBlocks(rfs.Context, old.blocks()); err != nil {
+			return err
+		}
+		return rfs.addWordIndex(fileName, fn)
 	} else {
 		rfs.deliverMessage("Could not get file node")
 		// Something went wrong, what to do? (probably propogate the error)
@@ -326,12 +637,7 @@ func (rfs *RootFileSystem) ReadFile(fileName string) ([]byte, error) {
 	fn, err := rfs.retrieveFn(fileName, false)
 
 	if err == nil {
-		buffer := new(bytes.Buffer)
-		for _, i := range fn.DefaultRoute.DataBlockNames {
-			data := rfs.BlockHandler.GetRawBlock(fn.DataBlocks[i])
-			buffer.Write(data)
-		}
-		return buffer.Bytes(), nil
+		return rfs.readRoute(fn, &fn.DefaultRoute)
 	} else {
 		return nil, err
 	}
@@ -350,13 +656,11 @@ func (rfs *RootFileSystem) ReadFileTag(fileName string, tagName string) ([]byte,
 		if !ok {
 			return nil, errors.New("That tag does not exist")
 		}
-		route := rfs.getRoute(routeBlock)
-		buffer := new(bytes.Buffer)
-		for _, i := range route.DataBlockNames {
-			data := rfs.BlockHandler.GetRawBlock(fn.DataBlocks[i])
-			buffer.Write(data)
+		route, err := rfs.getRoute(routeBlock)
+		if err != nil {
+			return nil, err
 		}
-		return buffer.Bytes(), nil
+		return rfs.readRoute(fn, route)
 	} else {
 		return nil, err
 	}
@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 func (rfs *RootFileSystem) retrieveFn(fileName string, createNew bool) (*FileNode, error) {
 	parts := strings.Split(fileName, "/")
-	dn, _ := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	dn, err := rfs.ChangeCache.GetDirectoryNode(rfs.SuperBlock.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
 	return dn.findNode(parts[1:], rfs, createNew)
 }
 
 func (fn *FileNode) getBlocksToFree() []BlockNode {
-	ret := make([]BlockNode, 10)
+	ret := make([]BlockNode, 0)
 	for _, v := range fn.DataBlocks {
 		ret = append(ret, v)
 	}
@@ -24,6 +28,48 @@ func (fn *FileNode) getBlocksToFree() []BlockNode {
 	}
 	return ret
 }
+
+// The data and versions of a file that overwriting it replaces, kept so that the file node can be
+// put back as it was if the new data can't be saved
+type fileContents struct {
+	dataBlocks      map[string]BlockNode
+	dataBlockSizes  map[string]int
+	alternateRoutes map[string]BlockNode
+	route           []string
+	size            int
+}
+
+// Empty the file node of its data and versions, returning what it held
+func (fn *FileNode) clearContents() fileContents {
+	old := fileContents{fn.DataBlocks, fn.DataBlockSizes, fn.AlternateRoutes, fn.DefaultRoute.DataBlockNames, fn.Stats.Size}
+	fn.DataBlocks = make(map[string]BlockNode)
+	fn.DataBlockSizes = make(map[string]int)
+	fn.AlternateRoutes = make(map[string]BlockNode)
+	fn.DefaultRoute.DataBlockNames = nil
+	fn.Stats.Size = 0
+	return old
+}
+
+func (fn *FileNode) restoreContents(old fileContents) {
+	fn.DataBlocks = old.dataBlocks
+	fn.DataBlockSizes = old.dataBlockSizes
+	fn.AlternateRoutes = old.alternateRoutes
+	fn.DefaultRoute.DataBlockNames = old.route
+	fn.Stats.Size = old.size
+}
+
+// The blocks that are freed once the file has been overwritten
+func (old fileContents) blocks() []BlockNode {
+	ret := make([]BlockNode, 0, len(old.dataBlocks)+len(old.alternateRoutes))
+	for _, v := range old.dataBlocks {
+		ret = append(ret, v)
+	}
+	for _, v := range old.alternateRoutes {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
 func safeAppend(target []byte, source []byte, maxSize int) ([]byte, []byte) {
 	lt := len(target)
 	toCopy := cap(target) - lt
@@ -38,25 +84,26 @@ func getKeyName(val int) string {
 	return fmt.Sprintf("%05d", val)
 }
 
-func (rfs *RootFileSystem) saveNewData(fullPath string, fn *FileNode, contents []byte) {
-	newBlockId := len(fn.DataBlocks) + 1
-	keyName := getKeyName(newBlockId)
-	rfs.SaveNewBlock(fullPath, fn, keyName, contents, false)
+// The key name for a new data block added to the end of this file
+func (fn *FileNode) nextKeyName() string {
+	return getKeyName(lastKey(fn.DataBlocks) + 1)
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// The largest numbered key of the data blocks, 0 if there are none
+func lastKey(dataBlocks map[string]BlockNode) int {
+	max := 0
+	for k := range dataBlocks {
+		if val, err := strconv.Atoi(k); err == nil && val > max {
+			max = val
 		}
 	}
-	return false
+	return max
 }
 
-// This function appends data to this fileNode
-func (rfs *RootFileSystem) SaveNewBlock(fullPath string, fn *FileNode, keyName string, contents []byte, sortBlocks bool) {
-	fn.Stats.Size = fn.Stats.Size + len(contents)
-	fn.Stats.modified()
+// Appends the contents to the file in new data blocks of at most BlockSize bytes and creates a
+// new version. If the filesystem runs out of space the file node is left as it was.
+func (rfs *RootFileSystem) saveNewData(fn *FileNode, contents []byte) error {
+	added := make([]string, 0)
 	for i := 0; i < len(contents); i = i + rfs.SuperBlock.BlockSize {
 		var toWrite []byte
 		if i+rfs.SuperBlock.BlockSize > len(contents) {
@@ -64,47 +111,196 @@ func (rfs *RootFileSystem) SaveNewBlock(fullPath string, fn *FileNode, keyName s
 		} else {
 			toWrite = contents[i : i+rfs.SuperBlock.BlockSize]
 		}
-		newDataNode, ok := fn.DataBlocks[keyName]
-		if !ok {
-			newDataNode = rfs.BlockHandler.GetFreeDataBlockNode(fn.Node, keyName)
-			fn.DataBlocks[keyName] = newDataNode
-			fn.DefaultRoute.DataBlockNames = append(fn.DefaultRoute.DataBlockNames, keyName)
-			if sortBlocks {
-				// We need to sort the Datablock names in the DefaultRoute
-				sort.Strings(fn.DefaultRoute.DataBlockNames)
-			}
-			rfs.BlockHandler.SaveRawBlock(newDataNode, toWrite)
-		} else {
-			rfs.BlockHandler.SaveRawBlock(newDataNode, toWrite)
+		keyName := fn.nextKeyName()
+		err := rfs.writeDataBlock(fn, keyName, toWrite, false)
+		if err != nil {
+			rfs.removeDataBlocks(fn, added)
+			return err
+		}
+		added = append(added, keyName)
+	}
+	fn.Stats.Size = fn.Stats.Size + len(contents)
+	err := rfs.saveVersion(fn)
+	if err != nil {
+		rfs.removeDataBlocks(fn, added)
+		fn.Stats.Size = fn.Stats.Size - len(contents)
+		return err
+	}
+	return nil
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// This function adds (or replaces) the data block with the given key in this fileNode and creates a new version
+func (rfs *RootFileSystem) SaveNewBlock(fullPath string, fn *FileNode, keyName string, contents []byte, sortBlocks bool) (err error) {
+	defer rfs.beginUpdate()(&err)
+	// Replacing a block changes the size by the difference
+	change := len(contents)
+	_, exists := fn.DataBlocks[keyName]
+	if exists {
+		size, err := rfs.blockSize(fn, keyName)
+		if err != nil {
+			return err
+		}
+		change -= size
+	}
+	err = rfs.writeDataBlock(fn, keyName, contents, sortBlocks)
+	if err != nil {
+		return err
+	}
+	fn.Stats.Size = fn.Stats.Size + change
+	err = rfs.saveVersion(fn)
+	if err != nil {
+		if !exists {
+			rfs.removeDataBlocks(fn, []string{keyName})
+		}
+		fn.Stats.Size = fn.Stats.Size - change
+		return err
+	}
+	// Structured (sorted) files are not indexed
+	if !sortBlocks {
+		return rfs.addWordIndex(fullPath, fn)
+	}
+	return nil
+}
+
+// Write the contents to the data block for the key, adding the key to the default route if it is new
+func (rfs *RootFileSystem) writeDataBlock(fn *FileNode, keyName string, contents []byte, sortBlocks bool) error {
+	newDataNode, ok := fn.DataBlocks[keyName]
+	if !ok {
+		var err error
+		newDataNode, err = rfs.getFreeDataBlockNode(fn.Node, keyName)
+		if err != nil {
+			return err
+		}
+		fn.DataBlocks[keyName] = newDataNode
+		fn.DefaultRoute.DataBlockNames = append(fn.DefaultRoute.DataBlockNames, keyName)
+		if sortBlocks {
+			// We need to sort the Datablock names in the DefaultRoute
+			sort.Strings(fn.DefaultRoute.DataBlockNames)
+		}
+	}
+	_, err := rfs.BlockHandler.SaveRawBlock(rfs.Context, newDataNode, contents)
+	if err == nil {
+		fn.DataBlockSizes[keyName] = len(contents)
+	}
+	return err
+}
+
+// The number of bytes in the data block for the key, reading the block if its size wasn't
+// recorded when it was written
+func (rfs *RootFileSystem) blockSize(fn *FileNode, keyName string) (int, error) {
+	if size, ok := fn.DataBlockSizes[keyName]; ok {
+		return size, nil
+	}
+	node, ok := fn.DataBlocks[keyName]
+	if !ok {
+		return 0, fmt.Errorf("Data block %s missing from file", keyName)
+	}
+	data, err := rfs.BlockHandler.GetRawBlock(rfs.Context, node)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Undo writeDataBlock for newly added keys, freeing their blocks
+func (rfs *RootFileSystem) removeDataBlocks(fn *FileNode, keys []string) {
+	blocks := make([]BlockNode, 0, len(keys))
+	for _, k := range keys {
+		blocks = append(blocks, fn.DataBlocks[k])
+		delete(fn.DataBlocks, k)
+		delete(fn.DataBlockSizes, k)
+	}
+	names := make([]string, 0, len(fn.DefaultRoute.DataBlockNames))
+	for _, name := range fn.DefaultRoute.DataBlockNames {
+		if !contains(keys, name) {
+			names = append(names, name)
 		}
 	}
-	// Now update the version route
+	fn.DefaultRoute.DataBlockNames = names
+	rfs.BlockHandler.FreeBlocks(rfs.Context, blocks)
+}
+
+// Record the default route as a new version of the file and save the file node
+func (rfs *RootFileSystem) saveVersion(fn *FileNode) error {
+	routeBlockId, err := rfs.getFreeBlockNode(ROUTE)
+	if err != nil {
+		return err
+	}
+	// Todo, put in cache
+	raw, err := rfs.encodeBlock(fn.DefaultRoute)
+	if err == nil {
+		_, err = rfs.BlockHandler.SaveRawBlock(rfs.Context, routeBlockId, raw)
+	}
+	if err != nil {
+		rfs.BlockHandler.FreeBlocks(rfs.Context, []BlockNode{routeBlockId})
+		return err
+	}
 	fn.Version++
 	newVersionTag := fmt.Sprintf("v%09d", fn.Version)
 	fn.LatestTag = newVersionTag
-	routeBlockId := rfs.BlockHandler.GetFreeBlockNode(ROUTE)
-	// Todo, put in cache
-	rfs.BlockHandler.SaveRawBlock(routeBlockId, rawBlock(fn.DefaultRoute))
 	fn.AlternateRoutes[newVersionTag] = routeBlockId
 	fn.Stats.modified()
 	rfs.ChangeCache.SaveFileNode(fn)
-	// If sortBlocks is false, save the index by creating words and updating the index
-	// for this version (and the latest version)
-	if !sortBlocks {
-		rfs.addWordIndex(fullPath, fn)
-	}
+	return nil
 }
 
-func (rfs *RootFileSystem) addWordIndex(fullPath string, fn *FileNode) {
+// Read the data blocks named in a route, one after the other
+func (rfs *RootFileSystem) readRoute(fn *FileNode, route *DataRoute) ([]byte, error) {
 	buffer := new(bytes.Buffer)
-	for _, i := range fn.DefaultRoute.DataBlockNames {
-		data := rfs.BlockHandler.GetRawBlock(fn.DataBlocks[i])
+	for _, i := range route.DataBlockNames {
+		node, ok := fn.DataBlocks[i]
+		if !ok {
+			return nil, fmt.Errorf("Data block %s missing from file", i)
+		}
+		data, err := rfs.BlockHandler.GetRawBlock(rfs.Context, node)
+		if err != nil {
+			return nil, err
+		}
 		buffer.Write(data)
 	}
-	fullString := string(buffer.Bytes())
-	words := regexp.MustCompile("\\w+")
-	w := words.FindAllString(fullString, -1)
-	rfs.SearchAddTerms("text", w, fullPath, fn.LatestTag)
+	return buffer.Bytes(), nil
+}
+
+var wordPattern = regexp.MustCompile("\\w+")
+
+// Add the words in the latest version of the file to the search index. The data blocks are read
+// one at a time, carrying a word that runs to the end of a block over to the next one.
+func (rfs *RootFileSystem) addWordIndex(fullPath string, fn *FileNode) error {
+	w := make([]string, 0)
+	carry := ""
+	for _, i := range fn.DefaultRoute.DataBlockNames {
+		node, ok := fn.DataBlocks[i]
+		if !ok {
+			return fmt.Errorf("Data block %s missing from file", i)
+		}
+		data, err := rfs.BlockHandler.GetRawBlock(rfs.Context, node)
+		if err != nil {
+			return err
+		}
+		text := carry + string(data)
+		found := wordPattern.FindAllStringIndex(text, -1)
+		carry = ""
+		if n := len(found); n > 0 && found[n-1][1] == len(text) {
+			carry = text[found[n-1][0]:]
+			found = found[:n-1]
+		}
+		for _, loc := range found {
+			w = append(w, text[loc[0]:loc[1]])
+		}
+	}
+	if carry != "" {
+		w = append(w, carry)
+	}
+	return rfs.searchAddTerms("text", w, fullPath, fn.LatestTag)
 }
 
 func getKeys(maps map[string]BlockNode) []string {
@@ -115,14 +311,20 @@ func getKeys(maps map[string]BlockNode) []string {
 	return keys
 }
 
-func (rfs *RootFileSystem) getRoute(node BlockNode) *DataRoute {
-	rawData := rfs.BlockHandler.GetRawBlock(node)
-	return getRoute(rawData)
+func (rfs *RootFileSystem) getRoute(node BlockNode) (*DataRoute, error) {
+	rawData, err := rfs.BlockHandler.GetRawBlock(rfs.Context, node)
+	if err != nil {
+		return nil, err
+	}
+	return getRoute(node, rawData)
 }
 
-func (rfs *RootFileSystem) getSearchIndex() *SearchIndex {
-	rawData := rfs.BlockHandler.GetRawBlock(rfs.SuperBlock.SearchIndexNode)
-	return getSearchIndex(rawData)
+func (rfs *RootFileSystem) getSearchIndex() (*SearchIndex, error) {
+	rawData, err := rfs.BlockHandler.GetRawBlock(rfs.Context, rfs.SuperBlock.SearchIndexNode)
+	if err != nil {
+		return nil, err
+	}
+	return getSearchIndex(rfs.SuperBlock.SearchIndexNode, rawData)
 }
 
 func (rfs *RootFileSystem) deliverMessage(msg string) {
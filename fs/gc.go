@@ -0,0 +1,438 @@
+package fs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The garbage collector reclaims blocks that can no longer be reached: route and data blocks left
+// behind by failed or partial updates, data blocks that no version of a file refers to any more
+// and anything else the BlockHandler holds that isn't linked from the SuperBlockNode.
+//
+// It is a mark and sweep collector that works a few blocks at a time so that it can run in the
+// background while the filesystem is in use. A cycle starts by listing every block the handler
+// holds (so the handler must be a BlockLister). The mark phase then walks the directories and
+// files through the cache, treating the DefaultRoute and every AlternateRoute of each FileNode as
+// the roots for its data. Blocks handed out while a cycle is running are never collected and any
+// directory or file saved during the mark phase is scanned again, so changes made while the
+// collector runs are safe. The sweep phase frees whatever was listed but not marked.
+
+type gcPhase int
+
+const (
+	gcIdle gcPhase = iota
+	gcMark
+	gcSweep
+)
+
+// The number of blocks marked or swept in each step by default
+const DefaultCollectorStepSize = 100
+
+type GarbageCollector struct {
+	Fs *RootFileSystem
+	// The number of blocks marked or swept in each step
+	StepSize int
+
+	phase gcPhase
+	// Blocks listed at the start of the cycle that have not been marked yet
+	candidates map[int]BlockNode
+	// Directories and files (and the search index) waiting to be scanned
+	queue []BlockNode
+	// Data keys that no route refers to, by the file node that holds them
+	deadKeys map[BlockNode][]string
+	stats    FileSystemStats
+	stop     chan struct{}
+	lock     sync.Mutex
+	// Nodes saved during the mark phase, these are added to the queue by the next step. They have
+	// their own lock as they are saved from inside the cache.
+	shaded    []BlockNode
+	marking   bool
+	shadeLock sync.Mutex
+	// Data blocks written through a File that hasn't been closed yet, which nothing refers to
+	held map[int]bool
+}
+
+func (gc *GarbageCollector) Init(fs *RootFileSystem) {
+	gc.Fs = fs
+	gc.StepSize = DefaultCollectorStepSize
+	gc.stats.GCReclaimedByType = make(map[string]int)
+	gc.reset()
+}
+
+// Abandon any cycle in progress, used when the filesystem is formatted or mounted
+func (gc *GarbageCollector) reset() {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	gc.phase = gcIdle
+	gc.candidates = nil
+	gc.queue = nil
+	gc.deadKeys = nil
+	gc.shadeLock.Lock()
+	gc.shaded = nil
+	gc.marking = false
+	gc.shadeLock.Unlock()
+}
+
+// Run a step every interval in a background goroutine, until Stop is called
+func (gc *GarbageCollector) Start(interval time.Duration) {
+	gc.Stop()
+	stop := make(chan struct{})
+	gc.lock.Lock()
+	gc.stop = stop
+	gc.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := gc.Step(); err != nil {
+					gc.Fs.deliverMessage(fmt.Sprintf("Garbage collection failed: %v", err))
+				}
+			}
+		}
+	}()
+}
+
+// Stop the background goroutine started by Start, a cycle in progress is continued by the next
+// Start or Collect
+func (gc *GarbageCollector) Stop() {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	if gc.stop != nil {
+		close(gc.stop)
+		gc.stop = nil
+	}
+}
+
+// Run steps until a complete cycle has finished, returning the number of blocks it reclaimed
+func (gc *GarbageCollector) Collect() (int, error) {
+	gc.lock.Lock()
+	// A cycle that is already under way may have started before changes the caller expects to
+	// be collected, so finish it and then run a full one
+	cycles := 1
+	if gc.phase != gcIdle {
+		cycles = 2
+	}
+	gc.lock.Unlock()
+	before := gc.Fs.Stats().GCReclaimed
+	for cycles > 0 {
+		done, err := gc.Step()
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			cycles--
+		}
+	}
+	return gc.Fs.Stats().GCReclaimed - before, nil
+}
+
+// Do the next piece of work, returning true when this step finished a cycle
+func (gc *GarbageCollector) Step() (_ bool, err error) {
+	defer gc.Fs.beginUpdate()(&err)
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	switch gc.phase {
+	case gcIdle:
+		return false, gc.startCycle()
+	case gcMark:
+		gc.shadeLock.Lock()
+		gc.queue = append(gc.queue, gc.shaded...)
+		gc.shaded = nil
+		gc.shadeLock.Unlock()
+		for i := 0; i < gc.StepSize && len(gc.queue) > 0; i++ {
+			node := gc.queue[0]
+			gc.queue = gc.queue[1:]
+			if err := gc.scan(node); err != nil {
+				return false, err
+			}
+		}
+		gc.shadeLock.Lock()
+		defer gc.shadeLock.Unlock()
+		if len(gc.queue) == 0 && len(gc.shaded) == 0 {
+			gc.phase = gcSweep
+			gc.marking = false
+		}
+		return false, nil
+	default:
+		return gc.sweep()
+	}
+}
+
+// Must be called with the lock held
+func (gc *GarbageCollector) startCycle() error {
+	lister, ok := gc.Fs.BlockHandler.(BlockLister)
+	if !ok {
+		return ErrNotSupported
+	}
+	blocks, err := lister.ListBlocks(gc.Fs.Context)
+	if err != nil {
+		return err
+	}
+	gc.candidates = make(map[int]BlockNode)
+	for _, node := range blocks {
+		if node.Type != SUPERBLOCK && !gc.held[node.Id] {
+			gc.candidates[node.Id] = node
+		}
+	}
+	gc.deadKeys = make(map[BlockNode][]string)
+	gc.queue = []BlockNode{gc.Fs.SuperBlock.RootDirectory, gc.Fs.SuperBlock.SearchIndexNode}
+	gc.phase = gcMark
+	gc.shadeLock.Lock()
+	gc.marking = true
+	gc.shadeLock.Unlock()
+	return nil
+}
+
+// Mark a node and everything it refers to, queueing the directories and files it contains.
+// Must be called with the lock held.
+func (gc *GarbageCollector) scan(node BlockNode) error {
+	delete(gc.candidates, node.Id)
+	switch node.Type {
+	case DIRECTORY:
+		dn, err := gc.Fs.ChangeCache.GetDirectoryNode(node)
+		if err != nil {
+			return gc.skip()
+		}
+		for _, folder := range dn.Folders {
+			gc.queue = append(gc.queue, folder)
+		}
+		for _, file := range dn.Files {
+			gc.queue = append(gc.queue, file)
+		}
+		if dn.Continuation.Type == DIRECTORY {
+			gc.queue = append(gc.queue, dn.Continuation)
+		}
+	case FILE:
+		fn, err := gc.Fs.ChangeCache.GetFileNode(node)
+		if err != nil {
+			return gc.skip()
+		}
+		live, err := gc.liveKeys(fn)
+		if err != nil {
+			return err
+		}
+		for _, route := range fn.AlternateRoutes {
+			delete(gc.candidates, route.Id)
+		}
+		dead := make([]string, 0)
+		for key, data := range fn.DataBlocks {
+			if live[key] {
+				delete(gc.candidates, data.Id)
+			} else {
+				dead = append(dead, key)
+			}
+		}
+		if len(dead) > 0 {
+			gc.deadKeys[node] = dead
+		} else {
+			delete(gc.deadKeys, node)
+		}
+	case SEARCHINDEX:
+		si, err := gc.Fs.ChangeCache.GetSearchIndex()
+		if err != nil {
+			return gc.skip()
+		}
+		for _, tree := range si.Terms {
+			delete(gc.candidates, tree.Id)
+		}
+	}
+	return nil
+}
+
+// The data keys named by the default route or by any version of the file
+func (gc *GarbageCollector) liveKeys(fn *FileNode) (map[string]bool, error) {
+	live := make(map[string]bool)
+	for _, name := range fn.DefaultRoute.DataBlockNames {
+		live[name] = true
+	}
+	for _, routeNode := range fn.AlternateRoutes {
+		route, err := gc.Fs.getRoute(routeNode)
+		if err == ErrBlockNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, name := range route.DataBlockNames {
+			live[name] = true
+		}
+	}
+	return live, nil
+}
+
+// A node that can't be read was removed while the cycle was running (or is waiting in the cache
+// to be deleted) and is simply skipped, unless the context has been cancelled
+func (gc *GarbageCollector) skip() error {
+	return gc.Fs.Context.Err()
+}
+
+// Must be called with the lock held
+func (gc *GarbageCollector) sweep() (bool, error) {
+	// Drop the unreferenced keys from their files first, so that nothing points at the blocks
+	// once they are freed
+	for node, keys := range gc.deadKeys {
+		delete(gc.deadKeys, node)
+		fn, err := gc.Fs.ChangeCache.GetFileNode(node)
+		if err != nil {
+			continue
+		}
+		live, err := gc.liveKeys(fn)
+		if err != nil {
+			return false, err
+		}
+		changed := false
+		for _, key := range keys {
+			data, ok := fn.DataBlocks[key]
+			if !ok {
+				continue
+			}
+			if live[key] {
+				delete(gc.candidates, data.Id)
+			} else if _, candidate := gc.candidates[data.Id]; candidate {
+				delete(fn.DataBlocks, key)
+				delete(fn.DataBlockSizes, key)
+				changed = true
+			}
+		}
+		if changed {
+			gc.Fs.ChangeCache.SaveFileNode(fn)
+		}
+		return false, nil
+	}
+
+	blocks := make([]BlockNode, 0, gc.StepSize)
+	for id, node := range gc.candidates {
+		if len(blocks) >= gc.StepSize {
+			break
+		}
+		delete(gc.candidates, id)
+		// The cache frees the nodes it is deleting itself
+		if gc.Fs.ChangeCache.pending(node) {
+			continue
+		}
+		blocks = append(blocks, node)
+	}
+	if len(blocks) > 0 {
+		err := gc.Fs.BlockHandler.FreeBlocks(gc.Fs.Context, blocks)
+		if err != nil {
+			return false, err
+		}
+		gc.Fs.ChangeCache.forget(blocks)
+		gc.stats.GCReclaimed += len(blocks)
+		for _, node := range blocks {
+			gc.stats.GCReclaimedByType[node.Type.String()]++
+		}
+	}
+	if len(gc.candidates) > 0 {
+		return false, nil
+	}
+	gc.phase = gcIdle
+	gc.candidates = nil
+	gc.deadKeys = nil
+	gc.stats.GCCycles++
+	return true, nil
+}
+
+// Called when a node is handed out, so that a block freed and reused during a cycle is not
+// collected. Must be called with the lock held.
+func (gc *GarbageCollector) allocated(node BlockNode) {
+	if gc.phase != gcIdle {
+		delete(gc.candidates, node.Id)
+	}
+}
+
+// Called when a directory, file or the search index is saved, so that anything newly linked
+// from it is marked
+func (gc *GarbageCollector) shade(node BlockNode) {
+	gc.shadeLock.Lock()
+	defer gc.shadeLock.Unlock()
+	if gc.marking {
+		gc.shaded = append(gc.shaded, node)
+	}
+}
+
+// Counters describing the work a filesystem has done
+type FileSystemStats struct {
+	// Garbage collection cycles completed
+	GCCycles int
+	// Blocks freed by the garbage collector, in total and by block type
+	GCReclaimed       int
+	GCReclaimedByType map[string]int
+	// Counters reported by the BlockHandler, if it is a StatsReporter
+	Handler map[string]float64
+}
+
+// A snapshot of the counters for this filesystem
+func (rfs *RootFileSystem) Stats() FileSystemStats {
+	gc := &rfs.Collector
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	stats := gc.stats
+	stats.GCReclaimedByType = make(map[string]int)
+	for k, v := range gc.stats.GCReclaimedByType {
+		stats.GCReclaimedByType[k] = v
+	}
+	if reporter, ok := rfs.BlockHandler.(StatsReporter); ok {
+		stats.Handler = reporter.HandlerStats()
+	}
+	return stats
+}
+
+// Allocate a block through the BlockHandler, telling the garbage collector about it
+func (rfs *RootFileSystem) getFreeBlockNode(nodeType BlockNodeType) (BlockNode, error) {
+	rfs.Collector.lock.Lock()
+	defer rfs.Collector.lock.Unlock()
+	node, err := rfs.BlockHandler.GetFreeBlockNode(rfs.Context, nodeType)
+	if err == nil {
+		rfs.Collector.allocated(node)
+	}
+	return node, err
+}
+
+func (rfs *RootFileSystem) getFreeDataBlockNode(parent BlockNode, key string) (BlockNode, error) {
+	rfs.Collector.lock.Lock()
+	defer rfs.Collector.lock.Unlock()
+	node, err := rfs.BlockHandler.GetFreeDataBlockNode(rfs.Context, parent, key)
+	if err == nil {
+		rfs.Collector.allocated(node)
+	}
+	return node, err
+}
+
+// Allocate a data block for a File that is being written. Nothing refers to it until the File is
+// closed, so the garbage collector leaves it alone until it is released.
+func (rfs *RootFileSystem) getHeldDataBlockNode(parent BlockNode, key string) (BlockNode, error) {
+	gc := &rfs.Collector
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	node, err := rfs.BlockHandler.GetFreeDataBlockNode(rfs.Context, parent, key)
+	if err == nil {
+		gc.allocated(node)
+		if gc.held == nil {
+			gc.held = make(map[int]bool)
+		}
+		gc.held[node.Id] = true
+	}
+	return node, err
+}
+
+// Whether the block is held for a File that is being written
+func (gc *GarbageCollector) isHeld(node BlockNode) bool {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return gc.held[node.Id]
+}
+
+// Let the garbage collector have blocks from getHeldDataBlockNode, once they are part of the file
+// or have been freed
+func (gc *GarbageCollector) release(nodes []BlockNode) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	for _, node := range nodes {
+		delete(gc.held, node.Id)
+	}
+}
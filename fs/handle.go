@@ -0,0 +1,355 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A File is a file opened with Open, for reading, or with Create, for writing. It works a block at
+// a time, so only one block of the file is held in memory however large the file is.
+//
+// Open reads the latest version of the file as it was when it was opened. Its blocks are read as
+// they are needed, so a file that is overwritten (freeing its old blocks) while it is open can no
+// longer be read. Create writes each data block as it fills, but the file is not changed until
+// Close, which replaces its contents with the blocks written as a single new version. The blocks
+// are kept from the garbage collector until then.
+type File struct {
+	rfs  *RootFileSystem
+	name string
+	// The data blocks being read, and the offset each one ends at as far as it is known (from the
+	// sizes recorded in the file node or by reading the blocks)
+	blocks []BlockNode
+	ends   []int64
+	// The last block read
+	current int
+	data    []byte
+	// The position in the file and its size
+	offset int64
+	size   int64
+	// For a File opened with Create: the file node, the blocks written so far and their sizes,
+	// the data waiting to fill the next one and the first error writing them
+	writing bool
+	node    BlockNode
+	written []BlockNode
+	sizes   []int
+	pending []byte
+	err     error
+	closed  bool
+	lock    sync.Mutex
+}
+
+var _ io.ReadWriteSeeker = (*File)(nil)
+var _ io.ReaderAt = (*File)(nil)
+var _ io.Closer = (*File)(nil)
+
+// Open the latest version of a file for reading
+func (rfs *RootFileSystem) Open(fileName string) (*File, error) {
+	fn, err := rfs.retrieveFn(fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	return rfs.openRoute(fileName, fn, &fn.DefaultRoute, int64(fn.Stats.Size))
+}
+
+// Open a version of a file for reading, by its tag (see GetTags)
+func (rfs *RootFileSystem) OpenTag(fileName string, tagName string) (*File, error) {
+	fn, err := rfs.retrieveFn(fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	routeBlock, ok := fn.AlternateRoutes[tagName]
+	if !ok {
+		return nil, errors.New("That tag does not exist")
+	}
+	route, err := rfs.getRoute(routeBlock)
+	if err != nil {
+		return nil, err
+	}
+	// Only the latest version has its size in the file node
+	var size int64
+	for _, name := range route.DataBlockNames {
+		blockSize, err := rfs.blockSize(fn, name)
+		if err != nil {
+			return nil, err
+		}
+		size += int64(blockSize)
+	}
+	return rfs.openRoute(fileName, fn, route, size)
+}
+
+func (rfs *RootFileSystem) openRoute(fileName string, fn *FileNode, route *DataRoute, size int64) (*File, error) {
+	f := &File{rfs: rfs, name: fileName, size: size}
+	known := true
+	var end int64
+	for _, name := range route.DataBlockNames {
+		node, ok := fn.DataBlocks[name]
+		if !ok {
+			return nil, fmt.Errorf("Data block %s missing from file", name)
+		}
+		f.blocks = append(f.blocks, node)
+		blockSize, ok := fn.DataBlockSizes[name]
+		if known = known && ok; known {
+			end += int64(blockSize)
+			f.ends = append(f.ends, end)
+		}
+	}
+	return f, nil
+}
+
+// Open a file for writing, creating it if it doesn't exist. What is written replaces the contents
+// of the file (and all of its versions, as WriteFile does) when the File is closed.
+func (rfs *RootFileSystem) Create(fileName string) (_ *File, err error) {
+	defer rfs.beginUpdate()(&err)
+	fn, err := rfs.retrieveFn(fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	return &File{rfs: rfs, name: fileName, writing: true, node: fn.Node}, nil
+}
+
+// The name the File was opened with
+func (f *File) Name() string {
+	return f.name
+}
+
+// The size of the file, for a File opened with Create the number of bytes written so far
+func (f *File) Size() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.size
+}
+
+func (f *File) check(writing bool) error {
+	if f.closed {
+		return ErrFileClosed
+	}
+	if f.writing != writing {
+		return ErrBadFileMode
+	}
+	return nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, offset int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	return f.readAt(p, offset)
+}
+
+func (f *File) readAt(p []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		at := offset + int64(n)
+		i, err := f.locate(at)
+		if err != nil {
+			return n, err
+		}
+		if i == len(f.blocks) {
+			return n, io.EOF
+		}
+		data, err := f.load(i)
+		if err != nil {
+			return n, err
+		}
+		var start int64
+		if i > 0 {
+			start = f.ends[i-1]
+		}
+		if int64(len(data)) != f.ends[i]-start {
+			return n, &ErrCorruptBlock{f.blocks[i], "Block is not the size recorded for it"}
+		}
+		n += copy(p[n:], data[at-start:])
+	}
+	return n, nil
+}
+
+// The index of the block holding the offset (or the number of blocks if it is past the end),
+// reading the blocks before it that haven't been read yet to find where they end
+func (f *File) locate(offset int64) (int, error) {
+	for {
+		i := sort.Search(len(f.ends), func(i int) bool { return f.ends[i] > offset })
+		if i < len(f.ends) || len(f.ends) == len(f.blocks) {
+			return i, nil
+		}
+		if _, err := f.load(len(f.ends)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// The data of a block, remembering where the block ends the first time it is read
+func (f *File) load(i int) ([]byte, error) {
+	if f.data != nil && f.current == i {
+		return f.data, nil
+	}
+	data, err := f.rfs.BlockHandler.GetRawBlock(f.rfs.Context, f.blocks[i])
+	if err != nil {
+		return nil, err
+	}
+	if i == len(f.ends) {
+		var start int64
+		if i > 0 {
+			start = f.ends[i-1]
+		}
+		f.ends = append(f.ends, start+int64(len(data)))
+	}
+	f.current, f.data = i, data
+	return data, nil
+}
+
+// Move the position that the next Read starts from. A File opened with Create can only be
+// written at the end, so its position can be asked for but not changed.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, ErrFileClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	if f.writing && offset != f.offset {
+		return 0, ErrNotSupported
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Add to the end of the file, writing a data block each time BlockSize bytes have been written
+func (f *File) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	rest := p
+	for len(rest) > 0 {
+		if f.pending == nil {
+			f.pending = make([]byte, 0, f.rfs.SuperBlock.BlockSize)
+		}
+		f.pending, rest = safeAppend(f.pending, rest, f.rfs.SuperBlock.BlockSize)
+		if len(f.pending) == cap(f.pending) {
+			if f.err = f.writeBlock(); f.err != nil {
+				break
+			}
+		}
+	}
+	n := len(p) - len(rest)
+	f.offset += int64(n)
+	f.size = f.offset
+	return n, f.err
+}
+
+// Save the pending data in a new data block
+func (f *File) writeBlock() error {
+	node, err := f.rfs.saveHeldBlock(f.node, getKeyName(len(f.written)+1), f.pending)
+	if err != nil {
+		return err
+	}
+	f.written = append(f.written, node)
+	f.sizes = append(f.sizes, len(f.pending))
+	f.pending = nil
+	return nil
+}
+
+// Save a data block for a File being written, as a change of its own so that it isn't caught up
+// in a transaction of another change
+func (rfs *RootFileSystem) saveHeldBlock(parent BlockNode, keyName string, contents []byte) (_ BlockNode, err error) {
+	defer rfs.beginUpdate()(&err)
+	node, err := rfs.getHeldDataBlockNode(parent, keyName)
+	if err != nil {
+		return node, err
+	}
+	if _, err = rfs.BlockHandler.SaveRawBlock(rfs.Context, node, contents); err != nil {
+		rfs.BlockHandler.FreeBlocks(rfs.Context, []BlockNode{node})
+		rfs.Collector.release([]BlockNode{node})
+	}
+	return node, err
+}
+
+// Close the File. For a File opened with Create this writes the last block and replaces the
+// contents of the file with what was written, returning any error from writing the blocks (in
+// which case the file is left as it was).
+func (f *File) Close() (err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return ErrFileClosed
+	}
+	f.closed = true
+	f.data = nil
+	if !f.writing {
+		return nil
+	}
+	defer f.rfs.Collector.release(f.written)
+	if f.err == nil && len(f.pending) > 0 {
+		f.err = f.writeBlock()
+	}
+	if f.err != nil {
+		f.rfs.BlockHandler.FreeBlocks(f.rfs.Context, f.written)
+		return f.err
+	}
+	return f.rfs.replaceData(f.name, f.written, f.sizes)
+}
+
+// Replace the contents of a file with data blocks that have already been written, as a single
+// new version. If that fails the blocks are freed and the file is left as it was.
+func (rfs *RootFileSystem) replaceData(fileName string, blocks []BlockNode, sizes []int) (err error) {
+	defer rfs.beginUpdate()(&err)
+	fn, err := rfs.retrieveFn(fileName, true)
+	if err != nil {
+		rfs.BlockHandler.FreeBlocks(rfs.Context, blocks)
+		return err
+	}
+	old := fn.clearContents()
+	for i, node := range blocks {
+		keyName := getKeyName(i + 1)
+		fn.DataBlocks[keyName] = node
+		fn.DataBlockSizes[keyName] = sizes[i]
+		fn.DefaultRoute.DataBlockNames = append(fn.DefaultRoute.DataBlockNames, keyName)
+		fn.Stats.Size += sizes[i]
+	}
+	if err = rfs.saveVersion(fn); err != nil {
+		fn.restoreContents(old)
+		rfs.BlockHandler.FreeBlocks(rfs.Context, blocks)
+		return err
+	}
+	if err = rfs.BlockHandler.FreeBlocks(rfs.Context, old.blocks()); err != nil {
+		return err
+	}
+	return rfs.addWordIndex(fileName, fn)
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// BlockHandlers can register themselves (usually from an init function) under a scheme name so
+// that they can be selected through the configuration string passed to RootFileSystem.Init,
+// e.g. "disk:/var/pmfs/data.pmfs" or "dir:/var/pmfs"
+var handlerFactories = make(map[string]func() BlockHandlerV2)
+var handlerLock sync.RWMutex
+
+func RegisterBlockHandler(scheme string, factory func() BlockHandlerV2) {
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	handlerFactories[scheme] = factory
+}
+
+// Create the BlockHandler named by the scheme at the start of a configuration string, returning
+// it with the rest of the configuration (which is what should be passed to its Init method)
+func NewBlockHandler(configuration string) (BlockHandlerV2, string, error) {
+	scheme, rest := configuration, ""
+	if i := strings.Index(configuration, ":"); i >= 0 {
+		scheme, rest = configuration[:i], configuration[i+1:]
+	}
+	handlerLock.RLock()
+	factory, ok := handlerFactories[scheme]
+	handlerLock.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("No block handler registered for '%s'", scheme)
+	}
+	return factory(), rest, nil
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"sort"
+)
+
+// The result of a Scrub
+type ScrubReport struct {
+	// The number of blocks read
+	Scanned int
+	// A CORRUPT problem for every damaged block
+	Problems []Problem
+	// The files and directories holding damaged blocks, in order
+	DamagedPaths []string
+	// Whether blocks that can't be reached from the SuperBlockNode were read too, which needs a
+	// BlockLister
+	OrphansChecked bool
+}
+
+// Read every block in the filesystem to find any that are damaged, e.g. by a BlockHandler that
+// checks a checksum of each block. Damaged blocks are reported with the path of the file or
+// directory they belong to, blocks that aren't reachable (and so belong to no path) are read if
+// the BlockHandler is a BlockLister.
+//
+// Pending changes are written from the cache first.
+func (rfs *RootFileSystem) Scrub() (*ScrubReport, error) {
+	rfs.lock.Lock()
+	defer rfs.lock.Unlock()
+	err := rfs.Sync()
+	if err != nil {
+		return nil, err
+	}
+	c := checker{rfs: rfs, report: &CheckReport{}, reachable: make(map[int]bool)}
+	c.walk()
+	if c.err != nil {
+		return nil, c.err
+	}
+	scanned := len(c.reachable)
+	report := &ScrubReport{}
+	if lister, ok := rfs.BlockHandler.(BlockLister); ok {
+		blocks, err := lister.ListBlocks(rfs.Context)
+		if err != nil && err != ErrNotSupported {
+			return nil, err
+		}
+		report.OrphansChecked = err == nil
+		for _, node := range blocks {
+			if !c.reachable[node.Id] {
+				c.read(node, "")
+				scanned++
+			}
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+	}
+	report.Scanned = scanned
+	paths := make(map[string]bool)
+	for _, problem := range c.report.Problems {
+		if problem.Type != CORRUPT {
+			continue
+		}
+		report.Problems = append(report.Problems, problem)
+		if len(problem.Path) > 0 && !paths[problem.Path] {
+			paths[problem.Path] = true
+			report.DamagedPaths = append(report.DamagedPaths, problem.Path)
+		}
+	}
+	sort.Strings(report.DamagedPaths)
+	return report, nil
+}
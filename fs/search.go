@@ -42,14 +42,24 @@ func (s SearchEntry) Less(than llrb.Item) bool {
 
 // Ok what does the outside world see in a filesystem?
 
-func (rfs *RootFileSystem) SearchAddTerms(area string, term []string, path string, version string) error {
-	searchIndex := rfs.ChangeCache.GetSearchIndex()
+func (rfs *RootFileSystem) SearchAddTerms(area string, term []string, path string, version string) (err error) {
+	defer rfs.beginUpdate()(&err)
+	return rfs.searchAddTerms(area, term, path, version)
+}
+
+func (rfs *RootFileSystem) searchAddTerms(area string, term []string, path string, version string) error {
+	searchIndex, err := rfs.ChangeCache.GetSearchIndex()
+	if err != nil {
+		return err
+	}
 	treeNode, ok := searchIndex.Terms[area]
 	var searchTree *SearchTree = &SearchTree{}
-	var err error
 	if !ok {
 		// Create a node for this tree
-		treeNode = rfs.BlockHandler.GetFreeBlockNode(SEARCHTREE)
+		treeNode, err = rfs.getFreeBlockNode(SEARCHTREE)
+		if err != nil {
+			return err
+		}
 		searchIndex.Terms[area] = treeNode
 		searchTree.Tree = llrb.New()
 		searchTree.Node = treeNode
@@ -81,14 +91,20 @@ func (rfs *RootFileSystem) SearchAddTerms(area string, term []string, path strin
 }
 
 // Add a term that can be searched on (append or create to an existing term)
-func (rfs *RootFileSystem) SearchAddTerm(area string, term string, path string, version string) error {
-	searchIndex := rfs.ChangeCache.GetSearchIndex()
+func (rfs *RootFileSystem) SearchAddTerm(area string, term string, path string, version string) (err error) {
+	defer rfs.beginUpdate()(&err)
+	searchIndex, err := rfs.ChangeCache.GetSearchIndex()
+	if err != nil {
+		return err
+	}
 	treeNode, ok := searchIndex.Terms[area]
 	var searchTree *SearchTree = &SearchTree{}
-	var err error
 	if !ok {
 		// Create a node for this tree
-		treeNode = rfs.BlockHandler.GetFreeBlockNode(SEARCHTREE)
+		treeNode, err = rfs.getFreeBlockNode(SEARCHTREE)
+		if err != nil {
+			return err
+		}
 		searchIndex.Terms[area] = treeNode
 		searchTree.Tree = llrb.New()
 		searchTree.Node = treeNode
@@ -117,6 +133,49 @@ func (rfs *RootFileSystem) SearchAddTerm(area string, term string, path string,
 	return nil
 }
 
+// Remove the entries for the paths that match from every search area, dropping any term that is
+// left without entries
+func (rfs *RootFileSystem) searchRemovePaths(remove func(path string) bool) error {
+	searchIndex, err := rfs.ChangeCache.GetSearchIndex()
+	if err != nil {
+		return err
+	}
+	for _, treeNode := range searchIndex.Terms {
+		searchTree, err := rfs.ChangeCache.GetSearchTree(treeNode)
+		if err != nil {
+			return err
+		}
+		if searchTree.Tree.Len() == 0 {
+			continue
+		}
+		changed := make([]SearchEntry, 0)
+		searchTree.Tree.AscendGreaterOrEqual(searchTree.Tree.Min(), func(item llrb.Item) bool {
+			entry := item.(SearchEntry)
+			matches := make([]Entry, 0, len(entry.Matches))
+			for _, match := range entry.Matches {
+				if !remove(match.Path) {
+					matches = append(matches, match)
+				}
+			}
+			if len(matches) != len(entry.Matches) {
+				changed = append(changed, SearchEntry{entry.Term, matches})
+			}
+			return true
+		})
+		for _, entry := range changed {
+			if len(entry.Matches) == 0 {
+				searchTree.Tree.Delete(entry)
+			} else {
+				searchTree.Tree.ReplaceOrInsert(entry)
+			}
+		}
+		if len(changed) > 0 {
+			rfs.ChangeCache.SaveSearchTree(searchTree)
+		}
+	}
+	return nil
+}
+
 // Remove a term that has been added
 func (rfs *RootFileSystem) SearchRemoveTerm(area string, term string, path string) {
 
@@ -124,7 +183,10 @@ func (rfs *RootFileSystem) SearchRemoveTerm(area string, term string, path strin
 
 // Find all entries that are between start and end for an area (set same value for ==)
 func (rfs *RootFileSystem) SearchFindTerms(area string, startTerm string, endTerm string) ([]Entry, error) {
-	searchIndex := rfs.ChangeCache.GetSearchIndex()
+	searchIndex, err := rfs.ChangeCache.GetSearchIndex()
+	if err != nil {
+		return nil, err
+	}
 	treeNode, ok := searchIndex.Terms[area]
 	if !ok {
 		// No tree, so screw that
@@ -1,7 +1,12 @@
 // The fs package represents the abstract file system
 package fs
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
 
 // BlockNodeType differentiates between the different types of Node in a filesystem
 type BlockNodeType int
@@ -17,6 +22,25 @@ const (
 	NIL
 )
 
+var blockNodeTypeNames = []string{"superblock", "directory", "file", "route", "data", "searchindex", "searchtree", "nil"}
+
+func (t BlockNodeType) String() string {
+	if t < 0 || int(t) >= len(blockNodeTypeNames) {
+		return fmt.Sprintf("type%d", int(t))
+	}
+	return blockNodeTypeNames[t]
+}
+
+// The BlockNodeType with the given name (as returned by String)
+func ParseBlockNodeType(name string) (BlockNodeType, bool) {
+	for i, n := range blockNodeTypeNames {
+		if n == name {
+			return BlockNodeType(i), true
+		}
+	}
+	return NIL, false
+}
+
 // A File in the file system can be either a normal file (containing data) or
 // a mounted filesystem. With a custom (non NORMAL) file type the file system
 // understands the format of the contained data
@@ -39,11 +63,20 @@ type Block struct {
 // The RootFileSystem contains the information about this filesystem and is the main
 // entry point for working with a file system.
 type RootFileSystem struct {
-	BlockHandler  BlockHandler
+	BlockHandler  BlockHandlerV2
 	Configuration string
-	SuperBlock    SuperBlockNode
-	Notification  chan string
-	ChangeCache   Cache
+	// The context passed to every BlockHandler call (defaults to context.Background())
+	Context context.Context
+	// How metadata blocks are encoded (defaults to GobCodec). Set this before Format, Mount
+	// sets it to the codec the mounted filesystem was formatted with.
+	Codec        Codec
+	SuperBlock   SuperBlockNode
+	Notification chan string
+	ChangeCache  Cache
+	Collector    GarbageCollector
+	// Held while the directories and files are changed, so that the garbage collector sees
+	// each change whole
+	lock sync.Mutex
 }
 
 // A BlockNode has a type and a unique id in the filesystem
@@ -87,9 +120,14 @@ type DirectoryNode struct {
 	Attributes   map[string]interface{}
 }
 
+// The version of the on disk structure written by Format. Mount refuses to open a
+// filesystem written with a later version than this.
+const FormatVersion = 1
+
 // This is the topmost node in a filesystem, always stored at node 0
 type SuperBlockNode struct {
 	Node            BlockNode
+	Version         int
 	BlockCount      int
 	BlockSize       int
 	RootDirectory   BlockNode
@@ -113,9 +151,13 @@ type FileNode struct {
 	Version         int
 	Attributes      map[string]interface{}
 	LatestTag       string
+	// The number of bytes in each data block, by key. Blocks written before sizes were recorded
+	// are missing and have to be read to find their size.
+	DataBlockSizes map[string]int
 }
 
-// The storage for a file system must implement this
+// The original storage interface for a file system. Its methods cannot fail, so it is only
+// suitable for storage that is always available (see BlockHandlerV2 and AdaptBlockHandler).
 type BlockHandler interface {
 	Init(configuration string)
 	Format(blockCount int, blockSize int)
@@ -126,3 +168,77 @@ type BlockHandler interface {
 	FreeBlocks(blocks []BlockNode)
 	DumpInfo()
 }
+
+// The storage for a file system must implement this (or BlockHandler, through AdaptBlockHandler).
+// Every method can be cancelled through its context and can fail. GetRawBlock returns
+// ErrBlockNotFound for a node that has not been saved and the GetFree methods return ErrNoSpace
+// when there are no blocks left.
+type BlockHandlerV2 interface {
+	Init(ctx context.Context, configuration string) error
+	Format(ctx context.Context, blockCount int, blockSize int) error
+	GetFreeBlockNode(ctx context.Context, NodeType BlockNodeType) (BlockNode, error)
+	GetFreeDataBlockNode(ctx context.Context, parent BlockNode, id string) (BlockNode, error)
+	GetRawBlock(ctx context.Context, node BlockNode) ([]byte, error)
+	SaveRawBlock(ctx context.Context, node BlockNode, data []byte) (BlockNode, error)
+	FreeBlocks(ctx context.Context, blocks []BlockNode) error
+	DumpInfo()
+}
+
+// A BlockHandlerV2 can also implement BlockLister to report every block it holds, which lets
+// Check find blocks that are no longer reachable from the SuperBlockNode.
+type BlockLister interface {
+	ListBlocks(ctx context.Context) ([]BlockNode, error)
+}
+
+// A BlockHandlerV2 that places blocks itself can implement BlockReserver, so that a node handed
+// out by another handler (e.g. when mirroring) is not used for anything else before it is saved.
+type BlockReserver interface {
+	ReserveBlockNode(ctx context.Context, node BlockNode) error
+}
+
+// A BlockHandlerV2 can also implement Transactional, so that each change to the filesystem (which
+// saves and frees several blocks, some of them from the cache in the background) is applied
+// completely or not at all. Begin is called before the change and Commit once every block it
+// touched has been written from the cache; Rollback discards them instead if the change failed.
+type Transactional interface {
+	Begin(ctx context.Context)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context)
+}
+
+// A BlockHandlerV2 that wraps another can pass transactions on to it by implementing
+// TransactionalWrapper, and is then treated as Transactional only if InnerTransactional says the
+// handler it wraps is.
+type TransactionalWrapper interface {
+	Transactional
+	InnerTransactional() bool
+}
+
+// Whether the handler is Transactional, looking through any TransactionalWrapper
+func IsTransactional(handler BlockHandlerV2) bool {
+	if wrapper, ok := handler.(TransactionalWrapper); ok {
+		return wrapper.InnerTransactional()
+	}
+	_, ok := handler.(Transactional)
+	return ok
+}
+
+// A BlockHandlerV2 that holds saved blocks back before writing them out can implement
+// BlockFlusher, so that Sync writes them out too.
+type BlockFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// A BlockHandlerV2 can also implement BlockCopier, so that a file copied within the filesystem
+// can share (or copy in place) the contents of its data blocks rather than have them read and
+// saved again. CopyBlock returns ErrNotSupported for a block it can't copy this way, which is then
+// copied as usual.
+type BlockCopier interface {
+	CopyBlock(ctx context.Context, source BlockNode, target BlockNode) error
+}
+
+// A BlockHandlerV2 can also implement StatsReporter to add its own counters to the Stats of the
+// filesystem. A handler that wraps another should include the counters of the inner handler.
+type StatsReporter interface {
+	HandlerStats() map[string]float64
+}
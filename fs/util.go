@@ -1,90 +1,95 @@
 package fs
 
 import (
-	"bytes"
-	"fmt"
-	"reflect"
-
 	"github.com/petar/GoLLRB/llrb"
 )
 
-import "encoding/gob"
+// The functions below decode the contents of a metadata block (see Codec), returning an
+// ErrCorruptBlock for the node if the contents can't be decoded
 
-func rawBlock(sb interface{}) []byte {
-	var buffer bytes.Buffer        // Stand-in for a network connection
-	enc := gob.NewEncoder(&buffer) // Will write to network.
-	fmt.Printf("Raw block on type %v\n", reflect.TypeOf(sb))
-	switch sb.(type) {
-	case *SearchTree:
-		// Need something special here
-		fmt.Println("Doing something special with a SearchTree")
-		st := sb.(*SearchTree)
-		enc.Encode(st.Node)
-		st.Tree.AscendGreaterOrEqual(st.Tree.Min(), func(i llrb.Item) bool {
-			enc.Encode(i)
-			return true
-		})
-		return buffer.Bytes()
-	default:
-		err := enc.Encode(sb)
-		if err == nil {
-			return buffer.Bytes()
-		}
-	}
-	return nil
+func getSuperBlockNode(node BlockNode, contents []byte) (*SuperBlockNode, error) {
+	var ret SuperBlockNode
+	err := decodeBlock(node, contents, &ret)
+	return &ret, err
 }
 
-func getRoute(contents []byte) *DataRoute {
-	buffer := bytes.NewBuffer(contents)
-	dec := gob.NewDecoder(buffer)
+func getRoute(node BlockNode, contents []byte) (*DataRoute, error) {
 	var ret DataRoute
-	dec.Decode(&ret)
-	return &ret
+	err := decodeBlock(node, contents, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
 }
 
-func getSearchTree(contents []byte) *SearchTree {
-	buffer := bytes.NewBuffer(contents)
-	dec := gob.NewDecoder(buffer)
-	var ret SearchTree
-	var node BlockNode
-	dec.Decode(&node)
-	ret.Node = node
-	ret.Tree = llrb.New()
-	for {
-		var element SearchEntry
-		err := dec.Decode(&element)
-		if err == nil {
-			fmt.Printf("Adding entry %v", element)
-			ret.Tree.ReplaceOrInsert(element)
-		} else {
-			break
-		}
-	}
-	return &ret
+func getSearchTree(node BlockNode, contents []byte) (*SearchTree, error) {
+	codec, body, err := splitBlockHeader(node, contents)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		return decodeLegacySearchTree(node, body)
+	}
+	var block searchTreeBlock
+	err = codec.Unmarshal(body, &block)
+	if err != nil {
+		return nil, &ErrCorruptBlock{node, err.Error()}
+	}
+	ret := &SearchTree{Node: block.Node, Tree: llrb.New()}
+	for _, element := range block.Entries {
+		ret.Tree.ReplaceOrInsert(element)
+	}
+	return ret, nil
 }
 
-func getSearchIndex(contents []byte) *SearchIndex {
-	buffer := bytes.NewBuffer(contents)
-	dec := gob.NewDecoder(buffer)
+func getSearchIndex(node BlockNode, contents []byte) (*SearchIndex, error) {
 	var ret SearchIndex
-	dec.Decode(&ret)
-	return &ret
+	err := decodeBlock(node, contents, &ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Terms == nil {
+		ret.Terms = make(map[string]BlockNode)
+	}
+	return &ret, nil
 }
 
-func getDirectoryNode(contents []byte) *DirectoryNode {
-	buffer := bytes.NewBuffer(contents)
-
-	dec := gob.NewDecoder(buffer)
+func getDirectoryNode(node BlockNode, contents []byte) (*DirectoryNode, error) {
 	var ret DirectoryNode
-	dec.Decode(&ret)
-	return &ret
+	err := decodeBlock(node, contents, &ret)
+	if err != nil {
+		return nil, err
+	}
+	// Empty maps are not written by every codec
+	if ret.Folders == nil {
+		ret.Folders = make(map[string]BlockNode)
+	}
+	if ret.Files == nil {
+		ret.Files = make(map[string]BlockNode)
+	}
+	if ret.Attributes == nil {
+		ret.Attributes = make(map[string]interface{})
+	}
+	return &ret, nil
 }
 
-func getFileNode(contents []byte) *FileNode {
-	buffer := bytes.NewBuffer(contents)
-
-	dec := gob.NewDecoder(buffer)
+func getFileNode(node BlockNode, contents []byte) (*FileNode, error) {
 	var ret FileNode
-	dec.Decode(&ret)
-	return &ret
+	err := decodeBlock(node, contents, &ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.DataBlocks == nil {
+		ret.DataBlocks = make(map[string]BlockNode)
+	}
+	if ret.AlternateRoutes == nil {
+		ret.AlternateRoutes = make(map[string]BlockNode)
+	}
+	if ret.Attributes == nil {
+		ret.Attributes = make(map[string]interface{})
+	}
+	if ret.DataBlockSizes == nil {
+		ret.DataBlockSizes = make(map[string]int)
+	}
+	return &ret, nil
 }
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"errors"
+)
+
+// Write the data into the file at the offset, creating the file if it doesn't exist. Writing past
+// the end of the file fills the gap with zeros.
+//
+// Only the data blocks that the data falls in are rewritten, into new blocks, and the new route is
+// saved as a new version. The blocks they replace are left alone so the earlier versions can still
+// be read (until the garbage collector finds no version uses them).
+func (rfs *RootFileSystem) WriteAt(fileName string, offset int, data []byte) (err error) {
+	defer rfs.beginUpdate()(&err)
+	if offset < 0 {
+		return errors.New("Negative offset")
+	}
+	fn, err := rfs.retrieveFn(fileName, true)
+	if err != nil {
+		return err
+	}
+	return rfs.rewriteRange(fileName, fn, offset, data, false)
+}
+
+// Change the size of the file, dropping everything after size or filling the file with zeros up
+// to it. As with WriteAt only the block the end of the file falls in is rewritten, and the new
+// size is saved as a new version.
+func (rfs *RootFileSystem) Truncate(fileName string, size int) (err error) {
+	defer rfs.beginUpdate()(&err)
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	fn, err := rfs.retrieveFn(fileName, false)
+	if err != nil {
+		return err
+	}
+	return rfs.rewriteRange(fileName, fn, size, nil, true)
+}
+
+// Replace the bytes from offset with the data, dropping everything after it if truncate is set,
+// and save the result as a new version. The blocks before and after the range are kept as they
+// are; the parts of the first and last blocks outside the range are written with the data into
+// new blocks of at most BlockSize bytes. A gap between the end of the file and the offset is
+// written a block of zeros at a time, so it is never held whole.
+func (rfs *RootFileSystem) rewriteRange(fullPath string, fn *FileNode, offset int, data []byte, truncate bool) error {
+	names := fn.DefaultRoute.DataBlockNames
+	sizes := make([]int, len(names))
+	total := 0
+	for i, name := range names {
+		size, err := rfs.blockSize(fn, name)
+		if err != nil {
+			return err
+		}
+		sizes[i] = size
+		total += size
+	}
+	gap := 0
+	if offset > total {
+		gap, offset = offset-total, total
+	}
+	end := offset + gap + len(data)
+	if gap == 0 && len(data) == 0 && (!truncate || end == total) {
+		return nil
+	}
+
+	// Find the blocks before and after the range, and what is kept of the blocks it falls in
+	before := make([]string, 0, len(names))
+	after := make([]string, 0)
+	var head, tail []byte
+	start := 0
+	for i, name := range names {
+		blockEnd := start + sizes[i]
+		switch {
+		case blockEnd <= offset:
+			before = append(before, name)
+		case start >= end:
+			if !truncate {
+				after = append(after, name)
+			}
+		default:
+			block, err := rfs.BlockHandler.GetRawBlock(rfs.Context, fn.DataBlocks[name])
+			if err != nil {
+				return err
+			}
+			if len(block) != sizes[i] {
+				return &ErrCorruptBlock{fn.DataBlocks[name], "Block is not the size recorded for it"}
+			}
+			if start < offset {
+				head = block[:offset-start]
+			}
+			if blockEnd > end && !truncate {
+				tail = block[end-start:]
+			}
+		}
+		start = blockEnd
+	}
+
+	// Whole blocks of the gap are written on their own, the rest of it goes before the data (the
+	// gap starts at the end of the file, so there is no head)
+	blockSize := rfs.SuperBlock.BlockSize
+	zeros := make([]byte, blockSize)
+	contents := make([]byte, 0, len(head)+gap%blockSize+len(data)+len(tail))
+	contents = append(append(append(append(contents, head...), zeros[:gap%blockSize]...), data...), tail...)
+	oldNames, oldSize := names, fn.Stats.Size
+	added := make([]string, 0)
+	write := func(toWrite []byte) error {
+		keyName := fn.nextKeyName()
+		// writeDataBlock adds the key to the end of the default route, which is rebuilt below
+		err := rfs.writeDataBlock(fn, keyName, toWrite, false)
+		if _, ok := fn.DataBlocks[keyName]; ok {
+			added = append(added, keyName)
+		}
+		if err != nil {
+			fn.DefaultRoute.DataBlockNames = oldNames
+			rfs.removeDataBlocks(fn, added)
+		}
+		return err
+	}
+	for i := 0; i < gap/blockSize; i++ {
+		if err := write(zeros); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(contents); i = i + blockSize {
+		toWrite := contents[i:]
+		if len(toWrite) > blockSize {
+			toWrite = toWrite[:blockSize]
+		}
+		if err := write(toWrite); err != nil {
+			return err
+		}
+	}
+	route := make([]string, 0, len(before)+len(added)+len(after))
+	route = append(append(append(route, before...), added...), after...)
+	fn.DefaultRoute.DataBlockNames = route
+	if truncate || end > total {
+		fn.Stats.Size = end
+	} else {
+		fn.Stats.Size = total
+	}
+	if err := rfs.saveVersion(fn); err != nil {
+		fn.DefaultRoute.DataBlockNames = oldNames
+		fn.Stats.Size = oldSize
+		rfs.removeDataBlocks(fn, added)
+		return err
+	}
+	return rfs.addWordIndex(fullPath, fn)
+}
@@ -0,0 +1,300 @@
+// Adapter presenting a RootFileSystem as an io/fs.FS, so that a pmfs tree can be passed to
+// anything that reads one (http.FS, template.ParseFS, fs.WalkDir and so on). Directories and files
+// map onto fs.File, fs.FileInfo and fs.DirEntry, with the size, modification time and permissions
+// taken from their FileStats. Files are read a block at a time through RootFileSystem.Open, so
+// they can be read with Seek and ReadAt as well as Read.
+//
+// The adapter can be pinned to a version tag, in which case each file is read as it was at that
+// version and files that don't have it are left out.
+//
+// Example:
+//
+//	http.Handle("/", http.FileServer(http.FS(iofs.New(&f))))
+package iofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	pmfs "github.com/amkimian/pmfs/fs"
+)
+
+type FS struct {
+	Fs *pmfs.RootFileSystem
+	// The version tag to read files at, the latest version if empty
+	Tag string
+}
+
+var _ fs.ReadDirFS = (*FS)(nil)
+var _ fs.ReadFileFS = (*FS)(nil)
+var _ fs.StatFS = (*FS)(nil)
+
+// The latest version of every file in the filesystem
+func New(rfs *pmfs.RootFileSystem) *FS {
+	return &FS{Fs: rfs}
+}
+
+// The files in the filesystem that have the version tag, as they were at that version
+func NewAtTag(rfs *pmfs.RootFileSystem, tag string) *FS {
+	return &FS{Fs: rfs, Tag: tag}
+}
+
+// The directory or file with the name, which must be valid for fs.ValidPath
+func (fsys *FS) lookup(op string, name string) (*pmfs.DirectoryNode, *pmfs.FileNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dn, err := fsys.Fs.ChangeCache.GetDirectoryNode(fsys.Fs.SuperBlock.RootDirectory)
+	if err != nil || name == "." {
+		return dn, nil, pathError(op, name, err)
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if node, ok := dn.Folders[part]; ok {
+			if dn, err = fsys.Fs.ChangeCache.GetDirectoryNode(node); err != nil {
+				return nil, nil, pathError(op, name, err)
+			}
+			continue
+		}
+		if node, ok := dn.Files[part]; ok && i == len(parts)-1 {
+			fn, err := fsys.Fs.ChangeCache.GetFileNode(node)
+			if err != nil {
+				return nil, nil, pathError(op, name, err)
+			}
+			if fsys.hasTag(fn) {
+				return nil, fn, nil
+			}
+		}
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return dn, nil, nil
+}
+
+func pathError(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *FS) hasTag(fn *pmfs.FileNode) bool {
+	if fsys.Tag == "" {
+		return true
+	}
+	_, ok := fn.AlternateRoutes[fsys.Tag]
+	return ok
+}
+
+// The path of a name within the filesystem
+func fullPath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	dn, fn, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if dn != nil {
+		return &dir{fsys: fsys, name: name, node: dn}, nil
+	}
+	var f *pmfs.File
+	if fsys.Tag == "" {
+		f, err = fsys.Fs.Open(fullPath(name))
+	} else {
+		f, err = fsys.Fs.OpenTag(fullPath(name), fsys.Tag)
+	}
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &file{File: f, info: fileInfo(path.Base(name), fn, f.Size())}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	dn, fn, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if dn != nil {
+		return dirInfo(path.Base(name), dn), nil
+	}
+	return fsys.fileInfo(name, fn)
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	_, fn, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if fn == nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	var data []byte
+	if fsys.Tag == "" {
+		data, err = fsys.Fs.ReadFile(fullPath(name))
+	} else {
+		data, err = fsys.Fs.ReadFileTag(fullPath(name), fsys.Tag)
+	}
+	return data, pathError("read", name, err)
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dn, _, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if dn == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.entries(name, dn)
+}
+
+// The entries of a directory, sorted by name
+func (fsys *FS) entries(name string, dn *pmfs.DirectoryNode) ([]fs.DirEntry, error) {
+	entries := make([]fs.DirEntry, 0, len(dn.Folders)+len(dn.Files))
+	for entryName := range dn.Folders {
+		entries = append(entries, &dirEntry{fsys: fsys, name: path.Join(name, entryName), dir: true})
+	}
+	for entryName, node := range dn.Files {
+		if fsys.Tag != "" {
+			fn, err := fsys.Fs.ChangeCache.GetFileNode(node)
+			if err != nil {
+				return nil, pathError("readdir", name, err)
+			}
+			if !fsys.hasTag(fn) {
+				continue
+			}
+		}
+		entries = append(entries, &dirEntry{fsys: fsys, name: path.Join(name, entryName)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// The FileInfo of a file, at the version tag if there is one
+func (fsys *FS) fileInfo(name string, fn *pmfs.FileNode) (fs.FileInfo, error) {
+	size := int64(fn.Stats.Size)
+	if fsys.Tag != "" {
+		f, err := fsys.Fs.OpenTag(fullPath(name), fsys.Tag)
+		if err != nil {
+			return nil, pathError("stat", name, err)
+		}
+		size = f.Size()
+		f.Close()
+	}
+	return fileInfo(path.Base(name), fn, size), nil
+}
+
+type info struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	sys     interface{}
+}
+
+func fileInfo(name string, fn *pmfs.FileNode, size int64) *info {
+	return &info{name, size, fs.FileMode(fn.Stats.Permissions) & fs.ModePerm, fn.Stats.Modified, fn}
+}
+
+func dirInfo(name string, dn *pmfs.DirectoryNode) *info {
+	return &info{name, 0, fs.ModeDir | fs.FileMode(dn.Stats.Permissions)&fs.ModePerm, dn.Stats.Modified, dn}
+}
+
+func (i *info) Name() string       { return i.name }
+func (i *info) Size() int64        { return i.size }
+func (i *info) Mode() fs.FileMode  { return i.mode }
+func (i *info) ModTime() time.Time { return i.modTime }
+func (i *info) IsDir() bool        { return i.mode.IsDir() }
+
+// The *pmfs.DirectoryNode or *pmfs.FileNode
+func (i *info) Sys() interface{} { return i.sys }
+
+// An entry read from a directory, its FileInfo is looked up when it is asked for
+type dirEntry struct {
+	fsys *FS
+	name string
+	dir  bool
+}
+
+func (e *dirEntry) Name() string { return path.Base(e.name) }
+func (e *dirEntry) IsDir() bool  { return e.dir }
+
+func (e *dirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	return e.fsys.Stat(e.name)
+}
+
+func (e *dirEntry) String() string {
+	return fs.FormatDirEntry(e)
+}
+
+// An open file, read through a pmfs.File
+type file struct {
+	*pmfs.File
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// An open directory
+type dir struct {
+	fsys    *FS
+	name    string
+	node    *pmfs.DirectoryNode
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return dirInfo(path.Base(d.name), d.node), nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+// The next n entries of the directory, or all of the rest if n <= 0
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.entries(d.name, d.node)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = d.entries[len(entries):]
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+package iofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/amkimian/pmfs/blocktest"
+	pmfs "github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+)
+
+func newFileSystem(m *testing.T) *pmfs.RootFileSystem {
+	f := blocktest.NewFileSystem(m, pmfs.AdaptBlockHandler(&memory.MemoryFileSystem{}), "", 1000, 10)
+	f.WriteFile("/top", []byte("At the top"))
+	f.WriteFile("/docs/readme.txt", []byte("Read me, spread over a few blocks"))
+	f.AppendFile("/docs/readme.txt", []byte(" and a second version"))
+	f.WriteFile("/docs/guide/one", []byte("The first page"))
+	f.WriteFile("/docs/guide/two", []byte(""))
+	f.MakeDirectory("/empty")
+	return f
+}
+
+func TestFS(m *testing.T) {
+	f := newFileSystem(m)
+	fsys := New(f)
+	if err := fstest.TestFS(fsys, "top", "docs/readme.txt", "docs/guide/one", "docs/guide/two", "empty"); err != nil {
+		m.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "docs/readme.txt")
+	if err != nil || string(data) != "Read me, spread over a few blocks and a second version" {
+		m.Errorf("Read %q, %v", data, err)
+	}
+	if _, err := fsys.Open("docs/missing"); !errors.Is(err, fs.ErrNotExist) {
+		m.Errorf("Expected a missing file not to exist, got %v", err)
+	}
+	if _, err := fsys.Open("/top"); !errors.Is(err, fs.ErrInvalid) {
+		m.Errorf("Expected an invalid path to be refused, got %v", err)
+	}
+	info, err := fs.Stat(fsys, "docs")
+	if err != nil || !info.IsDir() {
+		m.Errorf("Expected a directory, got %v, %v", info, err)
+	}
+
+	// Served over http, which seeks to find the size
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	response, err := http.Get(server.URL + "/docs/guide/one")
+	if err != nil {
+		m.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "The first page" {
+		m.Errorf("Served %q", body)
+	}
+}
+
+func TestTag(m *testing.T) {
+	f := newFileSystem(m)
+	fsys := NewAtTag(f, "v000000001")
+	if err := fstest.TestFS(fsys, "top", "docs/readme.txt", "docs/guide/one"); err != nil {
+		m.Fatal(err)
+	}
+	if data, _ := fs.ReadFile(fsys, "docs/readme.txt"); string(data) != "Read me, spread over a few blocks" {
+		m.Errorf("Expected the first version, got %q", data)
+	}
+	if info, _ := fs.Stat(fsys, "docs/readme.txt"); info.Size() != int64(len("Read me, spread over a few blocks")) {
+		m.Errorf("Expected the size of the first version, got %d", info.Size())
+	}
+
+	// A file without the tag is left out
+	f.WriteFile("/docs/guide/one", []byte("Rewritten, so the versions start again"))
+	if _, err := fs.Stat(fsys, "docs/guide/one"); !errors.Is(err, fs.ErrNotExist) {
+		m.Errorf("Expected the rewritten file to be left out, got %v", err)
+	}
+	entries, _ := fs.ReadDir(fsys, "docs/guide")
+	for _, entry := range entries {
+		if entry.Name() == "one" {
+			m.Errorf("Expected the rewritten file not to be listed")
+		}
+	}
+}
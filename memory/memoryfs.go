@@ -11,15 +11,30 @@
 package memory
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/amkimian/pmfs/fs"
 )
 
-// The MemoryFileSystem simply contains a map of blocks and an ever increasing next node id
+// The first node id handed out by a freshly formatted memory file system
+const firstNodeId = 20000
+
+// The MemoryFileSystem simply contains a map of blocks, the next never used node id and a list of
+// node ids that have been freed and can be handed out again. At most BlockCount nodes (including the
+// super block) can be in use at once.
 type MemoryFileSystem struct {
 	Blocks          map[fs.BlockNode][]byte
 	UnusedNodeStart int
+	BlockCount      int
+	FreeNodes       []int
+	allocated       map[int]bool
+	lock            sync.Mutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("memory", func() fs.BlockHandlerV2 { return fs.AdaptBlockHandler(&MemoryFileSystem{}) })
 }
 
 // Initialize the file system (does nothing for the memory filesystem)
@@ -30,44 +45,139 @@ func (mfs *MemoryFileSystem) Init(configuration string) {
 func (mfs *MemoryFileSystem) Format(blockCount int, blockSize int) {
 	// Initialize a new memory file system
 	//fmt.Println("Format memory filesystem")
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
 	mfs.Blocks = make(map[fs.BlockNode][]byte)
-	mfs.UnusedNodeStart = 20000
+	mfs.UnusedNodeStart = firstNodeId
+	mfs.BlockCount = blockCount
+	mfs.FreeNodes = make([]int, 0)
+	mfs.allocated = make(map[int]bool)
 }
 
-// Simply returns the next free node id
+// Returns a previously freed node id if there is one, otherwise the next never used node id.
+// Returns fs.NilBlock if BlockCount nodes are already in use.
 func (mfs *MemoryFileSystem) GetFreeBlockNode(NodeType fs.BlockNodeType) fs.BlockNode {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	id := mfs.allocate()
+	if id < 0 {
+		return fs.NilBlock
+	}
 	var node fs.BlockNode
 	node.Type = NodeType
-	node.Id = mfs.UnusedNodeStart
-	mfs.UnusedNodeStart = mfs.UnusedNodeStart + 1
+	node.Id = id
 	return node
 }
 
 func (mfs *MemoryFileSystem) GetFreeDataBlockNode(parent fs.BlockNode, key string) fs.BlockNode {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	id := mfs.allocate()
+	if id < 0 {
+		return fs.NilBlock
+	}
 	var node fs.BlockNode
 	node.Type = fs.DATA
 	node.RelativeTo = parent.Id
-	node.Id = mfs.UnusedNodeStart
-	mfs.UnusedNodeStart = mfs.UnusedNodeStart + 1
+	node.Id = id
 	return node
 }
 
+// Must be called with the lock held
+func (mfs *MemoryFileSystem) allocate() int {
+	if mfs.allocated == nil {
+		mfs.allocated = make(map[int]bool)
+	}
+	var id int
+	if len(mfs.FreeNodes) > 0 {
+		id = mfs.FreeNodes[len(mfs.FreeNodes)-1]
+		mfs.FreeNodes = mfs.FreeNodes[:len(mfs.FreeNodes)-1]
+	} else {
+		// The super block always takes one of the blocks
+		if mfs.BlockCount > 0 && len(mfs.allocated)+1 >= mfs.BlockCount {
+			return -1
+		}
+		id = mfs.UnusedNodeStart
+		mfs.UnusedNodeStart = mfs.UnusedNodeStart + 1
+	}
+	mfs.allocated[id] = true
+	return id
+}
+
+// Returns a copy of the block, or nil if it has not been saved
 func (mfs *MemoryFileSystem) GetRawBlock(node fs.BlockNode) []byte {
-	return mfs.Blocks[node]
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	data, ok := mfs.Blocks[node]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, data...)
 }
 
+// Saves a copy of the data, so the caller is free to change it afterwards
 func (mfs *MemoryFileSystem) SaveRawBlock(node fs.BlockNode, data []byte) fs.BlockNode {
-	mfs.Blocks[node] = data
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	mfs.Blocks[node] = append([]byte{}, data...)
 	return node
 }
 
+// Claim the id of a node handed out by another handler (e.g. when mirroring), so that it is never
+// handed out here
+func (mfs *MemoryFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	if node.Type == fs.SUPERBLOCK || mfs.allocated[node.Id] {
+		return nil
+	}
+	if mfs.allocated == nil {
+		mfs.allocated = make(map[int]bool)
+	}
+	mfs.allocated[node.Id] = true
+	if node.Id >= mfs.UnusedNodeStart {
+		mfs.UnusedNodeStart = node.Id + 1
+		return nil
+	}
+	for i, id := range mfs.FreeNodes {
+		if id == node.Id {
+			mfs.FreeNodes = append(mfs.FreeNodes[:i], mfs.FreeNodes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Remove the blocks, returning their node ids to the free list
 func (mfs *MemoryFileSystem) FreeBlocks(blocks []fs.BlockNode) {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
 	for i := range blocks {
 		delete(mfs.Blocks, blocks[i])
+		if mfs.allocated[blocks[i].Id] {
+			delete(mfs.allocated, blocks[i].Id)
+			mfs.FreeNodes = append(mfs.FreeNodes, blocks[i].Id)
+		}
+	}
+}
+
+// Every block that has been saved and not freed
+func (mfs *MemoryFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	blocks := make([]fs.BlockNode, 0, len(mfs.Blocks))
+	for node := range mfs.Blocks {
+		blocks = append(blocks, node)
 	}
+	return blocks, nil
 }
 
 func (mfs *MemoryFileSystem) DumpInfo() {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
 	fmt.Printf("Memory file system: next block id %v\n", mfs.UnusedNodeStart)
-	fmt.Printf("Total blocks %v\n", len(mfs.Blocks))
+	fmt.Printf("Total blocks %v, free list %v, block count %v\n", len(mfs.Blocks), len(mfs.FreeNodes), mfs.BlockCount)
 }
@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+)
+
+func TestConformance(m *testing.T) {
+	blocktest.TestBlockHandler(m, func(m *testing.T) (fs.BlockHandlerV2, string) {
+		return fs.AdaptBlockHandler(&MemoryFileSystem{}), ""
+	})
+}
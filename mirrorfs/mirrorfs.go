@@ -0,0 +1,547 @@
+// Mirroring block handler - keeps a copy of every block in each of several inner handlers
+// (replicas). Writes go to every replica and succeed once WriteQuorum of them have succeeded,
+// reads come from the first healthy replica that has the block.
+//
+// A replica that fails a write is marked unhealthy and is no longer read from until it has been
+// brought back into line with Resync, which copies whatever is missing or different from a
+// healthy replica (and can be used to fill a replica that has been replaced). Verify compares the
+// replicas block by block, using a checksum of each, and reports where they have diverged.
+//
+// Health is not stored anywhere, so Init compares the replicas and marks as unhealthy any that
+// disagree with most of the others about a block, such as one that missed writes before a
+// restart. That can only tell which replica is behind when the WriteQuorum is more than half the
+// replicas; where the replicas are evenly split none of them is trusted until SetHealthy is used
+// to say which is up to date. Replicas that aren't BlockListers can't be compared and are left
+// healthy.
+//
+// Nodes are handed out by the first healthy replica; replicas that place blocks themselves should
+// be BlockReservers (as the disk handler is) so that they can keep the node free until it is saved.
+// Verify and Resync need the replicas to be BlockListers.
+//
+// The configuration string passed to Init is the configuration of each replica, including its
+// scheme, separated by semicolons. An item of "quorum=N" sets the WriteQuorum, e.g.
+// "mirror:quorum=1;disk:/mnt/a/data.pmfs;disk:/mnt/b/data.pmfs". When Replicas is set before Init
+// the configuration is passed to each of them as it is.
+package mirrorfs
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type MirrorFileSystem struct {
+	Replicas []fs.BlockHandlerV2
+	// The number of replicas a save or free must succeed on, all of them if this is 0
+	WriteQuorum int
+	healthy     []bool
+	stats       mirrorStats
+	lock        sync.Mutex
+	// Held for writing by Resync, so that nothing changes while a replica is copied
+	resyncLock sync.RWMutex
+}
+
+type mirrorStats struct {
+	FailedWrites   int64
+	DivergentReads int64
+	Resynced       int64
+}
+
+// A block that is not the same on every replica. Missing lists the replicas that don't have it and
+// Different those whose contents don't match the first healthy replica that does.
+type Divergence struct {
+	Node      fs.BlockNode
+	Missing   []int
+	Different []int
+}
+
+func init() {
+	fs.RegisterBlockHandler("mirror", func() fs.BlockHandlerV2 { return &MirrorFileSystem{} })
+}
+
+// Create the replicas from the configuration if there aren't any, and initialize them
+func (mfs *MirrorFileSystem) Init(ctx context.Context, configuration string) error {
+	configurations := make([]string, 0)
+	if len(mfs.Replicas) == 0 {
+		for _, item := range strings.Split(configuration, ";") {
+			if strings.HasPrefix(item, "quorum=") {
+				quorum, err := strconv.Atoi(item[len("quorum="):])
+				if err != nil {
+					return err
+				}
+				mfs.WriteQuorum = quorum
+				continue
+			}
+			handler, rest, err := fs.NewBlockHandler(item)
+			if err != nil {
+				return err
+			}
+			mfs.Replicas = append(mfs.Replicas, handler)
+			configurations = append(configurations, rest)
+		}
+	} else {
+		for range mfs.Replicas {
+			configurations = append(configurations, configuration)
+		}
+	}
+	if len(mfs.Replicas) == 0 {
+		return fmt.Errorf("No replicas to mirror")
+	}
+	if mfs.WriteQuorum > len(mfs.Replicas) {
+		return fmt.Errorf("A write quorum of %d needs at least as many replicas", mfs.WriteQuorum)
+	}
+	mfs.lock.Lock()
+	mfs.healthy = make([]bool, len(mfs.Replicas))
+	mfs.stats = mirrorStats{}
+	mfs.lock.Unlock()
+	for i, replica := range mfs.Replicas {
+		if err := replica.Init(ctx, configurations[i]); err != nil {
+			return err
+		}
+		mfs.SetHealthy(i, true)
+	}
+	return mfs.compareReplicas(ctx)
+}
+
+// Mark as unhealthy every replica that can't be read or that is outvoted about a block, with a
+// replica that doesn't have the block counting as a vote for it being free. A block the replicas
+// are evenly split about marks all of them.
+func (mfs *MirrorFileSystem) compareReplicas(ctx context.Context) error {
+	all := make([]map[fs.BlockNode]uint32, len(mfs.Replicas))
+	nodes := make(map[fs.BlockNode]bool)
+	for i, replica := range mfs.Replicas {
+		sums, err := checksums(ctx, replica)
+		if err == fs.ErrNotSupported {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			mfs.SetHealthy(i, false)
+			continue
+		}
+		all[i] = sums
+		for node := range sums {
+			nodes[node] = true
+		}
+	}
+	for node := range nodes {
+		// The replicas holding each checksum, with -1 for those that don't have the block
+		votes := make(map[int64][]int)
+		for i, sums := range all {
+			if sums == nil {
+				continue
+			}
+			sum, ok := sums[node]
+			key := int64(-1)
+			if ok {
+				key = int64(sum)
+			}
+			votes[key] = append(votes[key], i)
+		}
+		most, tied := 0, false
+		for _, replicas := range votes {
+			if len(replicas) > most {
+				most, tied = len(replicas), false
+			} else if len(replicas) == most {
+				tied = true
+			}
+		}
+		for _, replicas := range votes {
+			if len(replicas) < most || tied {
+				for _, i := range replicas {
+					mfs.SetHealthy(i, false)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Mark a replica as healthy or not, e.g. to say which replica is up to date when Init couldn't
+// tell, so that the others can be brought into line with Resync
+func (mfs *MirrorFileSystem) SetHealthy(i int, healthy bool) {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	mfs.healthy[i] = healthy
+}
+
+// Whether each replica is healthy
+func (mfs *MirrorFileSystem) Health() []bool {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	return append([]bool(nil), mfs.healthy...)
+}
+
+// The indexes of the healthy replicas, in order
+func (mfs *MirrorFileSystem) healthyReplicas() []int {
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	replicas := make([]int, 0, len(mfs.healthy))
+	for i, healthy := range mfs.healthy {
+		if healthy {
+			replicas = append(replicas, i)
+		}
+	}
+	return replicas
+}
+
+func (mfs *MirrorFileSystem) quorum() int {
+	if mfs.WriteQuorum <= 0 {
+		return len(mfs.Replicas)
+	}
+	return mfs.WriteQuorum
+}
+
+// Run the operation on every replica, marking those it fails on as unhealthy. Succeeds if it
+// succeeded on at least the write quorum, otherwise returns the first error.
+func (mfs *MirrorFileSystem) write(ctx context.Context, op func(replica fs.BlockHandlerV2) error) error {
+	mfs.resyncLock.RLock()
+	defer mfs.resyncLock.RUnlock()
+	succeeded := 0
+	var firstErr error
+	for i, replica := range mfs.Replicas {
+		if err := op(replica); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			mfs.lock.Lock()
+			mfs.healthy[i] = false
+			mfs.stats.FailedWrites++
+			mfs.lock.Unlock()
+			continue
+		}
+		succeeded++
+	}
+	if succeeded >= mfs.quorum() {
+		return nil
+	}
+	return firstErr
+}
+
+// Every replica that formats is empty, and so in line with the others, and is marked as healthy.
+// Those that fail to format are marked as unhealthy.
+func (mfs *MirrorFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	for i := range mfs.Replicas {
+		mfs.SetHealthy(i, true)
+	}
+	return mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		return replica.Format(ctx, blockCount, blockSize)
+	})
+}
+
+// Take a node from the first healthy replica that has one and reserve it on the others
+func (mfs *MirrorFileSystem) allocate(ctx context.Context, get func(replica fs.BlockHandlerV2) (fs.BlockNode, error)) (fs.BlockNode, error) {
+	var err error = fs.ErrNoSpace
+	for _, i := range mfs.healthyReplicas() {
+		var node fs.BlockNode
+		node, err = get(mfs.Replicas[i])
+		if err != nil {
+			continue
+		}
+		return node, mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+			if reserver, ok := replica.(fs.BlockReserver); ok && replica != mfs.Replicas[i] {
+				return reserver.ReserveBlockNode(ctx, node)
+			}
+			return nil
+		})
+	}
+	return fs.NilBlock, err
+}
+
+func (mfs *MirrorFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return mfs.allocate(ctx, func(replica fs.BlockHandlerV2) (fs.BlockNode, error) {
+		return replica.GetFreeBlockNode(ctx, NodeType)
+	})
+}
+
+func (mfs *MirrorFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return mfs.allocate(ctx, func(replica fs.BlockHandlerV2) (fs.BlockNode, error) {
+		return replica.GetFreeDataBlockNode(ctx, parent, id)
+	})
+}
+
+// Read the block from the first healthy replica, falling back to the next if it is missing or
+// can't be read there
+func (mfs *MirrorFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	var firstErr error
+	for _, i := range mfs.healthyReplicas() {
+		data, err := mfs.Replicas[i].GetRawBlock(ctx, node)
+		if err == nil {
+			if firstErr != nil {
+				mfs.lock.Lock()
+				mfs.stats.DivergentReads++
+				mfs.lock.Unlock()
+			}
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return nil, fmt.Errorf("No healthy replicas")
+	}
+	return nil, firstErr
+}
+
+func (mfs *MirrorFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	err := mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		_, err := replica.SaveRawBlock(ctx, node, data)
+		return err
+	})
+	return node, err
+}
+
+func (mfs *MirrorFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	return mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		return replica.FreeBlocks(ctx, blocks)
+	})
+}
+
+// Every block held by the first healthy replica
+func (mfs *MirrorFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	for _, i := range mfs.healthyReplicas() {
+		if lister, ok := mfs.Replicas[i].(fs.BlockLister); ok {
+			return lister.ListBlocks(ctx)
+		}
+		return nil, fs.ErrNotSupported
+	}
+	return nil, fmt.Errorf("No healthy replicas")
+}
+
+// Pass a transaction on to every replica that is Transactional. A commit, like a write, succeeds if
+// it succeeds on the write quorum, and the replicas it fails on are marked as unhealthy.
+func (mfs *MirrorFileSystem) Begin(ctx context.Context) {
+	for _, replica := range mfs.Replicas {
+		if tx, ok := replica.(fs.Transactional); ok {
+			tx.Begin(ctx)
+		}
+	}
+}
+
+func (mfs *MirrorFileSystem) Commit(ctx context.Context) error {
+	return mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		if tx, ok := replica.(fs.Transactional); ok {
+			return tx.Commit(ctx)
+		}
+		return nil
+	})
+}
+
+func (mfs *MirrorFileSystem) Rollback(ctx context.Context) {
+	for _, replica := range mfs.Replicas {
+		if tx, ok := replica.(fs.Transactional); ok {
+			tx.Rollback(ctx)
+		}
+	}
+}
+
+// Only when every replica is, as otherwise a change could be half applied to one of them
+func (mfs *MirrorFileSystem) InnerTransactional() bool {
+	for _, replica := range mfs.Replicas {
+		if !fs.IsTransactional(replica) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write out the blocks held back by every replica that is a BlockFlusher
+func (mfs *MirrorFileSystem) Flush(ctx context.Context) error {
+	return mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		if flusher, ok := replica.(fs.BlockFlusher); ok {
+			return flusher.Flush(ctx)
+		}
+		return nil
+	})
+}
+
+// Reserve the node in every replica that is a BlockReserver
+func (mfs *MirrorFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	return mfs.write(ctx, func(replica fs.BlockHandlerV2) error {
+		if reserver, ok := replica.(fs.BlockReserver); ok {
+			return reserver.ReserveBlockNode(ctx, node)
+		}
+		return nil
+	})
+}
+
+// The checksum of every block held by a replica
+func checksums(ctx context.Context, replica fs.BlockHandlerV2) (map[fs.BlockNode]uint32, error) {
+	lister, ok := replica.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	blocks, err := lister.ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[fs.BlockNode]uint32, len(blocks))
+	for _, node := range blocks {
+		data, err := replica.GetRawBlock(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		sums[node] = crc32.Checksum(data, castagnoli)
+	}
+	return sums, nil
+}
+
+// Compare every replica with the first healthy one, reporting every block that is missing or
+// different on any of them
+func (mfs *MirrorFileSystem) Verify(ctx context.Context) ([]Divergence, error) {
+	mfs.resyncLock.Lock()
+	defer mfs.resyncLock.Unlock()
+	healthy := mfs.healthyReplicas()
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("No healthy replicas")
+	}
+	all := make([]map[fs.BlockNode]uint32, len(mfs.Replicas))
+	nodes := make(map[fs.BlockNode]bool)
+	for i, replica := range mfs.Replicas {
+		sums, err := checksums(ctx, replica)
+		if err != nil {
+			return nil, err
+		}
+		all[i] = sums
+		for node := range sums {
+			nodes[node] = true
+		}
+	}
+	divergences := make([]Divergence, 0)
+	for node := range nodes {
+		var expected uint32
+		found := false
+		for _, i := range healthy {
+			if expected, found = all[i][node]; found {
+				break
+			}
+		}
+		divergence := Divergence{Node: node}
+		for i := range mfs.Replicas {
+			sum, ok := all[i][node]
+			if !ok {
+				divergence.Missing = append(divergence.Missing, i)
+			} else if found && sum != expected {
+				divergence.Different = append(divergence.Different, i)
+			}
+		}
+		if len(divergence.Missing) > 0 || len(divergence.Different) > 0 {
+			divergences = append(divergences, divergence)
+		}
+	}
+	sort.Slice(divergences, func(i, j int) bool { return divergences[i].Node.Id < divergences[j].Node.Id })
+	return divergences, nil
+}
+
+// Bring a replica into line with the first other healthy replica, copying blocks that are
+// missing or different and freeing blocks the healthy replica doesn't have, then mark it as
+// healthy. Returns the number of blocks copied or freed. A replica that has been replaced must be
+// initialized (and formatted, if the handler needs it) first.
+func (mfs *MirrorFileSystem) Resync(ctx context.Context, index int) (int, error) {
+	mfs.resyncLock.Lock()
+	defer mfs.resyncLock.Unlock()
+	source := -1
+	for _, i := range mfs.healthyReplicas() {
+		if i != index {
+			source = i
+			break
+		}
+	}
+	if source < 0 {
+		return 0, fmt.Errorf("No other healthy replica to resync replica %d from", index)
+	}
+	from, to := mfs.Replicas[source], mfs.Replicas[index]
+	want, err := checksums(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	have, err := checksums(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	extra := make([]fs.BlockNode, 0)
+	for node := range have {
+		if _, ok := want[node]; !ok {
+			extra = append(extra, node)
+		}
+	}
+	if len(extra) > 0 {
+		if err = to.FreeBlocks(ctx, extra); err != nil {
+			return changed, err
+		}
+		changed += len(extra)
+	}
+	reserver, _ := to.(fs.BlockReserver)
+	for node, sum := range want {
+		existing, ok := have[node]
+		if ok && existing == sum {
+			continue
+		}
+		data, err := from.GetRawBlock(ctx, node)
+		if err != nil {
+			return changed, err
+		}
+		if !ok && reserver != nil {
+			if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+				return changed, err
+			}
+		}
+		if _, err = to.SaveRawBlock(ctx, node, data); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	mfs.healthy[index] = true
+	mfs.stats.Resynced += int64(changed)
+	return changed, nil
+}
+
+// The number of healthy replicas, failed writes, reads that had to fall back to another replica
+// and blocks resynced, with the counters of the first replica
+func (mfs *MirrorFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := mfs.Replicas[0].(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	mfs.lock.Lock()
+	defer mfs.lock.Unlock()
+	healthy := 0
+	for _, h := range mfs.healthy {
+		if h {
+			healthy++
+		}
+	}
+	stats["mirror.healthy_replicas"] = float64(healthy)
+	stats["mirror.failed_writes"] = float64(mfs.stats.FailedWrites)
+	stats["mirror.divergent_reads"] = float64(mfs.stats.DivergentReads)
+	stats["mirror.resynced_blocks"] = float64(mfs.stats.Resynced)
+	return stats
+}
+
+func (mfs *MirrorFileSystem) DumpInfo() {
+	health := mfs.Health()
+	fmt.Printf("Mirrored file system with %d replicas, write quorum %d\n", len(mfs.Replicas), mfs.quorum())
+	for i, replica := range mfs.Replicas {
+		fmt.Printf("Replica %d healthy %v:\n", i, health[i])
+		replica.DumpInfo()
+	}
+}
@@ -0,0 +1,312 @@
+package mirrorfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/disk"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/tierfs"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+// A replica whose saves can be made to fail
+type failingReplica struct {
+	fs.BlockHandlerV2
+	fail bool
+}
+
+func (r *failingReplica) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if r.fail {
+		return fs.NilBlock, errors.New("Replica is down")
+	}
+	return r.BlockHandlerV2.SaveRawBlock(ctx, node, data)
+}
+
+func (r *failingReplica) Format(ctx context.Context, blockCount int, blockSize int) error {
+	if r.fail {
+		return errors.New("Replica is down")
+	}
+	return r.BlockHandlerV2.Format(ctx, blockCount, blockSize)
+}
+
+func (r *failingReplica) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	return r.BlockHandlerV2.(fs.BlockLister).ListBlocks(ctx)
+}
+
+func newMirror(m *testing.T, quorum int) (*MirrorFileSystem, []*memory.MemoryFileSystem, *failingReplica) {
+	memories := []*memory.MemoryFileSystem{{}, {}, {}}
+	failing := &failingReplica{BlockHandlerV2: fs.AdaptBlockHandler(memories[2])}
+	mfs := &MirrorFileSystem{
+		Replicas:    []fs.BlockHandlerV2{fs.AdaptBlockHandler(memories[0]), fs.AdaptBlockHandler(memories[1]), failing},
+		WriteQuorum: quorum,
+	}
+	ctx := context.Background()
+	if err := mfs.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	if err := mfs.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	return mfs, memories, failing
+}
+
+func TestWritesReachEveryReplica(m *testing.T) {
+	ctx := context.Background()
+	mfs, memories, _ := newMirror(m, 0)
+	node, _ := mfs.GetFreeBlockNode(ctx, fs.FILE)
+	if _, err := mfs.SaveRawBlock(ctx, node, []byte("Hello world")); err != nil {
+		m.Fatal(err)
+	}
+	for i, mh := range memories {
+		if string(mh.Blocks[node]) != "Hello world" {
+			m.Errorf("Replica %d has %q", i, mh.Blocks[node])
+		}
+	}
+
+	// Reads fall back to the next replica when the block is missing from the first
+	delete(memories[0].Blocks, node)
+	if x, err := mfs.GetRawBlock(ctx, node); err != nil || string(x) != "Hello world" {
+		m.Errorf("Expected the block from the second replica, got %q, %v", x, err)
+	}
+	if stats := mfs.HandlerStats(); stats["mirror.divergent_reads"] != 1 {
+		m.Errorf("Expected a divergent read, got %v", stats)
+	}
+
+	mfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	for i, mh := range memories {
+		if _, ok := mh.Blocks[node]; ok {
+			m.Errorf("Replica %d still has the freed block", i)
+		}
+	}
+}
+
+func TestWriteQuorum(m *testing.T) {
+	ctx := context.Background()
+	mfs, _, failing := newMirror(m, 0)
+	failing.fail = true
+	node, _ := mfs.GetFreeBlockNode(ctx, fs.FILE)
+	if _, err := mfs.SaveRawBlock(ctx, node, []byte("Hello world")); err == nil {
+		m.Errorf("Expected the save to fail without every replica")
+	}
+
+	mfs, _, failing = newMirror(m, 2)
+	failing.fail = true
+	node, _ = mfs.GetFreeBlockNode(ctx, fs.FILE)
+	if _, err := mfs.SaveRawBlock(ctx, node, []byte("Hello world")); err != nil {
+		m.Errorf("Expected the save to succeed on two replicas, got %v", err)
+	}
+	if health := mfs.Health(); !health[0] || !health[1] || health[2] {
+		m.Errorf("Expected the third replica to be unhealthy, got %v", health)
+	}
+	stats := mfs.HandlerStats()
+	if stats["mirror.healthy_replicas"] != 2 || stats["mirror.failed_writes"] != 1 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestVerifyAndResync(m *testing.T) {
+	ctx := context.Background()
+	mfs, memories, failing := newMirror(m, 2)
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < 5; i++ {
+		node, _ := mfs.GetFreeBlockNode(ctx, fs.FILE)
+		mfs.SaveRawBlock(ctx, node, []byte(fmt.Sprintf("Block %d", i)))
+		nodes = append(nodes, node)
+	}
+	if divergences, err := mfs.Verify(ctx); err != nil || len(divergences) != 0 {
+		m.Fatalf("Expected the replicas to match, got %v, %v", divergences, err)
+	}
+
+	// Miss a write on the third replica and damage a block on the second
+	failing.fail = true
+	mfs.SaveRawBlock(ctx, nodes[0], []byte("Rewritten"))
+	failing.fail = false
+	memories[1].Blocks[nodes[1]] = []byte("Damaged")
+	delete(memories[1].Blocks, nodes[2])
+
+	divergences, err := mfs.Verify(ctx)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(divergences) != 3 {
+		m.Fatalf("Expected three divergent blocks, got %v", divergences)
+	}
+	if divergences[0].Node != nodes[0] || len(divergences[0].Different) != 1 || divergences[0].Different[0] != 2 {
+		m.Errorf("Expected the third replica to differ, got %v", divergences[0])
+	}
+	if len(divergences[2].Missing) != 1 || divergences[2].Missing[0] != 1 {
+		m.Errorf("Expected the block to be missing from the second replica, got %v", divergences[2])
+	}
+
+	for _, i := range []int{1, 2} {
+		if _, err := mfs.Resync(ctx, i); err != nil {
+			m.Fatal(err)
+		}
+	}
+	if divergences, err := mfs.Verify(ctx); err != nil || len(divergences) != 0 {
+		m.Errorf("Expected the replicas to match after resync, got %v, %v", divergences, err)
+	}
+	if health := mfs.Health(); !health[2] {
+		m.Errorf("Expected the third replica to be healthy again")
+	}
+
+	// A replacement replica is filled from the others
+	replacement := &memory.MemoryFileSystem{}
+	mfs.Replicas[0] = fs.AdaptBlockHandler(replacement)
+	mfs.Replicas[0].Format(ctx, 100, 100)
+	if changed, err := mfs.Resync(ctx, 0); err != nil || changed != len(nodes) {
+		m.Errorf("Expected %d blocks copied, got %d, %v", len(nodes), changed, err)
+	}
+	if string(replacement.Blocks[nodes[0]]) != "Rewritten" {
+		m.Errorf("Replacement has %q", replacement.Blocks[nodes[0]])
+	}
+}
+
+func TestMirrorOnDisk(m *testing.T) {
+	dir := m.TempDir()
+	configuration := fmt.Sprintf("mirror:disk:%s;disk:%s", filepath.Join(dir, "a.pmfs"), filepath.Join(dir, "b.pmfs"))
+	f := blocktest.NewFileSystem(m, nil, configuration, 200, 64)
+	// Blocks bigger than a slot take continuations, which must not collide between the replicas
+	long := make([]byte, 500)
+	for i := range long {
+		long[i] = byte('a' + i%26)
+	}
+	f.WriteFile("/mirror/long", long)
+	f.WriteFile("/mirror/short", []byte("Hello world"))
+	f.ChangeCache.Flush()
+	if x, err := f.ReadFile("/mirror/long"); err != nil || string(x) != string(long) {
+		m.Errorf("File not read back, %v", err)
+	}
+	mfs := f.BlockHandler.(*MirrorFileSystem)
+	if _, ok := mfs.Replicas[1].(*disk.DiskFileSystem); !ok {
+		m.Fatalf("Expected disk replicas, got %T", mfs.Replicas[1])
+	}
+	if divergences, err := mfs.Verify(context.Background()); err != nil || len(divergences) != 0 {
+		m.Errorf("Expected the disk replicas to match, got %v, %v", divergences, err)
+	}
+}
+
+func TestFormatFailure(m *testing.T) {
+	ctx := context.Background()
+	mfs, _, failing := newMirror(m, 2)
+	failing.fail = true
+	if err := mfs.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	if health := mfs.Health(); !health[0] || !health[1] || health[2] {
+		m.Errorf("Expected the replica that failed to format to be unhealthy, got %v", health)
+	}
+}
+
+func TestInitFindsStaleReplica(m *testing.T) {
+	ctx := context.Background()
+	mfs, memories, failing := newMirror(m, 2)
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < 3; i++ {
+		node, _ := mfs.GetFreeBlockNode(ctx, fs.FILE)
+		mfs.SaveRawBlock(ctx, node, []byte(fmt.Sprintf("Block %d", i)))
+		nodes = append(nodes, node)
+	}
+	failing.fail = true
+	mfs.SaveRawBlock(ctx, nodes[0], []byte("Rewritten"))
+	failing.fail = false
+
+	// After a restart the replica that missed the write is put first, where it would be read from
+	restarted := &MirrorFileSystem{
+		Replicas:    []fs.BlockHandlerV2{failing, fs.AdaptBlockHandler(memories[0]), fs.AdaptBlockHandler(memories[1])},
+		WriteQuorum: 2,
+	}
+	if err := restarted.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	if health := restarted.Health(); health[0] || !health[1] || !health[2] {
+		m.Errorf("Expected the stale replica to be unhealthy, got %v", health)
+	}
+	if x, err := restarted.GetRawBlock(ctx, nodes[0]); err != nil || string(x) != "Rewritten" {
+		m.Errorf("Expected the rewritten block, got %q, %v", x, err)
+	}
+
+	// Two replicas that disagree can't be told apart, so neither is read from until one is chosen
+	pair := &MirrorFileSystem{Replicas: []fs.BlockHandlerV2{failing, fs.AdaptBlockHandler(memories[0])}, WriteQuorum: 1}
+	if err := pair.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	if _, err := pair.GetRawBlock(ctx, nodes[0]); err == nil {
+		m.Errorf("Expected no replica to be read from")
+	}
+	pair.SetHealthy(1, true)
+	if _, err := pair.Resync(ctx, 0); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := pair.GetRawBlock(ctx, nodes[0]); err != nil || string(x) != "Rewritten" {
+		m.Errorf("Expected the rewritten block after resync, got %q, %v", x, err)
+	}
+}
+
+func TestForwardsToReplicas(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(replicas ...fs.BlockHandlerV2) *MirrorFileSystem {
+		mfs := &MirrorFileSystem{Replicas: replicas}
+		if err := mfs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		mfs.Format(ctx, 100, 100)
+		return mfs
+	}
+	wal := func() fs.BlockHandlerV2 {
+		return &walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}}
+	}
+
+	// Transactions, only when every replica has them
+	if fs.IsTransactional(wrap(wal(), fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a mirror with a replica over memory not to be transactional")
+	}
+	mfs := wrap(wal(), wal())
+	if !fs.IsTransactional(mfs) {
+		m.Errorf("Expected a mirror over walfs to be transactional")
+	}
+	node, _ := mfs.GetFreeBlockNode(ctx, fs.FILE)
+	mfs.Begin(ctx)
+	mfs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	mfs.Rollback(ctx)
+	for i, replica := range mfs.Replicas {
+		if _, err := replica.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+			m.Errorf("Expected the save to be rolled back on replica %d, got %v", i, err)
+		}
+	}
+	mfs.Begin(ctx)
+	mfs.SaveRawBlock(ctx, node, []byte("Committed"))
+	if err := mfs.Commit(ctx); err != nil {
+		m.Fatal(err)
+	}
+	if x, err := mfs.Replicas[1].GetRawBlock(ctx, node); err != nil || string(x) != "Committed" {
+		m.Errorf("Expected the save to be committed, got %q, %v", x, err)
+	}
+
+	// Flushes
+	colds := []*memory.MemoryFileSystem{{}, {}}
+	mfs = wrap(&tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(colds[0])}, &tierfs.TieredFileSystem{Cold: fs.AdaptBlockHandler(colds[1])})
+	node, _ = mfs.GetFreeBlockNode(ctx, fs.DATA)
+	mfs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := mfs.Flush(ctx); err != nil || string(colds[1].Blocks[node]) != "Held back" {
+		m.Errorf("Expected the flush to reach the cold tiers, got %v", err)
+	}
+
+	// and reservations
+	memories := []*memory.MemoryFileSystem{{}, {}}
+	mfs = wrap(fs.AdaptBlockHandler(memories[0]), fs.AdaptBlockHandler(memories[1]))
+	node, _ = mfs.GetFreeBlockNode(ctx, fs.FILE)
+	mfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := mfs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh := memories[1].GetFreeBlockNode(fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out by the second replica")
+	}
+}
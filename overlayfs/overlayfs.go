@@ -0,0 +1,415 @@
+// Copy-on-write overlay block handler - layers a writable handler (the upper) over a read-only one
+// (the base), e.g. so that several filesystems can start from the same golden dataset. Blocks are
+// read from the upper if it has them and from the base otherwise; saves and frees only ever go to
+// the upper, a free of a block in the base being recorded there as a whiteout that hides it.
+//
+// Commit writes the changes held in the upper into the base and empties the upper, Discard just
+// empties it. Both should be run while nothing else is using the filesystem, and a filesystem
+// using the overlay must be mounted again (or its cache cleared) after a Discard. When the base is
+// Transactional (e.g. walfs) the changes are written as one transaction, so the base gets all of
+// them or none; otherwise a Commit that fails part way through leaves the upper as it was, and
+// running it again finishes it.
+//
+// The base is never formatted: an overlay over an existing filesystem is mounted, and Format only
+// formats the upper (so the filesystem starts empty, hiding the base). A new upper that needs
+// formatting must be formatted on its own (through Upper) before the filesystem is mounted.
+//
+// Nodes are handed out by the upper, which must not hand out any already used in the base, so the
+// base must be a BlockLister. An upper that is a BlockReserver has every id used in the base
+// reserved in it when the overlay is initialized; with any other upper the ids of the base are
+// skipped, and stay allocated there. The upper should be one that keys blocks by node (memory,
+// dirfs or s3) rather than packing them into slots it places itself.
+//
+// Each block in the upper starts with a tag byte, marking it as data or a whiteout, so the
+// whiteouts survive with the upper.
+//
+// The configuration string passed to Init is the configuration of the base and then the upper,
+// each including its scheme, separated by a semicolon, e.g.
+// "overlay:disk:/var/pmfs/golden.pmfs;dir:/var/pmfs/changes". When Base and Upper are set before
+// Init the configuration is passed to both of them as it is.
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+const (
+	dataTag     byte = 'B'
+	whiteoutTag byte = 'W'
+)
+
+type OverlayFileSystem struct {
+	Base  fs.BlockHandlerV2
+	Upper fs.BlockHandlerV2
+	// The ids of every block in the base, which the upper must not hand out
+	baseIds map[int]bool
+	// The blocks of the base hidden by a whiteout in the upper
+	whiteouts map[fs.BlockNode]bool
+	stats     overlayStats
+	statsLock sync.Mutex
+	lock      sync.RWMutex
+}
+
+type overlayStats struct {
+	BaseReads  int64
+	UpperReads int64
+	Committed  int64
+	Discarded  int64
+}
+
+func init() {
+	fs.RegisterBlockHandler("overlay", func() fs.BlockHandlerV2 { return &OverlayFileSystem{} })
+}
+
+// Create the base and upper from the configuration if there aren't any, initialize them and find
+// the blocks in the base and the whiteouts in the upper
+func (ofs *OverlayFileSystem) Init(ctx context.Context, configuration string) error {
+	baseConfiguration, upperConfiguration := configuration, configuration
+	if ofs.Base == nil || ofs.Upper == nil {
+		parts := strings.SplitN(configuration, ";", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Overlay configuration '%s' is not base;upper", configuration)
+		}
+		var err error
+		if ofs.Base, baseConfiguration, err = fs.NewBlockHandler(parts[0]); err != nil {
+			return err
+		}
+		if ofs.Upper, upperConfiguration, err = fs.NewBlockHandler(parts[1]); err != nil {
+			return err
+		}
+	}
+	if err := ofs.Base.Init(ctx, baseConfiguration); err != nil {
+		return err
+	}
+	if err := ofs.Upper.Init(ctx, upperConfiguration); err != nil {
+		return err
+	}
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	ofs.stats = overlayStats{}
+	return ofs.scan(ctx)
+}
+
+// Find the ids used in the base, reserving them in the upper, and the whiteouts in the upper. Must
+// be called with the lock held.
+func (ofs *OverlayFileSystem) scan(ctx context.Context) error {
+	ofs.baseIds = make(map[int]bool)
+	ofs.whiteouts = make(map[fs.BlockNode]bool)
+	lister, ok := ofs.Base.(fs.BlockLister)
+	if !ok {
+		return fmt.Errorf("The base of an overlay must be a BlockLister")
+	}
+	blocks, err := lister.ListBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range blocks {
+		ofs.baseIds[node.Id] = true
+	}
+	if reserver, ok := ofs.Upper.(fs.BlockReserver); ok {
+		// Highest first, so an upper that hands out ids in order moves past them all at once
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i].Id > blocks[j].Id })
+		for _, node := range blocks {
+			if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+				return err
+			}
+		}
+	}
+	upper, err := ofs.upperBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	for node, whiteout := range upper {
+		if whiteout {
+			ofs.whiteouts[node] = true
+		}
+	}
+	return nil
+}
+
+// Every block in the upper, and whether it is a whiteout
+func (ofs *OverlayFileSystem) upperBlocks(ctx context.Context) (map[fs.BlockNode]bool, error) {
+	blocks := make(map[fs.BlockNode]bool)
+	lister, ok := ofs.Upper.(fs.BlockLister)
+	if !ok {
+		return blocks, nil
+	}
+	nodes, err := lister.ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		raw, err := ofs.Upper.GetRawBlock(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		blocks[node] = len(raw) > 0 && raw[0] == whiteoutTag
+	}
+	return blocks, nil
+}
+
+// Format the upper only, hiding everything in the base
+func (ofs *OverlayFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	if err := ofs.Upper.Format(ctx, blockCount, blockSize); err != nil {
+		return err
+	}
+	return ofs.scan(ctx)
+}
+
+// Take nodes from the upper until there is one that isn't used in the base (the first, unless the
+// upper is not a BlockReserver). The ones skipped stay allocated in the upper, so they are not
+// handed out again.
+func (ofs *OverlayFileSystem) allocate(get func() (fs.BlockNode, error)) (fs.BlockNode, error) {
+	ofs.lock.RLock()
+	defer ofs.lock.RUnlock()
+	for {
+		node, err := get()
+		if err != nil || !ofs.baseIds[node.Id] {
+			return node, err
+		}
+	}
+}
+
+func (ofs *OverlayFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return ofs.allocate(func() (fs.BlockNode, error) {
+		return ofs.Upper.GetFreeBlockNode(ctx, NodeType)
+	})
+}
+
+func (ofs *OverlayFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return ofs.allocate(func() (fs.BlockNode, error) {
+		return ofs.Upper.GetFreeDataBlockNode(ctx, parent, id)
+	})
+}
+
+// Read the block from the upper, falling through to the base if the upper doesn't have it.
+// Returns fs.ErrBlockNotFound for a block hidden by a whiteout.
+func (ofs *OverlayFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	ofs.lock.RLock()
+	defer ofs.lock.RUnlock()
+	if ofs.whiteouts[node] {
+		return nil, fs.ErrBlockNotFound
+	}
+	raw, err := ofs.Upper.GetRawBlock(ctx, node)
+	if err == nil {
+		if len(raw) == 0 || raw[0] != dataTag {
+			return nil, &fs.ErrCorruptBlock{Node: node, Reason: "Overlay block has no data tag"}
+		}
+		ofs.count(&ofs.stats.UpperReads)
+		return raw[1:], nil
+	}
+	if !errors.Is(err, fs.ErrBlockNotFound) {
+		return nil, err
+	}
+	ofs.count(&ofs.stats.BaseReads)
+	return ofs.Base.GetRawBlock(ctx, node)
+}
+
+// Counters are updated under the read lock, so have a lock of their own
+func (ofs *OverlayFileSystem) count(counter *int64) {
+	ofs.statsLock.Lock()
+	defer ofs.statsLock.Unlock()
+	*counter++
+}
+
+// Save a block of the upper with its tag. Must be called with the lock held.
+func (ofs *OverlayFileSystem) saveUpper(ctx context.Context, node fs.BlockNode, tag byte, data []byte) error {
+	_, err := ofs.Upper.SaveRawBlock(ctx, node, append([]byte{tag}, data...))
+	return err
+}
+
+// Save the block to the upper, replacing any whiteout
+func (ofs *OverlayFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	if err := ofs.saveUpper(ctx, node, dataTag, data); err != nil {
+		return node, err
+	}
+	delete(ofs.whiteouts, node)
+	return node, nil
+}
+
+// Free the blocks in the upper, leaving whiteouts for those in the base
+func (ofs *OverlayFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	upper := make([]fs.BlockNode, 0, len(blocks))
+	for _, node := range blocks {
+		if !ofs.baseIds[node.Id] {
+			upper = append(upper, node)
+			continue
+		}
+		if err := ofs.saveUpper(ctx, node, whiteoutTag, nil); err != nil {
+			return err
+		}
+		ofs.whiteouts[node] = true
+	}
+	return ofs.Upper.FreeBlocks(ctx, upper)
+}
+
+// Every block in the base that isn't hidden by a whiteout, and every block saved to the upper
+func (ofs *OverlayFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	if _, ok := ofs.Upper.(fs.BlockLister); !ok {
+		return nil, fs.ErrNotSupported
+	}
+	ofs.lock.RLock()
+	defer ofs.lock.RUnlock()
+	upper, err := ofs.upperBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	base, err := ofs.Base.(fs.BlockLister).ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]fs.BlockNode, 0, len(base)+len(upper))
+	for _, node := range base {
+		if _, ok := upper[node]; !ok {
+			blocks = append(blocks, node)
+		}
+	}
+	for node, whiteout := range upper {
+		if !whiteout {
+			blocks = append(blocks, node)
+		}
+	}
+	return blocks, nil
+}
+
+// Write every block saved to the upper into the base and free every block hidden by a whiteout,
+// in one transaction if the base is Transactional, then empty the upper. Returns the number of
+// blocks changed in the base.
+func (ofs *OverlayFileSystem) Commit(ctx context.Context) (int, error) {
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	upper, err := ofs.upperList(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx, ok := ofs.Base.(fs.Transactional)
+	if ok {
+		tx.Begin(ctx)
+	}
+	changed, err := ofs.commitBlocks(ctx, upper)
+	if ok {
+		if err == nil {
+			err = tx.Commit(ctx)
+		} else {
+			tx.Rollback(ctx)
+		}
+	}
+	if err != nil {
+		if ok {
+			changed = 0
+		}
+		// The base may hold some of the changes, unless they were rolled back
+		ofs.scan(ctx)
+		return changed, err
+	}
+	ofs.stats.Committed += int64(changed)
+	return changed, ofs.empty(ctx, upper)
+}
+
+// Save the blocks of the upper into the base and free the blocks hidden by whiteouts. Must be
+// called with the lock held.
+func (ofs *OverlayFileSystem) commitBlocks(ctx context.Context, upper map[fs.BlockNode]bool) (int, error) {
+	changed := 0
+	frees := make([]fs.BlockNode, 0)
+	for node, whiteout := range upper {
+		if whiteout {
+			frees = append(frees, node)
+			continue
+		}
+		raw, err := ofs.Upper.GetRawBlock(ctx, node)
+		if err != nil {
+			return changed, err
+		}
+		if reserver, ok := ofs.Base.(fs.BlockReserver); ok && !ofs.baseIds[node.Id] {
+			if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+				return changed, err
+			}
+		}
+		if _, err = ofs.Base.SaveRawBlock(ctx, node, raw[1:]); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	if len(frees) > 0 {
+		if err := ofs.Base.FreeBlocks(ctx, frees); err != nil {
+			return changed, err
+		}
+		changed += len(frees)
+	}
+	return changed, nil
+}
+
+// Throw away everything saved to the upper and every whiteout, returning the number of blocks
+// thrown away
+func (ofs *OverlayFileSystem) Discard(ctx context.Context) (int, error) {
+	ofs.lock.Lock()
+	defer ofs.lock.Unlock()
+	upper, err := ofs.upperList(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ofs.stats.Discarded += int64(len(upper))
+	return len(upper), ofs.empty(ctx, upper)
+}
+
+// Every block in the upper, which must be a BlockLister to be committed or discarded. Must be
+// called with the lock held.
+func (ofs *OverlayFileSystem) upperList(ctx context.Context) (map[fs.BlockNode]bool, error) {
+	if _, ok := ofs.Upper.(fs.BlockLister); !ok {
+		return nil, fs.ErrNotSupported
+	}
+	return ofs.upperBlocks(ctx)
+}
+
+// Free every block in the upper and rescan the base. Must be called with the lock held.
+func (ofs *OverlayFileSystem) empty(ctx context.Context, upper map[fs.BlockNode]bool) error {
+	nodes := make([]fs.BlockNode, 0, len(upper))
+	for node := range upper {
+		nodes = append(nodes, node)
+	}
+	if err := ofs.Upper.FreeBlocks(ctx, nodes); err != nil {
+		return err
+	}
+	return ofs.scan(ctx)
+}
+
+// The number of reads served by each layer, the blocks and whiteouts in the upper and the blocks
+// committed or discarded, with the counters of the upper
+func (ofs *OverlayFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := ofs.Upper.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	ofs.lock.RLock()
+	defer ofs.lock.RUnlock()
+	ofs.statsLock.Lock()
+	defer ofs.statsLock.Unlock()
+	stats["overlay.base_reads"] = float64(ofs.stats.BaseReads)
+	stats["overlay.upper_reads"] = float64(ofs.stats.UpperReads)
+	stats["overlay.whiteouts"] = float64(len(ofs.whiteouts))
+	stats["overlay.committed"] = float64(ofs.stats.Committed)
+	stats["overlay.discarded"] = float64(ofs.stats.Discarded)
+	return stats
+}
+
+func (ofs *OverlayFileSystem) DumpInfo() {
+	ofs.lock.RLock()
+	fmt.Printf("Overlay file system with %d whiteouts, upper:\n", len(ofs.whiteouts))
+	ofs.lock.RUnlock()
+	ofs.Upper.DumpInfo()
+	fmt.Println("Base:")
+	ofs.Base.DumpInfo()
+}
@@ -0,0 +1,246 @@
+package overlayfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	_ "github.com/amkimian/pmfs/dirfs"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+// A base with a couple of files in it
+func golden(m *testing.T) *memory.MemoryFileSystem {
+	var base memory.MemoryFileSystem
+	f := blocktest.Open(m, fs.AdaptBlockHandler(&base), "")
+	f.Format(1000, 100)
+	f.WriteFile("/golden/one", []byte("The first golden file"))
+	f.WriteFile("/golden/two", []byte("The second golden file"))
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+	return &base
+}
+
+func snapshot(mh *memory.MemoryFileSystem) map[fs.BlockNode][]byte {
+	blocks := make(map[fs.BlockNode][]byte)
+	for node, data := range mh.Blocks {
+		blocks[node] = append([]byte(nil), data...)
+	}
+	return blocks
+}
+
+func unchanged(m *testing.T, mh *memory.MemoryFileSystem, before map[fs.BlockNode][]byte) {
+	if len(mh.Blocks) != len(before) {
+		m.Errorf("Base has %d blocks, expected %d", len(mh.Blocks), len(before))
+	}
+	for node, data := range before {
+		if !bytes.Equal(mh.Blocks[node], data) {
+			m.Errorf("Base block %v has changed", node)
+		}
+	}
+}
+
+func expect(m *testing.T, f *fs.RootFileSystem, path string, contents string) {
+	x, err := f.ReadFile(path)
+	if contents == "" {
+		if err == nil {
+			m.Errorf("Expected %s not to exist, got %q", path, x)
+		}
+		return
+	}
+	if err != nil || string(x) != contents {
+		m.Errorf("Expected %s to hold %q, got %q, %v", path, contents, x, err)
+	}
+}
+
+// Mount a filesystem over the base and upper, change it and check the base hasn't been touched
+func change(m *testing.T, base, upper *memory.MemoryFileSystem) (*OverlayFileSystem, *fs.RootFileSystem) {
+	ofs := &OverlayFileSystem{Base: fs.AdaptBlockHandler(base), Upper: fs.AdaptBlockHandler(upper)}
+	f := blocktest.Open(m, ofs, "")
+	if err := f.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	expect(m, f, "/golden/one", "The first golden file")
+	before := snapshot(base)
+	f.WriteFile("/golden/one", []byte("Changed in the overlay"))
+	f.WriteFile("/golden/three", []byte("Added in the overlay"))
+	if err := f.DeleteFile("/golden/two"); err != nil {
+		m.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+	unchanged(m, base, before)
+	expect(m, f, "/golden/one", "Changed in the overlay")
+	expect(m, f, "/golden/two", "")
+	expect(m, f, "/golden/three", "Added in the overlay")
+	if report, err := f.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected the overlay to check clean, got %v, %v", report, err)
+	}
+	return ofs, f
+}
+
+func TestDiscard(m *testing.T) {
+	base := golden(m)
+	var upper memory.MemoryFileSystem
+	upper.Format(1000, 100)
+	ofs, f := change(m, base, &upper)
+	if stats := ofs.HandlerStats(); stats["overlay.whiteouts"] == 0 || stats["overlay.base_reads"] == 0 {
+		m.Errorf("Expected whiteouts and reads from the base, got %v", stats)
+	}
+
+	// The whiteouts are kept in the upper, so survive the overlay being opened again
+	g := blocktest.Open(m, &OverlayFileSystem{Base: fs.AdaptBlockHandler(base), Upper: fs.AdaptBlockHandler(&upper)}, "")
+	g.Mount()
+	expect(m, g, "/golden/two", "")
+	expect(m, g, "/golden/three", "Added in the overlay")
+
+	if discarded, err := ofs.Discard(context.Background()); err != nil || discarded == 0 {
+		m.Fatalf("Expected blocks to be discarded, got %d, %v", discarded, err)
+	}
+	if len(upper.Blocks) != 0 {
+		m.Errorf("Expected the upper to be empty, got %d blocks", len(upper.Blocks))
+	}
+	f.Mount()
+	expect(m, f, "/golden/one", "The first golden file")
+	expect(m, f, "/golden/two", "The second golden file")
+	expect(m, f, "/golden/three", "")
+}
+
+func TestCommit(m *testing.T) {
+	base := golden(m)
+	var upper memory.MemoryFileSystem
+	upper.Format(1000, 100)
+	ofs, f := change(m, base, &upper)
+	if changed, err := ofs.Commit(context.Background()); err != nil || changed == 0 {
+		m.Fatalf("Expected blocks to be committed, got %d, %v", changed, err)
+	}
+	if len(upper.Blocks) != 0 {
+		m.Errorf("Expected the upper to be empty, got %d blocks", len(upper.Blocks))
+	}
+	f.Mount()
+	expect(m, f, "/golden/three", "Added in the overlay")
+
+	// The base now holds the changes on its own
+	g := blocktest.Open(m, fs.AdaptBlockHandler(base), "")
+	if err := g.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	expect(m, g, "/golden/one", "Changed in the overlay")
+	expect(m, g, "/golden/two", "")
+	expect(m, g, "/golden/three", "Added in the overlay")
+	if report, err := g.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected the committed base to check clean, got %v, %v", report, err)
+	}
+
+	// and further changes can be made over it
+	f.WriteFile("/golden/four", []byte("After the commit"))
+	f.Sync()
+	expect(m, f, "/golden/four", "After the commit")
+	expect(m, f, "/golden/one", "Changed in the overlay")
+}
+
+// Fails every read once failAfter reads have been made
+type failingReads struct {
+	fs.BlockHandlerV2
+	reads     int
+	failAfter int
+}
+
+func (f *failingReads) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	f.reads++
+	if f.failAfter > 0 && f.reads > f.failAfter {
+		return nil, errors.New("Read failed")
+	}
+	return f.BlockHandlerV2.GetRawBlock(ctx, node)
+}
+
+func (f *failingReads) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	return f.BlockHandlerV2.(fs.BlockLister).ListBlocks(ctx)
+}
+
+func TestFailedCommit(m *testing.T) {
+	ctx := context.Background()
+	base := golden(m)
+	var upper memory.MemoryFileSystem
+	upper.Format(1000, 100)
+	failing := &failingReads{BlockHandlerV2: fs.AdaptBlockHandler(&upper)}
+	ofs := &OverlayFileSystem{Base: &walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(base), Log: &walfs.MemoryLog{}}, Upper: failing}
+	f := blocktest.Open(m, ofs, "")
+	if err := f.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	f.WriteFile("/golden/one", []byte("Changed in the overlay"))
+	f.WriteFile("/golden/three", []byte("Added in the overlay"))
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+
+	// Fail part way through, once the upper has been listed and one block committed
+	before := snapshot(base)
+	failing.reads, failing.failAfter = 0, len(upper.Blocks)+1
+	if _, err := ofs.Commit(ctx); err == nil {
+		m.Fatalf("Expected the commit to fail")
+	}
+	unchanged(m, base, before)
+	failing.failAfter = 0
+	f.ChangeCache.Clear()
+	expect(m, f, "/golden/one", "Changed in the overlay")
+
+	if changed, err := ofs.Commit(ctx); err != nil || changed == 0 {
+		m.Fatalf("Expected blocks to be committed, got %d, %v", changed, err)
+	}
+	g := blocktest.Open(m, fs.AdaptBlockHandler(base), "")
+	if err := g.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	expect(m, g, "/golden/one", "Changed in the overlay")
+	expect(m, g, "/golden/three", "Added in the overlay")
+}
+
+func TestWhiteouts(m *testing.T) {
+	ctx := context.Background()
+	var base, upper memory.MemoryFileSystem
+	base.Format(100, 100)
+	upper.Format(100, 100)
+	node := base.GetFreeBlockNode(fs.FILE)
+	base.SaveRawBlock(node, []byte("In the base"))
+
+	ofs := &OverlayFileSystem{Base: fs.AdaptBlockHandler(&base), Upper: fs.AdaptBlockHandler(&upper)}
+	if err := ofs.Init(ctx, ""); err != nil {
+		m.Fatal(err)
+	}
+	// The ids of the base are reserved in the upper, rather than skipped when handed out
+	if fresh := upper.GetFreeBlockNode(fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the id of the base to be reserved in the upper, got %v", fresh)
+	}
+	if fresh, _ := ofs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected a node not used in the base, got %v", fresh)
+	}
+	ofs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if _, err := ofs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the block to be hidden, got %v", err)
+	}
+	if blocks, _ := ofs.ListBlocks(ctx); len(blocks) != 0 {
+		m.Errorf("Expected no blocks to be listed, got %v", blocks)
+	}
+	ofs.SaveRawBlock(ctx, node, []byte("Saved again"))
+	if x, err := ofs.GetRawBlock(ctx, node); err != nil || string(x) != "Saved again" {
+		m.Errorf("Expected the save to replace the whiteout, got %q, %v", x, err)
+	}
+	if string(base.Blocks[node]) != "In the base" {
+		m.Errorf("Expected the base to be untouched, got %q", base.Blocks[node])
+	}
+}
+
+func TestConfiguration(m *testing.T) {
+	// As in the package documentation, with a directory for the upper
+	f := blocktest.NewFileSystem(m, nil, "overlay:memory;dir:"+m.TempDir(), 1000, 100)
+	f.WriteFile("/overlay/file", []byte("In the upper"))
+	expect(m, f, "/overlay/file", "In the upper")
+}
@@ -1,6 +1,7 @@
 package main
 
 import "fmt"
+import "time"
 import (
 	"github.com/amkimian/pmfs/fs"
 	"github.com/amkimian/pmfs/web"
@@ -50,6 +51,8 @@ func main() {
 		fmt.Printf("Created : %v\nModified : %v\nAccessed : %v\n", stats.Created, stats.Modified, stats.Accessed)
 	}
 
+	// Reclaim blocks left behind by old versions while the servers are running
+	f.Collector.Start(time.Second)
 	go web.StartAPIServer(&f)
 	web.StartWebServer()
 }
@@ -0,0 +1,274 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal client for the parts of the S3 REST api that the block handler needs (path style
+// addressing, AWS signature version 4), so that no SDK is required.
+
+var errNotFound = errors.New("Object not found")
+
+type client struct {
+	endpoint   *url.URL
+	bucket     string
+	region     string
+	accessKey  string
+	secretKey  string
+	retries    int
+	retryDelay time.Duration
+	http       *http.Client
+}
+
+// An error response from the server
+type responseError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("S3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Whether it is worth trying a request again after this error
+func retryable(err error) bool {
+	if re, ok := err.(*responseError); ok {
+		return re.StatusCode >= 500 || re.StatusCode == http.StatusTooManyRequests
+	}
+	return err != errNotFound
+}
+
+// Perform a request, retrying with an exponential backoff on network errors and server errors.
+// Returns the response body and headers. Gives up early if the context is cancelled.
+func (c *client) do(ctx context.Context, method string, key string, query url.Values, body []byte) ([]byte, http.Header, error) {
+	delay := c.retryDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		var data []byte
+		var header http.Header
+		data, header, err = c.doOnce(ctx, method, key, query, body)
+		if err == nil || !retryable(err) || attempt >= c.retries || ctx.Err() != nil {
+			return data, header, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (c *client) doOnce(ctx context.Context, method string, key string, query url.Values, body []byte) ([]byte, http.Header, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		re := &responseError{StatusCode: resp.StatusCode}
+		xml.Unmarshal(data, re)
+		return nil, nil, re
+	}
+	return data, resp.Header, nil
+}
+
+func (c *client) getObject(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.do(ctx, "GET", key, nil, nil)
+	return data, err
+}
+
+func (c *client) putObject(ctx context.Context, key string, data []byte) error {
+	_, _, err := c.do(ctx, "PUT", key, nil, data)
+	return err
+}
+
+func (c *client) deleteObject(ctx context.Context, key string) error {
+	_, _, err := c.do(ctx, "DELETE", key, nil, nil)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List every key starting with prefix
+func (c *client) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+		data, _, err := c.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err = xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+// Upload an object in parts of partSize bytes, aborting the upload if any part fails. The abort
+// is sent even if the context has been cancelled so that no parts are left behind.
+func (c *client) putObjectMultipart(ctx context.Context, key string, data []byte, partSize int) error {
+	body, _, err := c.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiate initiateMultipartUploadResult
+	if err = xml.Unmarshal(body, &initiate); err != nil {
+		return err
+	}
+	uploadId := initiate.UploadId
+	complete := completeMultipartUpload{}
+	for part := 1; len(data) > 0; part++ {
+		toWrite := data
+		if len(toWrite) > partSize {
+			toWrite = data[:partSize]
+		}
+		data = data[len(toWrite):]
+		var header http.Header
+		_, header, err = c.do(ctx, "PUT", key, url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {uploadId}}, toWrite)
+		if err != nil {
+			c.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadId}}, nil)
+			return err
+		}
+		complete.Parts = append(complete.Parts, completePart{part, header.Get("ETag")})
+	}
+	body, err = xml.Marshal(complete)
+	if err == nil {
+		_, _, err = c.do(ctx, "POST", key, url.Values{"uploadId": {uploadId}}, body)
+	}
+	if err != nil {
+		c.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadId}}, nil)
+	}
+	return err
+}
+
+// Add the AWS signature version 4 headers to a request
+func (c *client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := hashHex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+// The query string sorted by key with the strict encoding signature version 4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,405 @@
+// S3 file system - a block handler that stores every block as an object in an S3 compatible
+// bucket.
+//
+// The configuration string passed to Init is a url of the form
+//
+//	http(s)://host[:port]/bucket[/prefix]?region=..&accessKey=..&secretKey=..
+//
+// The credentials default to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+// variables. Other optional parameters are retries (the number of times a failed request is
+// retried), retryDelay (the initial backoff, e.g. 100ms) and partSize (blocks larger than this
+// are uploaded in parts of this size). The handler registers itself under the "s3" scheme.
+//
+// Example:
+//
+//	var f fs.RootFileSystem
+//
+//	f.Init(nil, "s3:https://s3.amazonaws.com/mybucket/pmfs?region=us-east-1")
+//	f.Format(1000, 1024*1024)
+//
+//	f.WriteFile("/fred/alan", []byte("Hello world"))
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Objects are stored at <prefix>/<type>/<id>, except for DATA blocks which are grouped under the
+// file node they belong to at <prefix>/data/<relativeTo>/<id>. The format and the end of the ids
+// leased so far are kept in <prefix>/state.json.
+
+const stateObject = "state.json"
+
+// Ids are leased from the state object this many at a time, so that handing out an id doesn't
+// write to the bucket each time. Init finds the ids in use by listing the objects, and the ids
+// below the end of the lease that aren't (including those freed) are handed out before new ones,
+// so that at most BlockCount blocks (including the super block) are in use at once.
+const idLease = 100
+
+var errNotConfigured = errors.New("S3 file system has not been initialised")
+
+// The smallest part S3 accepts in a multipart upload (except for the last part)
+const DefaultPartSize = 5 * 1024 * 1024
+
+type state struct {
+	BlockCount int
+	BlockSize  int
+	NextId     int
+}
+
+type S3FileSystem struct {
+	Prefix   string
+	PartSize int
+	State    state
+	// The next new id to hand out, below State.NextId (the end of the lease) unless a new lease
+	// is needed, the ids handed out or saved and not freed, and the ids below next that are free
+	next   int
+	used   map[int]bool
+	free   []int
+	client *client
+	lock   sync.Mutex
+}
+
+func init() {
+	fs.RegisterBlockHandler("s3", func() fs.BlockHandlerV2 { return &S3FileSystem{} })
+}
+
+// Parse the configuration url and load the state of an existing store
+func (sfs *S3FileSystem) Init(ctx context.Context, configuration string) error {
+	sfs.lock.Lock()
+	defer sfs.lock.Unlock()
+	sfs.State = state{}
+	sfs.next, sfs.used, sfs.free = 0, make(map[int]bool), nil
+	err := sfs.configure(configuration)
+	if err != nil {
+		return err
+	}
+	data, err := sfs.client.getObject(ctx, sfs.key(stateObject))
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &sfs.State); err != nil {
+		return err
+	}
+	sfs.next = sfs.State.NextId
+	blocks, err := sfs.ListBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range blocks {
+		if node.Type != fs.SUPERBLOCK {
+			sfs.used[node.Id] = true
+		}
+	}
+	for id := fs.SuperBlock.Id + 1; id < sfs.next; id++ {
+		if !sfs.used[id] {
+			sfs.free = append(sfs.free, id)
+		}
+	}
+	return nil
+}
+
+func (sfs *S3FileSystem) configure(configuration string) error {
+	u, err := url.Parse(configuration)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	path := strings.Trim(u.Path, "/")
+	if len(path) == 0 {
+		return fmt.Errorf("No bucket in configuration '%s'", configuration)
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 2 {
+		sfs.Prefix = parts[1]
+	}
+	c := &client{
+		endpoint:   &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:     parts[0],
+		region:     queryDefault(query, "region", "us-east-1"),
+		accessKey:  queryDefault(query, "accessKey", os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:  queryDefault(query, "secretKey", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		retries:    3,
+		retryDelay: 100 * time.Millisecond,
+		http:       &http.Client{Timeout: 60 * time.Second},
+	}
+	if v := query.Get("retries"); len(v) > 0 {
+		if c.retries, err = strconv.Atoi(v); err != nil {
+			return err
+		}
+	}
+	if v := query.Get("retryDelay"); len(v) > 0 {
+		if c.retryDelay, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+	sfs.PartSize = DefaultPartSize
+	if v := query.Get("partSize"); len(v) > 0 {
+		if sfs.PartSize, err = strconv.Atoi(v); err != nil {
+			return err
+		}
+	}
+	sfs.client = c
+	return nil
+}
+
+// Format the file system - removing every object under the prefix
+func (sfs *S3FileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	sfs.lock.Lock()
+	defer sfs.lock.Unlock()
+	if sfs.client == nil {
+		return errNotConfigured
+	}
+	keys, err := sfs.client.listObjects(ctx, sfs.key(""))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = sfs.client.deleteObject(ctx, k); err != nil {
+			return err
+		}
+	}
+	sfs.State = state{BlockCount: blockCount, BlockSize: blockSize, NextId: fs.SuperBlock.Id + 1}
+	sfs.next, sfs.used, sfs.free = sfs.State.NextId, make(map[int]bool), nil
+	return sfs.saveState(ctx)
+}
+
+// Returns a freed node id if there is one, otherwise the next new id (leasing more ids from the
+// state object when they run out). Returns fs.ErrNoSpace if BlockCount blocks are in use.
+func (sfs *S3FileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return fs.NilBlock, err
+	}
+	sfs.lock.Lock()
+	defer sfs.lock.Unlock()
+	if sfs.client == nil {
+		return fs.NilBlock, errNotConfigured
+	}
+	if sfs.used == nil {
+		sfs.used = make(map[int]bool)
+	}
+	// The super block always takes one of the blocks
+	if sfs.State.BlockCount > 0 && len(sfs.used)+1 >= sfs.State.BlockCount {
+		return fs.NilBlock, fs.ErrNoSpace
+	}
+	var node fs.BlockNode
+	node.Type = NodeType
+	if n := len(sfs.free); n > 0 {
+		node.Id = sfs.free[n-1]
+		sfs.free = sfs.free[:n-1]
+	} else {
+		if err := sfs.lease(ctx, sfs.next+1); err != nil {
+			return fs.NilBlock, err
+		}
+		node.Id = sfs.next
+		sfs.next++
+	}
+	sfs.used[node.Id] = true
+	return node, nil
+}
+
+// Make sure every id below end is leased, taking a new lease if it isn't. Must be called with the
+// lock held.
+func (sfs *S3FileSystem) lease(ctx context.Context, end int) error {
+	if end <= sfs.State.NextId {
+		return nil
+	}
+	leased := sfs.State.NextId
+	sfs.State.NextId = end - 1 + idLease
+	if err := sfs.saveState(ctx); err != nil {
+		sfs.State.NextId = leased
+		return err
+	}
+	return nil
+}
+
+func (sfs *S3FileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, key string) (fs.BlockNode, error) {
+	node, err := sfs.GetFreeBlockNode(ctx, fs.DATA)
+	if err != nil {
+		return node, err
+	}
+	node.RelativeTo = parent.Id
+	return node, nil
+}
+
+// Read the object for a node, returns fs.ErrBlockNotFound if it does not exist
+func (sfs *S3FileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	if sfs.client == nil {
+		return nil, errNotConfigured
+	}
+	data, err := sfs.client.getObject(ctx, sfs.blockKey(node))
+	if err == errNotFound {
+		return nil, fs.ErrBlockNotFound
+	}
+	return data, err
+}
+
+// Write the object for a node, using a multipart upload if it is larger than the part size
+func (sfs *S3FileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if sfs.client == nil {
+		return node, errNotConfigured
+	}
+	var err error
+	if len(data) > sfs.PartSize {
+		err = sfs.client.putObjectMultipart(ctx, sfs.blockKey(node), data, sfs.PartSize)
+	} else {
+		err = sfs.client.putObject(ctx, sfs.blockKey(node), data)
+	}
+	return node, err
+}
+
+// Claim the id of a node handed out by another handler (e.g. when mirroring), so that it is never
+// handed out here
+func (sfs *S3FileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if sfs.client == nil {
+		return errNotConfigured
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sfs.lock.Lock()
+	defer sfs.lock.Unlock()
+	if node.Type == fs.SUPERBLOCK || sfs.used[node.Id] {
+		return nil
+	}
+	if node.Id >= sfs.next {
+		if err := sfs.lease(ctx, node.Id+1); err != nil {
+			return err
+		}
+		for id := sfs.next; id < node.Id; id++ {
+			sfs.free = append(sfs.free, id)
+		}
+		sfs.next = node.Id + 1
+	} else {
+		// From the end, as ids reserved in descending order are added there
+		for i := len(sfs.free) - 1; i >= 0; i-- {
+			if sfs.free[i] == node.Id {
+				sfs.free = append(sfs.free[:i], sfs.free[i+1:]...)
+				break
+			}
+		}
+	}
+	if sfs.used == nil {
+		sfs.used = make(map[int]bool)
+	}
+	sfs.used[node.Id] = true
+	return nil
+}
+
+func (sfs *S3FileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	if sfs.client == nil {
+		return errNotConfigured
+	}
+	for _, node := range blocks {
+		if node.Type == fs.SUPERBLOCK {
+			continue
+		}
+		if err := sfs.client.deleteObject(ctx, sfs.blockKey(node)); err != nil {
+			return err
+		}
+		sfs.lock.Lock()
+		if sfs.used[node.Id] {
+			delete(sfs.used, node.Id)
+			sfs.free = append(sfs.free, node.Id)
+		}
+		sfs.lock.Unlock()
+	}
+	return nil
+}
+
+// Every block that has been saved and not freed, found by listing the objects under the prefix
+func (sfs *S3FileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	if sfs.client == nil {
+		return nil, errNotConfigured
+	}
+	keys, err := sfs.client.listObjects(ctx, sfs.key(""))
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]fs.BlockNode, 0, len(keys))
+	for _, k := range keys {
+		if node, ok := sfs.parseBlockKey(k); ok {
+			blocks = append(blocks, node)
+		}
+	}
+	return blocks, nil
+}
+
+func (sfs *S3FileSystem) DumpInfo() {
+	sfs.lock.Lock()
+	defer sfs.lock.Unlock()
+	if sfs.client == nil {
+		fmt.Println("S3 file system: not configured")
+		return
+	}
+	fmt.Printf("S3 file system: %s bucket %s prefix %s\n", sfs.client.endpoint, sfs.client.bucket, sfs.Prefix)
+	fmt.Printf("Next block id %v, leased up to %v, free list %v, block count %v\n", sfs.next, sfs.State.NextId, len(sfs.free), sfs.State.BlockCount)
+}
+
+func (sfs *S3FileSystem) key(name string) string {
+	if len(sfs.Prefix) == 0 {
+		return name
+	}
+	return sfs.Prefix + "/" + name
+}
+
+func (sfs *S3FileSystem) blockKey(node fs.BlockNode) string {
+	if node.Type == fs.DATA {
+		return sfs.key(fmt.Sprintf("%v/%d/%d", node.Type, node.RelativeTo, node.Id))
+	}
+	return sfs.key(fmt.Sprintf("%v/%d", node.Type, node.Id))
+}
+
+// The reverse of blockKey, returns false for anything that isn't a block
+func (sfs *S3FileSystem) parseBlockKey(key string) (fs.BlockNode, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, sfs.key("")), "/")
+	nodeType, ok := fs.ParseBlockNodeType(parts[0])
+	if !ok || (nodeType == fs.DATA) != (len(parts) == 3) || len(parts) < 2 || len(parts) > 3 {
+		return fs.NilBlock, false
+	}
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return fs.NilBlock, false
+	}
+	if nodeType == fs.SUPERBLOCK {
+		return fs.SuperBlock, id == fs.SuperBlock.Id
+	}
+	node := fs.BlockNode{Type: nodeType, Id: id}
+	if nodeType == fs.DATA {
+		if node.RelativeTo, err = strconv.Atoi(parts[1]); err != nil {
+			return fs.NilBlock, false
+		}
+	}
+	return node, true
+}
+
+// Must be called with the lock held
+func (sfs *S3FileSystem) saveState(ctx context.Context) error {
+	data, err := json.Marshal(sfs.State)
+	if err != nil {
+		return err
+	}
+	return sfs.client.putObject(ctx, sfs.key(stateObject), data)
+}
+
+func queryDefault(query url.Values, name string, def string) string {
+	if v := query.Get(name); len(v) > 0 {
+		return v
+	}
+	return def
+}
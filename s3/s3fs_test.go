@@ -0,0 +1,162 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/s3/s3test"
+)
+
+func startFs(m *testing.T, configuration string) *fs.RootFileSystem {
+	return blocktest.Open(m, nil, configuration)
+}
+
+func TestRoundTripThroughFakeServer(m *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	configuration := "s3:" + server.URL + "/bucket/pmfs?accessKey=test&secretKey=test&partSize=64&retryDelay=1ms"
+
+	f := startFs(m, configuration)
+	if err := f.Format(1000, 1000); err != nil {
+		m.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("A reasonably long string\n"), 20)
+	if err := f.WriteFile("/fred/alan", large); err != nil {
+		m.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+	if server.MultipartUploads == 0 {
+		m.Error("Expected a multipart upload for the large block")
+	}
+	if _, ok := server.Object("bucket", "pmfs/superblock/0"); !ok {
+		m.Errorf("Super block not stored where expected, have %v", server.Keys("bucket"))
+	}
+
+	// A restarted filesystem should see the same data, even with a flaky server
+	server.FailRequests = 2
+	restarted := startFs(m, configuration)
+	if err := restarted.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	x, err := restarted.ReadFile("/fred/alan")
+	if err != nil {
+		m.Fatal(err)
+	}
+	if !bytes.Equal(x, large) {
+		m.Errorf("Contents not the same, got %s", string(x))
+	}
+	if report, err := restarted.Check(false); err != nil || len(report.Problems) != 0 || !report.OrphansChecked {
+		m.Errorf("Check failed %v %v", err, report)
+	}
+	if _, ok := restarted.BlockHandler.(*S3FileSystem); !ok {
+		m.Errorf("Wrong handler %T", restarted.BlockHandler)
+	}
+}
+
+func TestFormatClearsPrefix(m *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	server.MaxKeys = 2
+
+	ctx := context.Background()
+	var h S3FileSystem
+	h.Init(ctx, server.URL+"/bucket/one?accessKey=test&secretKey=test")
+	h.Format(ctx, 100, 100)
+	for i := 0; i < 5; i++ {
+		node, _ := h.GetFreeBlockNode(ctx, fs.FILE)
+		h.SaveRawBlock(ctx, node, []byte("x"))
+	}
+	other := S3FileSystem{}
+	other.Init(ctx, server.URL+"/bucket/two?accessKey=test&secretKey=test")
+	other.Format(ctx, 100, 100)
+	node, _ := other.GetFreeBlockNode(ctx, fs.FILE)
+	other.SaveRawBlock(ctx, node, []byte("y"))
+
+	if err := h.Format(ctx, 100, 100); err != nil {
+		m.Fatal(err)
+	}
+	if keys := server.Keys("bucket"); len(keys) != 3 {
+		m.Errorf("Expected the state objects and one block to remain, have %v", keys)
+	}
+}
+
+func TestIdsAreLeased(m *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+
+	ctx := context.Background()
+	configuration := server.URL + "/bucket/pmfs?accessKey=test&secretKey=test"
+	var h S3FileSystem
+	h.Init(ctx, configuration)
+	h.Format(ctx, 1000, 100)
+	requests := server.Requests
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < 50; i++ {
+		node, err := h.GetFreeBlockNode(ctx, fs.FILE)
+		if err != nil {
+			m.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	if server.Requests-requests != 1 {
+		m.Errorf("Expected one request to lease the ids, got %d", server.Requests-requests)
+	}
+	ids := make(map[int]bool)
+	for _, node := range nodes {
+		h.SaveRawBlock(ctx, node, []byte("x"))
+		ids[node.Id] = true
+	}
+
+	// A restarted handler hands out the rest of the lease, but none of the ids in use
+	var restarted S3FileSystem
+	restarted.Init(ctx, configuration)
+	for i := 0; i < 100; i++ {
+		node, err := restarted.GetFreeBlockNode(ctx, fs.FILE)
+		if err != nil {
+			m.Fatal(err)
+		}
+		if ids[node.Id] {
+			m.Fatalf("Id %d handed out again after a restart", node.Id)
+		}
+		ids[node.Id] = true
+	}
+}
+
+func TestErrorsAreReturned(m *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+
+	ctx := context.Background()
+	var h S3FileSystem
+	if err := h.Init(ctx, server.URL+"/bucket/pmfs?accessKey=test&secretKey=test&retries=1&retryDelay=1ms"); err != nil {
+		m.Fatal(err)
+	}
+	h.Format(ctx, 100, 100)
+	if _, err := h.GetRawBlock(ctx, fs.BlockNode{Type: fs.FILE, Id: 42}); err != fs.ErrBlockNotFound {
+		m.Errorf("Expected ErrBlockNotFound, got %v", err)
+	}
+	server.FailRequests = 5
+	if _, err := h.SaveRawBlock(ctx, fs.BlockNode{Type: fs.FILE, Id: 1}, []byte("x")); err == nil {
+		m.Error("Expected the save to fail once the retries are used up")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := h.GetRawBlock(cancelled, fs.SuperBlock); !errors.Is(err, context.Canceled) {
+		m.Errorf("Expected the cancelled context to stop the request, got %v", err)
+	}
+}
+
+func TestConformance(m *testing.T) {
+	blocktest.TestBlockHandler(m, func(m *testing.T) (fs.BlockHandlerV2, string) {
+		server := s3test.NewServer()
+		m.Cleanup(server.Close)
+		return &S3FileSystem{}, server.URL + "/bucket/pmfs?accessKey=test&secretKey=test&partSize=64&retryDelay=1ms"
+	})
+}
@@ -0,0 +1,257 @@
+// Package s3test provides an in-process stand in for an S3 compatible object store, so that the
+// s3 block handler (and anything built on it) can be tested offline.
+//
+// Example:
+//
+//	server := s3test.NewServer()
+//	defer server.Close()
+//
+//	f.Init(nil, "s3:"+server.URL+"/bucket/prefix")
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The Server keeps objects in memory. Buckets are created on first use. Requests must carry a
+// signature version 4 Authorization header, but the signature itself is not checked.
+type Server struct {
+	*httptest.Server
+	// Set to make the next n requests fail with a 503 Slow Down error
+	FailRequests int
+	// Number of requests served (including failed ones)
+	Requests int
+	// Number of multipart uploads that have been completed
+	MultipartUploads int
+	// The maximum number of keys returned in one list page
+	MaxKeys int
+
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextId  int
+	lock    sync.Mutex
+}
+
+func NewServer() *Server {
+	s := &Server{MaxKeys: 1000, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// The keys of every object in a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0)
+	for k := range s.objects {
+		if strings.HasPrefix(k, bucket+"/") {
+			keys = append(keys, k[len(bucket)+1:])
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Return the contents of an object and whether it exists
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.objects[bucket+"/"+key]
+	return data, ok
+}
+
+// Remove an object behind the back of any client
+func (s *Server) DeleteObject(bucket string, key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.objects, bucket+"/"+key)
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.WriteHeader(status)
+	b, _ := xml.Marshal(errorResponse{Code: code, Message: message})
+	w.Write(b)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(b)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Requests++
+	if s.FailRequests > 0 {
+		s.FailRequests--
+		writeError(w, http.StatusServiceUnavailable, "SlowDown", "Injected failure")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "Missing signature")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	bucket := parts[0]
+	query := r.URL.Query()
+	if len(parts) == 1 || len(parts[1]) == 0 {
+		if r.Method == "GET" {
+			s.list(w, bucket, query.Get("prefix"), query.Get("continuation-token"))
+		} else {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+		}
+		return
+	}
+	name := bucket + "/" + parts[1]
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	_, initiate := query["uploads"]
+	uploadId := query.Get("uploadId")
+	switch {
+	case r.Method == "POST" && initiate:
+		s.nextId++
+		id := strconv.Itoa(s.nextId)
+		s.uploads[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: parts[1], UploadId: id})
+	case r.Method == "PUT" && len(uploadId) > 0:
+		upload, ok := s.uploads[uploadId]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || err != nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", uploadId)
+			return
+		}
+		upload[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "POST" && len(uploadId) > 0:
+		s.complete(w, name, uploadId, body)
+	case r.Method == "DELETE" && len(uploadId) > 0:
+		delete(s.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		s.objects[name] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := s.objects[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", parts[1])
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE":
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) complete(w http.ResponseWriter, name string, uploadId string, body []byte) {
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", uploadId)
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	data := make([]byte, 0)
+	for _, part := range request.Parts {
+		partData, ok := upload[part.PartNumber]
+		if !ok || etag(partData) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(part.PartNumber))
+			return
+		}
+		data = append(data, partData...)
+	}
+	delete(s.uploads, uploadId)
+	s.objects[name] = data
+	s.MultipartUploads++
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+		ETag    string
+	}{Key: name, ETag: etag(data)})
+}
+
+type listContents struct {
+	Key  string
+	Size int
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listContents
+}
+
+// List objects (version 2), the continuation token is simply the last key returned
+func (s *Server) list(w http.ResponseWriter, bucket string, prefix string, token string) {
+	keys := make([]string, 0)
+	for k := range s.objects {
+		if strings.HasPrefix(k, bucket+"/"+prefix) && k > bucket+"/"+token {
+			keys = append(keys, k[len(bucket)+1:])
+		}
+	}
+	sort.Strings(keys)
+	result := listResult{Name: bucket, Prefix: prefix}
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, listContents{k, len(s.objects[bucket+"/"+k])})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
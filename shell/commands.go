@@ -1,9 +1,11 @@
 package shell
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/amkimian/pmfs/fs"
 	"github.com/amkimian/pmfs/util"
 )
 
@@ -17,8 +19,14 @@ var parserCommands = map[string]ParserCommand{
 	"stat":       ParserCommand{1, executeStat},
 	"rm":         ParserCommand{1, executeRm},
 	"mv":         ParserCommand{2, executeMv},
+	"cp":         ParserCommand{2, executeCp},
+	"mkdir":      ParserCommand{1, executeMkdir},
+	"rmdir":      ParserCommand{1, executeRmdir},
 	"tags":       ParserCommand{1, executeTags},
 	"cattag":     ParserCommand{2, executeCatTag},
+	"fsck":       ParserCommand{0, executeFsck},
+	"gc":         ParserCommand{0, executeGC},
+	"scrub":      ParserCommand{0, executeScrub},
 }
 
 func executeTags(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
@@ -40,7 +48,9 @@ func executeCD(parameters []string, remainingCommand string, executor *ShellExec
 
 func executeAddFile(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	executor.Rfs.WriteFile(filePath, []byte(remainingCommand))
+	if err := executor.Rfs.WriteFile(filePath, []byte(remainingCommand)); err != nil {
+		return makeError(err)
+	}
 	ret := make([]string, 1)
 	ret[0] = fmt.Sprintf("Created file %s", filePath)
 	return ret
@@ -48,7 +58,9 @@ func executeAddFile(parameters []string, remainingCommand string, executor *Shel
 
 func executeAppend(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	executor.Rfs.AppendFile(filePath, []byte(remainingCommand))
+	if err := executor.Rfs.AppendFile(filePath, []byte(remainingCommand)); err != nil {
+		return makeError(err)
+	}
 	ret := make([]string, 1)
 	ret[0] = fmt.Sprintf("Appended to file %s", filePath)
 	return ret
@@ -56,7 +68,9 @@ func executeAppend(parameters []string, remainingCommand string, executor *Shell
 
 func executeAppendLine(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	executor.Rfs.AppendFile(filePath, []byte("\n"+remainingCommand))
+	if err := executor.Rfs.AppendFile(filePath, []byte("\n"+remainingCommand)); err != nil {
+		return makeError(err)
+	}
 	ret := make([]string, 1)
 	ret[0] = fmt.Sprintf("Appended with cr to file %s", filePath)
 	return ret
@@ -64,20 +78,29 @@ func executeAppendLine(parameters []string, remainingCommand string, executor *S
 
 func executeLS(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	ret, _ := executor.Rfs.ListDirectory(filePath)
+	ret, err := executor.Rfs.ListDirectory(filePath)
+	if err != nil {
+		return makeError(err)
+	}
 	return ret
 }
 
 func executeCat(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	arr, _ := executor.Rfs.ReadFile(filePath)
+	arr, err := executor.Rfs.ReadFile(filePath)
+	if err != nil {
+		return makeError(err)
+	}
 	// Need to convert it into a string, then split on \n
 	return strings.Split(string(arr), "\n")
 }
 
 func executeCatTag(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	arr, _ := executor.Rfs.ReadFileTag(filePath, parameters[1])
+	arr, err := executor.Rfs.ReadFileTag(filePath, parameters[1])
+	if err != nil {
+		return makeError(err)
+	}
 	// Need to convert it into a string, then split on \n
 	return strings.Split(string(arr), "\n")
 }
@@ -100,12 +123,57 @@ func makeError(err error) []string {
 }
 func executeRm(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	filePath := util.ResolvePath(executor.Cwd, parameters[0])
-	executor.Rfs.DeleteFile(filePath)
+	if err := executor.Rfs.DeleteFile(filePath); err != nil {
+		return makeError(err)
+	}
 	ret := make([]string, 1)
 	ret[0] = fmt.Sprintf("Removed %s", filePath)
 	return ret
 }
 
+// cp copies the latest version of a file or directory tree, or every version with
+// "cp <source> <target> history"
+func executeCp(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	sourceFilePath := util.ResolvePath(executor.Cwd, parameters[0])
+	targetFilePath := util.ResolvePath(executor.Cwd, parameters[1])
+	opts := fs.CopyOptions{History: strings.TrimSpace(remainingCommand) == "history"}
+	if err := executor.Rfs.CopyFileOrFolder(sourceFilePath, targetFilePath, opts); err != nil {
+		return makeError(err)
+	}
+	ret := make([]string, 1)
+	ret[0] = fmt.Sprintf("Copied %s to %s", sourceFilePath, targetFilePath)
+	return ret
+}
+
+func executeMkdir(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	dirPath := util.ResolvePath(executor.Cwd, parameters[0])
+	if err := executor.Rfs.MakeDirectory(dirPath); err != nil {
+		return makeError(err)
+	}
+	ret := make([]string, 1)
+	ret[0] = fmt.Sprintf("Created %s", dirPath)
+	return ret
+}
+
+// rmdir removes an empty directory, or everything below it with "rmdir -r <path>"
+func executeRmdir(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	recursive := parameters[0] == "-r"
+	dirName := parameters[0]
+	if recursive {
+		dirName = strings.TrimSpace(remainingCommand)
+		if dirName == "" {
+			return makeError(errors.New("rmdir -r needs a directory"))
+		}
+	}
+	dirPath := util.ResolvePath(executor.Cwd, dirName)
+	if err := executor.Rfs.RemoveDirectory(dirPath, recursive); err != nil {
+		return makeError(err)
+	}
+	ret := make([]string, 1)
+	ret[0] = fmt.Sprintf("Removed %s", dirPath)
+	return ret
+}
+
 func executeMv(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
 	sourceFilePath := util.ResolvePath(executor.Cwd, parameters[0])
 	targetFilePath := util.ResolvePath(executor.Cwd, parameters[1])
@@ -118,3 +186,53 @@ func executeMv(parameters []string, remainingCommand string, executor *ShellExec
 	}
 	return ret
 }
+
+// fsck checks the filesystem, "fsck repair" also frees any orphaned blocks
+func executeFsck(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	report, err := executor.Rfs.Check(strings.TrimSpace(remainingCommand) == "repair")
+	if err != nil {
+		return makeError(err)
+	}
+	ret := make([]string, 0)
+	for _, problem := range report.Problems {
+		ret = append(ret, problem.String())
+	}
+	ret = append(ret, fmt.Sprintf("%d reachable blocks, %d problems, %d freed", report.Reachable, len(report.Problems), report.Freed))
+	if !report.OrphansChecked {
+		ret = append(ret, "Orphaned blocks not checked, the block handler cannot list its blocks")
+	}
+	return ret
+}
+
+// gc runs a full garbage collection cycle and shows what has been reclaimed so far
+func executeGC(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	freed, err := executor.Rfs.Collector.Collect()
+	if err != nil {
+		return makeError(err)
+	}
+	stats := executor.Rfs.Stats()
+	ret := make([]string, 0)
+	ret = append(ret, fmt.Sprintf("%d blocks freed", freed))
+	for name, count := range stats.GCReclaimedByType {
+		ret = append(ret, fmt.Sprintf("%s: %d", name, count))
+	}
+	ret = append(ret, fmt.Sprintf("%d cycles, %d blocks freed in total", stats.GCCycles, stats.GCReclaimed))
+	return ret
+}
+
+// scrub reads every block, listing the damaged ones and the files they belong to
+func executeScrub(parameters []string, remainingCommand string, executor *ShellExecutor) []string {
+	report, err := executor.Rfs.Scrub()
+	if err != nil {
+		return makeError(err)
+	}
+	ret := make([]string, 0)
+	for _, problem := range report.Problems {
+		ret = append(ret, problem.String())
+	}
+	for _, path := range report.DamagedPaths {
+		ret = append(ret, "Damaged: "+path)
+	}
+	ret = append(ret, fmt.Sprintf("%d blocks read, %d damaged", report.Scanned, len(report.Problems)))
+	return ret
+}
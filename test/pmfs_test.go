@@ -2,10 +2,17 @@ package pmfs_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 import "fmt"
+import "github.com/amkimian/pmfs/blocktest"
 import "github.com/amkimian/pmfs/fs"
 import "github.com/amkimian/pmfs/memory"
 
@@ -128,3 +135,647 @@ func TestMultiBlockFile(m *testing.T) {
 func TestDump(m *testing.T) {
 	f.Dump()
 }
+
+func TestNoSpace(m *testing.T) {
+	var smallHandler memory.MemoryFileSystem
+	small := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&smallHandler), "", 12, 10)
+	// Root directory, search index, directory, file, data, route and search tree
+	if err := small.WriteFile("/full/1", []byte("0123456789")); err != nil {
+		m.Fatal(err)
+	}
+	err := small.WriteFile("/full/2", bytes.Repeat([]byte("0123456789"), 5))
+	if err != fs.ErrNoSpace {
+		m.Errorf("Expected ErrNoSpace, got %v", err)
+	}
+	if v, _ := small.ReadFile("/full/2"); len(v) != 0 {
+		m.Errorf("Partial write left behind %s", string(v))
+	}
+	// Space freed by a delete is available again
+	small.DeleteFile("/full/1")
+	small.DeleteFile("/full/2")
+	small.Sync()
+	if err := small.WriteFile("/full/3", bytes.Repeat([]byte("0123456789"), 3)); err != nil {
+		m.Error(err)
+	}
+	v, _ := small.ReadFile("/full/3")
+	if string(v) != "012345678901234567890123456789" {
+		m.Errorf("Contents not the same, got %s", string(v))
+	}
+}
+
+// An overwrite that runs out of space leaves the file with its old contents and versions
+func TestOverwriteNoSpace(m *testing.T) {
+	var smallHandler memory.MemoryFileSystem
+	small := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&smallHandler), "", 30, 10)
+	small.WriteFile("/full/1", []byte("First"))
+	small.AppendFile("/full/1", []byte(" then second"))
+	for i := 0; ; i++ {
+		if err := small.WriteFile(fmt.Sprintf("/full/fill/%d", i), []byte("0123456789")); err != nil {
+			break
+		}
+	}
+	if err := small.WriteFile("/full/1", bytes.Repeat([]byte("0123456789"), 5)); err != fs.ErrNoSpace {
+		m.Errorf("Expected ErrNoSpace, got %v", err)
+	}
+	if v, err := small.ReadFile("/full/1"); err != nil || string(v) != "First then second" {
+		m.Errorf("Expected the old contents, got %q, %v", v, err)
+	}
+	if v, err := small.ReadFileTag("/full/1", "v000000001"); err != nil || string(v) != "First" {
+		m.Errorf("Expected the first version to be kept, got %q, %v", v, err)
+	}
+	if fileNode, _ := small.StatFile("/full/1"); fileNode.Stats.Size != 17 || len(fileNode.AlternateRoutes) != 2 {
+		m.Errorf("Expected the size and versions to be kept, got %d, %v", fileNode.Stats.Size, fileNode.AlternateRoutes)
+	}
+	small.Sync()
+	if report, err := small.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+}
+
+func TestHandlerErrors(m *testing.T) {
+	var lossyHandler memory.MemoryFileSystem
+	lossy := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&lossyHandler), "", 1000, 100)
+	if err := lossy.WriteFile("/lost/data", []byte("Soon to be gone")); err != nil {
+		m.Fatal(err)
+	}
+	lossy.Sync()
+	fileNode, _ := lossy.StatFile("/lost/data")
+	for _, block := range fileNode.DataBlocks {
+		delete(lossyHandler.Blocks, block)
+	}
+	if _, err := lossy.ReadFile("/lost/data"); err != fs.ErrBlockNotFound {
+		m.Errorf("Expected ErrBlockNotFound, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lossy.Context = ctx
+	if err := lossy.WriteFile("/lost/more", []byte("Never written")); err != context.Canceled {
+		m.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCheck(m *testing.T) {
+	var checkedHandler memory.MemoryFileSystem
+	checked := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&checkedHandler), "", 1000, 10)
+	checked.WriteFile("/check/one", []byte("Hello world, more than one block"))
+	checked.AppendFile("/check/one", []byte(" and a second version"))
+	checked.WriteFile("/check/two", []byte("Soon to be deleted"))
+	checked.WriteFile("/check/two", []byte("Rewritten first"))
+	checked.DeleteFile("/check/two")
+	report, err := checked.Check(false)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.Problems) != 0 || !report.OrphansChecked {
+		m.Errorf("Expected a clean filesystem, got %v", report.Problems)
+	}
+
+	orphan := fs.BlockNode{Type: fs.FILE, Id: 99999}
+	checkedHandler.SaveRawBlock(orphan, []byte("Nobody points here"))
+	fileNode, _ := checked.StatFile("/check/one")
+	delete(checkedHandler.Blocks, fileNode.DataBlocks["00001"])
+	report, err = checked.Check(true)
+	if err != nil {
+		m.Fatal(err)
+	}
+	found := make(map[fs.ProblemType]int)
+	for _, problem := range report.Problems {
+		found[problem.Type]++
+	}
+	if found[fs.ORPHAN] != 1 || found[fs.DANGLING] != 1 || report.Freed != 1 {
+		m.Errorf("Expected one orphan freed and one dangling block, got %v", report.Problems)
+	}
+	if checkedHandler.GetRawBlock(orphan) != nil {
+		m.Error("Orphan not freed by repair")
+	}
+}
+
+func TestGarbageCollection(m *testing.T) {
+	var collectedHandler memory.MemoryFileSystem
+	collected := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&collectedHandler), "", 1000, 10)
+	collected.WriteFile("/gc/one", []byte("Hello world, more than one block"))
+	collected.AppendFile("/gc/one", []byte(" and a second version"))
+
+	// Leave behind blocks that nothing refers to, as a crash part way through a save would
+	leakedRoute := collectedHandler.GetFreeBlockNode(fs.ROUTE)
+	collectedHandler.SaveRawBlock(leakedRoute, []byte("route"))
+	fileNode, _ := collected.StatFile("/gc/one")
+	leakedData := collectedHandler.GetFreeDataBlockNode(fileNode.Node, "99999")
+	collectedHandler.SaveRawBlock(leakedData, []byte("data"))
+	// and a data block that the file holds but no version uses
+	unusedData := collectedHandler.GetFreeDataBlockNode(fileNode.Node, "99998")
+	collectedHandler.SaveRawBlock(unusedData, []byte("unused"))
+	fileNode.DataBlocks["99998"] = unusedData
+	collected.ChangeCache.SaveFileNode(fileNode)
+
+	reclaimed, err := collected.Collector.Collect()
+	if err != nil {
+		m.Fatal(err)
+	}
+	if reclaimed != 3 {
+		m.Errorf("Expected 3 blocks reclaimed, got %d", reclaimed)
+	}
+	stats := collected.Stats()
+	if stats.GCReclaimed != 3 || stats.GCReclaimedByType["data"] != 2 || stats.GCReclaimedByType["route"] != 1 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+	if v, _ := collected.ReadFile("/gc/one"); string(v) != "Hello world, more than one block and a second version" {
+		m.Errorf("Contents not the same, got %s", string(v))
+	}
+
+	// Collecting in the background while the filesystem changes must not lose anything
+	collected.Collector.StepSize = 2
+	collected.Collector.Start(time.Millisecond)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("/gc/many/%d", i)
+		collected.WriteFile(name, []byte(name+" has some contents"))
+		if i%3 == 0 {
+			collected.DeleteFile(fmt.Sprintf("/gc/many/%d", i/2))
+		}
+	}
+	collected.Collector.Stop()
+	collected.Collector.Collect()
+	report, err := collected.Check(false)
+	if err != nil {
+		m.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v", report.Problems)
+	}
+}
+
+func TestCodecs(m *testing.T) {
+	for _, codec := range []fs.Codec{fs.GobCodec, fs.JSONCodec, fs.BinaryCodec} {
+		var handler memory.MemoryFileSystem
+		written := blocktest.Open(m, fs.AdaptBlockHandler(&handler), "")
+		written.Codec = codec
+		written.Format(1000, 10)
+		written.WriteFile("/codec/one", []byte("Hello world, more than one block"))
+		written.AppendFile("/codec/one", []byte(" and a second version"))
+		fileNode, _ := written.StatFile("/codec/one")
+		fileNode.Attributes["colour"] = "blue"
+		written.ChangeCache.SaveFileNode(fileNode)
+		if err := written.Sync(); err != nil {
+			m.Fatalf("%s: %v", codec.Name(), err)
+		}
+
+		mounted := blocktest.Open(m, fs.AdaptBlockHandler(&handler), "")
+		if err := mounted.Mount(); err != nil {
+			m.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if mounted.Codec.Name() != codec.Name() {
+			m.Errorf("%s: mounted with codec %s", codec.Name(), mounted.Codec.Name())
+		}
+		if v, _ := mounted.ReadFile("/codec/one"); string(v) != "Hello world, more than one block and a second version" {
+			m.Errorf("%s: contents not the same, got %s", codec.Name(), string(v))
+		}
+		if v, _ := mounted.ReadFileTag("/codec/one", "v000000001"); string(v) != "Hello world, more than one block" {
+			m.Errorf("%s: first version not the same, got %s", codec.Name(), string(v))
+		}
+		fileNode, _ = mounted.StatFile("/codec/one")
+		if fileNode.Attributes["colour"] != "blue" {
+			m.Errorf("%s: attribute lost, got %v", codec.Name(), fileNode.Attributes)
+		}
+		found, _ := mounted.SearchFindTerms("text", "second", "secondz")
+		if len(found) != 1 || found[0].Path != "/codec/one" {
+			m.Errorf("%s: search index not read back, got %v", codec.Name(), found)
+		}
+		// and new files can be added to the mounted directories
+		if err := mounted.WriteFile("/codec/two", []byte("After mounting")); err != nil {
+			m.Errorf("%s: %v", codec.Name(), err)
+		}
+	}
+}
+
+func TestLegacyBlocks(m *testing.T) {
+	var handler memory.MemoryFileSystem
+	written := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&handler), "", 1000, 10)
+	written.WriteFile("/legacy/one", []byte("Written before blocks had a header"))
+	written.Sync()
+
+	// Rewrite every metadata block as it was before there was a header, a plain gob encoding
+	// (and for search trees the node followed by each entry)
+	for node, raw := range handler.Blocks {
+		if node.Type == fs.DATA || len(raw) == 0 || raw[0] != 0xB5 {
+			continue
+		}
+		body := raw[3+int(raw[2]):]
+		if node.Type == fs.SEARCHTREE {
+			var tree struct {
+				Node    fs.BlockNode
+				Entries []fs.SearchEntry
+			}
+			if err := fs.GobCodec.Unmarshal(body, &tree); err != nil {
+				m.Fatal(err)
+			}
+			var buffer bytes.Buffer
+			enc := gob.NewEncoder(&buffer)
+			enc.Encode(tree.Node)
+			for _, entry := range tree.Entries {
+				enc.Encode(entry)
+			}
+			body = buffer.Bytes()
+		}
+		handler.Blocks[node] = body
+	}
+
+	mounted := blocktest.Open(m, fs.AdaptBlockHandler(&handler), "")
+	if err := mounted.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	if v, _ := mounted.ReadFile("/legacy/one"); string(v) != "Written before blocks had a header" {
+		m.Errorf("Contents not the same, got %s", string(v))
+	}
+	found, _ := mounted.SearchFindTerms("text", "header", "headerz")
+	if len(found) != 1 {
+		m.Errorf("Search index not read back, got %v", found)
+	}
+}
+
+func TestCorruptBlock(m *testing.T) {
+	var handler memory.MemoryFileSystem
+	written := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&handler), "", 1000, 10)
+	written.WriteFile("/corrupt/one", []byte("Soon to be unreadable"))
+	written.Sync()
+	fileNode, _ := written.StatFile("/corrupt/one")
+	handler.Blocks[fileNode.Node] = []byte("Not a file node")
+
+	mounted := blocktest.Open(m, fs.AdaptBlockHandler(&handler), "")
+	if err := mounted.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	_, err := mounted.ReadFile("/corrupt/one")
+	var corrupt *fs.ErrCorruptBlock
+	if !errors.As(err, &corrupt) || corrupt.Node != fileNode.Node {
+		m.Errorf("Expected the file node to be reported corrupt, got %v", err)
+	}
+}
+
+func TestFileHandles(m *testing.T) {
+	var handler memory.MemoryFileSystem
+	streamed := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&handler), "", 1000, 10)
+	streamed.WriteFile("/stream/one", []byte("Replaced when the handle is closed"))
+	contents := strings.Repeat("A streamed file, written in pieces. ", 20)
+
+	w, err := streamed.Create("/stream/one")
+	if err != nil {
+		m.Fatal(err)
+	}
+	for i := 0; i < len(contents); i += 7 {
+		end := i + 7
+		if end > len(contents) {
+			end = len(contents)
+		}
+		if n, err := w.Write([]byte(contents[i:end])); err != nil || n != end-i {
+			m.Fatalf("Write returned %d, %v", n, err)
+		}
+		// Collecting garbage or repairing while the file is written must keep the blocks written
+		// so far
+		if i == 350 {
+			if _, err := streamed.Collector.Collect(); err != nil {
+				m.Fatal(err)
+			}
+		}
+		if i == 504 {
+			if report, err := streamed.Check(true); err != nil || len(report.Problems) != 0 {
+				m.Errorf("Expected the blocks being written not to be orphans, got %v, %v", report, err)
+			}
+		}
+	}
+	if v, _ := streamed.ReadFile("/stream/one"); string(v) != "Replaced when the handle is closed" {
+		m.Errorf("Expected the file to be unchanged until Close, got %q", v)
+	}
+	if _, err := w.Read(make([]byte, 1)); !errors.Is(err, fs.ErrBadFileMode) {
+		m.Errorf("Expected reading a created file to fail, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		m.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, fs.ErrFileClosed) {
+		m.Errorf("Expected a second Close to fail, got %v", err)
+	}
+	if v, _ := streamed.ReadFile("/stream/one"); string(v) != contents {
+		m.Errorf("Contents not the same, got %q", v)
+	}
+	fileNode, _ := streamed.StatFile("/stream/one")
+	if fileNode.Stats.Size != len(contents) || len(fileNode.AlternateRoutes) != 1 {
+		m.Errorf("Expected a single version of %d bytes, got %d bytes, %v", len(contents), fileNode.Stats.Size, fileNode.AlternateRoutes)
+	}
+	// Words crossing a block boundary are indexed whole
+	if found, _ := streamed.SearchFindTerms("text", "pieces", "piecesz"); len(found) != 1 {
+		m.Errorf("Expected the word to be indexed, got %v", found)
+	}
+	if found, _ := streamed.SearchFindTerms("text", "ieces", "iecesz"); len(found) != 0 {
+		m.Errorf("Expected no pieces of words to be indexed, got %v", found)
+	}
+
+	r, err := streamed.Open("/stream/one")
+	if err != nil {
+		m.Fatal(err)
+	}
+	if v, err := io.ReadAll(r); err != nil || string(v) != contents {
+		m.Errorf("Read %q, %v", v, err)
+	}
+	buffer := make([]byte, 12)
+	if n, err := r.ReadAt(buffer, 39); n != 12 || err != nil || string(buffer) != contents[39:51] {
+		m.Errorf("ReadAt returned %d, %v, %q", n, err, buffer)
+	}
+	if n, err := r.ReadAt(buffer, int64(len(contents)-5)); n != 5 || err != io.EOF {
+		m.Errorf("Expected a short read at the end, got %d, %v", n, err)
+	}
+	if pos, err := r.Seek(-8, io.SeekEnd); err != nil || pos != int64(len(contents)-8) {
+		m.Errorf("Seek returned %d, %v", pos, err)
+	}
+	if v, _ := io.ReadAll(r); string(v) != contents[len(contents)-8:] {
+		m.Errorf("Read after Seek returned %q", v)
+	}
+	if _, err := r.Write([]byte("x")); !errors.Is(err, fs.ErrBadFileMode) {
+		m.Errorf("Expected writing an opened file to fail, got %v", err)
+	}
+	r.Close()
+	if _, err := r.Read(buffer); !errors.Is(err, fs.ErrFileClosed) {
+		m.Errorf("Expected reading a closed file to fail, got %v", err)
+	}
+
+	// Appending leaves blocks that aren't full, which are found by reading them
+	streamed.WriteFile("/stream/two", []byte("abc"))
+	streamed.AppendFile("/stream/two", []byte("defghijklmnop"))
+	r, _ = streamed.Open("/stream/two")
+	if n, _ := r.ReadAt(buffer[:4], 11); n != 4 || string(buffer[:4]) != "lmno" {
+		m.Errorf("ReadAt across uneven blocks returned %q", buffer[:n])
+	}
+	r.Seek(2, io.SeekStart)
+	if n, _ := r.Read(buffer[:3]); string(buffer[:n]) != "cde" {
+		m.Errorf("Read across uneven blocks returned %q", buffer[:n])
+	}
+
+	if report, err := streamed.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+}
+
+func TestWriteAtAndTruncate(m *testing.T) {
+	var handler memory.MemoryFileSystem
+	written := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&handler), "", 1000, 10)
+	dataBlocks := func() int {
+		count := 0
+		blocks, _ := written.BlockHandler.(fs.BlockLister).ListBlocks(context.Background())
+		for _, node := range blocks {
+			if node.Type == fs.DATA {
+				count++
+			}
+		}
+		return count
+	}
+	expect := func(contents string) {
+		if v, err := written.ReadFile("/random/one"); err != nil || string(v) != contents {
+			m.Errorf("Expected %q, got %q, %v", contents, v, err)
+		}
+		if fileNode, _ := written.StatFile("/random/one"); fileNode.Stats.Size != len(contents) {
+			m.Errorf("Expected a size of %d, got %d", len(contents), fileNode.Stats.Size)
+		}
+	}
+	original := "0123456789abcdefghijABCDEFGHIJklmno"
+	written.WriteFile("/random/one", []byte(original))
+
+	// Writing inside a block rewrites just that block
+	before := dataBlocks()
+	if err := written.WriteAt("/random/one", 12, []byte("XY")); err != nil {
+		m.Fatal(err)
+	}
+	if dataBlocks() != before+1 {
+		m.Errorf("Expected one block to be written, went from %d to %d", before, dataBlocks())
+	}
+	expect("0123456789abXYefghijABCDEFGHIJklmno")
+	// and across a boundary rewrites the two blocks it touches
+	written.WriteAt("/random/one", 18, []byte("____"))
+	expect("0123456789abXYefgh____CDEFGHIJklmno")
+	// and past the end fills the gap with zeros
+	written.WriteAt("/random/one", 38, []byte("end"))
+	expect("0123456789abXYefgh____CDEFGHIJklmno\x00\x00\x00end")
+
+	written.Truncate("/random/one", 15)
+	expect("0123456789abXYe")
+	written.Truncate("/random/one", 17)
+	expect("0123456789abXYe\x00\x00")
+	if err := written.Truncate("/random/missing", 0); err == nil {
+		m.Errorf("Expected truncating a missing file to fail")
+	}
+
+	// Every earlier version can still be read, after the garbage collector has run
+	written.Collector.Collect()
+	if v, err := written.ReadFileTag("/random/one", "v000000001"); err != nil || string(v) != original {
+		m.Errorf("Expected the first version to be kept, got %q, %v", v, err)
+	}
+	if v, _ := written.ReadFileTag("/random/one", "v000000002"); string(v) != "0123456789abXYefghijABCDEFGHIJklmno" {
+		m.Errorf("Expected the second version to be kept, got %q", v)
+	}
+	if report, err := written.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+
+	// Replacing a block of a structured file changes the size by the difference
+	fileNode, _ := written.StatFile("/random/one")
+	written.SaveNewBlock("/random/one", fileNode, "00001", []byte("short"), true)
+	expect("shortabXYe\x00\x00")
+
+	// A gap of several blocks is written as whole blocks of zeros, then the rest with the data
+	before = dataBlocks()
+	written.WriteAt("/random/one", 40, []byte("far"))
+	expect("shortabXYe\x00\x00" + strings.Repeat("\x00", 28) + "far")
+	if dataBlocks() != before+4 {
+		m.Errorf("Expected four blocks to be written, went from %d to %d", before, dataBlocks())
+	}
+}
+
+func TestDirectories(m *testing.T) {
+	var handler memory.MemoryFileSystem
+	dirs := blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&handler), "", 1000, 100)
+	dirs.WriteFile("/keep/file", []byte("Nothing to remove"))
+	dataBlocks := func() int {
+		count := 0
+		blocks, _ := dirs.BlockHandler.(fs.BlockLister).ListBlocks(context.Background())
+		for _, node := range blocks {
+			if node.Type == fs.DATA {
+				count++
+			}
+		}
+		return count
+	}
+	before := dataBlocks()
+
+	if err := dirs.MakeDirectory("/one/two/three"); err != nil {
+		m.Fatal(err)
+	}
+	if err := dirs.MakeDirectory("/one/two"); err != nil {
+		m.Errorf("Expected an existing directory to be fine, got %v", err)
+	}
+	if names, err := dirs.ListDirectory("/one/two"); err != nil || len(names) != 1 {
+		m.Errorf("Expected the nested directory, got %v, %v", names, err)
+	}
+	if err := dirs.MakeDirectory("/keep/file/below"); err == nil {
+		m.Errorf("Expected a file in the way to fail")
+	}
+
+	// Files three levels down can be moved and deleted
+	dirs.WriteFile("/one/two/three/a", []byte("Moving words"))
+	if err := dirs.MoveFileOrFolder("/one/two/three/a", "/one/two/three/b"); err != nil {
+		m.Errorf("Expected the move to work, got %v", err)
+	}
+	dirs.WriteFile("/one/two/three/e", []byte("Deleted words"))
+	if err := dirs.DeleteFile("/one/two/three/e"); err != nil {
+		m.Errorf("Expected the delete to work, got %v", err)
+	}
+	if found, _ := dirs.SearchFindTerms("text", "Deleted", "Deletedz"); len(found) != 0 {
+		m.Errorf("Expected the deleted file to leave the search index, got %v", found)
+	}
+
+	dirs.WriteFile("/one/two/three/c", []byte("Removed words"))
+	dirs.AppendFile("/one/two/d", []byte(" and more"))
+	if err := dirs.RemoveDirectory("/one/two", false); err == nil {
+		m.Errorf("Expected removing a directory with contents to fail")
+	}
+	if err := dirs.RemoveDirectory("/", true); err == nil {
+		m.Errorf("Expected removing the root to fail")
+	}
+	if err := dirs.RemoveDirectory("/one/two", true); err != nil {
+		m.Fatal(err)
+	}
+	if names, err := dirs.ListDirectory("/one"); err != nil || len(names) != 0 {
+		m.Errorf("Expected /one to be empty, got %v, %v", names, err)
+	}
+	if _, err := dirs.ReadFile("/one/two/three/c"); err == nil {
+		m.Errorf("Expected the file to be gone")
+	}
+	if dataBlocks() != before {
+		m.Errorf("Expected the data blocks to be freed, went from %d to %d", before, dataBlocks())
+	}
+	if found, _ := dirs.SearchFindTerms("text", "Removed", "Removedz"); len(found) != 0 {
+		m.Errorf("Expected the removed files to leave the search index, got %v", found)
+	}
+	if found, _ := dirs.SearchFindTerms("text", "Nothing", "Nothingz"); len(found) != 1 {
+		m.Errorf("Expected other files to stay in the search index, got %v", found)
+	}
+	if err := dirs.RemoveDirectory("/one", false); err != nil {
+		m.Errorf("Expected the empty directory to be removed, got %v", err)
+	}
+
+	// Deleting the last file removes the directories it leaves empty, but not the root
+	dirs.WriteFile("/empty/below/last", []byte("Last words"))
+	dirs.WriteFile("/empty/other", []byte("Other words"))
+	if err := dirs.DeleteFile("/empty/below/last"); err != nil {
+		m.Fatal(err)
+	}
+	if names, err := dirs.ListDirectory("/empty"); err != nil || len(names) != 1 || names[0] != "other" {
+		m.Errorf("Expected only the other file to be left, got %v, %v", names, err)
+	}
+	if err := dirs.DeleteFile("/empty/other"); err != nil {
+		m.Fatal(err)
+	}
+	if names, err := dirs.ListDirectory("/"); err != nil || len(names) != 1 || names[0] != "keep" {
+		m.Errorf("Expected only /keep to be left, got %v, %v", names, err)
+	}
+	if err := dirs.DeleteFile("/keep/file"); err != nil {
+		m.Fatal(err)
+	}
+	if names, err := dirs.ListDirectory("/"); err != nil || len(names) != 0 {
+		m.Errorf("Expected an empty root, got %v, %v", names, err)
+	}
+
+	dirs.Sync()
+	dirs.Collector.Collect()
+	if report, err := dirs.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+}
+
+func TestCopy(m *testing.T) {
+	newFs := func(blockSize int) *fs.RootFileSystem {
+		return blocktest.NewFileSystem(m, fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), "", 1000, blockSize)
+	}
+	expect := func(rfs *fs.RootFileSystem, name string, contents string) {
+		if v, err := rfs.ReadFile(name); err != nil || string(v) != contents {
+			m.Errorf("Expected %s to be %q, got %q, %v", name, contents, v, err)
+		}
+	}
+	copied := newFs(10)
+	copied.WriteFile("/src/one", []byte("First version of the file"))
+	copied.AppendFile("/src/one", []byte(", then appended"))
+	copied.WriteFile("/src/sub/two", []byte("Another file"))
+	copied.MakeDirectory("/src/empty")
+
+	// The latest version only, as the first version of the copy
+	if err := copied.CopyFileOrFolder("/src/one", "/latest/one", fs.CopyOptions{}); err != nil {
+		m.Fatal(err)
+	}
+	expect(copied, "/latest/one", "First version of the file, then appended")
+	if fileNode, _ := copied.StatFile("/latest/one"); len(fileNode.AlternateRoutes) != 1 {
+		m.Errorf("Expected one version, got %v", fileNode.AlternateRoutes)
+	}
+	// or with every version
+	if err := copied.CopyFileOrFolder("/src/one", "/history/one", fs.CopyOptions{History: true}); err != nil {
+		m.Fatal(err)
+	}
+	if v, err := copied.ReadFileTag("/history/one", "v000000001"); err != nil || string(v) != "First version of the file" {
+		m.Errorf("Expected the first version to be copied, got %q, %v", v, err)
+	}
+	if found, _ := copied.SearchFindTerms("text", "appended", "appendedz"); len(found) != 3 {
+		m.Errorf("Expected the copies in the search index, got %v", found)
+	}
+
+	// Directories are copied with everything below them
+	if err := copied.CopyFileOrFolder("/src", "/tree/copy", fs.CopyOptions{}); err != nil {
+		m.Fatal(err)
+	}
+	expect(copied, "/tree/copy/sub/two", "Another file")
+	if names, _ := copied.ListDirectory("/tree/copy"); len(names) != 3 {
+		m.Errorf("Expected the directory to be copied whole, got %v", names)
+	}
+	if err := copied.CopyFileOrFolder("/src", "/src/sub/copy", fs.CopyOptions{}); err == nil {
+		m.Errorf("Expected copying a directory into itself to fail")
+	}
+	if err := copied.CopyFileOrFolder("/src/one", "/latest/one", fs.CopyOptions{}); err == nil {
+		m.Errorf("Expected copying over an existing file to fail")
+	}
+	if err := copied.CopyFileOrFolder("/src/missing", "/latest/missing", fs.CopyOptions{}); err == nil {
+		m.Errorf("Expected copying a missing file to fail")
+	}
+
+	// The copies don't share anything with the original
+	copied.WriteFile("/src/one", []byte("Replaced"))
+	copied.RemoveDirectory("/src", true)
+	expect(copied, "/latest/one", "First version of the file, then appended")
+	expect(copied, "/tree/copy/one", "First version of the file, then appended")
+	copied.Sync()
+	copied.Collector.Collect()
+	if report, err := copied.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+
+	// Into another filesystem
+	other := newFs(20)
+	if err := copied.CopyFileOrFolder("/history", "/from/other", fs.CopyOptions{History: true, Target: other}); err != nil {
+		m.Fatal(err)
+	}
+	expect(other, "/from/other/one", "First version of the file, then appended")
+	if v, err := other.ReadFileTag("/from/other/one", "v000000001"); err != nil || string(v) != "First version of the file" {
+		m.Errorf("Expected the first version to be copied, got %q, %v", v, err)
+	}
+	if report, err := other.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+
+	// Blocks larger than the target block size are split
+	small := newFs(5)
+	if err := other.CopyFileOrFolder("/from/other/one", "/small", fs.CopyOptions{History: true, Target: small}); err != nil {
+		m.Fatal(err)
+	}
+	expect(small, "/small", "First version of the file, then appended")
+	if v, err := small.ReadFileTag("/small", "v000000001"); err != nil || string(v) != "First version of the file" {
+		m.Errorf("Expected the first version to be copied, got %q, %v", v, err)
+	}
+	if report, err := small.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected a clean filesystem, got %v, %v", report, err)
+	}
+}
@@ -0,0 +1,404 @@
+// Tiered block handler - keeps recently used blocks in a bounded hot tier in memory in front of a
+// slower, persistent cold tier (another BlockHandlerV2). Saved data blocks stay in the hot tier
+// until they are the least recently used and have to make room, when they are spilled to the cold
+// tier, or until a metadata block is saved; Flush (called by RootFileSystem.Sync) spills every
+// block that hasn't been yet. So data saved since the last Sync that nothing refers to yet is lost
+// if the process dies, as it would be from the cache.
+//
+// Metadata blocks (everything but DATA blocks - directories, files, routes, the search index and
+// the SuperBlock) are written through to the cold tier as they are saved, after every data block
+// that hasn't been written yet, so the structure of the filesystem is as durable as the cold
+// tier's and never refers to data the cold tier doesn't have. They are also pinned in the hot tier
+// in preference to data, so only when the hot tier holds nothing but metadata is any of it
+// dropped. That keeps walking a path with findNode in memory on stores far bigger than the hot
+// tier.
+//
+// The hot tier holds at most HotBlocks blocks and, if HotBytes is set, at most that many bytes.
+// The configuration string passed to Init is the sizes followed by the configuration of the cold
+// tier, including its scheme, e.g. "tier:blocks=10000,bytes=67108864:disk:/var/pmfs/data.pmfs".
+// When Cold is set before Init only the sizes are needed, and either can be left out.
+package tierfs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// The number of blocks the hot tier holds if HotBlocks is not set
+const defaultHotBlocks = 1024
+
+type TieredFileSystem struct {
+	Cold      fs.BlockHandlerV2
+	HotBlocks int
+	HotBytes  int
+	// The blocks in the hot tier, each in the metadata or the data list with the most recently used
+	// at the front
+	hot map[fs.BlockNode]*list.Element
+	// The blocks in the hot tier that haven't been written to the cold tier
+	dirty    map[fs.BlockNode]*list.Element
+	metadata *list.List
+	data     *list.List
+	// The blocks saved or freed in the transaction in progress, if there is one
+	touched map[fs.BlockNode]bool
+	bytes   int
+	stats   tierStats
+	lock    sync.Mutex
+}
+
+type hotBlock struct {
+	node fs.BlockNode
+	data []byte
+	// Whether the block has been saved since it was last written to the cold tier
+	dirty bool
+}
+
+type tierStats struct {
+	Hits    int64
+	Misses  int64
+	Spilled int64
+}
+
+func init() {
+	fs.RegisterBlockHandler("tier", func() fs.BlockHandlerV2 { return &TieredFileSystem{} })
+}
+
+// Set the sizes of the hot tier from a list like "blocks=100,bytes=4096"
+func (tfs *TieredFileSystem) configure(sizes string) error {
+	for _, item := range strings.Split(sizes, ",") {
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Tier size '%s' is not name=value", item)
+		}
+		value, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return err
+		}
+		switch parts[0] {
+		case "blocks":
+			tfs.HotBlocks = value
+		case "bytes":
+			tfs.HotBytes = value
+		default:
+			return fmt.Errorf("Unknown tier size '%s'", parts[0])
+		}
+	}
+	return nil
+}
+
+// Set the sizes of the hot tier from the start of the configuration and initialize the cold tier
+// (creating it from the rest of the configuration if there isn't one)
+func (tfs *TieredFileSystem) Init(ctx context.Context, configuration string) error {
+	sizes, rest := configuration, ""
+	if i := strings.Index(configuration, ":"); i >= 0 {
+		sizes, rest = configuration[:i], configuration[i+1:]
+	}
+	if err := tfs.configure(sizes); err != nil {
+		return err
+	}
+	if tfs.HotBlocks <= 0 {
+		tfs.HotBlocks = defaultHotBlocks
+	}
+	tfs.lock.Lock()
+	tfs.clear()
+	tfs.stats = tierStats{}
+	tfs.lock.Unlock()
+	if tfs.Cold == nil {
+		cold, coldConfiguration, err := fs.NewBlockHandler(rest)
+		if err != nil {
+			return err
+		}
+		tfs.Cold, rest = cold, coldConfiguration
+	}
+	return tfs.Cold.Init(ctx, rest)
+}
+
+// Must be called with the lock held
+func (tfs *TieredFileSystem) clear() {
+	tfs.hot = make(map[fs.BlockNode]*list.Element)
+	tfs.dirty = make(map[fs.BlockNode]*list.Element)
+	tfs.metadata = list.New()
+	tfs.data = list.New()
+	tfs.bytes = 0
+}
+
+func (tfs *TieredFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	tfs.lock.Lock()
+	tfs.clear()
+	tfs.lock.Unlock()
+	return tfs.Cold.Format(ctx, blockCount, blockSize)
+}
+
+func (tfs *TieredFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return tfs.Cold.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (tfs *TieredFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return tfs.Cold.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+// The list a block belongs on, data blocks being spilled before metadata
+func (tfs *TieredFileSystem) listFor(node fs.BlockNode) *list.List {
+	if node.Type == fs.DATA {
+		return tfs.data
+	}
+	return tfs.metadata
+}
+
+// Put a block in the hot tier as the most recently used, then spill blocks until the tier is back
+// within its sizes. Must be called with the lock held.
+func (tfs *TieredFileSystem) put(ctx context.Context, node fs.BlockNode, data []byte, dirty bool) error {
+	element, ok := tfs.hot[node]
+	if ok {
+		block := element.Value.(*hotBlock)
+		tfs.bytes += len(data) - len(block.data)
+		block.data = data
+		block.dirty = block.dirty || dirty
+		tfs.listFor(node).MoveToFront(element)
+	} else {
+		element = tfs.listFor(node).PushFront(&hotBlock{node, data, dirty})
+		tfs.hot[node] = element
+		tfs.bytes += len(data)
+	}
+	if element.Value.(*hotBlock).dirty {
+		tfs.dirty[node] = element
+	}
+	for len(tfs.hot) > tfs.HotBlocks || (tfs.HotBytes > 0 && tfs.bytes > tfs.HotBytes) {
+		victim := tfs.data.Back()
+		if victim == nil {
+			victim = tfs.metadata.Back()
+		}
+		if err := tfs.spill(ctx, victim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a block out to the cold tier if it is dirty and drop it from the hot tier. Must be called
+// with the lock held.
+func (tfs *TieredFileSystem) spill(ctx context.Context, element *list.Element) error {
+	block := element.Value.(*hotBlock)
+	if block.dirty {
+		if _, err := tfs.Cold.SaveRawBlock(ctx, block.node, block.data); err != nil {
+			return err
+		}
+		tfs.stats.Spilled++
+	}
+	tfs.drop(element)
+	return nil
+}
+
+// Must be called with the lock held
+func (tfs *TieredFileSystem) drop(element *list.Element) {
+	block := element.Value.(*hotBlock)
+	tfs.listFor(block.node).Remove(element)
+	delete(tfs.hot, block.node)
+	delete(tfs.dirty, block.node)
+	tfs.bytes -= len(block.data)
+}
+
+// Read the block from the hot tier, or from the cold tier (keeping it in the hot tier) if it isn't
+// there. A block that can't be spilled to make room is left in the hot tier, for the next save or
+// Flush to report.
+func (tfs *TieredFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	if element, ok := tfs.hot[node]; ok {
+		tfs.stats.Hits++
+		tfs.listFor(node).MoveToFront(element)
+		return append([]byte(nil), element.Value.(*hotBlock).data...), nil
+	}
+	tfs.stats.Misses++
+	data, err := tfs.Cold.GetRawBlock(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	tfs.put(ctx, node, append([]byte(nil), data...), false)
+	return data, nil
+}
+
+// Keep the block in the hot tier, a data block to be written to the cold tier when it is spilled
+// and any other written to it now, after the data blocks that haven't been
+func (tfs *TieredFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return node, err
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	if tfs.touched != nil {
+		tfs.touched[node] = true
+	}
+	dirty := node.Type == fs.DATA
+	if !dirty {
+		if err := tfs.writeDirty(ctx); err != nil {
+			return node, err
+		}
+		if _, err := tfs.Cold.SaveRawBlock(ctx, node, data); err != nil {
+			return node, err
+		}
+	}
+	return node, tfs.put(ctx, node, append([]byte(nil), data...), dirty)
+}
+
+func (tfs *TieredFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	for _, node := range blocks {
+		if element, ok := tfs.hot[node]; ok {
+			tfs.drop(element)
+		}
+		if tfs.touched != nil {
+			tfs.touched[node] = true
+		}
+	}
+	return tfs.Cold.FreeBlocks(ctx, blocks)
+}
+
+// Pass a transaction on to the cold tier, if it is Transactional. Data blocks held back from
+// before the transaction are written out first, so that they aren't discarded with it, and blocks
+// the transaction touched are dropped from the hot tier if it is rolled back (or fails to commit).
+func (tfs *TieredFileSystem) Begin(ctx context.Context) {
+	tx, ok := tfs.Cold.(fs.Transactional)
+	if !ok {
+		return
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	tfs.writeDirty(ctx)
+	tfs.touched = make(map[fs.BlockNode]bool)
+	tx.Begin(ctx)
+}
+
+func (tfs *TieredFileSystem) Commit(ctx context.Context) error {
+	tx, ok := tfs.Cold.(fs.Transactional)
+	if !ok {
+		return nil
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	err := tx.Commit(ctx)
+	if err != nil {
+		tfs.forgetTouched()
+	}
+	tfs.touched = nil
+	return err
+}
+
+func (tfs *TieredFileSystem) Rollback(ctx context.Context) {
+	tx, ok := tfs.Cold.(fs.Transactional)
+	if !ok {
+		return
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	tx.Rollback(ctx)
+	tfs.forgetTouched()
+	tfs.touched = nil
+}
+
+// Must be called with the lock held
+func (tfs *TieredFileSystem) forgetTouched() {
+	for node := range tfs.touched {
+		if element, ok := tfs.hot[node]; ok {
+			tfs.drop(element)
+		}
+	}
+}
+
+func (tfs *TieredFileSystem) InnerTransactional() bool {
+	return fs.IsTransactional(tfs.Cold)
+}
+
+// Reserve the node in the cold tier, if it is a BlockReserver
+func (tfs *TieredFileSystem) ReserveBlockNode(ctx context.Context, node fs.BlockNode) error {
+	if reserver, ok := tfs.Cold.(fs.BlockReserver); ok {
+		return reserver.ReserveBlockNode(ctx, node)
+	}
+	return nil
+}
+
+// Write every block that has been saved since it was last spilled to the cold tier, keeping them
+// in the hot tier, then flush the cold tier if it is a BlockFlusher
+func (tfs *TieredFileSystem) Flush(ctx context.Context) error {
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	if err := tfs.writeDirty(ctx); err != nil {
+		return err
+	}
+	if flusher, ok := tfs.Cold.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (tfs *TieredFileSystem) writeDirty(ctx context.Context) error {
+	for node, element := range tfs.dirty {
+		block := element.Value.(*hotBlock)
+		if _, err := tfs.Cold.SaveRawBlock(ctx, block.node, block.data); err != nil {
+			return err
+		}
+		block.dirty = false
+		delete(tfs.dirty, node)
+		tfs.stats.Spilled++
+	}
+	return nil
+}
+
+// Every block held by the cold tier (if it is a BlockLister) and every block only in the hot tier
+func (tfs *TieredFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := tfs.Cold.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	blocks, err := lister.ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[fs.BlockNode]bool, len(blocks))
+	for _, node := range blocks {
+		seen[node] = true
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	for node := range tfs.hot {
+		if !seen[node] {
+			blocks = append(blocks, node)
+		}
+	}
+	return blocks, nil
+}
+
+// The size of the hot tier, how many reads it served and missed and how many blocks were spilled
+// to the cold tier, with the counters of the cold tier
+func (tfs *TieredFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := tfs.Cold.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	tfs.lock.Lock()
+	defer tfs.lock.Unlock()
+	stats["tier.hot_blocks"] = float64(len(tfs.hot))
+	stats["tier.hot_metadata_blocks"] = float64(tfs.metadata.Len())
+	stats["tier.hot_bytes"] = float64(tfs.bytes)
+	stats["tier.hits"] = float64(tfs.stats.Hits)
+	stats["tier.misses"] = float64(tfs.stats.Misses)
+	stats["tier.spilled"] = float64(tfs.stats.Spilled)
+	return stats
+}
+
+func (tfs *TieredFileSystem) DumpInfo() {
+	tfs.lock.Lock()
+	fmt.Printf("Tiered file system: %d of %d hot blocks (%d metadata), %d bytes, %d hits, %d misses, over:\n", len(tfs.hot), tfs.HotBlocks, tfs.metadata.Len(), tfs.bytes, tfs.stats.Hits, tfs.stats.Misses)
+	tfs.lock.Unlock()
+	tfs.Cold.DumpInfo()
+}
@@ -0,0 +1,253 @@
+package tierfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+	"github.com/amkimian/pmfs/walfs"
+)
+
+func newTiered(m *testing.T, configuration string) (*TieredFileSystem, *memory.MemoryFileSystem) {
+	var mh memory.MemoryFileSystem
+	tfs := &TieredFileSystem{Cold: fs.AdaptBlockHandler(&mh)}
+	ctx := context.Background()
+	if err := tfs.Init(ctx, configuration); err != nil {
+		m.Fatal(err)
+	}
+	tfs.Format(ctx, 100, 100)
+	return tfs, &mh
+}
+
+func TestSpillLeastRecentlyUsed(m *testing.T) {
+	ctx := context.Background()
+	tfs, mh := newTiered(m, "blocks=3")
+	nodes := make([]fs.BlockNode, 0)
+	for i := 0; i < 3; i++ {
+		node, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+		tfs.SaveRawBlock(ctx, node, []byte(fmt.Sprintf("Block %d", i)))
+		nodes = append(nodes, node)
+	}
+	if len(mh.Blocks) != 0 {
+		m.Errorf("Expected nothing in the cold tier yet, got %d blocks", len(mh.Blocks))
+	}
+
+	// Using the first block makes the second the least recently used
+	tfs.GetRawBlock(ctx, nodes[0])
+	node, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+	tfs.SaveRawBlock(ctx, node, []byte("Block 3"))
+	if len(mh.Blocks) != 1 || string(mh.Blocks[nodes[1]]) != "Block 1" {
+		m.Errorf("Expected the second block to be spilled, got %v", mh.Blocks)
+	}
+
+	// It is read back from the cold tier, spilling the next
+	if x, err := tfs.GetRawBlock(ctx, nodes[1]); err != nil || string(x) != "Block 1" {
+		m.Errorf("Expected the spilled block to be read back, got %q, %v", x, err)
+	}
+	stats := tfs.HandlerStats()
+	if stats["tier.hits"] != 1 || stats["tier.misses"] != 1 || stats["tier.spilled"] != 2 || stats["tier.hot_blocks"] != 3 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+
+	if err := tfs.Flush(ctx); err != nil {
+		m.Fatal(err)
+	}
+	if len(mh.Blocks) != 4 {
+		m.Errorf("Expected every block in the cold tier after a flush, got %d", len(mh.Blocks))
+	}
+	tfs.FreeBlocks(ctx, nodes)
+	if x, err := tfs.GetRawBlock(ctx, nodes[0]); err == nil {
+		m.Errorf("Expected a freed block to be gone, got %q", x)
+	}
+}
+
+func TestMetadataIsPinned(m *testing.T) {
+	ctx := context.Background()
+	tfs, mh := newTiered(m, "blocks=4")
+	dir, _ := tfs.GetFreeBlockNode(ctx, fs.DIRECTORY)
+	file, _ := tfs.GetFreeBlockNode(ctx, fs.FILE)
+	tfs.SaveRawBlock(ctx, dir, []byte("Directory"))
+	tfs.SaveRawBlock(ctx, file, []byte("File"))
+	for i := 0; i < 10; i++ {
+		node, _ := tfs.GetFreeDataBlockNode(ctx, file, fmt.Sprintf("%d", i))
+		tfs.SaveRawBlock(ctx, node, []byte(fmt.Sprintf("Data %d", i)))
+	}
+	// Metadata is written through to the cold tier, and stays in the hot tier
+	if string(mh.Blocks[dir]) != "Directory" || string(mh.Blocks[file]) != "File" {
+		m.Errorf("Expected the directory and file to be written through, got %q and %q", mh.Blocks[dir], mh.Blocks[file])
+	}
+	if _, ok := tfs.hot[dir]; !ok {
+		m.Errorf("Expected the directory to stay in the hot tier")
+	}
+	if _, ok := tfs.hot[file]; !ok {
+		m.Errorf("Expected the file to stay in the hot tier")
+	}
+	if stats := tfs.HandlerStats(); stats["tier.hot_metadata_blocks"] != 2 || stats["tier.spilled"] != 8 {
+		m.Errorf("Unexpected stats %v", stats)
+	}
+
+	// Metadata is only dropped when there is nothing else left
+	for i := 0; i < 4; i++ {
+		node, _ := tfs.GetFreeBlockNode(ctx, fs.FILE)
+		tfs.SaveRawBlock(ctx, node, []byte("Another file"))
+	}
+	if _, ok := tfs.hot[dir]; ok {
+		m.Errorf("Expected the directory to be dropped from the hot tier")
+	}
+	if x, err := tfs.GetRawBlock(ctx, dir); err != nil || string(x) != "Directory" {
+		m.Errorf("Expected the directory to be read from the cold tier, got %q, %v", x, err)
+	}
+}
+
+// Fails every save while fail is set
+type failingSaves struct {
+	fs.BlockHandlerV2
+	fail bool
+}
+
+func (f *failingSaves) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if f.fail {
+		return node, errors.New("Save failed")
+	}
+	return f.BlockHandlerV2.SaveRawBlock(ctx, node, data)
+}
+
+func TestReadWhenSpillFails(m *testing.T) {
+	ctx := context.Background()
+	tfs, mh := newTiered(m, "blocks=1")
+	cold := &failingSaves{BlockHandlerV2: tfs.Cold}
+	tfs.Cold = cold
+	spilled, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+	tfs.SaveRawBlock(ctx, spilled, []byte("Not spilled yet"))
+	read, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+	mh.SaveRawBlock(read, []byte("In the cold tier"))
+
+	// The read succeeds, and the block that couldn't be spilled is kept
+	cold.fail = true
+	if x, err := tfs.GetRawBlock(ctx, read); err != nil || string(x) != "In the cold tier" {
+		m.Errorf("Expected the block to be read, got %q, %v", x, err)
+	}
+	if err := tfs.Flush(ctx); err == nil {
+		m.Errorf("Expected the flush to fail")
+	}
+	cold.fail = false
+	if err := tfs.Flush(ctx); err != nil {
+		m.Fatal(err)
+	}
+	if string(mh.Blocks[spilled]) != "Not spilled yet" {
+		m.Errorf("Expected the block to be written by the flush, got %q", mh.Blocks[spilled])
+	}
+}
+
+func TestHotBytes(m *testing.T) {
+	ctx := context.Background()
+	tfs, mh := newTiered(m, "blocks=100,bytes=20")
+	for i := 0; i < 5; i++ {
+		node, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+		tfs.SaveRawBlock(ctx, node, []byte("0123456789"))
+	}
+	if stats := tfs.HandlerStats(); stats["tier.hot_bytes"] != 20 || len(mh.Blocks) != 3 {
+		m.Errorf("Expected two blocks to fit in the hot tier, got %v", stats)
+	}
+	if err := tfs.Init(ctx, "size=1"); err == nil {
+		m.Errorf("Expected an unknown size to be rejected")
+	}
+}
+
+func TestTieredFileSystem(m *testing.T) {
+	var mh memory.MemoryFileSystem
+	f := blocktest.NewFileSystem(m, &TieredFileSystem{Cold: fs.AdaptBlockHandler(&mh)}, "blocks=8", 1000, 20)
+	for i := 0; i < 10; i++ {
+		f.WriteFile(fmt.Sprintf("/tier/file%d", i), []byte(fmt.Sprintf("The contents of file %d", i)))
+	}
+	if err := f.Sync(); err != nil {
+		m.Fatal(err)
+	}
+
+	// Everything is in the cold tier after a Sync, so it can be mounted again with an empty hot tier
+	g := blocktest.Open(m, &TieredFileSystem{Cold: fs.AdaptBlockHandler(&mh)}, "blocks=8")
+	if err := g.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if x, err := g.ReadFile(fmt.Sprintf("/tier/file%d", i)); err != nil || string(x) != fmt.Sprintf("The contents of file %d", i) {
+			m.Errorf("File %d not read back, got %q, %v", i, x, err)
+		}
+	}
+}
+
+// Without a Sync, the metadata in the cold tier only refers to data that is there too
+func TestDataBeforeMetadata(m *testing.T) {
+	var mh memory.MemoryFileSystem
+	f := blocktest.NewFileSystem(m, &TieredFileSystem{Cold: fs.AdaptBlockHandler(&mh)}, "blocks=100", 1000, 20)
+	f.WriteFile("/tier/file", []byte("Written without a Sync, over several blocks"))
+	f.ChangeCache.Flush()
+
+	// As the cold tier would be found after a crash
+	g := blocktest.Open(m, fs.AdaptBlockHandler(&mh), "")
+	if err := g.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	if report, err := g.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected no problems in the cold tier, got %v, %v", report, err)
+	}
+	if x, err := g.ReadFile("/tier/file"); err != nil || string(x) != "Written without a Sync, over several blocks" {
+		m.Errorf("Expected the file in the cold tier, got %q, %v", x, err)
+	}
+}
+
+func TestForwardsToCold(m *testing.T) {
+	ctx := context.Background()
+	wrap := func(cold fs.BlockHandlerV2) *TieredFileSystem {
+		tfs := &TieredFileSystem{Cold: cold}
+		if err := tfs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		tfs.Format(ctx, 100, 100)
+		return tfs
+	}
+
+	// Transactions, only when the cold tier has them
+	if fs.IsTransactional(wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))) {
+		m.Errorf("Expected a tier over memory not to be transactional")
+	}
+	tfs := wrap(&walfs.WALFileSystem{Inner: fs.AdaptBlockHandler(&memory.MemoryFileSystem{}), Log: &walfs.MemoryLog{}})
+	if !fs.IsTransactional(tfs) {
+		m.Errorf("Expected a tier over walfs to be transactional")
+	}
+	node, _ := tfs.GetFreeBlockNode(ctx, fs.FILE)
+	data, _ := tfs.GetFreeBlockNode(ctx, fs.DATA)
+	tfs.Begin(ctx)
+	tfs.SaveRawBlock(ctx, data, []byte("Rolled back data"))
+	tfs.SaveRawBlock(ctx, node, []byte("Rolled back"))
+	tfs.Rollback(ctx)
+	for _, n := range []fs.BlockNode{node, data} {
+		if _, err := tfs.GetRawBlock(ctx, n); !errors.Is(err, fs.ErrBlockNotFound) {
+			m.Errorf("Expected the save of %v to be rolled back, got %v", n, err)
+		}
+	}
+
+	// Flushes
+	var cold memory.MemoryFileSystem
+	tfs = wrap(&TieredFileSystem{Cold: fs.AdaptBlockHandler(&cold)})
+	node, _ = tfs.GetFreeBlockNode(ctx, fs.DATA)
+	tfs.SaveRawBlock(ctx, node, []byte("Held back"))
+	if err := tfs.Flush(ctx); err != nil || string(cold.Blocks[node]) != "Held back" {
+		m.Errorf("Expected the flush to reach the coldest tier, got %v", err)
+	}
+
+	// and reservations
+	tfs = wrap(fs.AdaptBlockHandler(&memory.MemoryFileSystem{}))
+	node, _ = tfs.GetFreeBlockNode(ctx, fs.FILE)
+	tfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if err := tfs.ReserveBlockNode(ctx, node); err != nil {
+		m.Fatal(err)
+	}
+	if fresh, _ := tfs.GetFreeBlockNode(ctx, fs.FILE); fresh.Id == node.Id {
+		m.Errorf("Expected the reserved node not to be handed out")
+	}
+}
@@ -0,0 +1,481 @@
+// Write-ahead logging block handler - wraps another BlockHandlerV2 so that every change to the
+// filesystem is applied to it completely or not at all, even if the process dies part way through.
+//
+// The handler is Transactional, so RootFileSystem begins a transaction before each change (a
+// WriteFile, AppendFile, DeleteFile, ...) and commits it once the cache has written every block the
+// change touched. Until then the saves and frees are only held in memory. Commit writes them all
+// to the log as a single record, ending in a checksum, and only once the log has been written
+// applies them to the inner handler and clears the log. Saves and frees made outside a transaction
+// (e.g. while formatting) go straight through.
+//
+// When the handler is initialized (whenever the filesystem is opened) a complete record left in the
+// log is a change that was committed but may not have been applied, so it is replayed; a record
+// that is incomplete or damaged was never committed, and is dropped, leaving the inner handler as
+// it was before the change began. Nodes handed out for a change that is dropped are not freed, but
+// as they were never saved Check will not report them.
+//
+// The configuration string passed to Init is the path of the log file followed by the
+// configuration of the inner handler, including its scheme, e.g.
+// "wal:/var/pmfs/pmfs.wal:disk:/var/pmfs/data.pmfs". When Log is set before Init only the inner
+// handler's configuration is needed (and none at all if Inner is set as well).
+package walfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/amkimian/pmfs/fs"
+)
+
+// Every record starts with the magic and ends with a CRC32C checksum of everything before it
+var recordMagic = []byte("PMFSWAL1")
+
+const (
+	opSave byte = 1
+	opFree byte = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A LogStore holds the most recent record written to the log. Write replaces the record and must
+// not return until it is durable; a Write that fails part way may leave any prefix of the record.
+type LogStore interface {
+	Write(record []byte) error
+	Read() ([]byte, error)
+	Clear() error
+}
+
+// A LogStore kept in a file, synced on every write
+type FileLog struct {
+	Path string
+}
+
+func (l *FileLog) Write(record []byte) error {
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(record); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *FileLog) Read() ([]byte, error) {
+	record, err := os.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return record, err
+}
+
+func (l *FileLog) Clear() error {
+	return l.Write(nil)
+}
+
+// A LogStore kept in memory, which only survives as long as the process (used for testing)
+type MemoryLog struct {
+	Data []byte
+	lock sync.Mutex
+}
+
+func (l *MemoryLog) Write(record []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.Data = append([]byte(nil), record...)
+	return nil
+}
+
+func (l *MemoryLog) Read() ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]byte(nil), l.Data...), nil
+}
+
+func (l *MemoryLog) Clear() error {
+	return l.Write(nil)
+}
+
+// The saves and frees of a transaction, the last for each node winning. A nil entry is a free.
+type batch map[fs.BlockNode][]byte
+
+// The nodes of the batch in a fixed order, so records and replays are repeatable
+func (b batch) nodes() []fs.BlockNode {
+	nodes := make([]fs.BlockNode, 0, len(b))
+	for node := range b {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Id != nodes[j].Id {
+			return nodes[i].Id < nodes[j].Id
+		}
+		return nodes[i].Type < nodes[j].Type
+	})
+	return nodes
+}
+
+func (b batch) encode() []byte {
+	var buffer bytes.Buffer
+	buffer.Write(recordMagic)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putVarint := func(v int64) {
+		buffer.Write(scratch[:binary.PutVarint(scratch, v)])
+	}
+	putVarint(int64(len(b)))
+	for _, node := range b.nodes() {
+		data := b[node]
+		if data == nil {
+			buffer.WriteByte(opFree)
+		} else {
+			buffer.WriteByte(opSave)
+		}
+		putVarint(int64(node.RelativeTo))
+		putVarint(int64(node.Type))
+		putVarint(int64(node.Id))
+		if data != nil {
+			putVarint(int64(len(data)))
+			buffer.Write(data)
+		}
+	}
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(buffer.Bytes(), castagnoli))
+	buffer.Write(sum)
+	return buffer.Bytes()
+}
+
+var errTornRecord = errors.New("Log record is incomplete or damaged")
+
+func decodeBatch(record []byte) (batch, error) {
+	if len(record) < len(recordMagic)+4 || !bytes.Equal(record[:len(recordMagic)], recordMagic) {
+		return nil, errTornRecord
+	}
+	body := record[:len(record)-4]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(record[len(body):]) {
+		return nil, errTornRecord
+	}
+	reader := bytes.NewReader(body[len(recordMagic):])
+	count, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, errTornRecord
+	}
+	b := make(batch)
+	for i := int64(0); i < count; i++ {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return nil, errTornRecord
+		}
+		values := make([]int64, 3)
+		for v := range values {
+			if values[v], err = binary.ReadVarint(reader); err != nil {
+				return nil, errTornRecord
+			}
+		}
+		node := fs.BlockNode{RelativeTo: int(values[0]), Type: fs.BlockNodeType(values[1]), Id: int(values[2])}
+		if op == opFree {
+			b[node] = nil
+			continue
+		}
+		length, err := binary.ReadVarint(reader)
+		if err != nil || length < 0 || length > int64(reader.Len()) {
+			return nil, errTornRecord
+		}
+		data := make([]byte, length)
+		reader.Read(data)
+		b[node] = data
+	}
+	return b, nil
+}
+
+type WALFileSystem struct {
+	Inner fs.BlockHandlerV2
+	Log   LogStore
+	// The transaction in progress, if any
+	current batch
+	// A committed transaction that has not been completely applied to the inner handler yet
+	pending batch
+	stats   walStats
+	lock    sync.Mutex
+}
+
+type walStats struct {
+	Commits    int64
+	Replayed   int64
+	RolledBack int64
+	Dropped    int64
+}
+
+func init() {
+	fs.RegisterBlockHandler("wal", func() fs.BlockHandlerV2 { return &WALFileSystem{} })
+}
+
+// Create the log and the inner handler from the configuration if there aren't any, initialize the
+// inner handler, then recover whatever was left in the log
+func (wfs *WALFileSystem) Init(ctx context.Context, configuration string) error {
+	if wfs.Log == nil {
+		path, rest := configuration, ""
+		if i := strings.Index(configuration, ":"); i >= 0 {
+			path, rest = configuration[:i], configuration[i+1:]
+		}
+		wfs.Log, configuration = &FileLog{Path: path}, rest
+	}
+	if wfs.Inner == nil {
+		inner, rest, err := fs.NewBlockHandler(configuration)
+		if err != nil {
+			return err
+		}
+		wfs.Inner, configuration = inner, rest
+	}
+	if err := wfs.Inner.Init(ctx, configuration); err != nil {
+		return err
+	}
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	wfs.current, wfs.pending = nil, nil
+	wfs.stats = walStats{}
+	return wfs.recover(ctx)
+}
+
+// Replay a committed record left in the log, or drop one that was never completely written. The
+// nodes it saves were handed out before the restart, so if the inner handler is a BlockReserver
+// they are reserved first, as the inner handler won't know they are in use. Must be called with
+// the lock held.
+func (wfs *WALFileSystem) recover(ctx context.Context) error {
+	record, err := wfs.Log.Read()
+	if err != nil || len(record) == 0 {
+		return err
+	}
+	b, err := decodeBatch(record)
+	if err != nil {
+		wfs.stats.Dropped++
+		return wfs.Log.Clear()
+	}
+	if reserver, ok := wfs.Inner.(fs.BlockReserver); ok {
+		for node, data := range b {
+			if data == nil {
+				continue
+			}
+			if err = reserver.ReserveBlockNode(ctx, node); err != nil {
+				return err
+			}
+		}
+	}
+	wfs.pending = b
+	wfs.stats.Replayed++
+	return wfs.applyPending(ctx)
+}
+
+// Apply the committed transaction to the inner handler and clear the log. Applying a transaction
+// again is harmless, so if this fails it is simply tried again later. Must be called with the
+// lock held.
+func (wfs *WALFileSystem) applyPending(ctx context.Context) error {
+	if wfs.pending == nil {
+		return nil
+	}
+	frees := make([]fs.BlockNode, 0)
+	for _, node := range wfs.pending.nodes() {
+		data := wfs.pending[node]
+		if data == nil {
+			frees = append(frees, node)
+			continue
+		}
+		if _, err := wfs.Inner.SaveRawBlock(ctx, node, data); err != nil {
+			return err
+		}
+	}
+	if len(frees) > 0 {
+		if err := wfs.Inner.FreeBlocks(ctx, frees); err != nil {
+			return err
+		}
+	}
+	if err := wfs.Log.Clear(); err != nil {
+		return err
+	}
+	wfs.pending = nil
+	return nil
+}
+
+// Discard the log and anything in progress, and format the inner handler
+func (wfs *WALFileSystem) Format(ctx context.Context, blockCount int, blockSize int) error {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	wfs.current, wfs.pending = nil, nil
+	if err := wfs.Log.Clear(); err != nil {
+		return err
+	}
+	return wfs.Inner.Format(ctx, blockCount, blockSize)
+}
+
+func (wfs *WALFileSystem) GetFreeBlockNode(ctx context.Context, NodeType fs.BlockNodeType) (fs.BlockNode, error) {
+	return wfs.Inner.GetFreeBlockNode(ctx, NodeType)
+}
+
+func (wfs *WALFileSystem) GetFreeDataBlockNode(ctx context.Context, parent fs.BlockNode, id string) (fs.BlockNode, error) {
+	return wfs.Inner.GetFreeDataBlockNode(ctx, parent, id)
+}
+
+// Start holding back saves and frees until Commit or Rollback
+func (wfs *WALFileSystem) Begin(ctx context.Context) {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	wfs.current = make(batch)
+}
+
+// Write the transaction to the log and then apply it. Once the log has been written the
+// transaction is committed, so an error applying it is not returned here; it is tried again
+// before anything else is written, or replayed when the handler is next initialized.
+func (wfs *WALFileSystem) Commit(ctx context.Context) error {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	b := wfs.current
+	wfs.current = nil
+	if err := wfs.applyPending(ctx); err != nil {
+		wfs.stats.RolledBack++
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if err := wfs.Log.Write(b.encode()); err != nil {
+		wfs.stats.RolledBack++
+		return err
+	}
+	wfs.pending = b
+	wfs.stats.Commits++
+	wfs.applyPending(ctx)
+	return nil
+}
+
+// Discard the saves and frees of the transaction
+func (wfs *WALFileSystem) Rollback(ctx context.Context) {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	if wfs.current != nil {
+		wfs.stats.RolledBack++
+	}
+	wfs.current = nil
+}
+
+// Read the block as the transaction in progress and any committed one left it
+func (wfs *WALFileSystem) GetRawBlock(ctx context.Context, node fs.BlockNode) ([]byte, error) {
+	wfs.lock.Lock()
+	for _, b := range []batch{wfs.current, wfs.pending} {
+		if data, ok := b[node]; ok {
+			wfs.lock.Unlock()
+			if data == nil {
+				return nil, fs.ErrBlockNotFound
+			}
+			return append([]byte(nil), data...), nil
+		}
+	}
+	wfs.lock.Unlock()
+	return wfs.Inner.GetRawBlock(ctx, node)
+}
+
+func (wfs *WALFileSystem) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if err := ctx.Err(); err != nil {
+		return node, err
+	}
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	if wfs.current != nil {
+		wfs.current[node] = append(make([]byte, 0, len(data)), data...)
+		return node, nil
+	}
+	if err := wfs.applyPending(ctx); err != nil {
+		return node, err
+	}
+	return wfs.Inner.SaveRawBlock(ctx, node, data)
+}
+
+func (wfs *WALFileSystem) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	if wfs.current != nil {
+		for _, node := range blocks {
+			wfs.current[node] = nil
+		}
+		return nil
+	}
+	if err := wfs.applyPending(ctx); err != nil {
+		return err
+	}
+	return wfs.Inner.FreeBlocks(ctx, blocks)
+}
+
+// Write out a committed transaction that could not be applied before
+func (wfs *WALFileSystem) Flush(ctx context.Context) error {
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	if err := wfs.applyPending(ctx); err != nil {
+		return err
+	}
+	if flusher, ok := wfs.Inner.(fs.BlockFlusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Every block held by the inner handler (if it is a BlockLister), as the transaction in progress
+// and any committed one left it
+func (wfs *WALFileSystem) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	lister, ok := wfs.Inner.(fs.BlockLister)
+	if !ok {
+		return nil, fs.ErrNotSupported
+	}
+	blocks, err := lister.ListBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	present := make(map[fs.BlockNode]bool, len(blocks))
+	for _, node := range blocks {
+		present[node] = true
+	}
+	for _, b := range []batch{wfs.pending, wfs.current} {
+		for node, data := range b {
+			present[node] = data != nil
+		}
+	}
+	listed := make([]fs.BlockNode, 0, len(present))
+	for node, ok := range present {
+		if ok {
+			listed = append(listed, node)
+		}
+	}
+	return listed, nil
+}
+
+// The number of transactions committed, rolled back and replayed or dropped when the handler was
+// initialized, with the counters of the inner handler
+func (wfs *WALFileSystem) HandlerStats() map[string]float64 {
+	stats := make(map[string]float64)
+	if reporter, ok := wfs.Inner.(fs.StatsReporter); ok {
+		stats = reporter.HandlerStats()
+	}
+	wfs.lock.Lock()
+	defer wfs.lock.Unlock()
+	stats["wal.commits"] = float64(wfs.stats.Commits)
+	stats["wal.rolled_back"] = float64(wfs.stats.RolledBack)
+	stats["wal.replayed"] = float64(wfs.stats.Replayed)
+	stats["wal.dropped"] = float64(wfs.stats.Dropped)
+	return stats
+}
+
+func (wfs *WALFileSystem) DumpInfo() {
+	wfs.lock.Lock()
+	fmt.Printf("Write-ahead logged file system: %d commits, %d rolled back, %d replayed, %d dropped, over:\n", wfs.stats.Commits, wfs.stats.RolledBack, wfs.stats.Replayed, wfs.stats.Dropped)
+	wfs.lock.Unlock()
+	wfs.Inner.DumpInfo()
+}
@@ -0,0 +1,351 @@
+package walfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/amkimian/pmfs/blocktest"
+	"github.com/amkimian/pmfs/dirfs"
+	"github.com/amkimian/pmfs/fs"
+	"github.com/amkimian/pmfs/memory"
+)
+
+var errCrashed = errors.New("Crashed")
+
+// Counts the writes to the log and the inner handler, and after the number it is armed with has
+// been reached fails every write from then on, as if the process had died. The write it crashes
+// on is torn, only half of it being written.
+type crasher struct {
+	remaining int
+	armed     bool
+	crashed   bool
+	lock      sync.Mutex
+}
+
+func (c *crasher) arm(writes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remaining, c.armed = writes, true
+}
+
+// Whether the write should fail, and if so whether it is the one being torn
+func (c *crasher) write() (fail bool, torn bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.crashed {
+		return true, false
+	}
+	if !c.armed {
+		return false, false
+	}
+	c.remaining--
+	if c.remaining > 0 {
+		return false, false
+	}
+	c.crashed = true
+	return true, true
+}
+
+type crashingHandler struct {
+	fs.BlockHandlerV2
+	c *crasher
+}
+
+func (h *crashingHandler) SaveRawBlock(ctx context.Context, node fs.BlockNode, data []byte) (fs.BlockNode, error) {
+	if fail, torn := h.c.write(); fail {
+		if torn {
+			h.BlockHandlerV2.SaveRawBlock(ctx, node, data[:len(data)/2])
+		}
+		return node, errCrashed
+	}
+	return h.BlockHandlerV2.SaveRawBlock(ctx, node, data)
+}
+
+func (h *crashingHandler) FreeBlocks(ctx context.Context, blocks []fs.BlockNode) error {
+	if fail, torn := h.c.write(); fail {
+		if torn {
+			h.BlockHandlerV2.FreeBlocks(ctx, blocks[:len(blocks)/2])
+		}
+		return errCrashed
+	}
+	return h.BlockHandlerV2.FreeBlocks(ctx, blocks)
+}
+
+func (h *crashingHandler) ListBlocks(ctx context.Context) ([]fs.BlockNode, error) {
+	return h.BlockHandlerV2.(fs.BlockLister).ListBlocks(ctx)
+}
+
+type crashingLog struct {
+	*MemoryLog
+	c *crasher
+}
+
+func (l *crashingLog) Write(record []byte) error {
+	if fail, torn := l.c.write(); fail {
+		if torn {
+			l.MemoryLog.Write(record[:len(record)/2])
+		}
+		return errCrashed
+	}
+	return l.MemoryLog.Write(record)
+}
+
+func (l *crashingLog) Clear() error {
+	return l.Write(nil)
+}
+
+// Run the change with a crash injected after every possible number of writes in turn, until it
+// completes without one. After each crash the store is opened again as it was left, and must pass
+// Check and hold either everything from before the change or everything from after it.
+func crashTest(m *testing.T, setup func(f *fs.RootFileSystem), change func(f *fs.RootFileSystem), before, after func(f *fs.RootFileSystem) error) {
+	for writes := 1; ; writes++ {
+		var mh memory.MemoryFileSystem
+		log := &MemoryLog{}
+		c := &crasher{}
+		f := blocktest.Open(m, &WALFileSystem{Inner: &crashingHandler{fs.AdaptBlockHandler(&mh), c}, Log: &crashingLog{log, c}}, "")
+		f.Format(1000, 30)
+		setup(f)
+		if err := f.Sync(); err != nil {
+			m.Fatal(err)
+		}
+
+		c.arm(writes)
+		change(f)
+		f.Sync()
+		c.lock.Lock()
+		crashed := c.crashed
+		c.lock.Unlock()
+
+		g := blocktest.Open(m, &WALFileSystem{Inner: fs.AdaptBlockHandler(&mh), Log: log}, "")
+		if err := g.Mount(); err != nil {
+			m.Fatalf("Crash after %d writes: %v", writes, err)
+		}
+		report, err := g.Check(false)
+		if err != nil {
+			m.Fatalf("Crash after %d writes: %v", writes, err)
+		}
+		if len(report.Problems) != 0 {
+			m.Errorf("Crash after %d writes left problems %v", writes, report.Problems)
+		}
+		errBefore, errAfter := before(g), after(g)
+		if !crashed {
+			if errAfter != nil {
+				m.Errorf("Change without a crash: %v", errAfter)
+			}
+			if writes < 3 {
+				m.Errorf("Expected the change to take several writes, took %d", writes)
+			}
+			return
+		}
+		if errBefore != nil && errAfter != nil {
+			m.Errorf("Crash after %d writes left neither the old (%v) nor the new state (%v)", writes, errBefore, errAfter)
+		}
+	}
+}
+
+// An error unless the file holds the contents
+func holds(f *fs.RootFileSystem, path string, contents string) error {
+	x, err := f.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(x) != contents {
+		return fmt.Errorf("%s holds %q, expected %q", path, x, contents)
+	}
+	return nil
+}
+
+func TestCrashDuringAppend(m *testing.T) {
+	crashTest(m, func(f *fs.RootFileSystem) {
+		f.WriteFile("/wal/log", []byte("First line. "))
+	}, func(f *fs.RootFileSystem) {
+		f.AppendFile("/wal/log", []byte("Second line, which spans several blocks."))
+	}, func(f *fs.RootFileSystem) error {
+		return holds(f, "/wal/log", "First line. ")
+	}, func(f *fs.RootFileSystem) error {
+		return holds(f, "/wal/log", "First line. Second line, which spans several blocks.")
+	})
+}
+
+func TestCrashDuringWriteInNewDirectory(m *testing.T) {
+	crashTest(m, func(f *fs.RootFileSystem) {
+		f.WriteFile("/wal/existing", []byte("Already here"))
+	}, func(f *fs.RootFileSystem) {
+		f.WriteFile("/wal/new/deeper/file", []byte("A new file in new directories"))
+	}, func(f *fs.RootFileSystem) error {
+		if _, err := f.StatFile("/wal/new/deeper/file"); err == nil {
+			return errors.New("The new file exists")
+		}
+		return holds(f, "/wal/existing", "Already here")
+	}, func(f *fs.RootFileSystem) error {
+		if err := holds(f, "/wal/existing", "Already here"); err != nil {
+			return err
+		}
+		if results, err := f.SearchFindTerms("text", "directories", "directoriez"); err != nil || len(results) == 0 {
+			return fmt.Errorf("The new file is not indexed, %v", err)
+		}
+		return holds(f, "/wal/new/deeper/file", "A new file in new directories")
+	})
+}
+
+func TestCrashDuringMoveAndDelete(m *testing.T) {
+	setup := func(f *fs.RootFileSystem) {
+		f.WriteFile("/one/file", []byte("File one"))
+		f.WriteFile("/two/file", []byte("File two"))
+	}
+	crashTest(m, setup, func(f *fs.RootFileSystem) {
+		f.MoveFileOrFolder("/one/file", "/moved/file")
+	}, func(f *fs.RootFileSystem) error {
+		return holds(f, "/one/file", "File one")
+	}, func(f *fs.RootFileSystem) error {
+		if _, err := f.StatFile("/one/file"); err == nil {
+			return errors.New("The file is still in its old place")
+		}
+		return holds(f, "/moved/file", "File one")
+	})
+	crashTest(m, setup, func(f *fs.RootFileSystem) {
+		f.DeleteFile("/two/file")
+	}, func(f *fs.RootFileSystem) error {
+		return holds(f, "/two/file", "File two")
+	}, func(f *fs.RootFileSystem) error {
+		if _, err := f.StatFile("/two/file"); err == nil {
+			return errors.New("The file has not been deleted")
+		}
+		return holds(f, "/one/file", "File one")
+	})
+}
+
+func TestTornRecordIsDropped(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	log := &MemoryLog{}
+	wfs := &WALFileSystem{Inner: fs.AdaptBlockHandler(&mh), Log: log}
+	wfs.Init(ctx, "")
+	wfs.Format(ctx, 100, 100)
+	node, _ := wfs.GetFreeBlockNode(ctx, fs.FILE)
+	wfs.SaveRawBlock(ctx, node, []byte("Before"))
+
+	b := batch{node: []byte("After")}
+	record := b.encode()
+	for _, torn := range [][]byte{record[:len(record)-1], record[:5], append([]byte(nil), record...)} {
+		if len(torn) == len(record) {
+			torn[len(recordMagic)+5] ^= 0x01
+		}
+		log.Write(torn)
+		if err := wfs.Init(ctx, ""); err != nil {
+			m.Fatal(err)
+		}
+		if x, _ := wfs.GetRawBlock(ctx, node); string(x) != "Before" {
+			m.Errorf("Expected a torn record to be dropped, got %q", x)
+		}
+		if stats := wfs.HandlerStats(); stats["wal.dropped"] != 1 || len(log.Data) != 0 {
+			m.Errorf("Expected the record to be dropped and the log cleared, got %v", stats)
+		}
+	}
+
+	log.Write(record)
+	wfs.Init(ctx, "")
+	if x, _ := wfs.GetRawBlock(ctx, node); string(x) != "After" || string(mh.Blocks[node]) != "After" {
+		m.Errorf("Expected a complete record to be replayed, got %q", x)
+	}
+	if stats := wfs.HandlerStats(); stats["wal.replayed"] != 1 {
+		m.Errorf("Expected a replay, got %v", stats)
+	}
+}
+
+// A handler that rebuilds which ids are in use from the blocks it holds when it is initialized
+// doesn't know about the nodes of a record that is replayed, so they must be reserved
+func TestReplayOverDir(m *testing.T) {
+	root := m.TempDir()
+	log := &MemoryLog{}
+	c := &crasher{}
+	f := blocktest.Open(m, &WALFileSystem{Inner: &crashingHandler{&dirfs.DirFileSystem{}, c}, Log: &crashingLog{log, c}}, root)
+	f.Format(1000, 100)
+	f.WriteFile("/wal/existing", []byte("Already here"))
+	f.Sync()
+
+	// The record is written to the log, but the process dies before it is applied
+	c.arm(2)
+	f.WriteFile("/wal/committed", []byte("Committed before the crash"))
+	f.Sync()
+
+	g := blocktest.Open(m, &WALFileSystem{Inner: &dirfs.DirFileSystem{}, Log: log}, root)
+	if err := g.Mount(); err != nil {
+		m.Fatal(err)
+	}
+	ctx := context.Background()
+	blocks, _ := g.BlockHandler.(fs.BlockLister).ListBlocks(ctx)
+	live := make(map[int]bool)
+	for _, node := range blocks {
+		live[node.Id] = true
+	}
+	for i := 0; i < 5; i++ {
+		if node, _ := g.BlockHandler.GetFreeBlockNode(ctx, fs.DATA); live[node.Id] {
+			m.Errorf("Expected a free node, got %v which is in use", node)
+		}
+	}
+	g.WriteFile("/wal/after", []byte("Written after the restart"))
+	g.Sync()
+	for path, contents := range map[string]string{"/wal/existing": "Already here", "/wal/committed": "Committed before the crash", "/wal/after": "Written after the restart"} {
+		if err := holds(g, path, contents); err != nil {
+			m.Error(err)
+		}
+	}
+	if report, err := g.Check(false); err != nil || len(report.Problems) != 0 {
+		m.Errorf("Expected no problems, got %v, %v", report, err)
+	}
+}
+
+func TestRollback(m *testing.T) {
+	ctx := context.Background()
+	var mh memory.MemoryFileSystem
+	wfs := &WALFileSystem{Inner: fs.AdaptBlockHandler(&mh), Log: &MemoryLog{}}
+	wfs.Init(ctx, "")
+	wfs.Format(ctx, 100, 100)
+	node, _ := wfs.GetFreeBlockNode(ctx, fs.FILE)
+	wfs.SaveRawBlock(ctx, node, []byte("Committed"))
+
+	wfs.Begin(ctx)
+	wfs.SaveRawBlock(ctx, node, []byte("Uncommitted"))
+	if x, _ := wfs.GetRawBlock(ctx, node); string(x) != "Uncommitted" {
+		m.Errorf("Expected the transaction to see its own save, got %q", x)
+	}
+	if string(mh.Blocks[node]) != "Committed" {
+		m.Errorf("Expected the save to be held back, got %q", mh.Blocks[node])
+	}
+	wfs.Rollback(ctx)
+	if x, _ := wfs.GetRawBlock(ctx, node); string(x) != "Committed" {
+		m.Errorf("Expected the save to be rolled back, got %q", x)
+	}
+
+	wfs.Begin(ctx)
+	wfs.FreeBlocks(ctx, []fs.BlockNode{node})
+	if _, err := wfs.GetRawBlock(ctx, node); !errors.Is(err, fs.ErrBlockNotFound) {
+		m.Errorf("Expected the transaction to see its own free, got %v", err)
+	}
+	if err := wfs.Commit(ctx); err != nil {
+		m.Fatal(err)
+	}
+	if _, ok := mh.Blocks[node]; ok {
+		m.Errorf("Expected the free to be applied")
+	}
+}
+
+func TestFileLog(m *testing.T) {
+	path := filepath.Join(m.TempDir(), "pmfs.wal")
+	f := blocktest.NewFileSystem(m, nil, fmt.Sprintf("wal:%s:memory", path), 1000, 100)
+	f.WriteFile("/wal/file", []byte("Hello world"))
+	if err := holds(f, "/wal/file", "Hello world"); err != nil {
+		m.Error(err)
+	}
+	if stats := f.Stats().Handler; stats["wal.commits"] == 0 {
+		m.Errorf("Expected commits, got %v", stats)
+	}
+	if record, err := (&FileLog{Path: path}).Read(); err != nil || len(record) != 0 {
+		m.Errorf("Expected the log to be cleared, got %d bytes, %v", len(record), err)
+	}
+}
@@ -19,8 +19,12 @@ func blockAddFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSy
 		writeError(w, errors.New("Cannot add to a directory"))
 	} else {
 		// We have a filenode...
-		filesys.SaveNewBlock(r.URL.Path, fileNode, r.Form["block"][0], []byte(r.Form["data"][0]), true)
-		getFunc(w, r, filesys)
+		err = filesys.SaveNewBlock(r.URL.Path, fileNode, r.Form["block"][0], []byte(r.Form["data"][0]), true)
+		if err != nil {
+			writeError(w, err)
+		} else {
+			getFunc(w, r, filesys)
+		}
 	}
 }
 
@@ -127,12 +131,17 @@ func getFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem)
 	if err != nil {
 		writeError(w, err)
 	} else {
-		w.WriteHeader(http.StatusOK)
 		if fileNode != nil {
 			var x []byte
 			x, err = filesys.ReadFile(r.URL.Path)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "%v", string(x))
 		} else {
+			w.WriteHeader(http.StatusOK)
 			// Need to get file directory structure as a json object
 			dirStructure := getDirStructure(r.URL.Path, dirNode, filesys)
 			var b []byte
@@ -165,22 +174,101 @@ func deleteFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSyst
 	}
 }
 
+func mkdirFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	err := filesys.MakeDirectory(r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Created %s", r.URL.Path)
+	}
+}
+
+// Remove a directory, which must be empty unless the parameter recursive=true is given
+func rmdirFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	err := filesys.RemoveDirectory(r.URL.Path, getFormValue(r, "recursive", "false") == "true")
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Removed %s", r.URL.Path)
+	}
+}
+
+// Copy the file or directory to the path given by the parameter target, with every version of
+// each file if the parameter history=true is given
+func copyFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	target := getFormValue(r, "target", "")
+	if target == "" {
+		writeError(w, errors.New("No target given"))
+		return
+	}
+	err := filesys.CopyFileOrFolder(r.URL.Path, target, fs.CopyOptions{History: getFormValue(r, "history", "false") == "true"})
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Copied %s to %s", r.URL.Path, target)
+	}
+}
+
 // Add a new file, with optional content, optional mime type
 func addFileFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
-	filesys.WriteFile(r.URL.Path, []byte(r.Form["data"][0]))
-	getFunc(w, r, filesys)
+	err := filesys.WriteFile(r.URL.Path, []byte(r.Form["data"][0]))
+	if err != nil {
+		writeError(w, err)
+	} else {
+		getFunc(w, r, filesys)
+	}
 }
 
 // Append data to a file, with an optional block name (for series files and the like). If the block name is specified
 // it must not be present already (?) or it overwrites
 func appendFileFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
-	filesys.AppendFile(r.URL.Path, []byte(r.Form["data"][0]))
-	getFunc(w, r, filesys)
+	err := filesys.AppendFile(r.URL.Path, []byte(r.Form["data"][0]))
+	if err != nil {
+		writeError(w, err)
+	} else {
+		getFunc(w, r, filesys)
+	}
 }
 
 // Append a line to the data of a file, creating a new version. The data goes into a new block (with a CR added before)
 // and a new version created using this block
 func appendLineFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
-	filesys.AppendFile(r.URL.Path, []byte("\n"+r.Form["data"][0]))
-	getFunc(w, r, filesys)
+	err := filesys.AppendFile(r.URL.Path, []byte("\n"+r.Form["data"][0]))
+	if err != nil {
+		writeError(w, err)
+	} else {
+		getFunc(w, r, filesys)
+	}
+}
+
+// Check the filesystem structure, returning the report as json. With the parameter repair=true
+// any orphaned blocks are freed. The path is ignored, the whole filesystem is checked.
+func fsckFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	report, err := filesys.Check(getFormValue(r, "repair", "false") == "true")
+	if err != nil {
+		writeError(w, err)
+	} else {
+		var b []byte
+		b, err = json.MarshalIndent(report, "", "    ")
+		fmt.Fprintf(w, "%v", string(b))
+	}
+}
+
+func statsFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	b, _ := json.MarshalIndent(filesys.Stats(), "", "    ")
+	fmt.Fprintf(w, "%v", string(b))
+}
+
+func scrubFunc(w http.ResponseWriter, r *http.Request, filesys *fs.RootFileSystem) {
+	report, err := filesys.Scrub()
+	if err != nil {
+		writeError(w, err)
+	} else {
+		var b []byte
+		b, err = json.MarshalIndent(report, "", "    ")
+		fmt.Fprintf(w, "%v", string(b))
+	}
 }
@@ -15,6 +15,9 @@ var requests = map[string]ApiRequest{
 	"stat":       ApiRequest{statFunc},
 	"verget":     ApiRequest{verGetFunc},
 	"rm":         ApiRequest{deleteFunc},
+	"mkdir":      ApiRequest{mkdirFunc},
+	"rmdir":      ApiRequest{rmdirFunc},
+	"copy":       ApiRequest{copyFunc},
 	"addFile":    ApiRequest{addFileFunc},
 	"appendFile": ApiRequest{appendFileFunc},
 	"appendLine": ApiRequest{appendLineFunc},
@@ -24,4 +27,7 @@ var requests = map[string]ApiRequest{
 	"attr":       ApiRequest{attrListFunc},
 	"attrGet":    ApiRequest{attrGetFunc},
 	"find":       ApiRequest{attrFindFunc},
+	"fsck":       ApiRequest{fsckFunc},
+	"stats":      ApiRequest{statsFunc},
+	"scrub":      ApiRequest{scrubFunc},
 }